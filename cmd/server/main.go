@@ -2,65 +2,517 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+	_ "time/tzdata" // Quota time zones on images without a zoneinfo database
 
+	"google.golang.org/grpc"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/admin"
 	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/config"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/iplist"
 	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/limiter"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/metrics"
 	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/middleware"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/proxy"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/rls"
 	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/tokens"
 	"github.com/markuscandido/go-expert-desafio-rate-limiter/pkg/logger"
 )
 
 func main() {
+	if err := run(); err != nil {
+		logger.Error("Server stopped with error", "error", err)
+		logger.Sync()
+		os.Exit(1)
+	}
+	logger.Info("Server stopped")
+	logger.Sync()
+}
+
+// run wires the server together and serves until SIGINT or SIGTERM. Resources
+// are released in reverse order of creation: the HTTP server first, then storage.
+func run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Load configuration
-	cfg := config.LoadConfig()
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		for _, problem := range flattenErrors(err) {
+			logger.Error("Invalid configuration", "error", problem)
+		}
+		return errors.New("invalid configuration")
+	}
 	logger.Info("Starting rate limiter server",
 		"maxRequestsIP", cfg.MaxRequestsIP,
 		"enableIPLimit", cfg.EnableIPLimit,
 		"maxRequestsToken", cfg.MaxRequestsToken,
 		"enableTokenLimit", cfg.EnableTokenLimit,
+		"storage", cfg.StorageType,
 		"redisAddr", cfg.RedisAddr,
 	)
 
-	// Initialize Redis storage
-	redisStrategy, err := storage.NewRedisStrategy(cfg.RedisAddr, cfg.RedisDB, cfg.RedisPass)
+	// Initialize storage
+	store, err := newStorage(cfg)
 	if err != nil {
-		logger.Fatal("Failed to initialize Redis", "error", err)
+		return fmt.Errorf("failed to initialize %s storage: %w", cfg.StorageType, err)
 	}
-	defer redisStrategy.Close()
+	defer func() {
+		if err := store.Close(); err != nil {
+			logger.Error("Failed to close storage", "error", err)
+			return
+		}
+		logger.Info("Storage closed")
+	}()
 
-	// Create rate limiter
-	rateLimiter := limiter.NewRateLimiter(redisStrategy, cfg)
+	// Instrument storage
+	var limiterStore storage.Strategy = store
+	var appMetrics *metrics.Metrics
+	if cfg.MetricsEnabled {
+		appMetrics = newMetrics(cfg, store)
+		limiterStore = appMetrics.InstrumentStorage(store)
+	}
+
+	// Guard storage against failures
+	limiterStore, closeFallback := guardStorage(cfg, limiterStore, appMetrics)
+	defer closeFallback()
+
+	// Load the IP allow and deny lists
+	ipLists, err := newIPLists(ctx, cfg, store)
+	if err != nil {
+		return err
+	}
+
+	// Create rate limiter with the token registry, route rules and IP lists
+	opts, err := limiterOptions(cfg, store, ipLists)
+	if err != nil {
+		return err
+	}
+	rateLimiter := limiter.NewRateLimiter(limiterStore, cfg, opts...)
+	reload := &reloader{limiter: rateLimiter, store: store, ipLists: ipLists, load: config.LoadConfig}
 
 	// Create middleware
-	rateLimiterMiddleware := middleware.NewRateLimiterMiddleware(rateLimiter)
+	ipResolver, err := middleware.NewIPResolver(cfg.ClientIPMode, cfg.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("invalid client IP configuration: %w", err)
+	}
+	keyExtractor, err := middleware.NewKeyExtractor(cfg.KeyExtractors, cfg.JWTSecret)
+	if err != nil {
+		return fmt.Errorf("invalid key extractor configuration: %w", err)
+	}
+	middlewareOpts := []middleware.Option{
+		middleware.WithHeaderMode(cfg.HeaderMode),
+		middleware.WithIPResolver(ipResolver),
+		middleware.WithKeyExtractor(keyExtractor),
+		middleware.WithFailurePolicy(cfg.FailurePolicy, seconds(cfg.BreakerTimeout)),
+		middleware.WithCostHeader(cfg.CostHeader),
+	}
+	if appMetrics != nil {
+		middlewareOpts = append(middlewareOpts, middleware.WithDecisionObserver(appMetrics))
+	}
+	rateLimiterMiddleware := middleware.NewRateLimiterMiddleware(rateLimiter, middlewareOpts...)
 
-	// Create a simple handler
+	// Forward to the configured upstreams, or answer with a simple handler
+	var draining atomic.Bool
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"message": "Hello from rate-limiter server!"}`))
-	})
+	upstreams, err := newProxy(cfg, ipResolver)
+	if err != nil {
+		return fmt.Errorf("invalid proxy configuration: %w", err)
+	}
+	if upstreams != nil {
+		mux.Handle("/", upstreams)
+	} else {
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"message": "Hello from rate-limiter server!"}`))
+		})
+	}
 
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
+		// Fail health checks while draining so load balancers stop routing to us
+		if draining.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"status": "draining"}`))
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"status": "healthy"}`))
 	})
 
-	// Wrap with rate limiter middleware
-	handler := rateLimiterMiddleware.Handler(mux)
+	// Wrap with rate limiter middleware, keeping metrics scrapes and
+	// forward-auth subrequests out of it
+	var handler http.Handler = rateLimiterMiddleware.Handler(mux)
+	if appMetrics != nil || cfg.ForwardAuthEnabled {
+		root := http.NewServeMux()
+		if appMetrics != nil {
+			root.Handle(cfg.MetricsPath, appMetrics.Handler())
+		}
+		if cfg.ForwardAuthEnabled {
+			if cfg.ClientIPMode == config.ClientIPRemoteAddr {
+				logger.Warn("Forward auth is enabled but the client IP is the connection address, so no proxy is trusted and every subrequest is limited as itself",
+					"path", cfg.ForwardAuthPath,
+				)
+			}
+			root.Handle(cfg.ForwardAuthPath, rateLimiterMiddleware.CheckHandler(cfg.ForwardAuthHeaders))
+		}
+		root.Handle("/", handler)
+		handler = root
+	}
+
+	// Create admin API
+	var adminHandler http.Handler
+	if cfg.AdminAddr != "" {
+		if adminHandler, err = admin.NewHandler(store, cfg.AdminToken, admin.WithReloader(reload.Reload), admin.WithIPLists(ipLists), admin.WithLimiter(rateLimiter)); err != nil {
+			return fmt.Errorf("invalid admin API configuration: %w", err)
+		}
+	}
+
+	// Start servers
+	listener, err := net.Listen("tcp", cfg.ServerAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", cfg.ServerAddr, err)
+	}
+	logger.Info("Server listening", "address", listener.Addr().String())
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watchReloads(ctx, cfg, reload)
+	go ipLists.Watch(ctx, seconds(cfg.IPListRefreshInterval))
+	if upstreams != nil {
+		go upstreams.CheckHealth(ctx)
+	}
+
+	errCh := make(chan error, 3)
+	servers := 1
+	go func() {
+		errCh <- serve(ctx, newHTTPServer(cfg, handler), listener, shutdownPolicy{
+			delay:   seconds(cfg.ServerShutdownDelay),
+			timeout: seconds(cfg.ServerShutdownTimeout),
+			onDrain: func() { draining.Store(true) },
+		})
+	}()
+
+	if adminHandler != nil {
+		adminListener, err := net.Listen("tcp", cfg.AdminAddr)
+		if err != nil {
+			cancel()
+			return errors.Join(fmt.Errorf("failed to listen on %s: %w", cfg.AdminAddr, err), <-errCh)
+		}
+		logger.Info("Admin API listening", "address", adminListener.Addr().String())
+
+		adminServer := newHTTPServer(cfg, adminHandler)
+		adminServer.Addr = cfg.AdminAddr
+		servers++
+		go func() {
+			errCh <- serve(ctx, adminServer, adminListener, shutdownPolicy{timeout: seconds(cfg.ServerShutdownTimeout)})
+		}()
+	}
+
+	if cfg.RLSAddr != "" {
+		rlsListener, err := net.Listen("tcp", cfg.RLSAddr)
+		if err != nil {
+			cancel()
+			errs := []error{fmt.Errorf("failed to listen on %s: %w", cfg.RLSAddr, err)}
+			for i := 0; i < servers; i++ {
+				errs = append(errs, <-errCh)
+			}
+			return errors.Join(errs...)
+		}
+		logger.Info("Envoy rate limit service listening", "address", rlsListener.Addr().String())
+
+		rlsOpts := []rls.Option{rls.WithFailurePolicy(cfg.FailurePolicy)}
+		if appMetrics != nil {
+			rlsOpts = append(rlsOpts, rls.WithDecisionObserver(appMetrics))
+		}
+		grpcServer := grpc.NewServer()
+		rls.NewServer(rateLimiter, rlsOpts...).Register(grpcServer)
+		servers++
+		go func() {
+			errCh <- serveGRPC(ctx, grpcServer, rlsListener, seconds(cfg.ServerShutdownTimeout))
+		}()
+	}
+
+	// Stop every server as soon as one of them stops
+	var errs []error
+	for i := 0; i < servers; i++ {
+		errs = append(errs, <-errCh)
+		cancel()
+	}
+	return errors.Join(errs...)
+}
+
+// newHTTPServer applies the configured timeouts and limits to an http.Server
+func newHTTPServer(cfg *config.RateLimiterConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              cfg.ServerAddr,
+		Handler:           handler,
+		ReadTimeout:       seconds(cfg.ServerReadTimeout),
+		ReadHeaderTimeout: seconds(cfg.ServerReadHeaderTimeout),
+		WriteTimeout:      seconds(cfg.ServerWriteTimeout),
+		IdleTimeout:       seconds(cfg.ServerIdleTimeout),
+		MaxHeaderBytes:    cfg.ServerMaxHeaderBytes,
+		ErrorLog:          slog.NewLogLogger(logger.GetLogger().Handler(), slog.LevelWarn),
+	}
+}
+
+// shutdownPolicy controls how serve drains the server once ctx is cancelled
+type shutdownPolicy struct {
+	delay   time.Duration // Keep accepting requests this long after onDrain
+	timeout time.Duration // Maximum time in-flight requests get to finish
+	onDrain func()        // Called first, e.g. to fail health checks
+}
+
+// serve runs server on listener until ctx is cancelled, then drains it
+func serve(ctx context.Context, server *http.Server, listener net.Listener, policy shutdownPolicy) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("server error: %w", err)
+	case <-ctx.Done():
+	}
+
+	logger.Info("Shutdown signal received, draining",
+		"delay", policy.delay.String(),
+		"timeout", policy.timeout.String(),
+	)
+	if policy.onDrain != nil {
+		policy.onDrain()
+	}
+	time.Sleep(policy.delay)
 
-	// Start server
-	addr := ":8080"
-	logger.Info("Server listening", "address", addr)
-	if err := http.ListenAndServe(addr, handler); err != nil && err != http.ErrServerClosed {
-		logger.Fatal("Server error", "error", err)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), policy.timeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		server.Close()
+		return fmt.Errorf("failed to drain in-flight requests: %w", err)
 	}
+	if err := <-errCh; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("server error: %w", err)
+	}
+	logger.Info("HTTP server drained")
+	return nil
+}
+
+// serveGRPC runs server on listener until ctx is cancelled, then lets the
+// in-flight calls finish within timeout
+func serveGRPC(ctx context.Context, server *grpc.Server, listener net.Listener, timeout time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("grpc server error: %w", err)
+	case <-ctx.Done():
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		server.Stop()
+		return errors.New("failed to drain in-flight rate limit calls")
+	}
+	if err := <-errCh; err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		return fmt.Errorf("grpc server error: %w", err)
+	}
+	logger.Info("gRPC server drained")
+	return nil
+}
+
+// newStorage builds the storage backend selected in the configuration
+func newStorage(cfg *config.RateLimiterConfig) (storage.Strategy, error) {
+	if cfg.StorageType == config.StorageMemory {
+		return storage.NewMemoryStrategy(cfg.MemoryMaxKeys, seconds(cfg.MemoryCleanupInterval)), nil
+	}
+
+	tlsConfig, err := redisTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewRedisStrategyWithOptions(storage.RedisOptions{
+		Mode:             cfg.RedisMode,
+		Addrs:            cfg.RedisAddrs(),
+		MasterName:       cfg.RedisMasterName,
+		DB:               cfg.RedisDB,
+		Username:         cfg.RedisUsername,
+		Password:         cfg.RedisPass,
+		SentinelUsername: cfg.RedisSentinelUsername,
+		SentinelPassword: cfg.RedisSentinelPass,
+		TLS:              tlsConfig,
+		PoolSize:         cfg.RedisPoolSize,
+		DialTimeout:      milliseconds(cfg.RedisDialTimeout),
+		ReadTimeout:      milliseconds(cfg.RedisReadTimeout),
+		WriteTimeout:     milliseconds(cfg.RedisWriteTimeout),
+	})
+}
+
+// redisTLSConfig builds the TLS client configuration for Redis, or nil when TLS is disabled
+func redisTLSConfig(cfg *config.RateLimiterConfig) (*tls.Config, error) {
+	if !cfg.RedisTLS {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.RedisTLSServerName,
+		InsecureSkipVerify: cfg.RedisTLSInsecureSkipVerify,
+	}
+	if cfg.RedisTLSCAFile != "" {
+		pem, err := os.ReadFile(cfg.RedisTLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Redis CA file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in Redis CA file %s", cfg.RedisTLSCAFile)
+		}
+	}
+	if cfg.RedisTLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.RedisTLSCertFile, cfg.RedisTLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Redis client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// newMetrics creates the Prometheus metrics, including the blocked keys gauge
+// when enabled and Redis pool statistics when the storage backend supports them
+func newMetrics(cfg *config.RateLimiterConfig, store storage.Strategy) *metrics.Metrics {
+	m := metrics.New()
+	if counter, ok := store.(storage.BlockedCounter); ok && cfg.MetricsBlockedKeysInterval > 0 {
+		m.RegisterBlockedKeys(counter, time.Duration(cfg.MetricsBlockedKeysInterval)*time.Second)
+	}
+	if redisStrategy, ok := store.(*storage.RedisStrategy); ok {
+		m.RegisterRedisPool(redisStrategy.Client())
+	}
+	return m
+}
+
+// guardStorage wraps store in a circuit breaker and, with the fallback failure
+// policy, falls back to a local in-memory storage. The returned func closes
+// the fallback storage.
+func guardStorage(cfg *config.RateLimiterConfig, store storage.Strategy, m *metrics.Metrics) (storage.Strategy, func()) {
+	if cfg.BreakerThreshold > 0 {
+		var onChange func(from, to storage.BreakerState)
+		if m != nil {
+			onChange = m.ObserveBreakerTransition
+		}
+		breaker := storage.NewBreakerStrategy(store, cfg.BreakerThreshold, seconds(cfg.BreakerTimeout), onChange)
+		if m != nil {
+			m.RegisterBreaker(breaker)
+		}
+		store = breaker
+	}
+
+	if cfg.FailurePolicy != config.FailureFallback {
+		return store, func() {}
+	}
+	fallback := storage.NewMemoryStrategy(cfg.MemoryMaxKeys, seconds(cfg.MemoryCleanupInterval))
+	return storage.NewFallbackStrategy(store, fallback), func() { fallback.Close() }
+}
+
+// newTokenRegistry builds the token registry selected in the configuration, or nil when none is
+func newTokenRegistry(cfg *config.RateLimiterConfig, store storage.Strategy) (tokens.Registry, error) {
+	switch cfg.TokenRegistry {
+	case config.TokenRegistryFile:
+		return tokens.NewFileRegistry(cfg.TokenRegistryFile)
+	case config.TokenRegistryRedis:
+		redisStrategy, ok := store.(*storage.RedisStrategy)
+		if !ok {
+			return nil, fmt.Errorf("the redis token registry requires the redis storage")
+		}
+		return tokens.NewRedisRegistry(redisStrategy.Client(), seconds(cfg.TokenRegistryCacheTTL)), nil
+	}
+	if len(cfg.TokenOverrides) > 0 {
+		return tokens.NewStaticRegistry(cfg.TokenOverrides)
+	}
+	return nil, nil
+}
+
+// newProxy builds the reverse proxy to the configured upstreams, or nil when
+// none is configured
+func newProxy(cfg *config.RateLimiterConfig, ipResolver *middleware.IPResolver) (*proxy.Proxy, error) {
+	routes := cfg.AllProxyRoutes()
+	if len(routes) == 0 {
+		return nil, nil
+	}
+	p, err := proxy.New(routes,
+		proxy.WithTimeouts(seconds(cfg.ProxyDialTimeout), seconds(cfg.ProxyTimeout)),
+		proxy.WithHealthCheck(cfg.ProxyHealthCheckPath, seconds(cfg.ProxyHealthCheckInterval), seconds(cfg.ProxyHealthCheckTimeout)),
+		proxy.WithTrustedForwarding(ipResolver.TrustsForwarding),
+	)
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range routes {
+		logger.Info("Proxying requests", "pathPrefix", route.PathPrefix, "upstreams", route.Upstreams)
+	}
+	return p, nil
+}
+
+// newIPLists builds the IP allow and deny lists from the configuration and the
+// entries edited through the admin API, kept in Redis with the redis storage
+// so that every replica shares them
+func newIPLists(ctx context.Context, cfg *config.RateLimiterConfig, store storage.Strategy) (*iplist.Lists, error) {
+	entries, err := iplist.ParseEntries(cfg.IPAllowlist, cfg.IPDenylist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IP list: %w", err)
+	}
+
+	var listStore iplist.Store = iplist.NewMemoryStore()
+	if redisStrategy, ok := store.(*storage.RedisStrategy); ok {
+		listStore = iplist.NewRedisStore(redisStrategy.Client())
+	}
+	lists := iplist.NewLists(entries, listStore)
+	if err := lists.Refresh(ctx); err != nil {
+		logger.Warn("Failed to load stored IP list entries, retrying in the background", "error", err)
+	}
+	return lists, nil
+}
+
+// flattenErrors expands errors joined with errors.Join into their leaves
+func flattenErrors(err error) []error {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []error{err}
+	}
+	var leaves []error
+	for _, e := range joined.Unwrap() {
+		leaves = append(leaves, flattenErrors(e)...)
+	}
+	return leaves
+}
+
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
 }
 
-// Graceful shutdown can be added here
-func shutdown(ctx context.Context, server *http.Server) {
-	server.Shutdown(ctx)
+func milliseconds(n int) time.Duration {
+	return time.Duration(n) * time.Millisecond
 }
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sync"
+	"syscall"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/config"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/iplist"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/limiter"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/rules"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/pkg/logger"
+)
+
+// limiterOptions builds the reloadable parts of the rate limiter: the token
+// registry, the route rules and the IP lists
+func limiterOptions(cfg *config.RateLimiterConfig, store storage.Strategy, ipLists *iplist.Lists) ([]limiter.Option, error) {
+	var opts []limiter.Option
+	if ipLists != nil {
+		opts = append(opts, limiter.WithIPLists(ipLists))
+	}
+
+	registry, err := newTokenRegistry(cfg, store)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize token registry: %w", err)
+	}
+	if registry != nil {
+		opts = append(opts, limiter.WithTokenRegistry(registry))
+	}
+
+	var ruleSet *rules.Set
+	switch {
+	case cfg.RulesFile != "":
+		ruleSet, err = rules.LoadFile(cfg.RulesFile)
+	case len(cfg.Rules) > 0:
+		ruleSet, err = rules.NewSet(cfg.Rules)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(opts, limiter.WithRules(ruleSet)), nil
+}
+
+// reloader re-reads the configuration and swaps the limits, token registry,
+// route rules and configured IP lists of the rate limiter. An invalid
+// configuration is rejected and the current one is kept.
+type reloader struct {
+	mu      sync.Mutex
+	limiter *limiter.RateLimiter
+	store   storage.Strategy // Raw storage, used by the redis token registry
+	ipLists *iplist.Lists    // Optional, receives the configured allow and deny lists
+	load    func() (*config.RateLimiterConfig, error)
+}
+
+func (r *reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.reload()
+	if err != nil {
+		for _, problem := range flattenErrors(err) {
+			logger.Error("Configuration reload rejected, keeping the current configuration", "error", problem)
+		}
+	}
+	return err
+}
+
+func (r *reloader) reload() error {
+	cfg, err := r.load()
+	if err != nil {
+		return err
+	}
+	opts, err := limiterOptions(cfg, r.store, r.ipLists)
+	if err != nil {
+		return err
+	}
+	entries, err := iplist.ParseEntries(cfg.IPAllowlist, cfg.IPDenylist)
+	if err != nil {
+		return err
+	}
+
+	previous := r.limiter.Snapshot().Config()
+	if ignored := restartRequired(previous, cfg); len(ignored) > 0 {
+		logger.Warn("Configuration changes ignored until restart", "settings", ignored)
+	}
+	keepRestartOnly(previous, cfg)
+	if r.ipLists != nil {
+		r.ipLists.SetConfigured(entries)
+	}
+	r.limiter.Reload(cfg, opts...)
+	logger.Info("Configuration reloaded")
+	return nil
+}
+
+// watchedFiles returns the configuration files of the running configuration
+func (r *reloader) watchedFiles() []string {
+	return r.limiter.Snapshot().Config().WatchedFiles()
+}
+
+// watchReloads reloads the configuration on SIGHUP and whenever one of the
+// configuration files of the running configuration changes, until ctx is done
+func watchReloads(ctx context.Context, cfg *config.RateLimiterConfig, r *reloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				logger.Info("SIGHUP received, reloading configuration")
+				r.Reload()
+			}
+		}
+	}()
+
+	go config.Watch(ctx, r.watchedFiles, seconds(cfg.ConfigWatchInterval), func() {
+		r.Reload()
+	})
+}
+
+// keepRestartOnly copies the settings listed by restartRequired from running
+// into next, so the stored configuration keeps describing what is applied and
+// the changes are reported again on the next reload
+func keepRestartOnly(running, next *config.RateLimiterConfig) {
+	next.StorageType = running.StorageType
+	next.RedisMode = running.RedisMode
+	next.RedisAddr = running.RedisAddr
+	next.RedisDB = running.RedisDB
+	next.RedisUsername = running.RedisUsername
+	next.RedisPass = running.RedisPass
+	next.RedisMasterName = running.RedisMasterName
+	next.RedisSentinelUsername = running.RedisSentinelUsername
+	next.RedisSentinelPass = running.RedisSentinelPass
+	next.RedisPoolSize = running.RedisPoolSize
+	next.RedisDialTimeout = running.RedisDialTimeout
+	next.RedisReadTimeout = running.RedisReadTimeout
+	next.RedisWriteTimeout = running.RedisWriteTimeout
+	next.RedisTLS = running.RedisTLS
+	next.RedisTLSCAFile = running.RedisTLSCAFile
+	next.RedisTLSCertFile = running.RedisTLSCertFile
+	next.RedisTLSKeyFile = running.RedisTLSKeyFile
+	next.RedisTLSServerName = running.RedisTLSServerName
+	next.RedisTLSInsecureSkipVerify = running.RedisTLSInsecureSkipVerify
+	next.MemoryMaxKeys = running.MemoryMaxKeys
+	next.MemoryCleanupInterval = running.MemoryCleanupInterval
+	next.FailurePolicy = running.FailurePolicy
+	next.BreakerThreshold = running.BreakerThreshold
+	next.BreakerTimeout = running.BreakerTimeout
+	next.ClientIPMode = running.ClientIPMode
+	next.TrustedProxies = running.TrustedProxies
+	next.KeyExtractors = running.KeyExtractors
+	next.JWTSecret = running.JWTSecret
+	next.HeaderMode = running.HeaderMode
+	next.CostHeader = running.CostHeader
+	next.ServerAddr = running.ServerAddr
+	next.ServerReadTimeout = running.ServerReadTimeout
+	next.ServerReadHeaderTimeout = running.ServerReadHeaderTimeout
+	next.ServerWriteTimeout = running.ServerWriteTimeout
+	next.ServerIdleTimeout = running.ServerIdleTimeout
+	next.ServerMaxHeaderBytes = running.ServerMaxHeaderBytes
+	next.ServerShutdownDelay = running.ServerShutdownDelay
+	next.ServerShutdownTimeout = running.ServerShutdownTimeout
+	next.ProxyUpstreams = running.ProxyUpstreams
+	next.ProxyRoutes = running.ProxyRoutes
+	next.ProxyTimeout = running.ProxyTimeout
+	next.ProxyDialTimeout = running.ProxyDialTimeout
+	next.ProxyHealthCheckPath = running.ProxyHealthCheckPath
+	next.ProxyHealthCheckInterval = running.ProxyHealthCheckInterval
+	next.ProxyHealthCheckTimeout = running.ProxyHealthCheckTimeout
+	next.MetricsEnabled = running.MetricsEnabled
+	next.MetricsPath = running.MetricsPath
+	next.MetricsBlockedKeysInterval = running.MetricsBlockedKeysInterval
+	next.AdminAddr = running.AdminAddr
+	next.AdminToken = running.AdminToken
+	next.ForwardAuthEnabled = running.ForwardAuthEnabled
+	next.ForwardAuthPath = running.ForwardAuthPath
+	next.ForwardAuthHeaders = running.ForwardAuthHeaders
+	next.RLSAddr = running.RLSAddr
+	next.ConfigWatchInterval = running.ConfigWatchInterval
+	next.IPListRefreshInterval = running.IPListRefreshInterval
+}
+
+// restartRequired lists the settings that differ between previous and next but
+// are only read at startup
+func restartRequired(previous, next *config.RateLimiterConfig) []string {
+	var changed []string
+	for name, differs := range map[string]bool{
+		"storage": previous.StorageType != next.StorageType,
+		"redis": previous.RedisMode != next.RedisMode ||
+			previous.RedisAddr != next.RedisAddr ||
+			previous.RedisDB != next.RedisDB ||
+			previous.RedisUsername != next.RedisUsername ||
+			previous.RedisPass != next.RedisPass ||
+			previous.RedisMasterName != next.RedisMasterName ||
+			previous.RedisSentinelUsername != next.RedisSentinelUsername ||
+			previous.RedisSentinelPass != next.RedisSentinelPass ||
+			previous.RedisPoolSize != next.RedisPoolSize ||
+			previous.RedisDialTimeout != next.RedisDialTimeout ||
+			previous.RedisReadTimeout != next.RedisReadTimeout ||
+			previous.RedisWriteTimeout != next.RedisWriteTimeout ||
+			previous.RedisTLS != next.RedisTLS ||
+			previous.RedisTLSCAFile != next.RedisTLSCAFile ||
+			previous.RedisTLSCertFile != next.RedisTLSCertFile ||
+			previous.RedisTLSKeyFile != next.RedisTLSKeyFile ||
+			previous.RedisTLSServerName != next.RedisTLSServerName ||
+			previous.RedisTLSInsecureSkipVerify != next.RedisTLSInsecureSkipVerify,
+		"memory":         previous.MemoryMaxKeys != next.MemoryMaxKeys || previous.MemoryCleanupInterval != next.MemoryCleanupInterval,
+		"failure_policy": previous.FailurePolicy != next.FailurePolicy || previous.BreakerThreshold != next.BreakerThreshold || previous.BreakerTimeout != next.BreakerTimeout,
+		"client_ip":      previous.ClientIPMode != next.ClientIPMode || !slices.Equal(previous.TrustedProxies, next.TrustedProxies),
+		"keys":           !slices.Equal(previous.KeyExtractors, next.KeyExtractors) || previous.JWTSecret != next.JWTSecret,
+		"headers":        previous.HeaderMode != next.HeaderMode,
+		"cost_header":    previous.CostHeader != next.CostHeader,
+		"server": previous.ServerAddr != next.ServerAddr ||
+			previous.ServerReadTimeout != next.ServerReadTimeout ||
+			previous.ServerReadHeaderTimeout != next.ServerReadHeaderTimeout ||
+			previous.ServerWriteTimeout != next.ServerWriteTimeout ||
+			previous.ServerIdleTimeout != next.ServerIdleTimeout ||
+			previous.ServerMaxHeaderBytes != next.ServerMaxHeaderBytes ||
+			previous.ServerShutdownDelay != next.ServerShutdownDelay ||
+			previous.ServerShutdownTimeout != next.ServerShutdownTimeout,
+		"proxy": !reflect.DeepEqual(previous.AllProxyRoutes(), next.AllProxyRoutes()) ||
+			previous.ProxyTimeout != next.ProxyTimeout ||
+			previous.ProxyDialTimeout != next.ProxyDialTimeout ||
+			previous.ProxyHealthCheckPath != next.ProxyHealthCheckPath ||
+			previous.ProxyHealthCheckInterval != next.ProxyHealthCheckInterval ||
+			previous.ProxyHealthCheckTimeout != next.ProxyHealthCheckTimeout,
+		"metrics":         previous.MetricsEnabled != next.MetricsEnabled || previous.MetricsPath != next.MetricsPath || previous.MetricsBlockedKeysInterval != next.MetricsBlockedKeysInterval,
+		"admin":           previous.AdminAddr != next.AdminAddr || previous.AdminToken != next.AdminToken,
+		"forward_auth":    previous.ForwardAuthEnabled != next.ForwardAuthEnabled || previous.ForwardAuthPath != next.ForwardAuthPath || previous.ForwardAuthHeaders != next.ForwardAuthHeaders,
+		"rls":             previous.RLSAddr != next.RLSAddr,
+		"config_watching": previous.ConfigWatchInterval != next.ConfigWatchInterval,
+		"ip_list_refresh": previous.IPListRefreshInterval != next.IPListRefreshInterval,
+	} {
+		if differs {
+			changed = append(changed, name)
+		}
+	}
+	slices.Sort(changed)
+	return changed
+}
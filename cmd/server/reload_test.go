@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/config"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/limiter"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/rules"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
+)
+
+func TestReloaderSwapsLimits(t *testing.T) {
+	store := storage.NewMemoryStrategy(0, 0)
+	defer store.Close()
+
+	cfg := config.NewConfig()
+	rateLimiter := limiter.NewRateLimiter(store, cfg)
+
+	next := config.NewConfig()
+	next.MaxRequestsIP = 1
+	next.Rules = []rules.Rule{{ID: "search", PathPrefix: "/search"}}
+	r := &reloader{limiter: rateLimiter, store: store, load: func() (*config.RateLimiterConfig, error) {
+		return next, nil
+	}}
+
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	snapshot := rateLimiter.Snapshot()
+	if snapshot.Config() != next {
+		t.Error("Expected the new configuration to be active")
+	}
+
+	decision, err := snapshot.Decide(context.Background(), limiter.Request{IP: "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if decision.Limit != 1 {
+		t.Errorf("Expected reloaded limit 1, got %d", decision.Limit)
+	}
+}
+
+func TestReloaderSwapsIPLists(t *testing.T) {
+	store := storage.NewMemoryStrategy(0, 0)
+	defer store.Close()
+
+	cfg := config.NewConfig()
+	cfg.IPDenylist = []string{"192.0.2.0/24"}
+	ipLists, err := newIPLists(context.Background(), cfg, store)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	opts, err := limiterOptions(cfg, store, ipLists)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	rateLimiter := limiter.NewRateLimiter(store, cfg, opts...)
+	if _, err := rateLimiter.Decide(context.Background(), limiter.Request{IP: "192.0.2.1"}); !errors.Is(err, limiter.ErrIPDenied) {
+		t.Fatalf("Expected ErrIPDenied, got %v", err)
+	}
+
+	next := config.NewConfig()
+	next.IPAllowlist = []string{"192.0.2.0/24"}
+	r := &reloader{limiter: rateLimiter, store: store, ipLists: ipLists, load: func() (*config.RateLimiterConfig, error) {
+		return next, nil
+	}}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	decision, err := rateLimiter.Decide(context.Background(), limiter.Request{IP: "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if decision.Rule != limiter.RuleIPAllowlist {
+		t.Errorf("Expected the reloaded allow list to apply, got %+v", decision)
+	}
+}
+
+func TestReloaderKeepsConfigOnError(t *testing.T) {
+	store := storage.NewMemoryStrategy(0, 0)
+	defer store.Close()
+
+	cfg := config.NewConfig()
+	rateLimiter := limiter.NewRateLimiter(store, cfg)
+
+	for name, load := range map[string]func() (*config.RateLimiterConfig, error){
+		"invalid config": func() (*config.RateLimiterConfig, error) {
+			return nil, errors.Join(errors.New("ip window must be positive"), errors.New("bad extractor"))
+		},
+		"missing rules file": func() (*config.RateLimiterConfig, error) {
+			next := config.NewConfig()
+			next.RulesFile = "/does/not/exist.json"
+			return next, nil
+		},
+	} {
+		r := &reloader{limiter: rateLimiter, store: store, load: load}
+		if err := r.Reload(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if rateLimiter.Snapshot().Config() != cfg {
+			t.Errorf("%s: expected the previous configuration to be kept", name)
+		}
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	previous := config.NewConfig()
+	next := config.NewConfig()
+	next.MaxRequestsIP = 1
+	if changed := restartRequired(previous, next); len(changed) != 0 {
+		t.Errorf("Expected limits to be reloadable, got %v", changed)
+	}
+
+	next.StorageType = config.StorageMemory
+	next.ServerWriteTimeout = 1
+	next.KeyExtractors = []string{"bearer"}
+	next.CostHeader = "X-Cost"
+	expected := []string{"cost_header", "keys", "server", "storage"}
+	if changed := restartRequired(previous, next); !slices.Equal(changed, expected) {
+		t.Errorf("Expected %v, got %v", expected, changed)
+	}
+}
+
+func TestReloaderKeepsRestartOnlySettings(t *testing.T) {
+	store := storage.NewMemoryStrategy(0, 0)
+	defer store.Close()
+
+	cfg := config.NewConfig()
+	rateLimiter := limiter.NewRateLimiter(store, cfg)
+	r := &reloader{limiter: rateLimiter, store: store, load: func() (*config.RateLimiterConfig, error) {
+		next := config.NewConfig()
+		next.MaxRequestsIP = 1
+		next.ServerAddr = ":9090"
+		return next, nil
+	}}
+
+	for i := range 2 {
+		if changed := restartRequired(rateLimiter.Snapshot().Config(), mustLoad(t, r)); !slices.Equal(changed, []string{"server"}) {
+			t.Errorf("Reload %d: expected the server change to be reported, got %v", i+1, changed)
+		}
+		if err := r.Reload(); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		running := rateLimiter.Snapshot().Config()
+		if running.ServerAddr != cfg.ServerAddr || running.MaxRequestsIP != 1 {
+			t.Errorf("Reload %d: expected the running server address and the new limit, got %q and %d", i+1, running.ServerAddr, running.MaxRequestsIP)
+		}
+	}
+}
+
+func mustLoad(t *testing.T, r *reloader) *config.RateLimiterConfig {
+	t.Helper()
+	cfg, err := r.load()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return cfg
+}
+
+func TestKeepRestartOnlyCoversRestartRequired(t *testing.T) {
+	previous := config.NewConfig()
+	next := config.NewConfig()
+
+	// Change every plain setting, then restore the restart-only ones
+	fields := reflect.ValueOf(next).Elem()
+	for i := range fields.NumField() {
+		switch field := fields.Field(i); field.Kind() {
+		case reflect.String:
+			field.SetString(field.String() + "-changed")
+		case reflect.Int:
+			field.SetInt(field.Int() + 1)
+		case reflect.Bool:
+			field.SetBool(!field.Bool())
+		case reflect.Slice:
+			if field.Type().Elem().Kind() == reflect.String {
+				field.Set(reflect.ValueOf([]string{"changed"}))
+			}
+		}
+	}
+	if len(restartRequired(previous, next)) == 0 {
+		t.Fatal("Expected restart-only settings to differ")
+	}
+
+	keepRestartOnly(previous, next)
+	if changed := restartRequired(previous, next); len(changed) != 0 {
+		t.Errorf("Expected every restart-only setting to be kept, got %v", changed)
+	}
+}
@@ -0,0 +1,351 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/iplist"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/limiter"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/pkg/logger"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// KeyState is the rate limit state of a key returned by the admin API
+type KeyState struct {
+	Key       string     `json:"key"`
+	Count     int        `json:"count"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Blocked   bool       `json:"blocked"`
+}
+
+// BlockedPage is a page of currently blocked keys
+type BlockedPage struct {
+	Keys       []string `json:"keys"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+// Handler serves the admin API on top of the limiter storage:
+//
+//	GET    /admin/keys/{kind}/{id}        current count, expiry and block state
+//	DELETE /admin/keys/{kind}/{id}        reset the counter and lift any block
+//	PUT    /admin/keys/{kind}/{id}/block  block for {"duration": seconds}
+//	GET    /admin/blocked                 list blocked keys, paginated with cursor and limit
+//	POST   /admin/reload                  reload the configuration, when WithReloader is set
+//	GET    /admin/iplists                 list the allow and deny entries added through the API
+//	PUT    /admin/iplists/{list}/{entry}  add an IP or CIDR to the "allow" or "deny" list
+//	DELETE /admin/iplists/{list}/{entry}  remove an IP or CIDR added through the API
+//
+// The IP list endpoints are served when WithIPLists is set.
+// kind is "ip" or "token". The optional route query parameter targets the
+// counters of a route rule instead of the global ones.
+type Handler struct {
+	store   storage.Strategy
+	token   string
+	reload  func() error
+	ipLists *iplist.Lists
+	limiter *limiter.RateLimiter
+	mux     *http.ServeMux
+}
+
+// Option configures optional Handler endpoints
+type Option func(*Handler)
+
+// WithReloader serves POST /admin/reload, which calls reload and reports its error
+func WithReloader(reload func() error) Option {
+	return func(h *Handler) {
+		h.reload = reload
+	}
+}
+
+// WithIPLists serves the endpoints editing the IP allow and deny lists
+func WithIPLists(lists *iplist.Lists) Option {
+	return func(h *Handler) {
+		h.ipLists = lists
+	}
+}
+
+// WithLimiter keys IP ids like the current limits of l, so an IPv6 address
+// addresses the network its IP limit is aggregated to, e.g. 2001:db8:0:1::/64.
+// Without it, addresses are only normalized.
+func WithLimiter(l *limiter.RateLimiter) Option {
+	return func(h *Handler) {
+		h.limiter = l
+	}
+}
+
+// NewHandler creates the admin API; every request must carry token as a bearer token
+func NewHandler(store storage.Strategy, token string, opts ...Option) (*Handler, error) {
+	if token == "" {
+		return nil, errors.New("the admin API requires a token")
+	}
+
+	h := &Handler{store: store, token: token, mux: http.NewServeMux()}
+	for _, opt := range opts {
+		opt(h)
+	}
+	h.mux.HandleFunc("GET /admin/keys/{kind}/{id}", h.getKey)
+	h.mux.HandleFunc("DELETE /admin/keys/{kind}/{id}", h.resetKey)
+	h.mux.HandleFunc("PUT /admin/keys/{kind}/{id}/block", h.blockKey)
+	h.mux.HandleFunc("GET /admin/blocked", h.listBlocked)
+	if h.reload != nil {
+		h.mux.HandleFunc("POST /admin/reload", h.reloadConfig)
+	}
+	if h.ipLists != nil {
+		h.mux.HandleFunc("GET /admin/iplists", h.listIPLists)
+		h.mux.HandleFunc("PUT /admin/iplists/{list}/{entry...}", h.addIPListEntry)
+		h.mux.HandleFunc("DELETE /admin/iplists/{list}/{entry...}", h.removeIPListEntry)
+	}
+	return h, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		logger.Warn("Unauthorized admin request",
+			"path", r.URL.Path,
+			"remoteAddr", r.RemoteAddr,
+		)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		writeError(w, http.StatusUnauthorized, "missing or invalid admin token")
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) authorized(r *http.Request) bool {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+func (h *Handler) getKey(w http.ResponseWriter, r *http.Request) {
+	key, err := h.storageKey(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	data, err := h.store.GetData(r.Context(), key)
+	if err != nil {
+		logger.Error("Failed to read key", "key", key, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to read key")
+		return
+	}
+	if data == nil {
+		writeError(w, http.StatusNotFound, "no rate limit state for "+key)
+		return
+	}
+
+	state := KeyState{Key: key, Count: data.Count, Blocked: data.IsBlocked}
+	if !data.ExpiresAt.IsZero() {
+		state.ExpiresAt = &data.ExpiresAt
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+func (h *Handler) resetKey(w http.ResponseWriter, r *http.Request) {
+	key, err := h.storageKey(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := h.store.Reset(r.Context(), key); err != nil {
+		logger.Error("Failed to reset key", "key", key, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to reset key")
+		return
+	}
+
+	logger.Info("Key reset by admin", "key", key, "remoteAddr", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) blockKey(w http.ResponseWriter, r *http.Request) {
+	key, err := h.storageKey(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var body struct {
+		Duration int `json:"duration"` // Seconds
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	if body.Duration <= 0 {
+		writeError(w, http.StatusBadRequest, "duration must be a positive number of seconds")
+		return
+	}
+
+	if err := h.store.Block(r.Context(), key, body.Duration); err != nil {
+		logger.Error("Failed to block key", "key", key, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to block key")
+		return
+	}
+
+	logger.Info("Key blocked by admin",
+		"key", key,
+		"durationSeconds", body.Duration,
+		"remoteAddr", r.RemoteAddr,
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) listBlocked(w http.ResponseWriter, r *http.Request) {
+	lister, ok := h.store.(storage.BlockedLister)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, "the storage backend cannot list blocked keys")
+		return
+	}
+
+	limit := defaultPageSize
+	if val := r.URL.Query().Get("limit"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n <= 0 || n > maxPageSize {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageSize))
+			return
+		}
+		limit = n
+	}
+
+	keys, next, err := lister.ListBlocked(r.Context(), r.URL.Query().Get("cursor"), limit)
+	if err != nil {
+		logger.Error("Failed to list blocked keys", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to list blocked keys")
+		return
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+	writeJSON(w, http.StatusOK, BlockedPage{Keys: keys, NextCursor: next})
+}
+
+func (h *Handler) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	logger.Info("Configuration reload requested by admin", "remoteAddr", r.RemoteAddr)
+	if err := h.reload(); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+func (h *Handler) listIPLists(w http.ResponseWriter, r *http.Request) {
+	entries := h.ipLists.Stored()
+	if entries.Allow == nil {
+		entries.Allow = []netip.Prefix{}
+	}
+	if entries.Deny == nil {
+		entries.Deny = []netip.Prefix{}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (h *Handler) addIPListEntry(w http.ResponseWriter, r *http.Request) {
+	h.editIPList(w, r, "added", h.ipLists.Add)
+}
+
+func (h *Handler) removeIPListEntry(w http.ResponseWriter, r *http.Request) {
+	h.editIPList(w, r, "removed", h.ipLists.Remove)
+}
+
+func (h *Handler) editIPList(w http.ResponseWriter, r *http.Request, verb string, edit func(context.Context, iplist.Action, string) error) {
+	action, err := iplist.ParseAction(r.PathValue("list"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	entry := r.PathValue("entry")
+	if _, err := iplist.ParsePrefix(entry); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := edit(r.Context(), action, entry); err != nil {
+		logger.Error("Failed to edit ip list", "list", action, "entry", entry, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to edit the "+string(action)+" list")
+		return
+	}
+
+	logger.Info("IP list entry "+verb+" by admin",
+		"list", action,
+		"entry", entry,
+		"remoteAddr", r.RemoteAddr,
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// storageKey builds the storage key addressed by the request, matching the
+// keys written by the limiter: ip:<addr or network>, token:<token>,
+// route:<id>:<kind>:<id> and quota:<period>:token:<token>
+func (h *Handler) storageKey(r *http.Request) (string, error) {
+	kind, id := r.PathValue("kind"), r.PathValue("id")
+	if kind != "ip" && kind != "token" {
+		return "", fmt.Errorf("kind must be ip or token, got %q", kind)
+	}
+	if id == "" {
+		return "", errors.New("missing key id")
+	}
+
+	if kind == "ip" {
+		id = h.ipKey(id)
+	}
+	key := kind + ":" + id
+	if route := r.URL.Query().Get("route"); route != "" {
+		key = "route:" + route + ":" + key
+	}
+	if quota := r.URL.Query().Get("quota"); quota != "" {
+		period := limiter.QuotaPeriod(quota)
+		if !slices.Contains(limiter.QuotaPeriods, period) {
+			return "", fmt.Errorf("quota must be hourly, daily or monthly, got %q", quota)
+		}
+		if kind != "token" || r.URL.Query().Has("route") {
+			return "", errors.New("quotas only apply to tokens, across every route")
+		}
+		key = limiter.QuotaKey(period, id)
+	}
+	if shadow := r.URL.Query().Get("shadow"); shadow != "" {
+		dryRun, err := strconv.ParseBool(shadow)
+		if err != nil {
+			return "", fmt.Errorf("shadow must be true or false, got %q", shadow)
+		}
+		if dryRun {
+			key = "shadow:" + key
+		}
+	}
+	return key, nil
+}
+
+// ipKey normalizes an IP id like the limiter does
+func (h *Handler) ipKey(ip string) string {
+	if h.limiter != nil {
+		return h.limiter.Snapshot().IPKey(ip)
+	}
+	return limiter.IPKey(ip, 0, 0)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,320 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/config"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/iplist"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/limiter"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
+)
+
+const testToken = "secret"
+
+func testBackends(t *testing.T) map[string]storage.Strategy {
+	t.Helper()
+
+	memory := storage.NewMemoryStrategy(0, 0)
+	t.Cleanup(func() { memory.Close() })
+
+	mr := miniredis.RunT(t)
+	redisStore, err := storage.NewRedisStrategy(mr.Addr(), 0, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	t.Cleanup(func() { redisStore.Close() })
+
+	return map[string]storage.Strategy{"memory": memory, "redis": redisStore}
+}
+
+func do(t *testing.T, h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	if _, err := NewHandler(storage.NewMemoryStrategy(0, 0), ""); err == nil {
+		t.Error("Expected error without a token")
+	}
+
+	h, _ := NewHandler(storage.NewMemoryStrategy(0, 0), testToken)
+	for _, auth := range []string{"", "Bearer wrong", "Basic " + testToken, testToken} {
+		req := httptest.NewRequest("GET", "/admin/blocked", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: expected 401, got %d", auth, w.Code)
+		}
+	}
+}
+
+func TestAdminKeyLifecycle(t *testing.T) {
+	for name, store := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			h, _ := NewHandler(store, testToken)
+			ctx := context.Background()
+
+			if w := do(t, h, "GET", "/admin/keys/ip/10.0.0.1", ""); w.Code != http.StatusNotFound {
+				t.Errorf("Expected 404 for unknown key, got %d", w.Code)
+			}
+
+			limit := storage.Limit{Algorithm: storage.AlgorithmFixedWindow, Max: 10, Window: time.Minute}
+			for i := 0; i < 3; i++ {
+				store.Consume(ctx, "ip:10.0.0.1", limit)
+			}
+
+			w := do(t, h, "GET", "/admin/keys/ip/10.0.0.1", "")
+			var state KeyState
+			json.NewDecoder(w.Body).Decode(&state)
+			if w.Code != http.StatusOK || state.Key != "ip:10.0.0.1" || state.Count != 3 || state.Blocked || state.ExpiresAt == nil {
+				t.Errorf("Expected count 3 and unblocked, got %d %+v", w.Code, state)
+			}
+
+			if w := do(t, h, "PUT", "/admin/keys/ip/10.0.0.1/block", `{"duration": 60}`); w.Code != http.StatusNoContent {
+				t.Errorf("Expected 204 on block, got %d: %s", w.Code, w.Body.String())
+			}
+			if blocked, _ := store.IsBlocked(ctx, "ip:10.0.0.1"); !blocked {
+				t.Error("Expected key to be blocked")
+			}
+
+			if w := do(t, h, "DELETE", "/admin/keys/ip/10.0.0.1", ""); w.Code != http.StatusNoContent {
+				t.Errorf("Expected 204 on reset, got %d", w.Code)
+			}
+			if blocked, _ := store.IsBlocked(ctx, "ip:10.0.0.1"); blocked {
+				t.Error("Expected key to be unblocked after reset")
+			}
+			if data, _ := store.GetData(ctx, "ip:10.0.0.1"); data != nil {
+				t.Errorf("Expected key to be reset, got %+v", data)
+			}
+
+			// Route rule counters and tokens with reserved characters
+			do(t, h, "PUT", "/admin/keys/token/a%2Fb/block?route=search", `{"duration": 60}`)
+			if blocked, _ := store.IsBlocked(ctx, "route:search:token:a/b"); !blocked {
+				t.Error("Expected route token key to be blocked")
+			}
+
+			// Dry-run counters
+			do(t, h, "PUT", "/admin/keys/ip/10.0.0.2/block?route=search&shadow=true", `{"duration": 60}`)
+			if blocked, _ := store.IsBlocked(ctx, "shadow:route:search:ip:10.0.0.2"); !blocked {
+				t.Error("Expected shadow route IP key to be blocked")
+			}
+
+			// Token quota usage
+			store.Consume(ctx, "quota:daily:token:abc", limit)
+			w = do(t, h, "GET", "/admin/keys/token/abc?quota=daily", "")
+			if err := json.NewDecoder(w.Body).Decode(&state); err != nil || state.Key != "quota:daily:token:abc" || state.Count != 1 {
+				t.Errorf("Expected the daily quota usage, got %+v, %v", state, err)
+			}
+		})
+	}
+}
+
+func TestAdminNormalizesIPs(t *testing.T) {
+	store := storage.NewMemoryStrategy(0, 0)
+	t.Cleanup(func() { store.Close() })
+	rateLimiter := limiter.NewRateLimiter(store, &config.RateLimiterConfig{
+		MaxRequestsIP:   10,
+		BlockDurationIP: 60,
+		EnableIPLimit:   true,
+		IPv4Prefix:      32,
+		IPv6Prefix:      64,
+	})
+	h, _ := NewHandler(store, testToken, WithLimiter(rateLimiter))
+	ctx := context.Background()
+
+	for _, ip := range []string{"2001:db8:0:1::7", "::ffff:203.0.113.7"} {
+		rateLimiter.Decide(ctx, limiter.Request{IP: ip})
+	}
+	for id, key := range map[string]string{
+		"2001:db8:0:1:aaaa::1": "ip:2001:db8:0:1::/64",
+		"2001:db8:0:1::%2F64":  "ip:2001:db8:0:1::/64",
+		"::ffff:203.0.113.7":   "ip:203.0.113.7",
+		"203.0.113.7":          "ip:203.0.113.7",
+	} {
+		var state KeyState
+		w := do(t, h, "GET", "/admin/keys/ip/"+id, "")
+		if err := json.NewDecoder(w.Body).Decode(&state); err != nil || state.Key != key || state.Count != 1 {
+			t.Errorf("%s: expected %s counted once, got %d %+v", id, key, w.Code, state)
+		}
+	}
+
+	// Route and dry-run keys are normalized too
+	do(t, h, "PUT", "/admin/keys/ip/2001:db8:0:2::9/block?route=search&shadow=true", `{"duration": 60}`)
+	if blocked, _ := store.IsBlocked(ctx, "shadow:route:search:ip:2001:db8:0:2::/64"); !blocked {
+		t.Error("Expected the shadow route key of the /64 to be blocked")
+	}
+
+	// Resetting an address lifts the limit of its network
+	do(t, h, "DELETE", "/admin/keys/ip/2001:db8:0:1::ffff", "")
+	if data, _ := store.GetData(ctx, "ip:2001:db8:0:1::/64"); data != nil {
+		t.Errorf("Expected the /64 to be reset, got %+v", data)
+	}
+
+	// Without a limiter, addresses are only normalized
+	h, _ = NewHandler(store, testToken)
+	do(t, h, "PUT", "/admin/keys/ip/fe80::1%25eth0/block", `{"duration": 60}`)
+	if blocked, _ := store.IsBlocked(ctx, "ip:fe80::1"); !blocked {
+		t.Error("Expected the zone to be dropped")
+	}
+}
+
+func TestAdminRejectsInvalidRequests(t *testing.T) {
+	h, _ := NewHandler(storage.NewMemoryStrategy(0, 0), testToken)
+
+	tests := []struct {
+		method, target, body string
+		expected             int
+	}{
+		{"GET", "/admin/keys/user/1", "", http.StatusBadRequest},
+		{"PUT", "/admin/keys/ip/1.2.3.4/block", `{"duration": 0}`, http.StatusBadRequest},
+		{"PUT", "/admin/keys/ip/1.2.3.4/block", `not json`, http.StatusBadRequest},
+		{"GET", "/admin/keys/ip/1.2.3.4?shadow=maybe", "", http.StatusBadRequest},
+		{"GET", "/admin/keys/token/abc?quota=weekly", "", http.StatusBadRequest},
+		{"GET", "/admin/keys/ip/1.2.3.4?quota=daily", "", http.StatusBadRequest},
+		{"GET", "/admin/keys/token/abc?quota=daily&route=search", "", http.StatusBadRequest},
+		{"GET", "/admin/blocked?limit=0", "", http.StatusBadRequest},
+		{"GET", "/admin/blocked?limit=5000", "", http.StatusBadRequest},
+		{"POST", "/admin/keys/ip/1.2.3.4", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		if w := do(t, h, tt.method, tt.target, tt.body); w.Code != tt.expected {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.target, tt.expected, w.Code)
+		}
+	}
+}
+
+func TestAdminListsBlockedKeys(t *testing.T) {
+	for name, store := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			h, _ := NewHandler(store, testToken)
+			ctx := context.Background()
+
+			expected := map[string]bool{}
+			for _, key := range []string{"ip:1", "ip:2", "ip:3", "token:a", "token:b"} {
+				store.Block(ctx, key, 60)
+				expected[key] = true
+			}
+			store.Consume(ctx, "ip:4", storage.Limit{Algorithm: storage.AlgorithmFixedWindow, Max: 5, Window: time.Minute})
+
+			listed := map[string]bool{}
+			cursor := ""
+			for pages := 0; ; pages++ {
+				if pages > 10 {
+					t.Fatal("Pagination did not terminate")
+				}
+				w := do(t, h, "GET", "/admin/blocked?limit=2&cursor="+cursor, "")
+				if w.Code != http.StatusOK {
+					t.Fatalf("Expected 200, got %d", w.Code)
+				}
+				var page BlockedPage
+				json.NewDecoder(w.Body).Decode(&page)
+				for _, key := range page.Keys {
+					if listed[key] {
+						t.Errorf("Key %s listed twice", key)
+					}
+					listed[key] = true
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				cursor = page.NextCursor
+			}
+
+			if len(listed) != len(expected) {
+				t.Errorf("Expected %d blocked keys, got %v", len(expected), listed)
+			}
+			for key := range expected {
+				if !listed[key] {
+					t.Errorf("Expected %s to be listed", key)
+				}
+			}
+		})
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	store := storage.NewMemoryStrategy(0, 0)
+	defer store.Close()
+
+	h, _ := NewHandler(store, testToken)
+	if w := do(t, h, "POST", "/admin/reload", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 without a reloader, got %d", w.Code)
+	}
+
+	var reloadErr error
+	h, _ = NewHandler(store, testToken, WithReloader(func() error { return reloadErr }))
+	if w := do(t, h, "POST", "/admin/reload", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+
+	reloadErr = errors.New("ip window must be positive")
+	w := do(t, h, "POST", "/admin/reload", "")
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "ip window must be positive") {
+		t.Errorf("Expected the reload error in the body, got %s", w.Body.String())
+	}
+}
+
+func TestAdminIPLists(t *testing.T) {
+	store := storage.NewMemoryStrategy(0, 0)
+	defer store.Close()
+
+	lists := iplist.NewLists(iplist.Entries{}, iplist.NewMemoryStore())
+	h, _ := NewHandler(store, testToken, WithIPLists(lists))
+
+	for _, target := range []string{"/admin/iplists/deny/203.0.113.0/24", "/admin/iplists/allow/2001:db8::1"} {
+		if w := do(t, h, "PUT", target, ""); w.Code != http.StatusNoContent {
+			t.Errorf("PUT %s: expected 204, got %d: %s", target, w.Code, w.Body.String())
+		}
+	}
+	if got := lists.Lookup("203.0.113.9"); got != iplist.Deny {
+		t.Errorf("Expected the deny entry to apply, got %q", got)
+	}
+
+	w := do(t, h, "GET", "/admin/iplists", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	var entries struct {
+		Allow []string `json:"allow"`
+		Deny  []string `json:"deny"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(entries.Allow) != 1 || entries.Allow[0] != "2001:db8::1/128" || len(entries.Deny) != 1 || entries.Deny[0] != "203.0.113.0/24" {
+		t.Errorf("Expected the added entries, got %+v", entries)
+	}
+
+	if w := do(t, h, "DELETE", "/admin/iplists/deny/203.0.113.0/24", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d", w.Code)
+	}
+	if got := lists.Lookup("203.0.113.9"); got != "" {
+		t.Errorf("Expected the deny entry to be removed, got %q", got)
+	}
+
+	for _, target := range []string{"/admin/iplists/block/10.0.0.1", "/admin/iplists/deny/10.0.0.0/33", "/admin/iplists/deny/example.com"} {
+		if w := do(t, h, "PUT", target, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("PUT %s: expected 400, got %d", target, w.Code)
+		}
+	}
+}
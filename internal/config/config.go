@@ -1,32 +1,281 @@
 package config
 
+import (
+	"strings"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/proxy"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/rules"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/tokens"
+)
+
+// Supported token registries
+const (
+	TokenRegistryNone  = ""
+	TokenRegistryFile  = "file"
+	TokenRegistryRedis = "redis"
+)
+
+// Policies for tokens missing from the token registry
+const (
+	UnknownTokenDefault = "default" // Apply the global token limit
+	UnknownTokenReject  = "reject"  // Reject the request
+)
+
+// Rate limit header dialects sent by the middleware
+const (
+	HeadersIETF   = "ietf"   // RateLimit-* headers from draft-ietf-httpapi-ratelimit-headers
+	HeadersLegacy = "legacy" // X-RateLimit-* headers
+	HeadersBoth   = "both"
+	HeadersNone   = "none"
+)
+
+// Sources of the client IP address
+const (
+	ClientIPRemoteAddr    = "remote_addr"     // Connection address only, forwarding headers are ignored
+	ClientIPXForwardedFor = "x-forwarded-for" // X-Forwarded-For appended by trusted proxies
+	ClientIPForwarded     = "forwarded"       // RFC 7239 Forwarded header appended by trusted proxies
+	ClientIPXRealIP       = "x-real-ip"       // X-Real-IP set by a trusted proxy
+)
+
+// Kinds of key extractors, configured as "kind:argument"
+const (
+	KeyExtractorHeader = "header" // header:<name>
+	KeyExtractorBearer = "bearer" // Authorization: Bearer <key>
+	KeyExtractorQuery  = "query"  // query:<parameter>
+	KeyExtractorCookie = "cookie" // cookie:<name>
+	KeyExtractorJWT    = "jwt"    // jwt:<claim> of the bearer token
+	KeyExtractorMTLS   = "mtls"   // Subject of the TLS client certificate
+	KeyExtractorPath   = "path"   // path:<pattern with one {name} segment>
+)
+
+// Header families the forward-auth endpoint reads the original request from
+const (
+	ForwardAuthOriginal  = "original"  // X-Original-Method, X-Original-URI/X-Original-URL and X-Original-Host, set by nginx
+	ForwardAuthForwarded = "forwarded" // X-Forwarded-Method, X-Forwarded-Uri and X-Forwarded-Host, set by Traefik
+)
+
+// Policies applied when the storage cannot be reached
+const (
+	FailureOpen     = "fail_open"   // Let requests through unlimited
+	FailureClosed   = "fail_closed" // Reject requests with 503 and Retry-After
+	FailureFallback = "fallback"    // Limit requests with a local in-memory storage
+)
+
+// Supported storage backends
+const (
+	StorageRedis  = "redis"
+	StorageMemory = "memory"
+)
+
 type RateLimiterConfig struct {
+	// Configuration file and hot reload
+	ConfigFile          string // YAML or JSON file the configuration was loaded from (empty for environment only)
+	ConfigWatchInterval int    // Seconds between checks of the configuration, rules and token registry files for changes (0 disables watching)
+
 	// IP-based rate limiting
-	MaxRequestsIP   int // Maximum requests per second from a single IP
+	MaxRequestsIP   int // Maximum requests per window from a single IP
+	WindowIP        int // Window in seconds for IP
 	BlockDurationIP int // Block duration in seconds for IP
 	EnableIPLimit   bool
+	AlgorithmIP     string // Rate limiting algorithm for IP limits
+	IPv4Prefix      int    // Length of the IPv4 networks sharing an IP limit (32 limits each address)
+	IPv6Prefix      int    // Length of the IPv6 networks sharing an IP limit (128 limits each address)
+
+	// IP allow and deny lists
+	IPAllowlist           []string // IPs and CIDRs exempted from the IP limit
+	IPDenylist            []string // IPs and CIDRs whose requests are always rejected
+	IPListRefreshInterval int      // Seconds between reloads of the list entries edited through the admin API (0 disables reloading)
 
 	// Token-based rate limiting
-	MaxRequestsToken   int // Maximum requests per second for a token
+	MaxRequestsToken   int // Maximum requests per window for a token
+	WindowToken        int // Window in seconds for token
 	BlockDurationToken int // Block duration in seconds for token
 	EnableTokenLimit   bool
+	AlgorithmToken     string // Rate limiting algorithm for token limits
+
+	// Long-horizon token quotas, stacking with the token rate limit
+	HourlyQuotaToken  int    // Requests per calendar hour for a token (0 disables the quota)
+	DailyQuotaToken   int    // Requests per calendar day for a token (0 disables the quota)
+	MonthlyQuotaToken int    // Requests per calendar month for a token (0 disables the quota)
+	QuotaTimezone     string // IANA time zone the quota periods are aligned to
+
+	// Block escalation for repeat offenders, applied to every limit
+	PenaltyMultiplier float64 // Growth factor of the block per repeated violation (0 or 1 disables escalation)
+	PenaltyMaxBlock   int     // Longest escalated block in seconds
+	PenaltyDecay      int     // Seconds after a block ends before the violations are forgotten
+
+	// Dry-run mode
+	DryRun bool // Record every decision without enforcing it; route rules can opt in individually
+
+	// Weighted request cost
+	CostHeader string // Header carrying the requests charged for a request, set by a trusted upstream (empty charges the route rule cost)
+
+	// Per-token limit overrides
+	TokenRegistry         string         // Token registry backend: "", "file" or "redis"
+	TokenRegistryFile     string         // Path of the JSON file used by the file registry
+	TokenRegistryCacheTTL int            // Seconds the redis registry caches lookups
+	UnknownTokenPolicy    string         // What to do with tokens missing from the registry: "default" or "reject"
+	TokenOverrides        []tokens.Limit // Token limits from the configuration file, used when no registry is set
+
+	// Per-route rules
+	RulesFile string       // Path of the JSON file with route rules (empty applies the global limits everywhere)
+	Rules     []rules.Rule // Route rules from the configuration file, exclusive with RulesFile
+
+	// Client IP resolution
+	ClientIPMode   string   // Where the client IP is read from, see the ClientIP* constants
+	TrustedProxies []string // IPs and CIDRs of proxies whose forwarding headers are trusted
+
+	// Keys rate limited by the token limit, first match wins
+	KeyExtractors []string // Extractor specs, see the KeyExtractor* constants
+	JWTSecret     string   // HMAC secret verifying JWTs read by "jwt" extractors (empty reads claims unverified)
+
+	// Rate limit response headers: "ietf", "legacy", "both" or "none"
+	HeaderMode string
+
+	// Storage backend: "redis" or "memory"
+	StorageType string
+
+	// Storage failure handling
+	FailurePolicy    string // "fail_open", "fail_closed" or "fallback"
+	BreakerThreshold int    // Consecutive storage errors opening the circuit breaker (0 disables it)
+	BreakerTimeout   int    // Seconds the breaker stays open before probing the storage again
+
+	// In-memory storage configuration
+	MemoryMaxKeys         int // Maximum number of keys kept in memory (0 means unbounded)
+	MemoryCleanupInterval int // Interval in seconds between sweeps of expired keys
+
+	// HTTP server configuration
+	ServerAddr              string // Listen address
+	ServerReadTimeout       int    // Seconds to read a whole request, body included
+	ServerReadHeaderTimeout int    // Seconds to read the request headers
+	ServerWriteTimeout      int    // Seconds to write the response
+	ServerIdleTimeout       int    // Seconds keep-alive connections stay idle
+	ServerMaxHeaderBytes    int    // Maximum size of the request headers
+	ServerShutdownDelay     int    // Seconds /health reports draining before the listener closes
+	ServerShutdownTimeout   int    // Seconds in-flight requests get to finish on shutdown
+
+	// Reverse proxy mode, enabled when any upstream is configured
+	ProxyUpstreams           []string      // Upstreams of the requests matching no proxy route
+	ProxyRoutes              []proxy.Route // Path-based routes from the configuration file
+	ProxyTimeout             int           // Seconds to wait for the upstream response headers
+	ProxyDialTimeout         int           // Seconds to connect to an upstream
+	ProxyHealthCheckPath     string        // Path probed on every upstream (empty disables health checks)
+	ProxyHealthCheckInterval int           // Seconds between health checks
+	ProxyHealthCheckTimeout  int           // Seconds a health check may take
+
+	// Prometheus metrics
+	MetricsEnabled             bool
+	MetricsPath                string // Path serving the metrics, outside the rate limiter
+	MetricsBlockedKeysInterval int    // Seconds between counts of the blocked keys gauge (0 disables the gauge)
+
+	// Forward-auth decision endpoint
+	ForwardAuthEnabled bool
+	ForwardAuthPath    string // Path answering nginx auth_request and Traefik ForwardAuth subrequests
+	ForwardAuthHeaders string // Header family describing the original request, read from trusted proxies only
+
+	// Admin API
+	AdminAddr  string // Listen address of the admin API (empty disables it)
+	AdminToken string // Bearer token required by the admin API
+
+	// Envoy Rate Limit Service
+	RLSAddr string // Listen address of the Envoy RLS gRPC server (empty disables it)
 
 	// Redis configuration
-	RedisAddr string
-	RedisDB   int
-	RedisPass string
+	RedisMode             string // "standalone", "cluster" or "sentinel"
+	RedisAddr             string // Server address, or comma-separated cluster seeds or sentinel addresses
+	RedisDB               int
+	RedisUsername         string // ACL username
+	RedisPass             string
+	RedisMasterName       string // Master monitored by the sentinels
+	RedisSentinelUsername string
+	RedisSentinelPass     string
+	RedisPoolSize         int // Connections per node (0 uses the client default)
+	RedisDialTimeout      int // Milliseconds (0 uses the client default)
+	RedisReadTimeout      int // Milliseconds (0 uses the client default)
+	RedisWriteTimeout     int // Milliseconds (0 uses the client default)
+
+	// Redis TLS
+	RedisTLS                   bool
+	RedisTLSCAFile             string // PEM bundle verifying the server (empty uses the system roots)
+	RedisTLSCertFile           string // Client certificate for mutual TLS
+	RedisTLSKeyFile            string
+	RedisTLSServerName         string // Overrides the name verified in the server certificate
+	RedisTLSInsecureSkipVerify bool
 }
 
 func NewConfig() *RateLimiterConfig {
 	return &RateLimiterConfig{
-		MaxRequestsIP:      10,
-		BlockDurationIP:    60,
-		EnableIPLimit:      true,
-		MaxRequestsToken:   100,
-		BlockDurationToken: 60,
-		EnableTokenLimit:   true,
-		RedisAddr:          "localhost:6379",
-		RedisDB:            0,
-		RedisPass:          "",
+		ConfigWatchInterval:      5,
+		MaxRequestsIP:            10,
+		WindowIP:                 1,
+		BlockDurationIP:          60,
+		EnableIPLimit:            true,
+		AlgorithmIP:              string(storage.AlgorithmFixedWindow),
+		IPv4Prefix:               32,
+		IPv6Prefix:               64,
+		IPListRefreshInterval:    5,
+		MaxRequestsToken:         100,
+		WindowToken:              1,
+		BlockDurationToken:       60,
+		EnableTokenLimit:         true,
+		AlgorithmToken:           string(storage.AlgorithmFixedWindow),
+		QuotaTimezone:            "UTC",
+		PenaltyMaxBlock:          86400,
+		PenaltyDecay:             3600,
+		TokenRegistry:            TokenRegistryNone,
+		TokenRegistryCacheTTL:    5,
+		UnknownTokenPolicy:       UnknownTokenDefault,
+		ClientIPMode:             ClientIPRemoteAddr,
+		KeyExtractors:            []string{KeyExtractorHeader + ":API_KEY"},
+		HeaderMode:               HeadersIETF,
+		StorageType:              StorageRedis,
+		FailurePolicy:            FailureClosed,
+		BreakerThreshold:         5,
+		BreakerTimeout:           10,
+		MemoryMaxKeys:            100000,
+		MemoryCleanupInterval:    10,
+		ServerAddr:               ":8080",
+		ServerReadTimeout:        10,
+		ServerReadHeaderTimeout:  5,
+		ServerWriteTimeout:       10,
+		ServerIdleTimeout:        60,
+		ServerMaxHeaderBytes:     1 << 20,
+		ServerShutdownDelay:      0,
+		ServerShutdownTimeout:    15,
+		ProxyTimeout:             30,
+		ProxyDialTimeout:         5,
+		ProxyHealthCheckInterval: 10,
+		ProxyHealthCheckTimeout:  2,
+		MetricsEnabled:           true,
+		MetricsPath:              "/metrics",
+		ForwardAuthPath:          "/check",
+		ForwardAuthHeaders:       ForwardAuthOriginal,
+		RedisMode:                storage.RedisStandalone,
+		RedisAddr:                "localhost:6379",
+		RedisDB:                  0,
+		RedisPass:                "",
+	}
+}
+
+// AllProxyRoutes returns the proxy routes, followed by a catch-all route to
+// ProxyUpstreams when it is set. The server runs as a reverse proxy when the
+// result is not empty.
+func (c *RateLimiterConfig) AllProxyRoutes() []proxy.Route {
+	routes := append([]proxy.Route(nil), c.ProxyRoutes...)
+	if len(c.ProxyUpstreams) > 0 {
+		routes = append(routes, proxy.Route{Upstreams: c.ProxyUpstreams})
+	}
+	return routes
+}
+
+// RedisAddrs returns the Redis addresses listed in RedisAddr
+func (c *RateLimiterConfig) RedisAddrs() []string {
+	var addrs []string
+	for _, addr := range strings.Split(c.RedisAddr, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
 	}
+	return addrs
 }
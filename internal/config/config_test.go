@@ -0,0 +1,376 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/proxy"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if cfg.MaxRequestsIP != 10 || cfg.WindowIP != 1 {
+		t.Errorf("Expected default IP limit 10 per 1s, got %d per %ds", cfg.MaxRequestsIP, cfg.WindowIP)
+	}
+}
+
+func TestLoadConfigYAMLFile(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+ip:
+  max_requests: 5
+  window: 10
+  algorithm: sliding_log
+  allowlist: [10.0.0.0/8, "2001:db8::/32"]
+  denylist: [203.0.113.7]
+token:
+  enabled: false
+  quota:
+    daily: 10000
+    monthly: 1000000
+    timezone: America/Sao_Paulo
+  overrides:
+    - token: abc
+      max_requests: 1000
+      quota:
+        daily: 50000
+penalty:
+  multiplier: 1.5
+  max_block: 600
+dry_run: true
+cost_header: X-Cost
+rules:
+  - id: search
+    path_prefix: /search
+    dry_run: true
+    cost: 5
+    ip:
+      max_requests: 2
+client_ip:
+  mode: x-forwarded-for
+  trusted_proxies: [10.0.0.0/8]
+storage:
+  type: memory
+  memory:
+    max_keys: 50
+server:
+  addr: ":9090"
+rls:
+  addr: ":8081"
+proxy:
+  upstreams: [http://app:3000]
+  routes:
+    - path_prefix: /api/
+      upstreams: [http://api-1:8080, http://api-2:8080]
+      strip_prefix: true
+      request_headers:
+        set:
+          X-Tenant: acme
+  timeout: 60
+  health_check:
+    path: /healthz
+`)
+	t.Setenv("RATE_LIMITER_CONFIG_FILE", path)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if cfg.MaxRequestsIP != 5 || cfg.WindowIP != 10 || cfg.AlgorithmIP != "sliding_log" {
+		t.Errorf("Expected IP limit from file, got %d per %ds with %s", cfg.MaxRequestsIP, cfg.WindowIP, cfg.AlgorithmIP)
+	}
+	if len(cfg.IPAllowlist) != 2 || len(cfg.IPDenylist) != 1 {
+		t.Errorf("Expected IP lists from file, got %v and %v", cfg.IPAllowlist, cfg.IPDenylist)
+	}
+	if cfg.EnableTokenLimit {
+		t.Error("Expected token limit to be disabled")
+	}
+	if len(cfg.TokenOverrides) != 1 || cfg.TokenOverrides[0].MaxRequests != 1000 || cfg.TokenOverrides[0].Quota.Daily != 50000 || !cfg.TokenOverrides[0].Enabled {
+		t.Errorf("Expected one enabled override with 1000 requests and a daily quota of 50000, got %+v", cfg.TokenOverrides)
+	}
+	if cfg.HourlyQuotaToken != 0 || cfg.DailyQuotaToken != 10000 || cfg.MonthlyQuotaToken != 1000000 || cfg.QuotaTimezone != "America/Sao_Paulo" {
+		t.Errorf("Expected token quotas from file, got %d/%d/%d in %s", cfg.HourlyQuotaToken, cfg.DailyQuotaToken, cfg.MonthlyQuotaToken, cfg.QuotaTimezone)
+	}
+	if cfg.PenaltyMultiplier != 1.5 || cfg.PenaltyMaxBlock != 600 || cfg.PenaltyDecay != 3600 {
+		t.Errorf("Expected penalty from file with the default decay, got %+v", cfg)
+	}
+	if !cfg.DryRun {
+		t.Error("Expected dry-run from file")
+	}
+	if len(cfg.Rules) != 1 || cfg.Rules[0].IP.MaxRequests != 2 || !cfg.Rules[0].DryRun || cfg.Rules[0].Cost != 5 {
+		t.Errorf("Expected the search rule, got %+v", cfg.Rules)
+	}
+	if cfg.CostHeader != "X-Cost" {
+		t.Errorf("Expected the cost header from file, got %q", cfg.CostHeader)
+	}
+	if cfg.ClientIPMode != ClientIPXForwardedFor || len(cfg.TrustedProxies) != 1 {
+		t.Errorf("Expected client IP settings from file, got %s %v", cfg.ClientIPMode, cfg.TrustedProxies)
+	}
+	if cfg.StorageType != StorageMemory || cfg.MemoryMaxKeys != 50 {
+		t.Errorf("Expected memory storage with 50 keys, got %s with %d", cfg.StorageType, cfg.MemoryMaxKeys)
+	}
+	if cfg.ServerAddr != ":9090" || cfg.RLSAddr != ":8081" {
+		t.Errorf("Expected server and RLS addresses from file, got %s and %s", cfg.ServerAddr, cfg.RLSAddr)
+	}
+	routes := cfg.AllProxyRoutes()
+	if len(routes) != 2 || len(routes[0].Upstreams) != 2 || !routes[0].StripPrefix || routes[0].RequestHeaders.Set["X-Tenant"] != "acme" ||
+		routes[1].PathPrefix != "" || routes[1].Upstreams[0] != "http://app:3000" {
+		t.Errorf("Expected the api route and a catch-all route, got %+v", routes)
+	}
+	if cfg.ProxyTimeout != 60 || cfg.ProxyDialTimeout != 5 || cfg.ProxyHealthCheckPath != "/healthz" || cfg.ProxyHealthCheckInterval != 10 {
+		t.Errorf("Expected proxy timeouts and health check from file, got %+v", cfg)
+	}
+	if cfg.BlockDurationIP != 60 {
+		t.Errorf("Expected missing values to keep defaults, got block duration %d", cfg.BlockDurationIP)
+	}
+}
+
+func TestLoadConfigEnvOverridesFile(t *testing.T) {
+	path := writeConfigFile(t, "config.json", `{"ip": {"max_requests": 5, "block_duration": 30}}`)
+	t.Setenv("RATE_LIMITER_CONFIG_FILE", path)
+	t.Setenv("RATE_LIMITER_MAX_REQUESTS_IP", "7")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if cfg.MaxRequestsIP != 7 {
+		t.Errorf("Expected env to override file, got %d", cfg.MaxRequestsIP)
+	}
+	if cfg.BlockDurationIP != 30 {
+		t.Errorf("Expected block duration 30 from file, got %d", cfg.BlockDurationIP)
+	}
+}
+
+func TestLoadConfigReportsAllErrors(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+ip:
+  max_requests: -1
+  window: 0
+  burst: 3
+storage:
+  redis:
+    database: 1
+`)
+	t.Setenv("RATE_LIMITER_CONFIG_FILE", path)
+
+	_, err := LoadConfig()
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	for _, want := range []string{
+		"ip.burst: unknown key",
+		"storage.redis.database: unknown key",
+		"ip max requests must be positive",
+		"ip window must be positive",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to mention %q, got %v", want, err)
+		}
+	}
+}
+
+func TestLoadConfigInvalidEnv(t *testing.T) {
+	t.Setenv("RATE_LIMITER_MAX_REQUESTS_IP", "ten")
+	t.Setenv("RATE_LIMITER_ENABLE_TOKEN", "maybe")
+	t.Setenv("RATE_LIMITER_PENALTY_MULTIPLIER", "double")
+
+	_, err := LoadConfig()
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	for _, want := range []string{"RATE_LIMITER_MAX_REQUESTS_IP", "RATE_LIMITER_ENABLE_TOKEN", "RATE_LIMITER_PENALTY_MULTIPLIER"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to mention %s, got %v", want, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := NewConfig()
+	cfg.MaxRequestsIP = -1
+	cfg.WindowToken = 0
+	cfg.BlockDurationToken = -5
+	cfg.TrustedProxies = []string{"10.0.0.0/33"}
+	cfg.KeyExtractors = []string{"header"}
+	cfg.AdminAddr = ":9000"
+	cfg.PenaltyMultiplier = 2
+	cfg.PenaltyDecay = 0
+	cfg.IPDenylist = []string{"203.0.113.0/24", "203.0.113.300"}
+	cfg.IPv6Prefix = 129
+	cfg.ForwardAuthEnabled = true
+	cfg.ForwardAuthPath = "/metrics"
+	cfg.ForwardAuthHeaders = "x-forwarded"
+	cfg.ProxyUpstreams = []string{"app:3000"}
+	cfg.ProxyRoutes = []proxy.Route{
+		{PathPrefix: "/api", Upstreams: []string{"http://api:8080"}},
+		{PathPrefix: "/api", Upstreams: []string{"http://api-2:8080"}},
+	}
+	cfg.ProxyHealthCheckPath = "healthz"
+	cfg.DailyQuotaToken = -1
+	cfg.QuotaTimezone = "Mars/Olympus_Mons"
+	cfg.MetricsBlockedKeysInterval = -1
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	for _, want := range []string{
+		"ip max requests must be positive",
+		"token window must be positive",
+		"token block duration must not be negative",
+		`trusted proxy "10.0.0.0/33"`,
+		`invalid key extractor "header"`,
+		"admin token must be set",
+		"penalty decay must be positive",
+		`ip denylist entry "203.0.113.300"`,
+		"ipv6 prefix must be between 1 and 128",
+		`forward auth path "/metrics" is already used by the metrics`,
+		`invalid forward auth headers "x-forwarded"`,
+		`proxy route 1: path prefix "/api" is routed more than once`,
+		`proxy route 2: upstream "app:3000" must be an absolute http or https URL`,
+		`proxy health check path "healthz" must start with /`,
+		"token daily quota must not be negative",
+		`invalid quota timezone "Mars/Olympus_Mons"`,
+		"metrics blocked keys interval must not be negative",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to mention %q, got %v", want, err)
+		}
+	}
+
+	if err := NewConfig().Validate(); err != nil {
+		t.Errorf("Expected default configuration to be valid, got %v", err)
+	}
+}
+
+func TestExampleConfigFile(t *testing.T) {
+	t.Setenv("RATE_LIMITER_CONFIG_FILE", filepath.Join("..", "..", "config.example.yaml"))
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected the example configuration to be valid, got %v", err)
+	}
+	if len(cfg.TokenOverrides) != 2 || len(cfg.Rules) != 2 {
+		t.Errorf("Expected 2 overrides and 2 rules, got %d and %d", len(cfg.TokenOverrides), len(cfg.Rules))
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", "ip: {max_requests: 5}\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan struct{}, 10)
+	go Watch(ctx, func() []string { return []string{path} }, 10*time.Millisecond, func() { changes <- struct{}{} })
+
+	time.Sleep(30 * time.Millisecond)
+	select {
+	case <-changes:
+		t.Fatal("Expected no change before the file is written")
+	default:
+	}
+
+	future := time.Now().Add(time.Minute)
+	if err := os.WriteFile(path, []byte("ip: {max_requests: 6}\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	os.Chtimes(path, future, future)
+
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the change to be detected")
+	}
+}
+
+func TestWatchFollowsReloadedPaths(t *testing.T) {
+	configFile := writeConfigFile(t, "config.yaml", "rules_file: old.json\n")
+	rulesFile := writeConfigFile(t, "new.json", "[]\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan struct{}, 10)
+	watched := []string{configFile}
+	go Watch(ctx, func() []string { return watched }, 10*time.Millisecond, func() {
+		// The reloaded configuration names a new rules file
+		watched = []string{configFile, rulesFile}
+		changes <- struct{}{}
+	})
+
+	for i, path := range []string{configFile, rulesFile} {
+		time.Sleep(30 * time.Millisecond)
+		future := time.Now().Add(time.Duration(i+1) * time.Minute)
+		os.Chtimes(path, future, future)
+
+		select {
+		case <-changes:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the change of %s to be detected", filepath.Base(path))
+		}
+	}
+}
+
+func TestWatchedFiles(t *testing.T) {
+	cfg := NewConfig()
+	cfg.ConfigFile = "config.yaml"
+	cfg.RulesFile = "rules.json"
+	cfg.TokenRegistry = TokenRegistryFile
+	cfg.TokenRegistryFile = "tokens.json"
+
+	files := cfg.WatchedFiles()
+	if strings.Join(files, ",") != "config.yaml,rules.json,tokens.json" {
+		t.Errorf("Expected the three files, got %v", files)
+	}
+}
+
+func TestValidateRedis(t *testing.T) {
+	cfg := NewConfig()
+	cfg.RedisAddr = "10.0.0.1:6379, 10.0.0.2:6379"
+	cfg.RedisTLSCertFile = "client.pem"
+	cfg.RedisPoolSize = -1
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	for _, want := range []string{
+		"standalone redis takes a single address, got 2",
+		"cert file and key file must be set together",
+		"require redis tls to be enabled",
+		"redis pool size must not be negative",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to mention %q, got %v", want, err)
+		}
+	}
+
+	cfg = NewConfig()
+	cfg.RedisMode = "sentinel"
+	cfg.RedisAddr = "10.0.0.1:26379,10.0.0.2:26379"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "master name must be set") {
+		t.Errorf("Expected the missing master name to be reported, got %v", err)
+	}
+	cfg.RedisMasterName = "mymaster"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if addrs := cfg.RedisAddrs(); len(addrs) != 2 || addrs[1] != "10.0.0.2:26379" {
+		t.Errorf("Expected two sentinel addresses, got %v", addrs)
+	}
+}
@@ -0,0 +1,453 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/proxy"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/rules"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/tokens"
+)
+
+// fileConfig is the layout of the YAML or JSON configuration file. Every field
+// is optional; missing fields keep the defaults and environment variables take
+// precedence over the file.
+type fileConfig struct {
+	IP          *fileIPLimit     `json:"ip"`
+	Token       *fileTokenLimit  `json:"token"`
+	Penalty     *filePenalty     `json:"penalty"`
+	DryRun      *bool            `json:"dry_run"`
+	RulesFile   *string          `json:"rules_file"`
+	Rules       []rules.Rule     `json:"rules"`
+	ClientIP    *fileClientIP    `json:"client_ip"`
+	Keys        *fileKeys        `json:"keys"`
+	Headers     *string          `json:"headers"`
+	CostHeader  *string          `json:"cost_header"`
+	Storage     *fileStorage     `json:"storage"`
+	Server      *fileServer      `json:"server"`
+	Proxy       *fileProxy       `json:"proxy"`
+	Metrics     *fileMetrics     `json:"metrics"`
+	ForwardAuth *fileForwardAuth `json:"forward_auth"`
+	Admin       *fileAdmin       `json:"admin"`
+	RLS         *fileRLS         `json:"rls"`
+}
+
+type fileLimit struct {
+	Enabled       *bool   `json:"enabled"`
+	MaxRequests   *int    `json:"max_requests"`
+	Window        *int    `json:"window"`
+	BlockDuration *int    `json:"block_duration"`
+	Algorithm     *string `json:"algorithm"`
+}
+
+type fileIPLimit struct {
+	fileLimit
+	IPv4Prefix          *int     `json:"ipv4_prefix"`
+	IPv6Prefix          *int     `json:"ipv6_prefix"`
+	Allowlist           []string `json:"allowlist"`
+	Denylist            []string `json:"denylist"`
+	ListRefreshInterval *int     `json:"list_refresh_interval"`
+}
+
+type fileTokenLimit struct {
+	fileLimit
+	UnknownPolicy *string        `json:"unknown_policy"`
+	Quota         *fileQuota     `json:"quota"`
+	Registry      *fileRegistry  `json:"registry"`
+	Overrides     []tokens.Limit `json:"overrides"`
+}
+
+type fileQuota struct {
+	Hourly   *int    `json:"hourly"`
+	Daily    *int    `json:"daily"`
+	Monthly  *int    `json:"monthly"`
+	Timezone *string `json:"timezone"`
+}
+
+type filePenalty struct {
+	Multiplier *float64 `json:"multiplier"`
+	MaxBlock   *int     `json:"max_block"`
+	Decay      *int     `json:"decay"`
+}
+
+type fileRegistry struct {
+	Type     *string `json:"type"`
+	File     *string `json:"file"`
+	CacheTTL *int    `json:"cache_ttl"`
+}
+
+type fileClientIP struct {
+	Mode           *string  `json:"mode"`
+	TrustedProxies []string `json:"trusted_proxies"`
+}
+
+type fileKeys struct {
+	Extractors []string `json:"extractors"`
+	JWTSecret  *string  `json:"jwt_secret"`
+}
+
+type fileStorage struct {
+	Type          *string      `json:"type"`
+	FailurePolicy *string      `json:"failure_policy"`
+	Breaker       *fileBreaker `json:"breaker"`
+	Memory        *fileMemory  `json:"memory"`
+	Redis         *fileRedis   `json:"redis"`
+}
+
+type fileBreaker struct {
+	Threshold *int `json:"threshold"`
+	Timeout   *int `json:"timeout"`
+}
+
+type fileMemory struct {
+	MaxKeys         *int `json:"max_keys"`
+	CleanupInterval *int `json:"cleanup_interval"`
+}
+
+type fileRedis struct {
+	Mode             *string       `json:"mode"`
+	Addr             *string       `json:"addr"`
+	DB               *int          `json:"db"`
+	Username         *string       `json:"username"`
+	Password         *string       `json:"password"`
+	MasterName       *string       `json:"master_name"`
+	SentinelUsername *string       `json:"sentinel_username"`
+	SentinelPassword *string       `json:"sentinel_password"`
+	PoolSize         *int          `json:"pool_size"`
+	DialTimeoutMS    *int          `json:"dial_timeout_ms"`
+	ReadTimeoutMS    *int          `json:"read_timeout_ms"`
+	WriteTimeoutMS   *int          `json:"write_timeout_ms"`
+	TLS              *fileRedisTLS `json:"tls"`
+}
+
+type fileRedisTLS struct {
+	Enabled            *bool   `json:"enabled"`
+	CAFile             *string `json:"ca_file"`
+	CertFile           *string `json:"cert_file"`
+	KeyFile            *string `json:"key_file"`
+	ServerName         *string `json:"server_name"`
+	InsecureSkipVerify *bool   `json:"insecure_skip_verify"`
+}
+
+type fileServer struct {
+	Addr              *string `json:"addr"`
+	ReadTimeout       *int    `json:"read_timeout"`
+	ReadHeaderTimeout *int    `json:"read_header_timeout"`
+	WriteTimeout      *int    `json:"write_timeout"`
+	IdleTimeout       *int    `json:"idle_timeout"`
+	MaxHeaderBytes    *int    `json:"max_header_bytes"`
+	ShutdownDelay     *int    `json:"shutdown_delay"`
+	ShutdownTimeout   *int    `json:"shutdown_timeout"`
+}
+
+type fileProxy struct {
+	Upstreams   []string         `json:"upstreams"`
+	Routes      []proxy.Route    `json:"routes"`
+	Timeout     *int             `json:"timeout"`
+	DialTimeout *int             `json:"dial_timeout"`
+	HealthCheck *fileHealthCheck `json:"health_check"`
+}
+
+type fileHealthCheck struct {
+	Path     *string `json:"path"`
+	Interval *int    `json:"interval"`
+	Timeout  *int    `json:"timeout"`
+}
+
+type fileMetrics struct {
+	Enabled             *bool   `json:"enabled"`
+	Path                *string `json:"path"`
+	BlockedKeysInterval *int    `json:"blocked_keys_interval"`
+}
+
+type fileForwardAuth struct {
+	Enabled *bool   `json:"enabled"`
+	Path    *string `json:"path"`
+	Headers *string `json:"headers"`
+}
+
+type fileAdmin struct {
+	Addr  *string `json:"addr"`
+	Token *string `json:"token"`
+}
+
+type fileRLS struct {
+	Addr *string `json:"addr"`
+}
+
+// loadFile applies the configuration file at path to config. YAML files
+// (.yaml, .yml) are converted to JSON first so both formats share one schema.
+func loadFile(path string, config *RateLimiterConfig) []error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return []error{fmt.Errorf("failed to read config file: %w", err)}
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var doc any
+		if err := yaml.Unmarshal(content, &doc); err != nil {
+			return []error{fmt.Errorf("failed to parse config file %s: %w", path, err)}
+		}
+		if content, err = json.Marshal(doc); err != nil {
+			return []error{fmt.Errorf("failed to parse config file %s: %w", path, err)}
+		}
+	case ".json":
+	default:
+		return []error{fmt.Errorf("config file %s: unsupported extension, use .yaml, .yml or .json", path)}
+	}
+
+	var doc any
+	if err := json.Unmarshal(content, &doc); err != nil {
+		return []error{fmt.Errorf("failed to parse config file %s: %w", path, err)}
+	}
+	if doc == nil {
+		return nil
+	}
+	errs := unknownKeys(doc, reflect.TypeOf(fileConfig{}), "")
+
+	// Unknown keys are ignored by the decoder, so the known values are still
+	// applied and validated, letting one run report every problem in the file
+	var file fileConfig
+	if err := json.Unmarshal(content, &file); err != nil {
+		return append(errs, fmt.Errorf("config file %s: %w", path, err))
+	}
+	file.apply(config)
+	return errs
+}
+
+// unknownKeys reports every key of doc without a matching json field in t
+func unknownKeys(doc any, t reflect.Type, path string) []error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	var errs []error
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := doc.(map[string]any)
+		if !ok {
+			return nil
+		}
+		fields := jsonFields(t)
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			field, ok := fields[key]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown key", joinPath(path, key)))
+				continue
+			}
+			errs = append(errs, unknownKeys(object[key], field, joinPath(path, key))...)
+		}
+	case reflect.Slice:
+		list, ok := doc.([]any)
+		if !ok {
+			return nil
+		}
+		for i, item := range list {
+			errs = append(errs, unknownKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return errs
+}
+
+// jsonFields maps the json names of the fields of t, embedded structs included
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous {
+			for name, typ := range jsonFields(field.Type) {
+				fields[name] = typ
+			}
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// apply copies the values present in the file onto config
+func (f *fileConfig) apply(config *RateLimiterConfig) {
+	if ip := f.IP; ip != nil {
+		set(&config.EnableIPLimit, ip.Enabled)
+		set(&config.MaxRequestsIP, ip.MaxRequests)
+		set(&config.WindowIP, ip.Window)
+		set(&config.BlockDurationIP, ip.BlockDuration)
+		set(&config.AlgorithmIP, ip.Algorithm)
+		set(&config.IPv4Prefix, ip.IPv4Prefix)
+		set(&config.IPv6Prefix, ip.IPv6Prefix)
+		if ip.Allowlist != nil {
+			config.IPAllowlist = ip.Allowlist
+		}
+		if ip.Denylist != nil {
+			config.IPDenylist = ip.Denylist
+		}
+		set(&config.IPListRefreshInterval, ip.ListRefreshInterval)
+	}
+
+	if token := f.Token; token != nil {
+		set(&config.EnableTokenLimit, token.Enabled)
+		set(&config.MaxRequestsToken, token.MaxRequests)
+		set(&config.WindowToken, token.Window)
+		set(&config.BlockDurationToken, token.BlockDuration)
+		set(&config.AlgorithmToken, token.Algorithm)
+		set(&config.UnknownTokenPolicy, token.UnknownPolicy)
+		if quota := token.Quota; quota != nil {
+			set(&config.HourlyQuotaToken, quota.Hourly)
+			set(&config.DailyQuotaToken, quota.Daily)
+			set(&config.MonthlyQuotaToken, quota.Monthly)
+			set(&config.QuotaTimezone, quota.Timezone)
+		}
+		if registry := token.Registry; registry != nil {
+			set(&config.TokenRegistry, registry.Type)
+			set(&config.TokenRegistryFile, registry.File)
+			set(&config.TokenRegistryCacheTTL, registry.CacheTTL)
+		}
+		if token.Overrides != nil {
+			config.TokenOverrides = token.Overrides
+		}
+	}
+
+	if penalty := f.Penalty; penalty != nil {
+		set(&config.PenaltyMultiplier, penalty.Multiplier)
+		set(&config.PenaltyMaxBlock, penalty.MaxBlock)
+		set(&config.PenaltyDecay, penalty.Decay)
+	}
+
+	set(&config.DryRun, f.DryRun)
+	set(&config.CostHeader, f.CostHeader)
+
+	set(&config.RulesFile, f.RulesFile)
+	if f.Rules != nil {
+		config.Rules = f.Rules
+	}
+
+	if clientIP := f.ClientIP; clientIP != nil {
+		set(&config.ClientIPMode, clientIP.Mode)
+		if clientIP.TrustedProxies != nil {
+			config.TrustedProxies = clientIP.TrustedProxies
+		}
+	}
+
+	if keys := f.Keys; keys != nil {
+		if keys.Extractors != nil {
+			config.KeyExtractors = keys.Extractors
+		}
+		set(&config.JWTSecret, keys.JWTSecret)
+	}
+
+	set(&config.HeaderMode, f.Headers)
+
+	if st := f.Storage; st != nil {
+		set(&config.StorageType, st.Type)
+		set(&config.FailurePolicy, st.FailurePolicy)
+		if breaker := st.Breaker; breaker != nil {
+			set(&config.BreakerThreshold, breaker.Threshold)
+			set(&config.BreakerTimeout, breaker.Timeout)
+		}
+		if memory := st.Memory; memory != nil {
+			set(&config.MemoryMaxKeys, memory.MaxKeys)
+			set(&config.MemoryCleanupInterval, memory.CleanupInterval)
+		}
+		if redis := st.Redis; redis != nil {
+			set(&config.RedisMode, redis.Mode)
+			set(&config.RedisAddr, redis.Addr)
+			set(&config.RedisDB, redis.DB)
+			set(&config.RedisUsername, redis.Username)
+			set(&config.RedisPass, redis.Password)
+			set(&config.RedisMasterName, redis.MasterName)
+			set(&config.RedisSentinelUsername, redis.SentinelUsername)
+			set(&config.RedisSentinelPass, redis.SentinelPassword)
+			set(&config.RedisPoolSize, redis.PoolSize)
+			set(&config.RedisDialTimeout, redis.DialTimeoutMS)
+			set(&config.RedisReadTimeout, redis.ReadTimeoutMS)
+			set(&config.RedisWriteTimeout, redis.WriteTimeoutMS)
+			if tls := redis.TLS; tls != nil {
+				set(&config.RedisTLS, tls.Enabled)
+				set(&config.RedisTLSCAFile, tls.CAFile)
+				set(&config.RedisTLSCertFile, tls.CertFile)
+				set(&config.RedisTLSKeyFile, tls.KeyFile)
+				set(&config.RedisTLSServerName, tls.ServerName)
+				set(&config.RedisTLSInsecureSkipVerify, tls.InsecureSkipVerify)
+			}
+		}
+	}
+
+	if server := f.Server; server != nil {
+		set(&config.ServerAddr, server.Addr)
+		set(&config.ServerReadTimeout, server.ReadTimeout)
+		set(&config.ServerReadHeaderTimeout, server.ReadHeaderTimeout)
+		set(&config.ServerWriteTimeout, server.WriteTimeout)
+		set(&config.ServerIdleTimeout, server.IdleTimeout)
+		set(&config.ServerMaxHeaderBytes, server.MaxHeaderBytes)
+		set(&config.ServerShutdownDelay, server.ShutdownDelay)
+		set(&config.ServerShutdownTimeout, server.ShutdownTimeout)
+	}
+
+	if proxy := f.Proxy; proxy != nil {
+		if proxy.Upstreams != nil {
+			config.ProxyUpstreams = proxy.Upstreams
+		}
+		if proxy.Routes != nil {
+			config.ProxyRoutes = proxy.Routes
+		}
+		set(&config.ProxyTimeout, proxy.Timeout)
+		set(&config.ProxyDialTimeout, proxy.DialTimeout)
+		if healthCheck := proxy.HealthCheck; healthCheck != nil {
+			set(&config.ProxyHealthCheckPath, healthCheck.Path)
+			set(&config.ProxyHealthCheckInterval, healthCheck.Interval)
+			set(&config.ProxyHealthCheckTimeout, healthCheck.Timeout)
+		}
+	}
+
+	if metrics := f.Metrics; metrics != nil {
+		set(&config.MetricsEnabled, metrics.Enabled)
+		set(&config.MetricsPath, metrics.Path)
+		set(&config.MetricsBlockedKeysInterval, metrics.BlockedKeysInterval)
+	}
+
+	if forwardAuth := f.ForwardAuth; forwardAuth != nil {
+		set(&config.ForwardAuthEnabled, forwardAuth.Enabled)
+		set(&config.ForwardAuthPath, forwardAuth.Path)
+		set(&config.ForwardAuthHeaders, forwardAuth.Headers)
+	}
+
+	if admin := f.Admin; admin != nil {
+		set(&config.AdminAddr, admin.Addr)
+		set(&config.AdminToken, admin.Token)
+	}
+
+	if rls := f.RLS; rls != nil {
+		set(&config.RLSAddr, rls.Addr)
+	}
+}
+
+// set assigns *src to dst when the file provides a value
+func set[T any](dst *T, src *T) {
+	if src != nil {
+		*dst = *src
+	}
+}
@@ -1,85 +1,266 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 
 	"github.com/markuscandido/go-expert-desafio-rate-limiter/pkg/logger"
 )
 
-func LoadConfig() *RateLimiterConfig {
+// LoadConfig builds the configuration from the defaults, the YAML or JSON file
+// named by RATE_LIMITER_CONFIG_FILE and the environment, in increasing order of
+// precedence. Every problem found is returned at once, joined in a single error.
+func LoadConfig() (*RateLimiterConfig, error) {
 	godotenv.Load()
 
 	config := NewConfig()
-	logger.Debug("Loading configuration from environment")
+	var errs []error
 
-	// Load IP-based limiting config
-	if val := os.Getenv("RATE_LIMITER_ENABLE_IP"); val != "" {
-		config.EnableIPLimit = val == "true"
-		logger.Debug("Configuration loaded", "RATE_LIMITER_ENABLE_IP", config.EnableIPLimit)
+	if path := os.Getenv("RATE_LIMITER_CONFIG_FILE"); path != "" {
+		logger.Debug("Loading configuration file", "path", path)
+		config.ConfigFile = path
+		errs = append(errs, loadFile(path, config)...)
 	}
-	if val := os.Getenv("RATE_LIMITER_MAX_REQUESTS_IP"); val != "" {
-		if maxReq, err := strconv.Atoi(val); err == nil {
-			config.MaxRequestsIP = maxReq
-			logger.Debug("Configuration loaded", "RATE_LIMITER_MAX_REQUESTS_IP", maxReq)
-		} else {
-			logger.Warn("Invalid value for RATE_LIMITER_MAX_REQUESTS_IP", "value", val, "error", err)
-		}
+
+	logger.Debug("Loading configuration from environment")
+	errs = append(errs, loadEnv(config)...)
+	if err := config.Validate(); err != nil {
+		errs = append(errs, err)
 	}
-	if val := os.Getenv("RATE_LIMITER_BLOCK_DURATION_IP"); val != "" {
-		if blockDur, err := strconv.Atoi(val); err == nil {
-			config.BlockDurationIP = blockDur
-			logger.Debug("Configuration loaded", "RATE_LIMITER_BLOCK_DURATION_IP", blockDur)
-		} else {
-			logger.Warn("Invalid value for RATE_LIMITER_BLOCK_DURATION_IP", "value", val, "error", err)
-		}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
 	}
 
+	logger.Info("Configuration loaded successfully",
+		"ipLimitEnabled", config.EnableIPLimit,
+		"tokenLimitEnabled", config.EnableTokenLimit,
+		"storage", config.StorageType,
+		"ipAlgorithm", config.AlgorithmIP,
+		"tokenAlgorithm", config.AlgorithmToken,
+		"dryRun", config.DryRun,
+	)
+	return config, nil
+}
+
+// loadEnv overrides config with the environment variables that are set
+func loadEnv(config *RateLimiterConfig) []error {
+	env := &envLoader{}
+
+	// Load hot reload config
+	env.int("RATE_LIMITER_CONFIG_WATCH_INTERVAL", &config.ConfigWatchInterval)
+
+	// Load IP-based limiting config
+	env.bool("RATE_LIMITER_ENABLE_IP", &config.EnableIPLimit)
+	env.int("RATE_LIMITER_MAX_REQUESTS_IP", &config.MaxRequestsIP)
+	env.int("RATE_LIMITER_WINDOW_IP", &config.WindowIP)
+	env.int("RATE_LIMITER_BLOCK_DURATION_IP", &config.BlockDurationIP)
+	env.string("RATE_LIMITER_ALGORITHM_IP", &config.AlgorithmIP)
+	env.int("RATE_LIMITER_IPV4_PREFIX", &config.IPv4Prefix)
+	env.int("RATE_LIMITER_IPV6_PREFIX", &config.IPv6Prefix)
+
+	// Load IP allow and deny lists config
+	env.list("RATE_LIMITER_IP_ALLOWLIST", &config.IPAllowlist)
+	env.list("RATE_LIMITER_IP_DENYLIST", &config.IPDenylist)
+	env.int("RATE_LIMITER_IP_LIST_REFRESH_INTERVAL", &config.IPListRefreshInterval)
+
 	// Load Token-based limiting config
-	if val := os.Getenv("RATE_LIMITER_ENABLE_TOKEN"); val != "" {
-		config.EnableTokenLimit = val == "true"
-		logger.Debug("Configuration loaded", "RATE_LIMITER_ENABLE_TOKEN", config.EnableTokenLimit)
+	env.bool("RATE_LIMITER_ENABLE_TOKEN", &config.EnableTokenLimit)
+	env.int("RATE_LIMITER_MAX_REQUESTS_TOKEN", &config.MaxRequestsToken)
+	env.int("RATE_LIMITER_WINDOW_TOKEN", &config.WindowToken)
+	env.int("RATE_LIMITER_BLOCK_DURATION_TOKEN", &config.BlockDurationToken)
+	env.string("RATE_LIMITER_ALGORITHM_TOKEN", &config.AlgorithmToken)
+
+	// Load token quota config
+	env.int("RATE_LIMITER_HOURLY_QUOTA_TOKEN", &config.HourlyQuotaToken)
+	env.int("RATE_LIMITER_DAILY_QUOTA_TOKEN", &config.DailyQuotaToken)
+	env.int("RATE_LIMITER_MONTHLY_QUOTA_TOKEN", &config.MonthlyQuotaToken)
+	env.string("RATE_LIMITER_QUOTA_TIMEZONE", &config.QuotaTimezone)
+
+	// Load block escalation config
+	env.float("RATE_LIMITER_PENALTY_MULTIPLIER", &config.PenaltyMultiplier)
+	env.int("RATE_LIMITER_PENALTY_MAX_BLOCK", &config.PenaltyMaxBlock)
+	env.int("RATE_LIMITER_PENALTY_DECAY", &config.PenaltyDecay)
+
+	// Load dry-run config
+	env.bool("RATE_LIMITER_DRY_RUN", &config.DryRun)
+
+	// Load request cost config
+	env.string("RATE_LIMITER_COST_HEADER", &config.CostHeader)
+
+	// Load token registry config
+	env.string("RATE_LIMITER_TOKEN_REGISTRY", &config.TokenRegistry)
+	env.string("RATE_LIMITER_TOKEN_REGISTRY_FILE", &config.TokenRegistryFile)
+	env.int("RATE_LIMITER_TOKEN_REGISTRY_CACHE_TTL", &config.TokenRegistryCacheTTL)
+	env.string("RATE_LIMITER_UNKNOWN_TOKEN_POLICY", &config.UnknownTokenPolicy)
+
+	// Load route rules config
+	env.string("RATE_LIMITER_RULES_FILE", &config.RulesFile)
+
+	// Load client IP config
+	env.string("RATE_LIMITER_CLIENT_IP_MODE", &config.ClientIPMode)
+	env.list("RATE_LIMITER_TRUSTED_PROXIES", &config.TrustedProxies)
+
+	// Load key extractor config
+	env.list("RATE_LIMITER_KEY_EXTRACTORS", &config.KeyExtractors)
+	env.secret("RATE_LIMITER_JWT_SECRET", &config.JWTSecret)
+
+	// Load response header config
+	env.string("RATE_LIMITER_HEADERS", &config.HeaderMode)
+
+	// Load storage config
+	env.string("RATE_LIMITER_STORAGE", &config.StorageType)
+	env.int("RATE_LIMITER_MEMORY_MAX_KEYS", &config.MemoryMaxKeys)
+	env.int("RATE_LIMITER_MEMORY_CLEANUP_INTERVAL", &config.MemoryCleanupInterval)
+
+	// Load storage failure config
+	env.string("RATE_LIMITER_FAILURE_POLICY", &config.FailurePolicy)
+	env.int("RATE_LIMITER_BREAKER_THRESHOLD", &config.BreakerThreshold)
+	env.int("RATE_LIMITER_BREAKER_TIMEOUT", &config.BreakerTimeout)
+
+	// Load HTTP server config
+	env.string("SERVER_ADDR", &config.ServerAddr)
+	env.int("SERVER_READ_TIMEOUT", &config.ServerReadTimeout)
+	env.int("SERVER_READ_HEADER_TIMEOUT", &config.ServerReadHeaderTimeout)
+	env.int("SERVER_WRITE_TIMEOUT", &config.ServerWriteTimeout)
+	env.int("SERVER_IDLE_TIMEOUT", &config.ServerIdleTimeout)
+	env.int("SERVER_MAX_HEADER_BYTES", &config.ServerMaxHeaderBytes)
+	env.int("SERVER_SHUTDOWN_DELAY", &config.ServerShutdownDelay)
+	env.int("SERVER_SHUTDOWN_TIMEOUT", &config.ServerShutdownTimeout)
+
+	// Load reverse proxy config
+	env.list("PROXY_UPSTREAMS", &config.ProxyUpstreams)
+	env.int("PROXY_TIMEOUT", &config.ProxyTimeout)
+	env.int("PROXY_DIAL_TIMEOUT", &config.ProxyDialTimeout)
+	env.string("PROXY_HEALTH_CHECK_PATH", &config.ProxyHealthCheckPath)
+	env.int("PROXY_HEALTH_CHECK_INTERVAL", &config.ProxyHealthCheckInterval)
+	env.int("PROXY_HEALTH_CHECK_TIMEOUT", &config.ProxyHealthCheckTimeout)
+
+	// Load metrics config
+	env.bool("METRICS_ENABLED", &config.MetricsEnabled)
+	env.string("METRICS_PATH", &config.MetricsPath)
+	env.int("METRICS_BLOCKED_KEYS_INTERVAL", &config.MetricsBlockedKeysInterval)
+
+	// Load forward-auth config
+	env.bool("FORWARD_AUTH_ENABLED", &config.ForwardAuthEnabled)
+	env.string("FORWARD_AUTH_PATH", &config.ForwardAuthPath)
+	env.string("FORWARD_AUTH_HEADERS", &config.ForwardAuthHeaders)
+
+	// Load admin API config
+	env.string("ADMIN_ADDR", &config.AdminAddr)
+	env.secret("ADMIN_TOKEN", &config.AdminToken)
+
+	// Load Envoy RLS config
+	env.string("RLS_ADDR", &config.RLSAddr)
+
+	// Load Redis config
+	env.string("REDIS_MODE", &config.RedisMode)
+	env.string("REDIS_ADDR", &config.RedisAddr)
+	env.int("REDIS_DB", &config.RedisDB)
+	env.string("REDIS_USERNAME", &config.RedisUsername)
+	env.secret("REDIS_PASS", &config.RedisPass)
+	env.string("REDIS_MASTER_NAME", &config.RedisMasterName)
+	env.string("REDIS_SENTINEL_USERNAME", &config.RedisSentinelUsername)
+	env.secret("REDIS_SENTINEL_PASS", &config.RedisSentinelPass)
+	env.int("REDIS_POOL_SIZE", &config.RedisPoolSize)
+	env.int("REDIS_DIAL_TIMEOUT_MS", &config.RedisDialTimeout)
+	env.int("REDIS_READ_TIMEOUT_MS", &config.RedisReadTimeout)
+	env.int("REDIS_WRITE_TIMEOUT_MS", &config.RedisWriteTimeout)
+
+	// Load Redis TLS config
+	env.bool("REDIS_TLS", &config.RedisTLS)
+	env.string("REDIS_TLS_CA_FILE", &config.RedisTLSCAFile)
+	env.string("REDIS_TLS_CERT_FILE", &config.RedisTLSCertFile)
+	env.string("REDIS_TLS_KEY_FILE", &config.RedisTLSKeyFile)
+	env.string("REDIS_TLS_SERVER_NAME", &config.RedisTLSServerName)
+	env.bool("REDIS_TLS_INSECURE_SKIP_VERIFY", &config.RedisTLSInsecureSkipVerify)
+
+	return env.errs
+}
+
+// envLoader reads typed environment variables, collecting parse errors
+type envLoader struct {
+	errs []error
+}
+
+func (l *envLoader) lookup(name string) (string, bool) {
+	val := os.Getenv(name)
+	return val, val != ""
+}
+
+func (l *envLoader) string(name string, target *string) {
+	if val, ok := l.lookup(name); ok {
+		*target = val
+		logger.Debug("Configuration loaded", name, val)
 	}
-	if val := os.Getenv("RATE_LIMITER_MAX_REQUESTS_TOKEN"); val != "" {
-		if maxReq, err := strconv.Atoi(val); err == nil {
-			config.MaxRequestsToken = maxReq
-			logger.Debug("Configuration loaded", "RATE_LIMITER_MAX_REQUESTS_TOKEN", maxReq)
-		} else {
-			logger.Warn("Invalid value for RATE_LIMITER_MAX_REQUESTS_TOKEN", "value", val, "error", err)
-		}
+}
+
+// secret loads a value that must not appear in logs
+func (l *envLoader) secret(name string, target *string) {
+	if val, ok := l.lookup(name); ok {
+		*target = val
+		logger.Debug("Configuration loaded", name, "***")
 	}
-	if val := os.Getenv("RATE_LIMITER_BLOCK_DURATION_TOKEN"); val != "" {
-		if blockDur, err := strconv.Atoi(val); err == nil {
-			config.BlockDurationToken = blockDur
-			logger.Debug("Configuration loaded", "RATE_LIMITER_BLOCK_DURATION_TOKEN", blockDur)
-		} else {
-			logger.Warn("Invalid value for RATE_LIMITER_BLOCK_DURATION_TOKEN", "value", val, "error", err)
-		}
+}
+
+func (l *envLoader) bool(name string, target *bool) {
+	val, ok := l.lookup(name)
+	if !ok {
+		return
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: invalid boolean %q", name, val))
+		return
 	}
+	*target = b
+	logger.Debug("Configuration loaded", name, b)
+}
 
-	// Load Redis config
-	if val := os.Getenv("REDIS_ADDR"); val != "" {
-		config.RedisAddr = val
-		logger.Debug("Configuration loaded", "REDIS_ADDR", val)
+func (l *envLoader) int(name string, target *int) {
+	val, ok := l.lookup(name)
+	if !ok {
+		return
 	}
-	if val := os.Getenv("REDIS_DB"); val != "" {
-		if db, err := strconv.Atoi(val); err == nil {
-			config.RedisDB = db
-			logger.Debug("Configuration loaded", "REDIS_DB", db)
-		} else {
-			logger.Warn("Invalid value for REDIS_DB", "value", val, "error", err)
-		}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: invalid integer %q", name, val))
+		return
+	}
+	*target = n
+	logger.Debug("Configuration loaded", name, n)
+}
+
+func (l *envLoader) float(name string, target *float64) {
+	val, ok := l.lookup(name)
+	if !ok {
+		return
 	}
-	if val := os.Getenv("REDIS_PASS"); val != "" {
-		config.RedisPass = val
-		logger.Debug("Configuration loaded", "REDIS_PASS", "***")
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: invalid number %q", name, val))
+		return
 	}
+	*target = f
+	logger.Debug("Configuration loaded", name, f)
+}
 
-	logger.Info("Configuration loaded successfully",
-		"ipLimitEnabled", config.EnableIPLimit,
-		"tokenLimitEnabled", config.EnableTokenLimit,
-	)
-	return config
+// list loads a comma-separated list, trimming spaces around the entries
+func (l *envLoader) list(name string, target *[]string) {
+	val, ok := l.lookup(name)
+	if !ok {
+		return
+	}
+	var values []string
+	for _, entry := range strings.Split(val, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			values = append(values, entry)
+		}
+	}
+	*target = values
+	logger.Debug("Configuration loaded", name, values)
 }
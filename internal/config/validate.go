@@ -0,0 +1,275 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
+)
+
+// Validate checks the whole configuration and returns every problem found,
+// joined in a single error, or nil when the configuration is usable
+func (c *RateLimiterConfig) Validate() error {
+	v := &validator{}
+
+	v.nonNegative("config watch interval", c.ConfigWatchInterval)
+	v.limit("ip", c.EnableIPLimit, c.MaxRequestsIP, c.WindowIP, c.BlockDurationIP, c.AlgorithmIP)
+	if c.IPv4Prefix < 1 || c.IPv4Prefix > 32 {
+		v.fail("ipv4 prefix must be between 1 and 32, got %d", c.IPv4Prefix)
+	}
+	if c.IPv6Prefix < 1 || c.IPv6Prefix > 128 {
+		v.fail("ipv6 prefix must be between 1 and 128, got %d", c.IPv6Prefix)
+	}
+	for _, list := range []struct {
+		name    string
+		entries []string
+	}{{"ip allowlist", c.IPAllowlist}, {"ip denylist", c.IPDenylist}} {
+		for _, entry := range list.entries {
+			if !validIPOrCIDR(entry) {
+				v.fail("%s entry %q is not an IP address or CIDR", list.name, entry)
+			}
+		}
+	}
+	v.nonNegative("ip list refresh interval", c.IPListRefreshInterval)
+	v.limit("token", c.EnableTokenLimit, c.MaxRequestsToken, c.WindowToken, c.BlockDurationToken, c.AlgorithmToken)
+	v.nonNegative("token hourly quota", c.HourlyQuotaToken)
+	v.nonNegative("token daily quota", c.DailyQuotaToken)
+	v.nonNegative("token monthly quota", c.MonthlyQuotaToken)
+	if _, err := time.LoadLocation(c.QuotaTimezone); err != nil {
+		v.fail("invalid quota timezone %q: %v", c.QuotaTimezone, err)
+	}
+
+	if math.IsNaN(c.PenaltyMultiplier) || math.IsInf(c.PenaltyMultiplier, 0) || (c.PenaltyMultiplier != 0 && c.PenaltyMultiplier < 1) {
+		v.fail("penalty multiplier must be 0 (disabled) or at least 1, got %v", c.PenaltyMultiplier)
+	}
+	if c.PenaltyMultiplier > 1 {
+		if c.PenaltyMaxBlock <= 0 {
+			v.fail("penalty max block must be positive, got %d", c.PenaltyMaxBlock)
+		}
+		if c.PenaltyDecay <= 0 {
+			v.fail("penalty decay must be positive, got %d", c.PenaltyDecay)
+		}
+	}
+
+	v.oneOf("token registry", c.TokenRegistry, TokenRegistryNone, TokenRegistryFile, TokenRegistryRedis)
+	if c.TokenRegistry == TokenRegistryFile && c.TokenRegistryFile == "" {
+		v.fail("token registry file must be set when the token registry is %q", TokenRegistryFile)
+	}
+	v.nonNegative("token registry cache ttl", c.TokenRegistryCacheTTL)
+	v.oneOf("unknown token policy", c.UnknownTokenPolicy, UnknownTokenDefault, UnknownTokenReject)
+	if len(c.TokenOverrides) > 0 && c.TokenRegistry != TokenRegistryNone {
+		v.fail("token overrides cannot be combined with the %q token registry", c.TokenRegistry)
+	}
+	seen := make(map[string]bool, len(c.TokenOverrides))
+	for i := range c.TokenOverrides {
+		override := &c.TokenOverrides[i]
+		if err := override.Validate(); err != nil {
+			v.fail("token override %d: %v", i, err)
+			continue
+		}
+		if seen[override.Token] {
+			v.fail("token override %d: token %s is defined more than once", i, override.Token)
+		}
+		seen[override.Token] = true
+	}
+
+	if len(c.Rules) > 0 && c.RulesFile != "" {
+		v.fail("rules cannot be set both inline and through a rules file")
+	}
+	ids := make(map[string]bool, len(c.Rules))
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if err := rule.Validate(); err != nil {
+			v.fail("rule %d: %v", i, err)
+			continue
+		}
+		if ids[rule.ID] {
+			v.fail("rule %d: rule %s is defined more than once", i, rule.ID)
+		}
+		ids[rule.ID] = true
+	}
+
+	v.oneOf("client ip mode", c.ClientIPMode, ClientIPRemoteAddr, ClientIPXForwardedFor, ClientIPForwarded, ClientIPXRealIP)
+	for _, proxy := range c.TrustedProxies {
+		if !validIPOrCIDR(proxy) {
+			v.fail("trusted proxy %q is not an IP address or CIDR", proxy)
+		}
+	}
+
+	if len(c.KeyExtractors) == 0 {
+		v.fail("at least one key extractor must be configured")
+	}
+	for _, spec := range c.KeyExtractors {
+		if !validKeyExtractor(spec) {
+			v.fail("invalid key extractor %q", spec)
+		}
+	}
+
+	v.oneOf("headers", c.HeaderMode, HeadersIETF, HeadersLegacy, HeadersBoth, HeadersNone)
+
+	v.oneOf("storage", c.StorageType, StorageRedis, StorageMemory)
+	v.oneOf("failure policy", c.FailurePolicy, FailureOpen, FailureClosed, FailureFallback)
+	v.nonNegative("breaker threshold", c.BreakerThreshold)
+	v.nonNegative("breaker timeout", c.BreakerTimeout)
+	v.nonNegative("memory max keys", c.MemoryMaxKeys)
+	if c.MemoryCleanupInterval <= 0 {
+		v.fail("memory cleanup interval must be positive, got %d", c.MemoryCleanupInterval)
+	}
+	v.oneOf("redis mode", c.RedisMode, storage.RedisStandalone, storage.RedisCluster, storage.RedisSentinel)
+	addrs := c.RedisAddrs()
+	switch {
+	case len(addrs) == 0:
+		v.fail("redis address must not be empty")
+	case c.RedisMode == storage.RedisStandalone && len(addrs) > 1:
+		v.fail("standalone redis takes a single address, got %d; set the redis mode to %q or %q", len(addrs), storage.RedisCluster, storage.RedisSentinel)
+	}
+	if c.RedisMode == storage.RedisSentinel && c.RedisMasterName == "" {
+		v.fail("redis master name must be set in %q mode", storage.RedisSentinel)
+	}
+	if c.RedisMode == storage.RedisCluster && c.RedisDB != 0 {
+		v.fail("redis db must be 0 in %q mode, got %d", storage.RedisCluster, c.RedisDB)
+	}
+	v.nonNegative("redis db", c.RedisDB)
+	v.nonNegative("redis pool size", c.RedisPoolSize)
+	v.nonNegative("redis dial timeout", c.RedisDialTimeout)
+	v.nonNegative("redis read timeout", c.RedisReadTimeout)
+	v.nonNegative("redis write timeout", c.RedisWriteTimeout)
+	if (c.RedisTLSCertFile == "") != (c.RedisTLSKeyFile == "") {
+		v.fail("redis tls cert file and key file must be set together")
+	}
+	if !c.RedisTLS && (c.RedisTLSCAFile != "" || c.RedisTLSCertFile != "" || c.RedisTLSServerName != "" || c.RedisTLSInsecureSkipVerify) {
+		v.fail("redis tls settings require redis tls to be enabled")
+	}
+
+	if c.ServerAddr == "" {
+		v.fail("server address must not be empty")
+	}
+	v.nonNegative("server read timeout", c.ServerReadTimeout)
+	v.nonNegative("server read header timeout", c.ServerReadHeaderTimeout)
+	v.nonNegative("server write timeout", c.ServerWriteTimeout)
+	v.nonNegative("server idle timeout", c.ServerIdleTimeout)
+	v.nonNegative("server max header bytes", c.ServerMaxHeaderBytes)
+	v.nonNegative("server shutdown delay", c.ServerShutdownDelay)
+	v.nonNegative("server shutdown timeout", c.ServerShutdownTimeout)
+
+	prefixes := make(map[string]bool)
+	for i, route := range c.AllProxyRoutes() {
+		if err := route.Validate(); err != nil {
+			v.fail("proxy route %d: %v", i, err)
+			continue
+		}
+		if prefixes[route.PathPrefix] {
+			v.fail("proxy route %d: path prefix %q is routed more than once", i, route.PathPrefix)
+		}
+		prefixes[route.PathPrefix] = true
+	}
+	if c.ProxyTimeout <= 0 {
+		v.fail("proxy timeout must be positive, got %d", c.ProxyTimeout)
+	}
+	if c.ProxyDialTimeout <= 0 {
+		v.fail("proxy dial timeout must be positive, got %d", c.ProxyDialTimeout)
+	}
+	if c.ProxyHealthCheckPath != "" {
+		if !strings.HasPrefix(c.ProxyHealthCheckPath, "/") {
+			v.fail("proxy health check path %q must start with /", c.ProxyHealthCheckPath)
+		}
+		if c.ProxyHealthCheckInterval <= 0 {
+			v.fail("proxy health check interval must be positive, got %d", c.ProxyHealthCheckInterval)
+		}
+		if c.ProxyHealthCheckTimeout <= 0 {
+			v.fail("proxy health check timeout must be positive, got %d", c.ProxyHealthCheckTimeout)
+		}
+	}
+
+	if !strings.HasPrefix(c.MetricsPath, "/") {
+		v.fail("metrics path %q must start with /", c.MetricsPath)
+	}
+	if c.MetricsBlockedKeysInterval < 0 {
+		v.fail("metrics blocked keys interval must not be negative, got %d", c.MetricsBlockedKeysInterval)
+	}
+	if c.ForwardAuthEnabled {
+		if !strings.HasPrefix(c.ForwardAuthPath, "/") {
+			v.fail("forward auth path %q must start with /", c.ForwardAuthPath)
+		} else if c.MetricsEnabled && c.ForwardAuthPath == c.MetricsPath {
+			v.fail("forward auth path %q is already used by the metrics", c.ForwardAuthPath)
+		}
+		v.oneOf("forward auth headers", c.ForwardAuthHeaders, ForwardAuthOriginal, ForwardAuthForwarded)
+	}
+	if c.AdminAddr != "" && c.AdminToken == "" {
+		v.fail("admin token must be set when the admin API is enabled")
+	}
+
+	return errors.Join(v.errs...)
+}
+
+// validator collects validation errors
+type validator struct {
+	errs []error
+}
+
+func (v *validator) fail(format string, args ...any) {
+	v.errs = append(v.errs, fmt.Errorf(format, args...))
+}
+
+// limit checks a global limit; values of a disabled limit must still not be negative
+func (v *validator) limit(name string, enabled bool, maxRequests, window, blockDuration int, algorithm string) {
+	if enabled && maxRequests <= 0 {
+		v.fail("%s max requests must be positive, got %d", name, maxRequests)
+	} else if maxRequests < 0 {
+		v.fail("%s max requests must not be negative, got %d", name, maxRequests)
+	}
+	if window <= 0 {
+		v.fail("%s window must be positive, got %d", name, window)
+	}
+	v.nonNegative(name+" block duration", blockDuration)
+	if _, err := storage.ParseAlgorithm(algorithm); err != nil {
+		v.fail("%s algorithm: %v", name, err)
+	}
+}
+
+func (v *validator) nonNegative(name string, value int) {
+	if value < 0 {
+		v.fail("%s must not be negative, got %d", name, value)
+	}
+}
+
+func (v *validator) oneOf(name, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	quoted := make([]string, 0, len(allowed))
+	for _, a := range allowed {
+		if a != "" {
+			quoted = append(quoted, fmt.Sprintf("%q", a))
+		}
+	}
+	v.fail("invalid %s %q, expected one of %s", name, value, strings.Join(quoted, ", "))
+}
+
+func validIPOrCIDR(value string) bool {
+	if _, err := netip.ParsePrefix(value); err == nil {
+		return true
+	}
+	_, err := netip.ParseAddr(value)
+	return err == nil
+}
+
+func validKeyExtractor(spec string) bool {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case KeyExtractorBearer, KeyExtractorMTLS:
+		return true
+	case KeyExtractorHeader, KeyExtractorQuery, KeyExtractorCookie, KeyExtractorJWT:
+		return arg != ""
+	case KeyExtractorPath:
+		return strings.Contains(arg, "{")
+	default:
+		return false
+	}
+}
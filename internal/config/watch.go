@@ -0,0 +1,95 @@
+package config
+
+import (
+	"context"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/pkg/logger"
+)
+
+// Watch polls the files returned by paths every interval and calls onChange
+// once per check in which any of them was modified, created or removed, until
+// ctx is done. paths is called again after onChange, so files named by the
+// reloaded configuration are watched from then on. Polling follows symlinks,
+// so it also notices Kubernetes ConfigMap updates.
+func Watch(ctx context.Context, paths func() []string, interval time.Duration, onChange func()) {
+	watched := paths()
+	if len(watched) == 0 || interval <= 0 {
+		return
+	}
+
+	states := make(map[string]fileState, len(watched))
+	for _, path := range watched {
+		states[path] = statFile(path)
+	}
+	logger.Info("Watching configuration files", "paths", watched, "interval", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed := false
+		for _, path := range watched {
+			state := statFile(path)
+			if state != states[path] {
+				logger.Info("Configuration file changed", "path", path)
+				states[path] = state
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		onChange()
+
+		if next := paths(); !slices.Equal(next, watched) {
+			nextStates := make(map[string]fileState, len(next))
+			for _, path := range next {
+				if state, ok := states[path]; ok {
+					nextStates[path] = state
+				} else {
+					nextStates[path] = statFile(path)
+				}
+			}
+			watched, states = next, nextStates
+			logger.Info("Watching configuration files", "paths", watched, "interval", interval)
+		}
+	}
+}
+
+// fileState is what Watch compares to detect changes
+type fileState struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
+
+func statFile(path string) fileState {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{exists: true, size: info.Size(), modTime: info.ModTime()}
+}
+
+// WatchedFiles returns the files the configuration is read from: the
+// configuration file, the rules file and the file token registry
+func (c *RateLimiterConfig) WatchedFiles() []string {
+	var paths []string
+	for _, path := range []string{c.ConfigFile, c.RulesFile} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if c.TokenRegistry == TokenRegistryFile && c.TokenRegistryFile != "" {
+		paths = append(paths, c.TokenRegistryFile)
+	}
+	return paths
+}
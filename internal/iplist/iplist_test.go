@@ -0,0 +1,180 @@
+package iplist
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func mustEntries(t *testing.T, allow, deny []string) Entries {
+	t.Helper()
+
+	entries, err := ParseEntries(allow, deny)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return entries
+}
+
+func TestListLookup(t *testing.T) {
+	list := NewList(mustEntries(t,
+		[]string{"10.0.0.0/8", "192.168.1.10", "2001:db8::/32", "::ffff:172.16.0.0/108"},
+		[]string{"10.1.0.0/16", "203.0.113.0/24", "2001:db8:bad::/48", "192.168.1.10"},
+	))
+
+	tests := []struct {
+		ip   string
+		want Action
+	}{
+		{"10.2.3.4", Allow},
+		{"10.1.2.3", Deny}, // The more specific deny range wins
+		{"192.168.1.10", Deny},
+		{"192.168.1.11", ""},
+		{"203.0.113.200", Deny},
+		{"2001:db8:1::1", Allow},
+		{"2001:db8:bad::1", Deny},
+		{"2001:db9::1", ""},
+		{"::ffff:10.2.3.4", Allow}, // IPv4-mapped addresses match IPv4 entries
+		{"172.16.5.5", Allow},      // IPv4-mapped entries match IPv4 addresses
+		{"fe80::1%eth0", ""},
+		{"not-an-ip", ""},
+	}
+	for _, tt := range tests {
+		if got := list.Lookup(tt.ip); got != tt.want {
+			t.Errorf("Lookup(%s): expected %q, got %q", tt.ip, tt.want, got)
+		}
+	}
+
+	var empty *List
+	if got := empty.Lookup("10.0.0.1"); got != "" {
+		t.Errorf("Expected a nil list to match nothing, got %q", got)
+	}
+}
+
+func TestTreeLongestPrefixMatch(t *testing.T) {
+	var tree Tree
+	for i := 0; i < 20000; i++ {
+		tree.Insert(netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 0}), 24), Deny)
+	}
+	tree.Insert(netip.MustParsePrefix("10.0.0.0/8"), Allow)
+	tree.Insert(netip.MustParsePrefix("0.0.0.0/0"), Deny)
+	tree.Insert(netip.MustParsePrefix("10.0.0.0/8"), Allow) // Duplicates are counted once
+
+	if tree.Len() != 20002 {
+		t.Errorf("Expected 20002 prefixes, got %d", tree.Len())
+	}
+	for ip, want := range map[string]Action{
+		"10.0.5.1":   Deny,  // 10.0.5.0/24
+		"10.78.31.9": Deny,  // 10.78.31.0/24
+		"10.200.0.1": Allow, // Only 10.0.0.0/8
+		"11.0.0.1":   Deny,  // Only 0.0.0.0/0
+	} {
+		if got := tree.Lookup(netip.MustParseAddr(ip)); got != want {
+			t.Errorf("Lookup(%s): expected %q, got %q", ip, want, got)
+		}
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	for input, want := range map[string]string{
+		"192.168.1.7":         "192.168.1.7/32",
+		"192.168.1.7/24":      "192.168.1.0/24",
+		"2001:db8::1":         "2001:db8::1/128",
+		"2001:db8::1/32":      "2001:db8::/32",
+		"::ffff:192.168.1.7":  "192.168.1.7/32",
+		"::ffff:10.0.0.0/104": "10.0.0.0/8",
+		"fe80::1%eth0":        "fe80::1/128",
+		" 10.0.0.1 ":          "10.0.0.1/32",
+	} {
+		prefix, err := ParsePrefix(input)
+		if err != nil {
+			t.Errorf("ParsePrefix(%q): expected no error, got %v", input, err)
+			continue
+		}
+		if prefix.String() != want {
+			t.Errorf("ParsePrefix(%q): expected %s, got %s", input, want, prefix)
+		}
+	}
+
+	for _, input := range []string{"", "10.0.0.0/33", "example.com"} {
+		if _, err := ParsePrefix(input); err == nil {
+			t.Errorf("ParsePrefix(%q): expected an error", input)
+		}
+	}
+}
+
+func TestListsCombineConfiguredAndStoredEntries(t *testing.T) {
+	ctx := context.Background()
+	lists := NewLists(mustEntries(t, []string{"10.0.0.0/8"}, nil), NewMemoryStore())
+
+	if err := lists.Add(ctx, Deny, "203.0.113.7"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := lists.Lookup("203.0.113.7"); got != Deny {
+		t.Errorf("Expected the added entry to apply immediately, got %q", got)
+	}
+	if got := lists.Lookup("10.0.0.1"); got != Allow {
+		t.Errorf("Expected the configured entry to be kept, got %q", got)
+	}
+
+	lists.SetConfigured(Entries{})
+	if got := lists.Lookup("10.0.0.1"); got != "" {
+		t.Errorf("Expected the configured entry to be replaced, got %q", got)
+	}
+	if got := lists.Lookup("203.0.113.7"); got != Deny {
+		t.Errorf("Expected the stored entry to survive a reload, got %q", got)
+	}
+
+	if err := lists.Remove(ctx, Deny, "203.0.113.7/32"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := lists.Lookup("203.0.113.7"); got != "" {
+		t.Errorf("Expected the removed entry to stop applying, got %q", got)
+	}
+
+	if err := NewLists(Entries{}, nil).Add(ctx, Allow, "10.0.0.1"); err != ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly without a store, got %v", err)
+	}
+}
+
+func TestRedisStoreSharesEntriesAcrossReplicas(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx := context.Background()
+	newReplica := func() *Lists {
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { client.Close() })
+		return NewLists(Entries{}, NewRedisStore(client))
+	}
+	first, second := newReplica(), newReplica()
+
+	for i := 0; i < 3; i++ {
+		if err := first.Add(ctx, Deny, fmt.Sprintf("2001:db8:%d::/48", i)); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	if err := first.Add(ctx, Allow, "192.168.0.0/16"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if got := second.Lookup("2001:db8:1::1"); got != "" {
+		t.Errorf("Expected the other replica to see the change only after a refresh, got %q", got)
+	}
+	if err := second.Refresh(ctx); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := second.Lookup("2001:db8:1::1"); got != Deny {
+		t.Errorf("Expected the deny entry on the other replica, got %q", got)
+	}
+	if got := second.Lookup("192.168.4.4"); got != Allow {
+		t.Errorf("Expected the allow entry on the other replica, got %q", got)
+	}
+
+	stored := second.Stored()
+	if len(stored.Allow) != 1 || len(stored.Deny) != 3 || stored.Deny[0].String() != "2001:db8::/48" {
+		t.Errorf("Expected 1 allow and 3 sorted deny entries, got %+v", stored)
+	}
+}
@@ -0,0 +1,116 @@
+// Package iplist decides which client IPs bypass the IP rate limit and which
+// are always rejected, from allow and deny lists of IPs and CIDRs.
+package iplist
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Action is what a list does with the addresses it contains
+type Action string
+
+const (
+	Allow Action = "allow" // Bypass the IP limit
+	Deny  Action = "deny"  // Reject every request
+)
+
+// ParseAction returns the action named by s
+func ParseAction(s string) (Action, error) {
+	switch action := Action(s); action {
+	case Allow, Deny:
+		return action, nil
+	default:
+		return "", fmt.Errorf("unknown ip list %q, expected %q or %q", s, Allow, Deny)
+	}
+}
+
+// ParsePrefix parses an IP address or CIDR, IPv4 or IPv6, into a masked
+// prefix. A single address becomes a full-length prefix and IPv4-mapped IPv6
+// prefixes are stored as IPv4, so they match requests from either form.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		addr, addrErr := netip.ParseAddr(s)
+		if addrErr != nil {
+			return netip.Prefix{}, fmt.Errorf("%q is not an IP address or CIDR", s)
+		}
+		addr = addr.WithZone("")
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+
+	if addr := prefix.Addr(); addr.Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
+}
+
+// Entries are the prefixes of the allow and deny lists
+type Entries struct {
+	Allow []netip.Prefix `json:"allow"`
+	Deny  []netip.Prefix `json:"deny"`
+}
+
+// ParseEntries parses the IPs and CIDRs of the allow and deny lists
+func ParseEntries(allow, deny []string) (Entries, error) {
+	var entries Entries
+	for _, list := range []struct {
+		values []string
+		target *[]netip.Prefix
+	}{{allow, &entries.Allow}, {deny, &entries.Deny}} {
+		for _, value := range list.values {
+			prefix, err := ParsePrefix(value)
+			if err != nil {
+				return Entries{}, err
+			}
+			*list.target = append(*list.target, prefix)
+		}
+	}
+	return entries, nil
+}
+
+// Len returns the number of entries in both lists
+func (e Entries) Len() int {
+	return len(e.Allow) + len(e.Deny)
+}
+
+// List is an immutable lookup structure over allow and deny lists. The most
+// specific prefix containing an address decides; a prefix present in both
+// lists denies.
+type List struct {
+	tree Tree
+}
+
+// NewList builds a list from every entry of sources
+func NewList(sources ...Entries) *List {
+	l := &List{}
+	for _, entries := range sources {
+		for _, prefix := range entries.Allow {
+			l.tree.Insert(prefix, Allow)
+		}
+		for _, prefix := range entries.Deny {
+			l.tree.Insert(prefix, Deny)
+		}
+	}
+	return l
+}
+
+// Lookup returns the action for the client IP ip, or "" when neither list
+// contains it or ip is not a valid address
+func (l *List) Lookup(ip string) Action {
+	if l == nil || l.tree.Len() == 0 {
+		return ""
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	return l.tree.Lookup(addr.Unmap().WithZone(""))
+}
+
+// Len returns the number of distinct prefixes in the list
+func (l *List) Len() int {
+	return l.tree.Len()
+}
@@ -0,0 +1,129 @@
+package iplist
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/pkg/logger"
+)
+
+// ErrReadOnly is returned when editing lists created without a Store
+var ErrReadOnly = errors.New("ip lists cannot be edited without a store")
+
+// Lists combines the configured entries with those edited at runtime in a
+// Store. Lookups read an immutable List swapped atomically whenever either
+// source changes, so they never wait on the store.
+type Lists struct {
+	store Store // nil when entries can only come from the configuration
+
+	mu         sync.Mutex // Serializes rebuilds
+	configured Entries
+	stored     Entries
+	list       atomic.Pointer[List]
+}
+
+// NewLists creates lists holding the configured entries, extended with the
+// entries of store once Refresh is called
+func NewLists(configured Entries, store Store) *Lists {
+	l := &Lists{store: store, configured: configured}
+	l.list.Store(NewList(configured))
+	return l
+}
+
+// Lookup returns the action for the client IP ip, or "" when no list contains it
+func (l *Lists) Lookup(ip string) Action {
+	return l.list.Load().Lookup(ip)
+}
+
+// SetConfigured replaces the entries from the configuration, e.g. on reload
+func (l *Lists) SetConfigured(configured Entries) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.configured = configured
+	l.rebuild()
+}
+
+// Stored returns the entries edited at runtime
+func (l *Lists) Stored() Entries {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stored
+}
+
+// Refresh reloads the entries of the store
+func (l *Lists) Refresh(ctx context.Context) error {
+	if l.store == nil {
+		return nil
+	}
+	stored, err := l.store.Entries(ctx)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stored = stored
+	l.rebuild()
+	return nil
+}
+
+// Add stores the IP or CIDR entry in the list of action and applies it immediately
+func (l *Lists) Add(ctx context.Context, action Action, entry string) error {
+	return l.edit(ctx, action, entry, Store.Add)
+}
+
+// Remove deletes the IP or CIDR entry from the list of action and applies it
+// immediately. Entries from the configuration are not affected.
+func (l *Lists) Remove(ctx context.Context, action Action, entry string) error {
+	return l.edit(ctx, action, entry, Store.Remove)
+}
+
+func (l *Lists) edit(ctx context.Context, action Action, entry string, apply func(Store, context.Context, Action, netip.Prefix) error) error {
+	if l.store == nil {
+		return ErrReadOnly
+	}
+	prefix, err := ParsePrefix(entry)
+	if err != nil {
+		return err
+	}
+	if err := apply(l.store, ctx, action, prefix); err != nil {
+		return err
+	}
+	return l.Refresh(ctx)
+}
+
+// Watch refreshes the entries of the store every interval until ctx is done,
+// picking up the changes made by other replicas
+func (l *Lists) Watch(ctx context.Context, interval time.Duration) {
+	if l.store == nil || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.Refresh(ctx); err != nil && ctx.Err() == nil {
+				logger.Warn("Failed to refresh ip lists, keeping the current entries", "error", err)
+			}
+		}
+	}
+}
+
+// rebuild swaps in a List of the configured and stored entries; l.mu must be held
+func (l *Lists) rebuild() {
+	list := NewList(l.configured, l.stored)
+	l.list.Store(list)
+	logger.Debug("IP lists updated",
+		"configured", l.configured.Len(),
+		"stored", l.stored.Len(),
+		"prefixes", list.Len(),
+	)
+}
@@ -0,0 +1,126 @@
+package iplist
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/pkg/logger"
+)
+
+// Store persists the list entries edited at runtime, outside the configuration
+type Store interface {
+	// Entries returns every stored entry
+	Entries(ctx context.Context) (Entries, error)
+
+	// Add stores prefix in the list of action
+	Add(ctx context.Context, action Action, prefix netip.Prefix) error
+
+	// Remove deletes prefix from the list of action
+	Remove(ctx context.Context, action Action, prefix netip.Prefix) error
+}
+
+// redisKeys names the Redis sets holding the entries of each list
+var redisKeys = map[Action]string{
+	Allow: "ip_allowlist",
+	Deny:  "ip_denylist",
+}
+
+// RedisStore keeps the entries in Redis sets, so that every replica sees the
+// changes made through any of them
+type RedisStore struct {
+	client redis.UniversalClient
+}
+
+// NewRedisStore creates a store backed by client
+func NewRedisStore(client redis.UniversalClient) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+func (s *RedisStore) Entries(ctx context.Context) (Entries, error) {
+	var entries Entries
+	for action, target := range map[Action]*[]netip.Prefix{Allow: &entries.Allow, Deny: &entries.Deny} {
+		members, err := s.client.SMembers(ctx, redisKeys[action]).Result()
+		if err != nil {
+			logger.Error("Failed to read ip list", "list", action, "error", err)
+			return Entries{}, err
+		}
+		for _, member := range members {
+			prefix, err := ParsePrefix(member)
+			if err != nil {
+				logger.Warn("Ignoring invalid ip list entry", "list", action, "entry", member)
+				continue
+			}
+			*target = append(*target, prefix)
+		}
+		sortPrefixes(*target)
+	}
+	return entries, nil
+}
+
+func (s *RedisStore) Add(ctx context.Context, action Action, prefix netip.Prefix) error {
+	if err := s.client.SAdd(ctx, redisKeys[action], prefix.String()).Err(); err != nil {
+		logger.Error("Failed to add ip list entry", "list", action, "error", err)
+		return err
+	}
+	return nil
+}
+
+func (s *RedisStore) Remove(ctx context.Context, action Action, prefix netip.Prefix) error {
+	if err := s.client.SRem(ctx, redisKeys[action], prefix.String()).Err(); err != nil {
+		logger.Error("Failed to remove ip list entry", "list", action, "error", err)
+		return err
+	}
+	return nil
+}
+
+// MemoryStore keeps the entries in process, for single-node deployments
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[Action][]netip.Prefix
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[Action][]netip.Prefix)}
+}
+
+func (s *MemoryStore) Entries(ctx context.Context) (Entries, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Entries{
+		Allow: slices.Clone(s.entries[Allow]),
+		Deny:  slices.Clone(s.entries[Deny]),
+	}, nil
+}
+
+func (s *MemoryStore) Add(ctx context.Context, action Action, prefix netip.Prefix) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !slices.Contains(s.entries[action], prefix) {
+		s.entries[action] = append(s.entries[action], prefix)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Remove(ctx context.Context, action Action, prefix netip.Prefix) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[action] = slices.DeleteFunc(s.entries[action], func(p netip.Prefix) bool {
+		return p == prefix
+	})
+	return nil
+}
+
+// sortPrefixes orders prefixes by address, then by length
+func sortPrefixes(prefixes []netip.Prefix) {
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int {
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c
+		}
+		return a.Bits() - b.Bits()
+	})
+}
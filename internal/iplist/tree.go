@@ -0,0 +1,127 @@
+package iplist
+
+import "net/netip"
+
+// Tree is a path-compressed binary radix tree mapping IP prefixes to actions.
+// Lookups walk at most one node per distinct prefix length on the path to the
+// address, so they stay fast with tens of thousands of entries. IPv4 and IPv6
+// prefixes live in separate trees. A Tree is not safe for concurrent writes;
+// List builds one and never modifies it afterwards.
+type Tree struct {
+	v4, v6 *node
+	size   int
+}
+
+type node struct {
+	prefix   netip.Prefix // Masked prefix shared by every entry below the node
+	action   Action       // Action of the prefix itself, "" for branching nodes
+	children [2]*node     // Indexed by the first bit after the prefix
+}
+
+// Insert maps prefix to action. When the same prefix is inserted with both
+// actions, Deny wins.
+func (t *Tree) Insert(prefix netip.Prefix, action Action) {
+	prefix = prefix.Masked()
+	link := &t.v6
+	if prefix.Addr().Is4() {
+		link = &t.v4
+	}
+
+	for {
+		n := *link
+		if n == nil {
+			*link = &node{prefix: prefix, action: action}
+			t.size++
+			return
+		}
+
+		common := commonBits(n.prefix, prefix)
+		switch {
+		case common == n.prefix.Bits() && common == prefix.Bits():
+			// Same prefix, possibly a branching node becoming an entry
+			if n.action == "" {
+				t.size++
+			}
+			if n.action != Deny {
+				n.action = action
+			}
+			return
+		case common == n.prefix.Bits():
+			// n contains prefix, descend
+			link = &n.children[bit(prefix.Addr(), common)]
+		case common == prefix.Bits():
+			// prefix contains n, insert above it
+			parent := &node{prefix: prefix, action: action}
+			parent.children[bit(n.prefix.Addr(), common)] = n
+			*link = parent
+			t.size++
+			return
+		default:
+			// The prefixes diverge, branch where they stop sharing bits
+			branch := &node{prefix: netip.PrefixFrom(prefix.Addr(), common).Masked()}
+			branch.children[bit(n.prefix.Addr(), common)] = n
+			branch.children[bit(prefix.Addr(), common)] = &node{prefix: prefix, action: action}
+			*link = branch
+			t.size++
+			return
+		}
+	}
+}
+
+// Lookup returns the action of the longest prefix containing addr, or "" when
+// no prefix contains it
+func (t *Tree) Lookup(addr netip.Addr) Action {
+	n := t.v6
+	if addr.Is4() {
+		n = t.v4
+	}
+
+	var action Action
+	for n != nil && n.prefix.Contains(addr) {
+		if n.action != "" {
+			action = n.action
+		}
+		if n.prefix.Bits() == addr.BitLen() {
+			break
+		}
+		n = n.children[bit(addr, n.prefix.Bits())]
+	}
+	return action
+}
+
+// Len returns the number of prefixes in the tree
+func (t *Tree) Len() int {
+	return t.size
+}
+
+// commonBits returns the length of the longest prefix shared by a and b
+func commonBits(a, b netip.Prefix) int {
+	limit := min(a.Bits(), b.Bits())
+	x, y := addrBytes(a.Addr()), addrBytes(b.Addr())
+	for i := 0; i < limit; i += 8 {
+		diff := x[i/8] ^ y[i/8]
+		if diff == 0 {
+			continue
+		}
+		n := i
+		for mask := byte(0x80); diff&mask == 0; mask >>= 1 {
+			n++
+		}
+		return min(n, limit)
+	}
+	return limit
+}
+
+// bit returns the i-th most significant bit of addr
+func bit(addr netip.Addr, i int) int {
+	return int(addrBytes(addr)[i/8]>>(7-i%8)) & 1
+}
+
+func addrBytes(addr netip.Addr) []byte {
+	if addr.Is4() {
+		b := addr.As4()
+		return b[:]
+	}
+	b := addr.As16()
+	return b[:]
+}
@@ -0,0 +1,89 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
+)
+
+// Algorithm decides whether a request against a key fits within its limit.
+// The bookkeeping is delegated to the storage backend so that the decision is
+// atomic across every replica sharing the same storage.
+type Algorithm interface {
+	// Name returns the name used to select the algorithm in the configuration
+	Name() string
+
+	// Allow consumes cost requests at once from the key's allowance of max
+	// requests per window and blocks the key for block once the allowance is
+	// exceeded, escalated by penalty for keys that keep exceeding it. A cost of
+	// 0 counts as 1.
+	Allow(ctx context.Context, key string, cost, max int, window, block time.Duration, penalty storage.Penalty) (*storage.HitResult, error)
+}
+
+// storageAlgorithm runs one of the algorithms implemented by every storage backend
+type storageAlgorithm struct {
+	algorithm storage.Algorithm
+	storage   storage.Strategy
+}
+
+// NewFixedWindow counts requests in a window started by the first request.
+// It is the cheapest algorithm but lets up to twice the limit through around
+// a window boundary.
+func NewFixedWindow(st storage.Strategy) Algorithm {
+	return &storageAlgorithm{algorithm: storage.AlgorithmFixedWindow, storage: st}
+}
+
+// NewSlidingLog records every request and counts those in the trailing window.
+// It is exact, at the cost of memory proportional to the limit.
+func NewSlidingLog(st storage.Strategy) Algorithm {
+	return &storageAlgorithm{algorithm: storage.AlgorithmSlidingLog, storage: st}
+}
+
+// NewSlidingWindowCounter approximates the trailing window count by weighting
+// the previous aligned window with its overlap.
+func NewSlidingWindowCounter(st storage.Strategy) Algorithm {
+	return &storageAlgorithm{algorithm: storage.AlgorithmSlidingWindowCounter, storage: st}
+}
+
+// NewTokenBucket allows bursts of up to max requests and refills max tokens per window.
+func NewTokenBucket(st storage.Strategy) Algorithm {
+	return &storageAlgorithm{algorithm: storage.AlgorithmTokenBucket, storage: st}
+}
+
+// NewGCRA spaces requests window/max apart while tolerating bursts of up to max requests.
+func NewGCRA(st storage.Strategy) Algorithm {
+	return &storageAlgorithm{algorithm: storage.AlgorithmGCRA, storage: st}
+}
+
+// NewAlgorithm returns the algorithm selected by name, defaulting to the fixed window
+func NewAlgorithm(name string, st storage.Strategy) (Algorithm, error) {
+	if name == "" {
+		return NewFixedWindow(st), nil
+	}
+	algorithm, err := storage.ParseAlgorithm(name)
+	if err != nil {
+		return nil, err
+	}
+	return &storageAlgorithm{algorithm: algorithm, storage: st}, nil
+}
+
+func (a *storageAlgorithm) Name() string {
+	return string(a.algorithm)
+}
+
+func (a *storageAlgorithm) Allow(ctx context.Context, key string, cost, max int, window, block time.Duration, penalty storage.Penalty) (*storage.HitResult, error) {
+	result, err := a.storage.Consume(ctx, key, storage.Limit{
+		Algorithm: a.algorithm,
+		Max:       max,
+		Cost:      cost,
+		Window:    window,
+		Block:     block,
+		Penalty:   penalty,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", a.algorithm, err)
+	}
+	return result, nil
+}
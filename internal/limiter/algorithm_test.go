@@ -0,0 +1,81 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/config"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
+)
+
+func TestNewAlgorithm(t *testing.T) {
+	store := newTestStorage(t)
+
+	for _, algorithm := range storage.Algorithms {
+		a, err := NewAlgorithm(string(algorithm), store)
+		if err != nil {
+			t.Fatalf("Expected no error for %s, got %v", algorithm, err)
+		}
+		if a.Name() != string(algorithm) {
+			t.Errorf("Expected name %s, got %s", algorithm, a.Name())
+		}
+	}
+
+	a, err := NewAlgorithm("", store)
+	if err != nil || a.Name() != string(storage.AlgorithmFixedWindow) {
+		t.Errorf("Expected fixed window by default, got %v, %v", a, err)
+	}
+
+	if _, err := NewAlgorithm("leaky_faucet", store); err == nil {
+		t.Error("Expected an error for an unknown algorithm")
+	}
+}
+
+func TestConfiguredAlgorithmIsUsed(t *testing.T) {
+	for _, algorithm := range storage.Algorithms {
+		t.Run(string(algorithm), func(t *testing.T) {
+			store := newTestStorage(t)
+			cfg := &config.RateLimiterConfig{
+				MaxRequestsIP:   3,
+				BlockDurationIP: 60,
+				EnableIPLimit:   true,
+				AlgorithmIP:     string(algorithm),
+			}
+
+			rateLimiter := NewRateLimiter(store, cfg)
+			ctx := context.Background()
+
+			for i := 0; i < 3; i++ {
+				allowed, _, err := rateLimiter.AllowRequest(ctx, "192.168.1.1", "")
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				if !allowed {
+					t.Errorf("Request %d should be allowed", i+1)
+				}
+			}
+
+			allowed, blockDuration, err := rateLimiter.AllowRequest(ctx, "192.168.1.1", "")
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if allowed || blockDuration != 60 {
+				t.Errorf("4th request should be blocked for 60s, got allowed=%v blockDuration=%d", allowed, blockDuration)
+			}
+		})
+	}
+}
+
+func TestUnknownAlgorithmReturnsError(t *testing.T) {
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsIP: 3,
+		EnableIPLimit: true,
+		AlgorithmIP:   "leaky_faucet",
+	}
+
+	rateLimiter := NewRateLimiter(store, cfg)
+	if _, _, err := rateLimiter.AllowRequest(context.Background(), "192.168.1.1", ""); err == nil {
+		t.Error("Expected an error for an unknown algorithm")
+	}
+}
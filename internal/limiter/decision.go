@@ -0,0 +1,68 @@
+package limiter
+
+import (
+	"math"
+	"time"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/rules"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
+)
+
+// KeyKind identifies what a rate limit key is derived from
+type KeyKind string
+
+const (
+	KeyKindIP    KeyKind = "ip"
+	KeyKindToken KeyKind = "token"
+)
+
+// Names of the rules a decision can be matched against
+const (
+	RuleGlobal        = "global"         // Global IP or token limit from the configuration
+	RuleTokenRegistry = "token_registry" // Token limit overridden by the token registry
+	RuleIPAllowlist   = "ip_allowlist"   // IP exempted from the IP limit by the allow list
+	RuleRoutePrefix   = "route:"         // Prefix of the name of route rules, followed by the rule id
+)
+
+// Request describes the request being rate limited
+type Request struct {
+	IP    string
+	Token string
+	Route *rules.Rule // Route rule matched by the request, nil for the global limits
+	Cost  int         // Requests charged against every limit, 0 for the cost of the route rule or 1
+}
+
+// Decision represents the result of a rate limit check
+type Decision struct {
+	Allowed    bool
+	Blocked    bool          // Whether the key was already blocked before this request
+	Limit      int           // Requests allowed per window by the matched rule (0 when no limit applies)
+	Window     time.Duration // Window of the matched rule
+	Remaining  int           // Requests left in the current window
+	Reset      time.Time     // When the limit is fully replenished
+	RetryAfter time.Duration // When denied, how long the client should wait before retrying
+	Rule       string        // Name of the matched rule
+	KeyKind    KeyKind       // Whether the limit was keyed by IP or token
+	Shadow     bool          // Whether the limit is in dry-run: recorded but not to be enforced
+	Quota      QuotaPeriod   // Period of the token quota the request exceeded, empty when a rate limit decided
+}
+
+// RetryAfterSeconds returns RetryAfter rounded up to whole seconds
+func (d *Decision) RetryAfterSeconds() int {
+	return int(math.Ceil(d.RetryAfter.Seconds()))
+}
+
+// newDecision builds a decision from the storage result of the matched rule
+func newDecision(kind KeyKind, rule string, maxRequests int, window time.Duration, result *storage.HitResult) *Decision {
+	return &Decision{
+		Allowed:    result.Allowed,
+		Blocked:    result.Blocked,
+		Limit:      maxRequests,
+		Window:     window,
+		Remaining:  result.Remaining,
+		Reset:      time.Now().Add(result.ResetAfter),
+		RetryAfter: result.RetryAfter,
+		Rule:       rule,
+		KeyKind:    kind,
+	}
+}
@@ -2,185 +2,462 @@ package limiter
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/netip"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/config"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/iplist"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/rules"
 	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/tokens"
 	"github.com/markuscandido/go-expert-desafio-rate-limiter/pkg/logger"
 )
 
+// ErrTokenRejected is returned when a token is disabled in the token registry,
+// or unknown while the unknown token policy is "reject"
+var ErrTokenRejected = errors.New("token rejected")
+
+// ErrIPDenied is returned for requests from an IP in the deny list
+var ErrIPDenied = errors.New("ip denied")
+
 type RateLimiter struct {
-	storage storage.Strategy
+	storage    storage.Strategy
+	algorithms map[string]Algorithm
+	snapshot   atomic.Pointer[Snapshot]
+}
+
+// Snapshot is an immutable view of the limits, token registry and route rules.
+// A request is decided against a single snapshot, so a concurrent Reload never
+// mixes old and new settings within one request.
+type Snapshot struct {
+	limiter *RateLimiter
 	config  *config.RateLimiterConfig
+	tokens  tokens.Registry
+	rules   *rules.Set
+	ipLists *iplist.Lists
+
+	quotaLocation *time.Location // Time zone the quota periods are aligned to
+}
+
+// Option configures optional RateLimiter dependencies
+type Option func(*Snapshot)
+
+// WithTokenRegistry makes token limits come from registry, falling back to the
+// global token limit for unknown tokens unless the policy rejects them
+func WithTokenRegistry(registry tokens.Registry) Option {
+	return func(s *Snapshot) {
+		s.tokens = registry
+	}
 }
 
-func NewRateLimiter(st storage.Strategy, cfg *config.RateLimiterConfig) *RateLimiter {
-	return &RateLimiter{
-		storage: st,
-		config:  cfg,
+// WithRules gives the requests matching a route rule that rule's limits
+func WithRules(set *rules.Set) Option {
+	return func(s *Snapshot) {
+		s.rules = set
+	}
+}
+
+// WithIPLists exempts the IPs in the allow list from the IP limit and rejects
+// the IPs in the deny list before any storage call
+func WithIPLists(lists *iplist.Lists) Option {
+	return func(s *Snapshot) {
+		s.ipLists = lists
+	}
+}
+
+func NewRateLimiter(st storage.Strategy, cfg *config.RateLimiterConfig, opts ...Option) *RateLimiter {
+	algorithms := make(map[string]Algorithm)
+	for _, algorithm := range []Algorithm{
+		NewFixedWindow(st),
+		NewSlidingLog(st),
+		NewSlidingWindowCounter(st),
+		NewTokenBucket(st),
+		NewGCRA(st),
+	} {
+		algorithms[algorithm.Name()] = algorithm
+	}
+
+	rl := &RateLimiter{
+		storage:    st,
+		algorithms: algorithms,
 	}
+	rl.Reload(cfg, opts...)
+	return rl
+}
+
+// Reload atomically replaces the limits, token registry and route rules.
+// Requests already being decided finish with the previous snapshot.
+func (rl *RateLimiter) Reload(cfg *config.RateLimiterConfig, opts ...Option) {
+	snapshot := &Snapshot{limiter: rl, config: cfg, quotaLocation: loadQuotaLocation(cfg.QuotaTimezone)}
+	for _, opt := range opts {
+		opt(snapshot)
+	}
+	rl.snapshot.Store(snapshot)
+}
+
+// Snapshot returns the current limits
+func (rl *RateLimiter) Snapshot() *Snapshot {
+	return rl.snapshot.Load()
+}
+
+// Config returns the configuration of the snapshot
+func (s *Snapshot) Config() *config.RateLimiterConfig {
+	return s.config
+}
+
+// Match returns the route rule of the snapshot matching req, or nil when the
+// global limits apply
+func (s *Snapshot) Match(req *http.Request) *rules.Rule {
+	return s.rules.Match(req)
+}
+
+// Rule returns the route rule of the snapshot with id, or nil when there is none
+func (s *Snapshot) Rule(id string) *rules.Rule {
+	return s.rules.Get(id)
 }
 
 // AllowRequest checks if a request should be allowed based on IP and/or token
 // Returns (allowed, blockDuration, error)
+//
+// It is a compatibility wrapper around Decide, reporting the retry delay in seconds.
 func (rl *RateLimiter) AllowRequest(ctx context.Context, ip string, token string) (allowed bool, blockDuration int, err error) {
-	var limit *RequestLimit
+	decision, err := rl.Decide(ctx, Request{IP: ip, Token: token})
+	if err != nil {
+		return false, 0, err
+	}
+	if decision.Allowed {
+		return true, 0, nil
+	}
+	return false, decision.RetryAfterSeconds(), nil
+}
+
+// Decide checks if a request should be allowed based on IP and/or token and
+// reports the quota left on the matched limit. Requests matching a route rule
+// are counted against the rule's own limits.
+func (rl *RateLimiter) Decide(ctx context.Context, req Request) (*Decision, error) {
+	return rl.Snapshot().Decide(ctx, req)
+}
+
+// Decide is like RateLimiter.Decide, using the limits of this snapshot. The
+// route of req should come from the same snapshot's Match.
+func (s *Snapshot) Decide(ctx context.Context, req Request) (*Decision, error) {
+	allowlisted := false
+	if s.ipLists != nil && req.IP != "" {
+		switch s.ipLists.Lookup(req.IP) {
+		case iplist.Deny:
+			logger.Warn("Denylisted IP rejected", "ip", req.IP)
+			return nil, ErrIPDenied
+		case iplist.Allow:
+			allowlisted = true
+		}
+	}
+
+	if req.Route != nil && req.Route.Exempt {
+		return &Decision{Allowed: true, Rule: RuleRoutePrefix + req.Route.ID}, nil
+	}
+
+	cost := max(req.Cost, 0)
+	if cost == 0 && req.Route != nil {
+		cost = req.Route.Cost
+	}
 
 	// Check token limit first (takes precedence over IP limit)
-	if rl.config.EnableTokenLimit && token != "" {
-		token = strings.TrimSpace(token)
-		limit, err = rl.checkTokenLimit(ctx, token)
+	if s.config.EnableTokenLimit && req.Token != "" {
+		decision, err := s.checkTokenLimit(ctx, strings.TrimSpace(req.Token), req.Route, cost)
 		if err != nil {
-			return false, 0, err
+			return nil, err
 		}
-		if limit != nil {
-			return limit.Allowed, limit.BlockDuration, nil
+		if decision != nil {
+			return decision, nil
 		}
 	}
 
+	// Allowlisted IPs bypass the IP limit
+	if allowlisted {
+		return &Decision{Allowed: true, Rule: RuleIPAllowlist, KeyKind: KeyKindIP}, nil
+	}
+
 	// Check IP limit
-	if rl.config.EnableIPLimit && ip != "" {
-		limit, err = rl.checkIPLimit(ctx, ip)
+	if s.config.EnableIPLimit && req.IP != "" {
+		decision, err := s.checkIPLimit(ctx, req.IP, req.Route, cost)
 		if err != nil {
-			return false, 0, err
+			return nil, err
 		}
-		if limit != nil {
-			return limit.Allowed, limit.BlockDuration, nil
+		if decision != nil {
+			return decision, nil
 		}
 	}
 
 	// If no limit is enabled, allow the request
-	return true, 0, nil
+	return &Decision{Allowed: true}, nil
 }
 
-func (rl *RateLimiter) checkIPLimit(ctx context.Context, ip string) (*RequestLimit, error) {
-	if !rl.config.EnableIPLimit {
+func (s *Snapshot) checkIPLimit(ctx context.Context, ip string, route *rules.Rule, cost int) (*Decision, error) {
+	if !s.config.EnableIPLimit {
 		return nil, nil
 	}
 
-	key := fmt.Sprintf("ip:%s", ip)
+	key := "ip:" + s.IPKey(ip)
+	maxRequests, window, blockDuration := s.config.MaxRequestsIP, globalWindow(s.config.WindowIP), s.config.BlockDurationIP
+	algorithmName, rule := s.config.AlgorithmIP, RuleGlobal
+	if route != nil {
+		key = routeKey(route, key)
+		maxRequests, window, blockDuration, algorithmName = applyRouteLimit(route.IP, maxRequests, window, blockDuration, algorithmName)
+		rule = RuleRoutePrefix + route.ID
+	}
+	dryRun := s.dryRun(route)
+	if dryRun {
+		key = shadowKey(key)
+	}
 
-	// Check if blocked
-	isBlocked, err := rl.storage.IsBlocked(ctx, key)
+	algorithm, err := s.limiter.algorithm(algorithmName)
 	if err != nil {
-		logger.Error("Failed to check if IP is blocked",
-			"ip", ip,
-			"error", err,
-		)
 		return nil, err
 	}
 
-	if isBlocked {
-		logger.Warn("IP blocked",
-			"ip", ip,
-			"blockDuration", rl.config.BlockDurationIP,
-		)
-		return &RequestLimit{
-			Allowed:       false,
-			BlockDuration: rl.config.BlockDurationIP,
-		}, nil
-	}
-
-	// Check and increment
-	allowed, err := rl.storage.CheckAndIncrement(ctx, key, rl.config.MaxRequestsIP, 1)
+	// Check, consume and block in a single atomic storage operation
+	result, err := algorithm.Allow(ctx, key, cost, maxRequests, window, seconds(blockDuration), s.penalty())
 	if err != nil {
 		logger.Error("Failed to check and increment IP limit",
 			"ip", ip,
+			"rule", rule,
 			"error", err,
 		)
 		return nil, err
 	}
 
-	if !allowed {
-		// Block the IP
-		err = rl.storage.Block(ctx, key, rl.config.BlockDurationIP)
-		if err != nil {
-			logger.Error("Failed to block IP",
-				"ip", ip,
-				"blockDuration", rl.config.BlockDurationIP,
-				"error", err,
-			)
-			return nil, err
-		}
+	decision := newDecision(KeyKindIP, rule, maxRequests, window, result)
+	decision.Shadow = dryRun
+	if result.Blocked {
+		logger.Warn("IP blocked",
+			"ip", ip,
+			"rule", rule,
+			"retryAfter", decision.RetryAfterSeconds(),
+			"dryRun", dryRun,
+		)
+	} else if !result.Allowed {
 		logger.Warn("IP rate limit exceeded",
 			"ip", ip,
-			"blockDuration", rl.config.BlockDurationIP,
+			"rule", rule,
+			"blockDuration", blockDuration,
+			"retryAfter", decision.RetryAfterSeconds(),
+			"strikes", result.Strikes,
+			"dryRun", dryRun,
 		)
-		return &RequestLimit{
-			Allowed:       false,
-			BlockDuration: rl.config.BlockDurationIP,
-		}, nil
 	}
-
-	return &RequestLimit{
-		Allowed:       true,
-		BlockDuration: 0,
-	}, nil
+	return decision, nil
 }
 
-func (rl *RateLimiter) checkTokenLimit(ctx context.Context, token string) (*RequestLimit, error) {
-	if !rl.config.EnableTokenLimit {
+func (s *Snapshot) checkTokenLimit(ctx context.Context, token string, route *rules.Rule, cost int) (*Decision, error) {
+	if !s.config.EnableTokenLimit {
 		return nil, nil
 	}
 
 	key := fmt.Sprintf("token:%s", token)
 
-	// Check if blocked
-	isBlocked, err := rl.storage.IsBlocked(ctx, key)
+	maxRequests, window, blockDuration, quota, rule, err := s.tokenLimit(ctx, token)
 	if err != nil {
-		logger.Error("Failed to check if token is blocked",
-			"error", err,
-		)
 		return nil, err
 	}
+	quotaRule := rule
 
-	if isBlocked {
-		logger.Warn("Token blocked",
-			"blockDuration", rl.config.BlockDurationToken,
-		)
-		return &RequestLimit{
-			Allowed:       false,
-			BlockDuration: rl.config.BlockDurationToken,
-		}, nil
+	algorithmName := s.config.AlgorithmToken
+	if route != nil {
+		key = routeKey(route, key)
+		maxRequests, window, blockDuration, algorithmName = applyRouteLimit(route.Token, maxRequests, window, blockDuration, algorithmName)
+		rule = RuleRoutePrefix + route.ID
+	}
+	dryRun := s.dryRun(route)
+	if dryRun {
+		key = shadowKey(key)
+	}
+
+	algorithm, err := s.limiter.algorithm(algorithmName)
+	if err != nil {
+		return nil, err
 	}
 
-	// Check and increment
-	allowed, err := rl.storage.CheckAndIncrement(ctx, key, rl.config.MaxRequestsToken, 1)
+	// Requests over a quota are denied before the rate limit is charged
+	quotaDecision, err := s.chargeQuotas(ctx, token, cost, quota, quotaRule, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	if quotaDecision != nil {
+		return quotaDecision, nil
+	}
+
+	// Check, consume and block in a single atomic storage operation
+	result, err := algorithm.Allow(ctx, key, cost, maxRequests, window, seconds(blockDuration), s.penalty())
+	if err != nil || !result.Allowed {
+		// Quotas only count the requests the rate limit lets through
+		s.refundQuotas(ctx, token, cost, limitedPeriods(quota), dryRun)
+	}
 	if err != nil {
 		logger.Error("Failed to check and increment token limit",
+			"rule", rule,
 			"error", err,
 		)
 		return nil, err
 	}
 
-	if !allowed {
-		// Block the token
-		err = rl.storage.Block(ctx, key, rl.config.BlockDurationToken)
+	decision := newDecision(KeyKindToken, rule, maxRequests, window, result)
+	decision.Shadow = dryRun
+
+	if result.Blocked {
+		logger.Warn("Token blocked",
+			"rule", rule,
+			"retryAfter", decision.RetryAfterSeconds(),
+			"dryRun", dryRun,
+		)
+	} else if !result.Allowed {
+		logger.Warn("Token rate limit exceeded",
+			"rule", rule,
+			"blockDuration", blockDuration,
+			"retryAfter", decision.RetryAfterSeconds(),
+			"strikes", result.Strikes,
+			"dryRun", dryRun,
+		)
+	}
+	return decision, nil
+}
+
+// tokenLimit returns the max requests, window, block duration in seconds, quotas
+// and rule name for token, taking overrides from the token registry
+func (s *Snapshot) tokenLimit(ctx context.Context, token string) (maxRequests int, window time.Duration, blockDuration int, quota tokens.Quota, rule string, err error) {
+	maxRequests, window, blockDuration, rule = s.config.MaxRequestsToken, globalWindow(s.config.WindowToken), s.config.BlockDurationToken, RuleGlobal
+
+	var override *tokens.Limit
+	if s.tokens != nil {
+		override, err = s.tokens.Lookup(ctx, token)
 		if err != nil {
-			logger.Error("Failed to block token",
-				"blockDuration", rl.config.BlockDurationToken,
+			logger.Error("Failed to look up token limit",
 				"error", err,
 			)
-			return nil, err
+			return 0, 0, 0, tokens.Quota{}, "", err
 		}
-		logger.Warn("Token rate limit exceeded",
-			"blockDuration", rl.config.BlockDurationToken,
-		)
-		return &RequestLimit{
-			Allowed:       false,
-			BlockDuration: rl.config.BlockDurationToken,
-		}, nil
 	}
 
-	return &RequestLimit{
-		Allowed:       true,
-		BlockDuration: 0,
-	}, nil
+	if override == nil {
+		if s.config.UnknownTokenPolicy == config.UnknownTokenReject {
+			logger.Warn("Unknown token rejected")
+			return 0, 0, 0, tokens.Quota{}, "", ErrTokenRejected
+		}
+		return maxRequests, window, blockDuration, s.tokenQuota(nil), rule, nil
+	}
+
+	if !override.Enabled {
+		logger.Warn("Disabled token rejected")
+		return 0, 0, 0, tokens.Quota{}, "", ErrTokenRejected
+	}
+	if override.MaxRequests > 0 {
+		maxRequests = override.MaxRequests
+	}
+	if override.Window > 0 {
+		window = seconds(override.Window)
+	}
+	if override.BlockDuration > 0 {
+		blockDuration = override.BlockDuration
+	}
+	return maxRequests, window, blockDuration, s.tokenQuota(override), RuleTokenRegistry, nil
+}
+
+// IPKey returns the part of the IP limit key identifying the client at ip,
+// aggregated by the prefixes of the snapshot, see IPKey
+func (s *Snapshot) IPKey(ip string) string {
+	return IPKey(ip, s.config.IPv4Prefix, s.config.IPv6Prefix)
+}
+
+// IPKey returns the part of the IP limit key identifying the client at ip: the
+// normalized address, or its network when an aggregation prefix shorter than
+// the address applies, e.g. 2001:db8:0:1::/64. IPv4-mapped IPv6 addresses are
+// keyed as IPv4 and zones are dropped. Unparsable values, networks included,
+// are used verbatim.
+func IPKey(ip string, ipv4Prefix, ipv6Prefix int) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap().WithZone("")
+
+	bits := ipv6Prefix
+	if addr.Is4() {
+		bits = ipv4Prefix
+	}
+	if bits <= 0 || bits >= addr.BitLen() {
+		return addr.String()
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix.String()
+}
+
+// dryRun reports whether the limits applied to route are only recorded, not
+// enforced, either globally or by the route rule
+func (s *Snapshot) dryRun(route *rules.Rule) bool {
+	return s.config.DryRun || (route != nil && route.DryRun)
+}
+
+// penalty returns the block escalation applied to every limit of the snapshot
+func (s *Snapshot) penalty() storage.Penalty {
+	return storage.Penalty{
+		Multiplier: s.config.PenaltyMultiplier,
+		MaxBlock:   seconds(s.config.PenaltyMaxBlock),
+		Decay:      seconds(s.config.PenaltyDecay),
+	}
+}
+
+// algorithm returns the algorithm configured under name
+func (rl *RateLimiter) algorithm(name string) (Algorithm, error) {
+	if name == "" {
+		name = string(storage.AlgorithmFixedWindow)
+	}
+	algorithm, ok := rl.algorithms[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown rate limiting algorithm %q", name)
+	}
+	return algorithm, nil
+}
+
+// routeKey namespaces key under the route rule, e.g. route:search:ip:1.2.3.4
+func routeKey(route *rules.Rule, key string) string {
+	return fmt.Sprintf("route:%s:%s", route.ID, key)
+}
+
+// shadowKey namespaces the key of a dry-run limit, e.g. shadow:ip:1.2.3.4, so
+// its counters never affect the enforced limit of the same key
+func shadowKey(key string) string {
+	return "shadow:" + key
+}
+
+// applyRouteLimit overrides the inherited limit with the non-zero values of a route limit
+func applyRouteLimit(limit rules.Limit, maxRequests int, window time.Duration, blockDuration int, algorithm string) (int, time.Duration, int, string) {
+	if limit.MaxRequests > 0 {
+		maxRequests = limit.MaxRequests
+	}
+	if limit.Window > 0 {
+		window = seconds(limit.Window)
+	}
+	if limit.BlockDuration > 0 {
+		blockDuration = limit.BlockDuration
+	}
+	if limit.Algorithm != "" {
+		algorithm = limit.Algorithm
+	}
+	return maxRequests, window, blockDuration, algorithm
+}
+
+// globalWindow returns a global limit window, counting per second when it is unset
+func globalWindow(n int) time.Duration {
+	if n <= 0 {
+		return time.Second
+	}
+	return seconds(n)
 }
 
-// RequestLimit represents the result of a rate limit check
-type RequestLimit struct {
-	Allowed       bool
-	BlockDuration int
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
 }
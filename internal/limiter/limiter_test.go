@@ -2,59 +2,28 @@ package limiter
 
 import (
 	"context"
+	"errors"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/config"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/iplist"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/rules"
 	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/tokens"
 )
 
-// MockStrategy is a mock implementation of storage.Strategy for testing
-type MockStrategy struct {
-	data    map[string]*storage.LimiterData
-	blocked map[string]bool
-}
-
-func NewMockStrategy() *MockStrategy {
-	return &MockStrategy{
-		data:    make(map[string]*storage.LimiterData),
-		blocked: make(map[string]bool),
-	}
-}
-
-func (m *MockStrategy) CheckAndIncrement(ctx context.Context, key string, maxRequests int, windowSeconds int) (allowed bool, err error) {
-	if m.data[key] == nil {
-		m.data[key] = &storage.LimiterData{Count: 0}
-	}
-
-	m.data[key].Count++
-	return m.data[key].Count <= maxRequests, nil
-}
-
-func (m *MockStrategy) IsBlocked(ctx context.Context, key string) (blocked bool, err error) {
-	return m.blocked[key], nil
-}
-
-func (m *MockStrategy) Block(ctx context.Context, key string, durationSeconds int) error {
-	m.blocked[key] = true
-	return nil
-}
-
-func (m *MockStrategy) Reset(ctx context.Context, key string) error {
-	delete(m.data, key)
-	delete(m.blocked, key)
-	return nil
-}
-
-func (m *MockStrategy) GetData(ctx context.Context, key string) (*storage.LimiterData, error) {
-	return m.data[key], nil
-}
+func newTestStorage(t *testing.T) *storage.MemoryStrategy {
+	t.Helper()
 
-func (m *MockStrategy) Close() error {
-	return nil
+	store := storage.NewMemoryStrategy(0, 0)
+	t.Cleanup(func() { store.Close() })
+	return store
 }
 
 func TestIPRateLimiting(t *testing.T) {
-	mockStorage := NewMockStrategy()
+	store := newTestStorage(t)
 	cfg := &config.RateLimiterConfig{
 		MaxRequestsIP:    5,
 		BlockDurationIP:  60,
@@ -62,7 +31,7 @@ func TestIPRateLimiting(t *testing.T) {
 		EnableTokenLimit: false,
 	}
 
-	rateLimiter := NewRateLimiter(mockStorage, cfg)
+	rateLimiter := NewRateLimiter(store, cfg)
 	ctx := context.Background()
 
 	// First 5 requests should be allowed
@@ -99,7 +68,7 @@ func TestIPRateLimiting(t *testing.T) {
 }
 
 func TestTokenRateLimiting(t *testing.T) {
-	mockStorage := NewMockStrategy()
+	store := newTestStorage(t)
 	cfg := &config.RateLimiterConfig{
 		MaxRequestsToken:   10,
 		BlockDurationToken: 60,
@@ -107,7 +76,7 @@ func TestTokenRateLimiting(t *testing.T) {
 		EnableTokenLimit:   true,
 	}
 
-	rateLimiter := NewRateLimiter(mockStorage, cfg)
+	rateLimiter := NewRateLimiter(store, cfg)
 	ctx := context.Background()
 
 	// First 10 requests should be allowed
@@ -144,7 +113,7 @@ func TestTokenRateLimiting(t *testing.T) {
 }
 
 func TestTokenPrecedenceOverIP(t *testing.T) {
-	mockStorage := NewMockStrategy()
+	store := newTestStorage(t)
 	cfg := &config.RateLimiterConfig{
 		MaxRequestsIP:      5,
 		BlockDurationIP:    60,
@@ -154,7 +123,7 @@ func TestTokenPrecedenceOverIP(t *testing.T) {
 		EnableTokenLimit:   true,
 	}
 
-	rateLimiter := NewRateLimiter(mockStorage, cfg)
+	rateLimiter := NewRateLimiter(store, cfg)
 	ctx := context.Background()
 
 	ip := "192.168.1.1"
@@ -175,7 +144,7 @@ func TestTokenPrecedenceOverIP(t *testing.T) {
 	}
 
 	// But with token, it should be allowed (token has higher limit)
-	mockStorage.Reset(ctx, "ip:"+ip)
+	store.Reset(ctx, "ip:"+ip)
 	allowed, _, _ = rateLimiter.AllowRequest(ctx, ip, token)
 	if !allowed {
 		t.Error("Request with token should be allowed (token precedence)")
@@ -183,13 +152,13 @@ func TestTokenPrecedenceOverIP(t *testing.T) {
 }
 
 func TestDisabledLimits(t *testing.T) {
-	mockStorage := NewMockStrategy()
+	store := newTestStorage(t)
 	cfg := &config.RateLimiterConfig{
 		EnableIPLimit:    false,
 		EnableTokenLimit: false,
 	}
 
-	rateLimiter := NewRateLimiter(mockStorage, cfg)
+	rateLimiter := NewRateLimiter(store, cfg)
 	ctx := context.Background()
 
 	// All requests should be allowed
@@ -205,7 +174,7 @@ func TestDisabledLimits(t *testing.T) {
 }
 
 func TestIPsAreIndependent_AfterBlock(t *testing.T) {
-	mockStorage := NewMockStrategy()
+	store := newTestStorage(t)
 	cfg := &config.RateLimiterConfig{
 		MaxRequestsIP:    2,
 		BlockDurationIP:  60,
@@ -213,7 +182,7 @@ func TestIPsAreIndependent_AfterBlock(t *testing.T) {
 		EnableTokenLimit: false,
 	}
 
-	rateLimiter := NewRateLimiter(mockStorage, cfg)
+	rateLimiter := NewRateLimiter(store, cfg)
 	ctx := context.Background()
 
 	ip1 := "192.168.1.1"
@@ -247,4 +216,518 @@ func TestIPsAreIndependent_AfterBlock(t *testing.T) {
 	if !allowed {
 		t.Error("Request from IP2 should be allowed as it is independent")
 	}
-}
\ No newline at end of file
+}
+
+// staticRegistry is a fixed in-memory token registry
+type staticRegistry map[string]*tokens.Limit
+
+func (r staticRegistry) Lookup(ctx context.Context, token string) (*tokens.Limit, error) {
+	return r[token], nil
+}
+
+func TestTokenRegistryOverrides(t *testing.T) {
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsToken:   2,
+		BlockDurationToken: 60,
+		EnableTokenLimit:   true,
+		UnknownTokenPolicy: config.UnknownTokenDefault,
+	}
+	registry := staticRegistry{
+		"premium": {Token: "premium", MaxRequests: 5, BlockDuration: 30, Enabled: true},
+		"revoked": {Token: "revoked", MaxRequests: 5, Enabled: false},
+	}
+
+	rateLimiter := NewRateLimiter(store, cfg, WithTokenRegistry(registry))
+	ctx := context.Background()
+
+	// Registered token gets its own limit and block duration
+	for i := 0; i < 5; i++ {
+		allowed, _, err := rateLimiter.AllowRequest(ctx, "", "premium")
+		if err != nil || !allowed {
+			t.Fatalf("Premium request %d should be allowed, got allowed=%v err=%v", i+1, allowed, err)
+		}
+	}
+	allowed, blockDuration, err := rateLimiter.AllowRequest(ctx, "", "premium")
+	if err != nil || allowed || blockDuration != 30 {
+		t.Errorf("6th premium request should be blocked for 30s, got allowed=%v blockDuration=%d err=%v", allowed, blockDuration, err)
+	}
+
+	// Unknown token falls back to the global token limit
+	for i := 0; i < 2; i++ {
+		allowed, _, _ := rateLimiter.AllowRequest(ctx, "", "unknown")
+		if !allowed {
+			t.Fatalf("Unknown token request %d should be allowed", i+1)
+		}
+	}
+	allowed, blockDuration, _ = rateLimiter.AllowRequest(ctx, "", "unknown")
+	if allowed || blockDuration != 60 {
+		t.Errorf("3rd unknown token request should be blocked for 60s, got allowed=%v blockDuration=%d", allowed, blockDuration)
+	}
+
+	// Disabled token is rejected
+	if _, _, err := rateLimiter.AllowRequest(ctx, "", "revoked"); !errors.Is(err, ErrTokenRejected) {
+		t.Errorf("Expected ErrTokenRejected for a disabled token, got %v", err)
+	}
+}
+
+func TestUnknownTokenRejectPolicy(t *testing.T) {
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsToken:   2,
+		EnableTokenLimit:   true,
+		UnknownTokenPolicy: config.UnknownTokenReject,
+	}
+	registry := staticRegistry{
+		"premium": {Token: "premium", Enabled: true},
+	}
+
+	rateLimiter := NewRateLimiter(store, cfg, WithTokenRegistry(registry))
+	ctx := context.Background()
+
+	if _, _, err := rateLimiter.AllowRequest(ctx, "", "unknown"); !errors.Is(err, ErrTokenRejected) {
+		t.Errorf("Expected ErrTokenRejected for an unknown token, got %v", err)
+	}
+
+	// Zero values inherit the global token limit
+	allowed, _, err := rateLimiter.AllowRequest(ctx, "", "premium")
+	if err != nil || !allowed {
+		t.Errorf("Registered token should be allowed, got allowed=%v err=%v", allowed, err)
+	}
+}
+
+func TestDecideReportsQuota(t *testing.T) {
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsIP:    3,
+		BlockDurationIP:  60,
+		EnableIPLimit:    true,
+		MaxRequestsToken: 10,
+		EnableTokenLimit: true,
+	}
+	registry := staticRegistry{
+		"premium": {Token: "premium", MaxRequests: 20, Window: 2, Enabled: true},
+	}
+
+	rateLimiter := NewRateLimiter(store, cfg, WithTokenRegistry(registry))
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		decision, err := rateLimiter.Decide(ctx, Request{IP: "192.168.1.1"})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !decision.Allowed || decision.Limit != 3 || decision.Remaining != 2-i {
+			t.Errorf("Request %d: expected allowed with limit 3 and %d remaining, got %+v", i+1, 2-i, decision)
+		}
+		if decision.KeyKind != KeyKindIP || decision.Rule != RuleGlobal {
+			t.Errorf("Request %d: expected global IP rule, got %+v", i+1, decision)
+		}
+		if time.Until(decision.Reset) > time.Second || time.Until(decision.Reset) <= 0 {
+			t.Errorf("Request %d: expected reset within the 1s window, got %v", i+1, decision.Reset)
+		}
+	}
+
+	decision, err := rateLimiter.Decide(ctx, Request{IP: "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if decision.Allowed || decision.Remaining != 0 || decision.RetryAfterSeconds() != 60 {
+		t.Errorf("4th request should be denied for 60s, got %+v", decision)
+	}
+
+	decision, err = rateLimiter.Decide(ctx, Request{IP: "192.168.1.1", Token: "premium"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !decision.Allowed || decision.KeyKind != KeyKindToken || decision.Rule != RuleTokenRegistry {
+		t.Errorf("Expected token registry rule, got %+v", decision)
+	}
+	if decision.Limit != 20 || decision.Window != 2*time.Second || decision.Remaining != 19 {
+		t.Errorf("Expected 20 requests per 2s with 19 remaining, got %+v", decision)
+	}
+}
+
+func TestRouteRules(t *testing.T) {
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsIP:    5,
+		BlockDurationIP:  60,
+		EnableIPLimit:    true,
+		MaxRequestsToken: 100,
+		EnableTokenLimit: true,
+	}
+	rateLimiter := NewRateLimiter(store, cfg)
+	ctx := context.Background()
+
+	search := &rules.Rule{
+		ID:    "search",
+		IP:    rules.Limit{MaxRequests: 2, BlockDuration: 5},
+		Token: rules.Limit{MaxRequests: 1},
+	}
+
+	for i := 0; i < 2; i++ {
+		decision, err := rateLimiter.Decide(ctx, Request{IP: "192.168.1.1", Route: search})
+		if err != nil || !decision.Allowed {
+			t.Fatalf("Request %d should be allowed, got %+v (%v)", i+1, decision, err)
+		}
+		if decision.Rule != "route:search" || decision.Limit != 2 {
+			t.Errorf("Expected route:search with limit 2, got %s with %d", decision.Rule, decision.Limit)
+		}
+	}
+	decision, _ := rateLimiter.Decide(ctx, Request{IP: "192.168.1.1", Route: search})
+	if decision.Allowed || decision.RetryAfterSeconds() != 5 {
+		t.Errorf("Expected the route block of 5s, got %+v", decision)
+	}
+
+	// The route is counted apart from the global IP limit
+	decision, _ = rateLimiter.Decide(ctx, Request{IP: "192.168.1.1"})
+	if !decision.Allowed || decision.Remaining != 4 {
+		t.Errorf("Expected the global limit to be untouched, got %+v", decision)
+	}
+	if data, _ := store.GetData(ctx, "route:search:ip:192.168.1.1"); data == nil || !data.IsBlocked {
+		t.Errorf("Expected route key to be blocked, got %+v", data)
+	}
+
+	decision, _ = rateLimiter.Decide(ctx, Request{IP: "192.168.1.1", Token: "abc", Route: search})
+	if !decision.Allowed || decision.KeyKind != KeyKindToken || decision.Limit != 1 {
+		t.Errorf("Expected the route token limit, got %+v", decision)
+	}
+
+	exempt := &rules.Rule{ID: "health", Exempt: true}
+	for i := 0; i < 10; i++ {
+		decision, _ = rateLimiter.Decide(ctx, Request{IP: "192.168.1.1", Route: exempt})
+		if !decision.Allowed || decision.Limit != 0 {
+			t.Fatalf("Exempt route should always be allowed, got %+v", decision)
+		}
+	}
+}
+
+func TestConfiguredWindows(t *testing.T) {
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsIP:    3,
+		WindowIP:         60,
+		EnableIPLimit:    true,
+		MaxRequestsToken: 10,
+		WindowToken:      3600,
+		EnableTokenLimit: true,
+	}
+
+	rateLimiter := NewRateLimiter(store, cfg)
+	ctx := context.Background()
+
+	decision, err := rateLimiter.Decide(ctx, Request{IP: "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if decision.Window != time.Minute {
+		t.Errorf("Expected 1m IP window, got %v", decision.Window)
+	}
+
+	decision, err = rateLimiter.Decide(ctx, Request{IP: "192.168.1.1", Token: "abc"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if decision.Window != time.Hour {
+		t.Errorf("Expected 1h token window, got %v", decision.Window)
+	}
+}
+
+func TestReloadKeepsSnapshotsConsistent(t *testing.T) {
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsIP: 5,
+		EnableIPLimit: true,
+	}
+	rateLimiter := NewRateLimiter(store, cfg)
+	ctx := context.Background()
+
+	previous := rateLimiter.Snapshot()
+	set, err := rules.NewSet([]rules.Rule{{ID: "all", PathPrefix: "/", IP: rules.Limit{MaxRequests: 2}}})
+	if err != nil {
+		t.Fatalf("Failed to create rules: %v", err)
+	}
+	rateLimiter.Reload(&config.RateLimiterConfig{MaxRequestsIP: 1, EnableIPLimit: true}, WithRules(set))
+
+	// A request that started before the reload finishes with the old limits
+	decision, err := previous.Decide(ctx, Request{IP: "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if decision.Limit != 5 {
+		t.Errorf("Expected the previous limit 5, got %d", decision.Limit)
+	}
+
+	decision, err = rateLimiter.Decide(ctx, Request{IP: "192.168.1.2"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if decision.Limit != 1 {
+		t.Errorf("Expected the reloaded limit 1, got %d", decision.Limit)
+	}
+
+	req := httptest.NewRequest("GET", "/search", nil)
+	if route := rateLimiter.Snapshot().Match(req); route == nil || route.ID != "all" {
+		t.Errorf("Expected the reloaded rule to match, got %+v", route)
+	}
+	if route := previous.Match(req); route != nil {
+		t.Errorf("Expected the previous snapshot to have no rules, got %+v", route)
+	}
+}
+
+// limitRecorder remembers the last limit consumed from the wrapped storage
+type limitRecorder struct {
+	storage.Strategy
+	last storage.Limit
+}
+
+func (r *limitRecorder) Consume(ctx context.Context, key string, limit storage.Limit) (*storage.HitResult, error) {
+	r.last = limit
+	return r.Strategy.Consume(ctx, key, limit)
+}
+
+func TestPenaltyAppliesToEveryLimit(t *testing.T) {
+	store := &limitRecorder{Strategy: newTestStorage(t)}
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsIP:      1,
+		BlockDurationIP:    10,
+		EnableIPLimit:      true,
+		MaxRequestsToken:   1,
+		BlockDurationToken: 20,
+		EnableTokenLimit:   true,
+		PenaltyMultiplier:  2,
+		PenaltyMaxBlock:    300,
+		PenaltyDecay:       600,
+	}
+	want := storage.Penalty{Multiplier: 2, MaxBlock: 300 * time.Second, Decay: 600 * time.Second}
+
+	rateLimiter := NewRateLimiter(store, cfg)
+	ctx := context.Background()
+
+	for _, req := range []Request{{IP: "192.168.1.1"}, {IP: "192.168.1.1", Token: "abc"}} {
+		if _, err := rateLimiter.Decide(ctx, req); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if store.last.Penalty != want {
+			t.Errorf("Expected penalty %+v for %+v, got %+v", want, req, store.last.Penalty)
+		}
+	}
+
+	// The first violation blocks for the base duration
+	decision, err := rateLimiter.Decide(ctx, Request{IP: "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if decision.Allowed || decision.RetryAfterSeconds() != 10 {
+		t.Errorf("Expected the first violation to block for 10s, got %+v", decision)
+	}
+}
+
+func TestIPLists(t *testing.T) {
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsIP:    1,
+		BlockDurationIP:  60,
+		EnableIPLimit:    true,
+		MaxRequestsToken: 1,
+		EnableTokenLimit: true,
+	}
+	entries, err := iplist.ParseEntries([]string{"10.0.0.0/8"}, []string{"10.66.0.0/16", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	rateLimiter := NewRateLimiter(store, cfg, WithIPLists(iplist.NewLists(entries, nil)))
+	ctx := context.Background()
+
+	// Allowlisted IPs bypass the IP limit
+	for i := 0; i < 5; i++ {
+		decision, err := rateLimiter.Decide(ctx, Request{IP: "10.1.2.3"})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !decision.Allowed || decision.Rule != RuleIPAllowlist {
+			t.Errorf("Request %d from an allowlisted IP should be allowed, got %+v", i+1, decision)
+		}
+	}
+
+	// but not the token limit
+	rateLimiter.Decide(ctx, Request{IP: "10.1.2.3", Token: "abc"})
+	if decision, _ := rateLimiter.Decide(ctx, Request{IP: "10.1.2.3", Token: "abc"}); decision.Allowed {
+		t.Error("Expected the token limit to apply to allowlisted IPs")
+	}
+
+	// Denylisted IPs are rejected before any storage call
+	for _, ip := range []string{"10.66.1.1", "2001:db8::7"} {
+		if _, err := rateLimiter.Decide(ctx, Request{IP: ip}); !errors.Is(err, ErrIPDenied) {
+			t.Errorf("Expected ErrIPDenied for %s, got %v", ip, err)
+		}
+		if data, _ := store.GetData(ctx, "ip:"+ip); data != nil {
+			t.Errorf("Expected no state stored for denied IP %s, got %+v", ip, data)
+		}
+	}
+
+	// Other IPs are limited as usual
+	rateLimiter.Decide(ctx, Request{IP: "192.168.1.1"})
+	if decision, _ := rateLimiter.Decide(ctx, Request{IP: "192.168.1.1"}); decision.Allowed {
+		t.Error("Expected the IP limit to apply to unlisted IPs")
+	}
+}
+
+func TestIPKeyAggregation(t *testing.T) {
+	snapshot := NewRateLimiter(newTestStorage(t), &config.RateLimiterConfig{IPv4Prefix: 32, IPv6Prefix: 64}).Snapshot()
+	for ip, want := range map[string]string{
+		"192.168.1.7":          "192.168.1.7",
+		"::ffff:192.168.1.7":   "192.168.1.7",
+		"2001:db8:0:1:aaaa::1": "2001:db8:0:1::/64",
+		"2001:db8:0:1:ffff::2": "2001:db8:0:1::/64",
+		"fe80::1%eth0":         "fe80::/64",
+		"2001:DB8:0:2::1":      "2001:db8:0:2::/64",
+		"unix-socket":          "unix-socket",
+	} {
+		if got := snapshot.IPKey(ip); got != want {
+			t.Errorf("IPKey(%s): expected %s, got %s", ip, want, got)
+		}
+	}
+
+	snapshot = NewRateLimiter(newTestStorage(t), &config.RateLimiterConfig{IPv4Prefix: 24, IPv6Prefix: 128}).Snapshot()
+	for ip, want := range map[string]string{
+		"192.168.1.7":          "192.168.1.0/24",
+		"2001:db8:0:1:aaaa::1": "2001:db8:0:1:aaaa::1",
+	} {
+		if got := snapshot.IPKey(ip); got != want {
+			t.Errorf("IPKey(%s): expected %s, got %s", ip, want, got)
+		}
+	}
+}
+
+func TestIPv6NetworkSharesIPLimit(t *testing.T) {
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsIP:   2,
+		BlockDurationIP: 60,
+		EnableIPLimit:   true,
+		IPv4Prefix:      32,
+		IPv6Prefix:      64,
+	}
+	rateLimiter := NewRateLimiter(store, cfg)
+	ctx := context.Background()
+
+	// Rotating addresses within the same /64 does not escape the limit
+	for i, ip := range []string{"2001:db8::1", "2001:db8::2", "2001:db8::ffff:3"} {
+		allowed, _, err := rateLimiter.AllowRequest(ctx, ip, "")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if want := i < 2; allowed != want {
+			t.Errorf("Request %d from %s: expected allowed=%v, got %v", i+1, ip, want, allowed)
+		}
+	}
+
+	allowed, _, err := rateLimiter.AllowRequest(ctx, "2001:db8:0:1::1", "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !allowed {
+		t.Error("Expected another /64 to have its own limit")
+	}
+	if data, _ := store.GetData(ctx, "ip:2001:db8::/64"); data == nil || !data.IsBlocked {
+		t.Errorf("Expected the /64 key to be blocked, got %+v", data)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsIP:   1,
+		BlockDurationIP: 60,
+		EnableIPLimit:   true,
+	}
+	rateLimiter := NewRateLimiter(store, cfg)
+	ctx := context.Background()
+
+	// A dry-run rule is decided as usual, flagged and counted apart
+	search := &rules.Rule{ID: "search", DryRun: true}
+	for i, allowed := range []bool{true, false, false} {
+		decision, err := rateLimiter.Decide(ctx, Request{IP: "192.168.1.1", Route: search})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if decision.Allowed != allowed || !decision.Shadow {
+			t.Errorf("Request %d: expected a shadow decision allowed=%v, got %+v", i+1, allowed, decision)
+		}
+	}
+	if data, _ := store.GetData(ctx, "shadow:route:search:ip:192.168.1.1"); data == nil || !data.IsBlocked {
+		t.Errorf("Expected the shadow route key to be blocked, got %+v", data)
+	}
+	if data, _ := store.GetData(ctx, "route:search:ip:192.168.1.1"); data != nil {
+		t.Errorf("Expected the enforced route key to be untouched, got %+v", data)
+	}
+
+	// Other routes are still enforced
+	decision, _ := rateLimiter.Decide(ctx, Request{IP: "192.168.1.1"})
+	if !decision.Allowed || decision.Shadow {
+		t.Errorf("Expected an enforced allowed decision, got %+v", decision)
+	}
+
+	// The global setting puts every limit in dry-run
+	rateLimiter.Reload(&config.RateLimiterConfig{
+		MaxRequestsIP:   1,
+		BlockDurationIP: 60,
+		EnableIPLimit:   true,
+		DryRun:          true,
+	})
+	decision, _ = rateLimiter.Decide(ctx, Request{IP: "192.168.1.1"})
+	if !decision.Allowed || !decision.Shadow {
+		t.Errorf("Expected the shadow counter to start empty, got %+v", decision)
+	}
+	if data, _ := store.GetData(ctx, "shadow:ip:192.168.1.1"); data == nil || data.Count != 1 {
+		t.Errorf("Expected the shadow IP key to be counted, got %+v", data)
+	}
+}
+
+func TestRequestCost(t *testing.T) {
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsIP:      10,
+		BlockDurationIP:    60,
+		EnableIPLimit:      true,
+		MaxRequestsToken:   100,
+		BlockDurationToken: 60,
+		EnableTokenLimit:   true,
+		DailyQuotaToken:    25,
+	}
+	rateLimiter := NewRateLimiter(store, cfg)
+	ctx := context.Background()
+
+	// The request cost takes precedence over the rule cost
+	export := &rules.Rule{ID: "export", Cost: 4}
+	for i, tt := range []struct {
+		cost      int
+		allowed   bool
+		remaining int
+	}{{0, true, 6}, {2, true, 4}, {5, false, 0}} {
+		decision, err := rateLimiter.Decide(ctx, Request{IP: "192.168.1.1", Route: export, Cost: tt.cost})
+		if err != nil || decision.Allowed != tt.allowed || decision.Remaining != tt.remaining {
+			t.Errorf("Request %d: expected allowed=%v with %d remaining, got %+v, %v", i+1, tt.allowed, tt.remaining, decision, err)
+		}
+	}
+	if data, _ := store.GetData(ctx, "route:export:ip:192.168.1.1"); data == nil || data.Count != 6 {
+		t.Errorf("Expected the denied cost not to be consumed, got %+v", data)
+	}
+
+	// Quotas are charged the same cost
+	for i := 0; i < 2; i++ {
+		if decision, _ := rateLimiter.Decide(ctx, Request{Token: "abc", Cost: 10}); !decision.Allowed {
+			t.Fatalf("Request %d should be allowed, got %+v", i+1, decision)
+		}
+	}
+	decision, _ := rateLimiter.Decide(ctx, Request{Token: "abc", Cost: 10})
+	if decision.Allowed || decision.Quota != QuotaDaily {
+		t.Errorf("Expected the daily quota to deny a cost above the 5 requests left, got %+v", decision)
+	}
+	if decision, _ := rateLimiter.Decide(ctx, Request{Token: "abc", Cost: 5}); !decision.Allowed {
+		t.Errorf("Expected the 5 requests left to be consumed, got %+v", decision)
+	}
+}
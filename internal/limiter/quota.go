@@ -0,0 +1,178 @@
+package limiter
+
+import (
+	"context"
+	"time"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/tokens"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/pkg/logger"
+)
+
+// QuotaPeriod is the calendar period a token quota is counted over
+type QuotaPeriod string
+
+const (
+	QuotaHourly  QuotaPeriod = "hourly"
+	QuotaDaily   QuotaPeriod = "daily"
+	QuotaMonthly QuotaPeriod = "monthly"
+)
+
+// QuotaPeriods lists every quota period, in the order quotas are checked
+var QuotaPeriods = []QuotaPeriod{QuotaHourly, QuotaDaily, QuotaMonthly}
+
+// Bounds returns the start and end of the period containing now, aligned to
+// the calendar of loc: hours start on the hour, days at midnight and months
+// on their first day
+func (p QuotaPeriod) Bounds(now time.Time, loc *time.Location) (start, end time.Time) {
+	now = now.In(loc)
+	year, month, day := now.Date()
+	switch p {
+	case QuotaHourly:
+		// Counted back from now, as an hour repeated by a DST change has no single local start
+		start = now.Add(-time.Duration(now.Minute())*time.Minute - time.Duration(now.Second())*time.Second - time.Duration(now.Nanosecond()))
+		return start, start.Add(time.Hour)
+	case QuotaDaily:
+		return time.Date(year, month, day, 0, 0, 0, 0, loc), time.Date(year, month, day+1, 0, 0, 0, 0, loc)
+	default:
+		return time.Date(year, month, 1, 0, 0, 0, 0, loc), time.Date(year, month+1, 1, 0, 0, 0, 0, loc)
+	}
+}
+
+// of returns the requests quota allows over the period, 0 when it is not limited
+func (p QuotaPeriod) of(quota tokens.Quota) int {
+	switch p {
+	case QuotaHourly:
+		return quota.Hourly
+	case QuotaDaily:
+		return quota.Daily
+	default:
+		return quota.Monthly
+	}
+}
+
+// limitedPeriods returns the periods quota limits, in checking order
+func limitedPeriods(quota tokens.Quota) []QuotaPeriod {
+	var periods []QuotaPeriod
+	for _, period := range QuotaPeriods {
+		if period.of(quota) > 0 {
+			periods = append(periods, period)
+		}
+	}
+	return periods
+}
+
+// QuotaKey returns the storage key counting the requests of token over period,
+// e.g. quota:daily:token:abc, whose data holds the requests used so far and
+// the end of the period
+func QuotaKey(period QuotaPeriod, token string) string {
+	return "quota:" + string(period) + ":token:" + token
+}
+
+// chargeQuotas charges cost to every quota of the token and returns the
+// decision of the first quota it exceeds, or nil when every quota allows it.
+// Quotas apply to the token across every route. A request is charged to all
+// of its quotas or to none: on denial the quotas already charged are refunded.
+func (s *Snapshot) chargeQuotas(ctx context.Context, token string, cost int, quota tokens.Quota, rule string, dryRun bool) (*Decision, error) {
+	algorithm, err := s.limiter.algorithm(string(storage.AlgorithmFixedWindow))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var charged []QuotaPeriod
+	for _, period := range limitedPeriods(quota) {
+		maxRequests := period.of(quota)
+
+		// A fixed window opened by the first request of the period expires at
+		// its end, so the next request opens the window of the next period
+		start, end := period.Bounds(now, s.quotaLocation)
+		result, err := algorithm.Allow(ctx, quotaKey(period, token, dryRun), cost, maxRequests, max(end.Sub(now), time.Millisecond), 0, storage.Penalty{})
+		if err != nil {
+			logger.Error("Failed to check and increment token quota",
+				"rule", rule,
+				"quota", period,
+				"error", err,
+			)
+			s.refundQuotas(ctx, token, cost, charged, dryRun)
+			return nil, err
+		}
+		if !result.Allowed {
+			s.refundQuotas(ctx, token, cost, charged, dryRun)
+			return quotaExceeded(period, rule, maxRequests, end.Sub(start), result, dryRun), nil
+		}
+		charged = append(charged, period)
+	}
+	return nil, nil
+}
+
+// refundQuotas gives cost back to the quotas of token over periods, after a
+// later quota or the rate limit denied the request they were charged for.
+// Failures are logged, as the request is denied either way.
+func (s *Snapshot) refundQuotas(ctx context.Context, token string, cost int, periods []QuotaPeriod, dryRun bool) {
+	for _, period := range periods {
+		if err := s.limiter.storage.Refund(ctx, quotaKey(period, token, dryRun), max(cost, 1)); err != nil {
+			logger.Error("Failed to refund token quota",
+				"quota", period,
+				"error", err,
+			)
+		}
+	}
+}
+
+// quotaExceeded logs and returns the decision of a request over the quota of
+// period, whose current occurrence lasts length
+func quotaExceeded(period QuotaPeriod, rule string, maxRequests int, length time.Duration, result *storage.HitResult, dryRun bool) *Decision {
+	decision := newDecision(KeyKindToken, rule, maxRequests, length, result)
+	decision.Quota = period
+	decision.Shadow = dryRun
+	logger.Warn("Token quota exceeded",
+		"rule", rule,
+		"quota", period,
+		"limit", maxRequests,
+		"retryAfter", decision.RetryAfterSeconds(),
+		"dryRun", dryRun,
+	)
+	return decision
+}
+
+// quotaKey returns the key counting the quota of token over period, apart for dry-run
+func quotaKey(period QuotaPeriod, token string, dryRun bool) string {
+	if dryRun {
+		return shadowKey(QuotaKey(period, token))
+	}
+	return QuotaKey(period, token)
+}
+
+// tokenQuota returns the global token quotas, overridden by the non-zero quotas of override
+func (s *Snapshot) tokenQuota(override *tokens.Limit) tokens.Quota {
+	quota := tokens.Quota{
+		Hourly:  s.config.HourlyQuotaToken,
+		Daily:   s.config.DailyQuotaToken,
+		Monthly: s.config.MonthlyQuotaToken,
+	}
+	if override == nil {
+		return quota
+	}
+	if override.Quota.Hourly > 0 {
+		quota.Hourly = override.Quota.Hourly
+	}
+	if override.Quota.Daily > 0 {
+		quota.Daily = override.Quota.Daily
+	}
+	if override.Quota.Monthly > 0 {
+		quota.Monthly = override.Quota.Monthly
+	}
+	return quota
+}
+
+// loadQuotaLocation returns the time zone named by the configuration, UTC when
+// it is unset or unknown
+func loadQuotaLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		logger.Warn("Unknown quota timezone, using UTC", "timezone", name, "error", err)
+		return time.UTC
+	}
+	return loc
+}
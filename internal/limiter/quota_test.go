@@ -0,0 +1,228 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/config"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/rules"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/tokens"
+)
+
+func TestQuotaPeriodBounds(t *testing.T) {
+	load := func(name string) *time.Location {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			t.Fatalf("Failed to load %s: %v", name, err)
+		}
+		return loc
+	}
+	utc := func(value string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", value, err)
+		}
+		return parsed
+	}
+
+	tests := []struct {
+		period     QuotaPeriod
+		loc        *time.Location
+		now        string
+		start, end string
+	}{
+		// Half-hour offset: local hours start at :30 UTC
+		{QuotaHourly, load("Asia/Kolkata"), "2026-10-17T10:45:30Z", "2026-10-17T10:30:00Z", "2026-10-17T11:30:00Z"},
+		// The hour repeated when DST ends is counted once per occurrence
+		{QuotaHourly, load("America/New_York"), "2026-11-01T06:30:00Z", "2026-11-01T06:00:00Z", "2026-11-01T07:00:00Z"},
+		{QuotaDaily, load("America/Sao_Paulo"), "2026-10-18T02:00:00Z", "2026-10-17T03:00:00Z", "2026-10-18T03:00:00Z"},
+		// The day DST ends lasts 25 hours
+		{QuotaDaily, load("America/New_York"), "2026-11-01T12:00:00Z", "2026-11-01T04:00:00Z", "2026-11-02T05:00:00Z"},
+		{QuotaMonthly, time.UTC, "2026-12-31T23:59:59Z", "2026-12-01T00:00:00Z", "2027-01-01T00:00:00Z"},
+		{QuotaMonthly, load("Asia/Tokyo"), "2026-02-28T15:00:00Z", "2026-02-28T15:00:00Z", "2026-03-31T15:00:00Z"},
+	}
+	for _, tt := range tests {
+		start, end := tt.period.Bounds(utc(tt.now), tt.loc)
+		if !start.Equal(utc(tt.start)) || !end.Equal(utc(tt.end)) {
+			t.Errorf("%s in %s at %s: expected %s to %s, got %s to %s", tt.period, tt.loc, tt.now,
+				tt.start, tt.end, start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339))
+		}
+	}
+}
+
+func TestTokenQuotas(t *testing.T) {
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsToken:   100,
+		BlockDurationToken: 60,
+		EnableTokenLimit:   true,
+		UnknownTokenPolicy: config.UnknownTokenDefault,
+		DailyQuotaToken:    3,
+		QuotaTimezone:      "America/Sao_Paulo",
+	}
+	registry := staticRegistry{
+		"premium": {Token: "premium", Quota: tokens.Quota{Hourly: 2}, Enabled: true},
+	}
+	rateLimiter := NewRateLimiter(store, cfg, WithTokenRegistry(registry))
+	ctx := context.Background()
+
+	// Quotas are shared by every route of the token
+	search := &rules.Rule{ID: "search"}
+	for i, route := range []*rules.Rule{nil, search, nil} {
+		decision, err := rateLimiter.Decide(ctx, Request{Token: "basic", Route: route})
+		if err != nil || !decision.Allowed || decision.Quota != "" || decision.Limit != 100 {
+			t.Fatalf("Request %d: expected the rate limit decision, got %+v, %v", i+1, decision, err)
+		}
+	}
+	decision, err := rateLimiter.Decide(ctx, Request{Token: "basic"})
+	if err != nil || decision.Allowed || decision.Quota != QuotaDaily || decision.Limit != 3 || decision.Remaining != 0 {
+		t.Fatalf("Expected the daily quota to deny the 4th request, got %+v, %v", decision, err)
+	}
+	loc, _ := time.LoadLocation("America/Sao_Paulo")
+	_, end := QuotaDaily.Bounds(time.Now(), loc)
+	if retryAfter := time.Until(end); (decision.RetryAfter - retryAfter).Abs() > time.Second {
+		t.Errorf("Expected to retry at the end of the day, in %v, got %v", retryAfter, decision.RetryAfter)
+	}
+	if decision.Blocked || decision.Rule != RuleGlobal {
+		t.Errorf("Expected an unblocked decision of the global rule, got %+v", decision)
+	}
+
+	// Usage is readable through GetData
+	data, err := store.GetData(ctx, QuotaKey(QuotaDaily, "basic"))
+	if err != nil || data == nil || data.Count != 3 {
+		t.Fatalf("Expected 3 requests used, got %+v, %v", data, err)
+	}
+	if data.ExpiresAt.Sub(end).Abs() > time.Second {
+		t.Errorf("Expected the usage to expire at the end of the day %v, got %v", end, data.ExpiresAt)
+	}
+
+	// Registry quotas stack with the inherited global ones
+	for i := 0; i < 2; i++ {
+		if decision, _ := rateLimiter.Decide(ctx, Request{Token: "premium"}); !decision.Allowed {
+			t.Fatalf("Premium request %d should be allowed, got %+v", i+1, decision)
+		}
+	}
+	decision, _ = rateLimiter.Decide(ctx, Request{Token: "premium"})
+	if decision.Allowed || decision.Quota != QuotaHourly || decision.Limit != 2 || decision.Rule != RuleTokenRegistry {
+		t.Errorf("Expected the hourly quota to deny the 3rd premium request, got %+v", decision)
+	}
+	if data, _ := store.GetData(ctx, QuotaKey(QuotaDaily, "premium")); data == nil || data.Count != 2 {
+		t.Errorf("Expected the denied request not to count against the daily quota, got %+v", data)
+	}
+
+	// Throttled requests are not counted against the quotas
+	rateLimiter.Reload(&config.RateLimiterConfig{
+		MaxRequestsToken:   1,
+		BlockDurationToken: 60,
+		EnableTokenLimit:   true,
+		DailyQuotaToken:    3,
+	})
+	for i, allowed := range []bool{true, false} {
+		decision, _ := rateLimiter.Decide(ctx, Request{Token: "bursty"})
+		if decision.Allowed != allowed || decision.Quota != "" {
+			t.Errorf("Request %d: expected the rate limit to decide allowed=%v, got %+v", i+1, allowed, decision)
+		}
+	}
+	if data, _ := store.GetData(ctx, QuotaKey(QuotaDaily, "bursty")); data == nil || data.Count != 1 {
+		t.Errorf("Expected only the allowed request to be counted, got %+v", data)
+	}
+}
+
+func TestQuotaDenialChargesNothing(t *testing.T) {
+	store := newTestStorage(t)
+	rateLimiter := NewRateLimiter(store, &config.RateLimiterConfig{
+		MaxRequestsToken:   100,
+		BlockDurationToken: 60,
+		EnableTokenLimit:   true,
+		HourlyQuotaToken:   10,
+		DailyQuotaToken:    10,
+		MonthlyQuotaToken:  2,
+	})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if decision, _ := rateLimiter.Decide(ctx, Request{Token: "abc"}); !decision.Allowed {
+			t.Fatalf("Request %d should be allowed, got %+v", i+1, decision)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		decision, err := rateLimiter.Decide(ctx, Request{Token: "abc"})
+		if err != nil || decision.Allowed || decision.Quota != QuotaMonthly || decision.Remaining != 0 || decision.RetryAfter <= 0 {
+			t.Fatalf("Retry %d: expected the monthly quota to deny, got %+v, %v", i+1, decision, err)
+		}
+	}
+
+	// Neither the shorter quotas nor the rate limit were charged by the retries
+	for _, key := range []string{QuotaKey(QuotaHourly, "abc"), QuotaKey(QuotaDaily, "abc"), "token:abc"} {
+		if data, _ := store.GetData(ctx, key); data == nil || data.Count != 2 {
+			t.Errorf("Expected %s to count the 2 allowed requests, got %+v", key, data)
+		}
+	}
+}
+
+// slowStorage delays every Consume call, so concurrent requests interleave
+type slowStorage struct {
+	storage.Strategy
+}
+
+func (s slowStorage) Consume(ctx context.Context, key string, limit storage.Limit) (*storage.HitResult, error) {
+	time.Sleep(time.Millisecond)
+	return s.Strategy.Consume(ctx, key, limit)
+}
+
+func TestConcurrentQuotaChargesOnlyAllowedRequests(t *testing.T) {
+	for _, tt := range []struct {
+		name           string
+		maxRequests    int
+		monthly        int
+		expectedAllows int
+	}{
+		{"monthly quota", 100, 5, 5},
+		{"rate limit", 3, 100, 3},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStorage(t)
+			rateLimiter := NewRateLimiter(slowStorage{store}, &config.RateLimiterConfig{
+				MaxRequestsToken:  tt.maxRequests,
+				WindowToken:       60,
+				EnableTokenLimit:  true,
+				HourlyQuotaToken:  50,
+				DailyQuotaToken:   50,
+				MonthlyQuotaToken: tt.monthly,
+			})
+			ctx := context.Background()
+
+			var allowed atomic.Int32
+			var wg sync.WaitGroup
+			for range 40 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					decision, err := rateLimiter.Decide(ctx, Request{Token: "abc"})
+					if err != nil {
+						t.Errorf("Expected no error, got %v", err)
+						return
+					}
+					if decision.Allowed {
+						allowed.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if int(allowed.Load()) != tt.expectedAllows {
+				t.Fatalf("Expected %d allowed requests, got %d", tt.expectedAllows, allowed.Load())
+			}
+			// Denied requests are refunded from every quota they were charged to
+			for _, key := range []string{QuotaKey(QuotaHourly, "abc"), QuotaKey(QuotaDaily, "abc"), QuotaKey(QuotaMonthly, "abc"), "token:abc"} {
+				if data, _ := store.GetData(ctx, key); data == nil || data.Count != tt.expectedAllows {
+					t.Errorf("%s: expected %d charged requests, got %+v", key, tt.expectedAllows, data)
+				}
+			}
+		})
+	}
+}
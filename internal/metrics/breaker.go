@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
+)
+
+var breakerStates = []storage.BreakerState{storage.BreakerClosed, storage.BreakerOpen, storage.BreakerHalfOpen}
+
+// RegisterBreaker exports the state and state transitions of a storage circuit
+// breaker. Pass ObserveBreakerTransition as the breaker's onChange callback.
+func (m *Metrics) RegisterBreaker(breaker *storage.BreakerStrategy) {
+	m.registry.MustRegister(m.breakerTransitions, &breakerStateCollector{
+		breaker: breaker,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "storage_breaker", "state"),
+			"Current state of the storage circuit breaker (1 for the active state).",
+			[]string{"state"}, nil,
+		),
+	})
+}
+
+// ObserveBreakerTransition counts a circuit breaker state transition
+func (m *Metrics) ObserveBreakerTransition(from, to storage.BreakerState) {
+	m.breakerTransitions.WithLabelValues(string(from), string(to)).Inc()
+}
+
+type breakerStateCollector struct {
+	breaker *storage.BreakerStrategy
+	desc    *prometheus.Desc
+}
+
+func (c *breakerStateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *breakerStateCollector) Collect(ch chan<- prometheus.Metric) {
+	current := c.breaker.State()
+	for _, state := range breakerStates {
+		value := 0.0
+		if state == current {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, value, string(state))
+	}
+}
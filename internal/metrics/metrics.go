@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/limiter"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
+)
+
+const namespace = "rate_limiter"
+
+// Decision results recorded by ObserveDecision
+const (
+	ResultAllowed       = "allowed"
+	ResultDenied        = "denied"
+	ResultQuotaExceeded = "quota_exceeded" // Denied by an hourly, daily or monthly token quota
+	ResultRejected      = "rejected"       // Token rejected by the token registry, or IP in the deny list
+	ResultError         = "error"
+
+	// Dry-run decisions, which are never enforced
+	ResultShadowAllowed = "shadow_allowed"
+	ResultShadowDenied  = "shadow_denied"
+)
+
+// labelNone replaces empty key kind and rule labels, e.g. when no limit applied
+const labelNone = "none"
+
+// Metrics holds the Prometheus collectors of the rate limiter in a registry of its own
+type Metrics struct {
+	registry        *prometheus.Registry
+	decisions       *prometheus.CounterVec
+	storageDuration *prometheus.HistogramVec
+
+	breakerTransitions *prometheus.CounterVec
+}
+
+// New creates the rate limiter metrics along with the Go runtime and process collectors
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		decisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "decisions_total",
+			Help:      "Rate limit decisions by result, key kind and rule.",
+		}, []string{"result", "key_kind", "rule"}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "storage_duration_seconds",
+			Help:      "Latency of storage calls by method and result.",
+			Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"method", "result"}),
+		breakerTransitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "storage_breaker_transitions_total",
+			Help:      "State transitions of the storage circuit breaker.",
+		}, []string{"from", "to"}),
+	}
+	m.registry.MustRegister(
+		m.decisions,
+		m.storageDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Registry returns the registry holding every collector
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// Handler serves the metrics in the Prometheus exposition format. A failing
+// collector only drops its own metrics from the scrape.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{
+		ErrorHandling: promhttp.ContinueOnError,
+	})
+}
+
+// ObserveDecision counts a decision returned by limiter.Decide
+func (m *Metrics) ObserveDecision(decision *limiter.Decision, err error) {
+	kind, rule := labelNone, labelNone
+	if decision != nil {
+		if decision.KeyKind != "" {
+			kind = string(decision.KeyKind)
+		}
+		if decision.Rule != "" {
+			rule = decision.Rule
+		}
+	}
+
+	var result string
+	switch {
+	case errors.Is(err, limiter.ErrTokenRejected), errors.Is(err, limiter.ErrIPDenied):
+		result = ResultRejected
+	case err != nil:
+		result = ResultError
+	case decision.Shadow && decision.Allowed:
+		result = ResultShadowAllowed
+	case decision.Shadow:
+		result = ResultShadowDenied
+	case decision.Allowed:
+		result = ResultAllowed
+	case decision.Quota != "":
+		result = ResultQuotaExceeded
+	default:
+		result = ResultDenied
+	}
+	m.decisions.WithLabelValues(result, kind, rule).Inc()
+}
+
+// RegisterBlockedKeys exports the number of keys currently blocked in counter.
+// Counting may scan the whole storage, so the count is reused by the scrapes
+// of the following interval.
+func (m *Metrics) RegisterBlockedKeys(counter storage.BlockedCounter, interval time.Duration) {
+	m.registry.MustRegister(&blockedKeysCollector{
+		counter:  counter,
+		interval: interval,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "blocked_keys"),
+			"Keys currently blocked.",
+			nil, nil,
+		),
+	})
+}
+
+type blockedKeysCollector struct {
+	counter  storage.BlockedCounter
+	interval time.Duration
+	desc     *prometheus.Desc
+
+	mu        sync.Mutex
+	blocked   int
+	countedAt time.Time
+}
+
+func (c *blockedKeysCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect counts the blocked keys once per interval; concurrent scrapes wait
+// for the same count instead of scanning the storage again
+func (c *blockedKeysCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.countedAt.IsZero() || time.Since(c.countedAt) >= c.interval {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		blocked, err := c.counter.CountBlocked(ctx)
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(c.desc, err)
+			return
+		}
+		c.blocked, c.countedAt = blocked, time.Now()
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(c.blocked))
+}
@@ -0,0 +1,192 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/limiter"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
+)
+
+func TestObserveDecision(t *testing.T) {
+	m := New()
+
+	m.ObserveDecision(&limiter.Decision{Allowed: true, KeyKind: limiter.KeyKindIP, Rule: limiter.RuleGlobal}, nil)
+	m.ObserveDecision(&limiter.Decision{Allowed: true, KeyKind: limiter.KeyKindIP, Rule: limiter.RuleGlobal}, nil)
+	m.ObserveDecision(&limiter.Decision{KeyKind: limiter.KeyKindToken, Rule: "route:search"}, nil)
+	m.ObserveDecision(&limiter.Decision{Allowed: true}, nil)
+	m.ObserveDecision(&limiter.Decision{Allowed: true, Shadow: true, KeyKind: limiter.KeyKindIP, Rule: "route:search"}, nil)
+	m.ObserveDecision(&limiter.Decision{Shadow: true, KeyKind: limiter.KeyKindIP, Rule: "route:search"}, nil)
+	m.ObserveDecision(&limiter.Decision{Quota: limiter.QuotaDaily, KeyKind: limiter.KeyKindToken, Rule: limiter.RuleTokenRegistry}, nil)
+	m.ObserveDecision(nil, limiter.ErrTokenRejected)
+	m.ObserveDecision(nil, errors.New("connection refused"))
+
+	tests := []struct {
+		labels   []string
+		expected float64
+	}{
+		{[]string{ResultAllowed, "ip", "global"}, 2},
+		{[]string{ResultDenied, "token", "route:search"}, 1},
+		{[]string{ResultAllowed, "none", "none"}, 1},
+		{[]string{ResultShadowAllowed, "ip", "route:search"}, 1},
+		{[]string{ResultShadowDenied, "ip", "route:search"}, 1},
+		{[]string{ResultQuotaExceeded, "token", "token_registry"}, 1},
+		{[]string{ResultRejected, "none", "none"}, 1},
+		{[]string{ResultError, "none", "none"}, 1},
+	}
+	for _, tt := range tests {
+		if got := testutil.ToFloat64(m.decisions.WithLabelValues(tt.labels...)); got != tt.expected {
+			t.Errorf("decisions%v: expected %v, got %v", tt.labels, tt.expected, got)
+		}
+	}
+}
+
+func TestInstrumentStorageRecordsLatency(t *testing.T) {
+	m := New()
+	store := storage.NewMemoryStrategy(0, 0)
+	defer store.Close()
+	st := m.InstrumentStorage(store)
+	ctx := context.Background()
+
+	limit := storage.Limit{Algorithm: storage.AlgorithmFixedWindow, Max: 1, Window: time.Second}
+	for i := 0; i < 3; i++ {
+		if _, err := st.Consume(ctx, "ip:1", limit); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	if _, err := st.Consume(ctx, "ip:1", storage.Limit{}); err == nil {
+		t.Fatal("Expected invalid limit to fail")
+	}
+	st.GetData(ctx, "ip:1")
+
+	if count := testutil.CollectAndCount(m.storageDuration); count != 3 {
+		t.Errorf("Expected 3 series (Consume ok, Consume error, GetData ok), got %d", count)
+	}
+	if got := sampleCount(t, m, "Consume", "ok"); got != 3 {
+		t.Errorf("Expected 3 successful Consume observations, got %d", got)
+	}
+}
+
+func TestBlockedKeysGauge(t *testing.T) {
+	m := New()
+	store := storage.NewMemoryStrategy(0, 0)
+	defer store.Close()
+	m.RegisterBlockedKeys(store, time.Minute)
+	ctx := context.Background()
+
+	store.Block(ctx, "ip:1", 60)
+	store.Block(ctx, "ip:2", 60)
+	store.Consume(ctx, "ip:3", storage.Limit{Algorithm: storage.AlgorithmFixedWindow, Max: 5, Window: time.Second})
+
+	expected := `
+		# HELP rate_limiter_blocked_keys Keys currently blocked.
+		# TYPE rate_limiter_blocked_keys gauge
+		rate_limiter_blocked_keys 2
+	`
+	if err := testutil.GatherAndCompare(m.Registry(), strings.NewReader(expected), "rate_limiter_blocked_keys"); err != nil {
+		t.Error(err)
+	}
+
+	// Scrapes within the interval reuse the previous count
+	store.Block(ctx, "ip:4", 60)
+	if err := testutil.GatherAndCompare(m.Registry(), strings.NewReader(expected), "rate_limiter_blocked_keys"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRedisCollectors(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store, err := storage.NewRedisStrategy(mr.Addr(), 0, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer store.Close()
+
+	m := New()
+	m.RegisterBlockedKeys(store, 0)
+	m.RegisterRedisPool(store.Client())
+
+	store.Block(context.Background(), "token:abc", 60)
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+
+	for _, line := range []string{
+		"rate_limiter_blocked_keys 1",
+		"rate_limiter_redis_pool_connections ",
+		"rate_limiter_redis_pool_hits_total ",
+		"go_goroutines ",
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("Expected metrics to contain %q", line)
+		}
+	}
+}
+
+func sampleCount(t *testing.T, m *Metrics, method, result string) uint64 {
+	t.Helper()
+
+	families, err := m.Registry().Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "rate_limiter_storage_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["method"] == method && labels["result"] == result {
+				return metric.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return 0
+}
+
+// unavailableStorage fails every Consume call, like an unreachable Redis
+type unavailableStorage struct {
+	storage.Strategy
+}
+
+func (unavailableStorage) Consume(ctx context.Context, key string, limit storage.Limit) (*storage.HitResult, error) {
+	return nil, errors.New("dial tcp: connection refused")
+}
+
+func TestBreakerMetrics(t *testing.T) {
+	m := New()
+	store := storage.NewMemoryStrategy(0, 0)
+	defer store.Close()
+	breaker := storage.NewBreakerStrategy(unavailableStorage{store}, 1, time.Minute, m.ObserveBreakerTransition)
+	m.RegisterBreaker(breaker)
+
+	// A storage error opens the breaker
+	breaker.Consume(context.Background(), "ip:1", storage.Limit{Algorithm: storage.AlgorithmFixedWindow, Max: 1, Window: time.Second})
+
+	expected := `
+		# HELP rate_limiter_storage_breaker_state Current state of the storage circuit breaker (1 for the active state).
+		# TYPE rate_limiter_storage_breaker_state gauge
+		rate_limiter_storage_breaker_state{state="closed"} 0
+		rate_limiter_storage_breaker_state{state="half_open"} 0
+		rate_limiter_storage_breaker_state{state="open"} 1
+		# HELP rate_limiter_storage_breaker_transitions_total State transitions of the storage circuit breaker.
+		# TYPE rate_limiter_storage_breaker_transitions_total counter
+		rate_limiter_storage_breaker_transitions_total{from="closed",to="open"} 1
+	`
+	if err := testutil.GatherAndCompare(m.Registry(), strings.NewReader(expected),
+		"rate_limiter_storage_breaker_state", "rate_limiter_storage_breaker_transitions_total"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
+)
+
+// InstrumentStorage wraps st so the latency of every call is recorded
+func (m *Metrics) InstrumentStorage(st storage.Strategy) storage.Strategy {
+	return &instrumentedStrategy{next: st, metrics: m}
+}
+
+type instrumentedStrategy struct {
+	next    storage.Strategy
+	metrics *Metrics
+}
+
+// observe records the duration of a storage call started at start
+func (s *instrumentedStrategy) observe(method string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	s.metrics.storageDuration.WithLabelValues(method, result).Observe(time.Since(start).Seconds())
+}
+
+func (s *instrumentedStrategy) CheckAndIncrement(ctx context.Context, key string, maxRequests int, windowSeconds int) (bool, error) {
+	start := time.Now()
+	allowed, err := s.next.CheckAndIncrement(ctx, key, maxRequests, windowSeconds)
+	s.observe("CheckAndIncrement", start, err)
+	return allowed, err
+}
+
+func (s *instrumentedStrategy) Consume(ctx context.Context, key string, limit storage.Limit) (*storage.HitResult, error) {
+	start := time.Now()
+	result, err := s.next.Consume(ctx, key, limit)
+	s.observe("Consume", start, err)
+	return result, err
+}
+
+func (s *instrumentedStrategy) IsBlocked(ctx context.Context, key string) (bool, error) {
+	start := time.Now()
+	blocked, err := s.next.IsBlocked(ctx, key)
+	s.observe("IsBlocked", start, err)
+	return blocked, err
+}
+
+func (s *instrumentedStrategy) Block(ctx context.Context, key string, durationSeconds int) error {
+	start := time.Now()
+	err := s.next.Block(ctx, key, durationSeconds)
+	s.observe("Block", start, err)
+	return err
+}
+
+func (s *instrumentedStrategy) Reset(ctx context.Context, key string) error {
+	start := time.Now()
+	err := s.next.Reset(ctx, key)
+	s.observe("Reset", start, err)
+	return err
+}
+
+func (s *instrumentedStrategy) Refund(ctx context.Context, key string, cost int) error {
+	start := time.Now()
+	err := s.next.Refund(ctx, key, cost)
+	s.observe("Refund", start, err)
+	return err
+}
+
+func (s *instrumentedStrategy) GetData(ctx context.Context, key string) (*storage.LimiterData, error) {
+	start := time.Now()
+	data, err := s.next.GetData(ctx, key)
+	s.observe("GetData", start, err)
+	return data, err
+}
+
+func (s *instrumentedStrategy) Close() error {
+	return s.next.Close()
+}
@@ -0,0 +1,182 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/config"
+)
+
+// IPResolver finds the client address of a request. Forwarding headers are
+// only honoured when the request comes from a trusted proxy, and the hop chain
+// is walked right to left so clients cannot inject their own address.
+type IPResolver struct {
+	mode           string
+	trustedProxies []netip.Prefix
+}
+
+// NewIPResolver creates a resolver reading the header selected by mode
+// (config.ClientIPRemoteAddr ignores every header) from the given trusted
+// proxies, expressed as IPs or CIDRs
+func NewIPResolver(mode string, trustedProxies []string) (*IPResolver, error) {
+	switch mode {
+	case "":
+		mode = config.ClientIPRemoteAddr
+	case config.ClientIPRemoteAddr, config.ClientIPXForwardedFor, config.ClientIPForwarded, config.ClientIPXRealIP:
+	default:
+		return nil, fmt.Errorf("unknown client IP mode %q", mode)
+	}
+
+	prefixes := make([]netip.Prefix, 0, len(trustedProxies))
+	for _, proxy := range trustedProxies {
+		prefix, err := parsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	return &IPResolver{mode: mode, trustedProxies: prefixes}, nil
+}
+
+// ClientIP returns the address of the client that originated r
+func (res *IPResolver) ClientIP(r *http.Request) string {
+	remote := remoteIP(r)
+	if res.mode == config.ClientIPRemoteAddr || !res.trusted(remote) {
+		return remote
+	}
+
+	var hops []string
+	switch res.mode {
+	case config.ClientIPXForwardedFor:
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+	case config.ClientIPForwarded:
+		hops = forwardedFor(r.Header.Values("Forwarded"))
+	case config.ClientIPXRealIP:
+		hops = r.Header.Values("X-Real-IP")
+	}
+
+	// Walk from the hop closest to us; the first untrusted address is the
+	// client, anything to its left may have been forged by it
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := parseHop(hops[i])
+		if err != nil {
+			// A malformed hop means the chain cannot be trusted past this point
+			return client
+		}
+		client = addr.String()
+		if !res.trusted(client) {
+			return client
+		}
+	}
+	return client
+}
+
+// TrustsForwarding reports whether the forwarding headers of r are honoured:
+// the mode reads them and r comes from a trusted proxy
+func (res *IPResolver) TrustsForwarding(r *http.Request) bool {
+	return res.mode != config.ClientIPRemoteAddr && res.trusted(remoteIP(r))
+}
+
+func (res *IPResolver) trusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range res.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+func parsePrefix(value string) (netip.Prefix, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(prefix.Addr().Unmap(), unmappedBits(prefix)).Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// unmappedBits converts the length of an IPv4-mapped IPv6 prefix to IPv4
+func unmappedBits(prefix netip.Prefix) int {
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		return prefix.Bits() - 96
+	}
+	return prefix.Bits()
+}
+
+// parseHop parses a forwarding hop, accepting an optional port and IPv6 brackets
+func parseHop(hop string) (netip.Addr, error) {
+	hop = strings.TrimSpace(hop)
+	if addrPort, err := netip.ParseAddrPort(hop); err == nil {
+		return addrPort.Addr().Unmap(), nil
+	}
+	hop = strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")
+	addr, err := netip.ParseAddr(hop)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
+}
+
+// forwardedFor extracts the for= parameter of every RFC 7239 Forwarded element
+// in order. Elements without a for= parameter yield an empty, invalid hop.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			hop := ""
+			for _, pair := range splitQuoted(element, ';') {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hop = strings.Trim(val, `"`)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// splitQuoted splits s on sep, ignoring separators inside quoted strings
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
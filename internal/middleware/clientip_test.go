@@ -0,0 +1,241 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/config"
+)
+
+func TestIPResolverClientIP(t *testing.T) {
+	trusted := []string{"10.0.0.0/8", "192.168.1.10", "2001:db8:ffff::/48"}
+
+	tests := []struct {
+		name       string
+		mode       string
+		trusted    []string
+		remoteAddr string
+		headers    map[string][]string
+		expected   string
+	}{
+		{
+			name:       "remote addr mode ignores spoofed X-Forwarded-For",
+			mode:       config.ClientIPRemoteAddr,
+			trusted:    trusted,
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.1.1.1"}},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "remote addr mode ignores spoofed X-Real-IP",
+			mode:       config.ClientIPRemoteAddr,
+			remoteAddr: "203.0.113.7:1234",
+			headers:    map[string][]string{"X-Real-IP": {"1.1.1.1"}},
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "untrusted peer cannot set X-Forwarded-For",
+			mode:       config.ClientIPXForwardedFor,
+			trusted:    trusted,
+			remoteAddr: "203.0.113.7:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.1.1.1"}},
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "no trusted proxies ignores headers",
+			mode:       config.ClientIPXForwardedFor,
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.1.1.1"}},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "trusted proxy hop is used",
+			mode:       config.ClientIPXForwardedFor,
+			trusted:    trusted,
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.4"}},
+			expected:   "198.51.100.4",
+		},
+		{
+			name:       "client prepended hops are ignored",
+			mode:       config.ClientIPXForwardedFor,
+			trusted:    trusted,
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.1.1.1, 2.2.2.2, 198.51.100.4"}},
+			expected:   "198.51.100.4",
+		},
+		{
+			name:       "chain of trusted proxies is skipped",
+			mode:       config.ClientIPXForwardedFor,
+			trusted:    trusted,
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.1.1.1, 198.51.100.4, 192.168.1.10, 10.1.2.3"}},
+			expected:   "198.51.100.4",
+		},
+		{
+			name:       "multiple X-Forwarded-For lines are joined in order",
+			mode:       config.ClientIPXForwardedFor,
+			trusted:    trusted,
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.1.1.1", "198.51.100.4, 10.1.2.3"}},
+			expected:   "198.51.100.4",
+		},
+		{
+			name:       "all hops trusted returns the leftmost",
+			mode:       config.ClientIPXForwardedFor,
+			trusted:    trusted,
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"10.9.9.9, 10.1.2.3"}},
+			expected:   "10.9.9.9",
+		},
+		{
+			name:       "malformed hop stops at the last trusted address",
+			mode:       config.ClientIPXForwardedFor,
+			trusted:    trusted,
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.4, not-an-ip, 10.1.2.3"}},
+			expected:   "10.1.2.3",
+		},
+		{
+			name:       "missing header falls back to remote addr",
+			mode:       config.ClientIPXForwardedFor,
+			trusted:    trusted,
+			remoteAddr: "10.0.0.1:1234",
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "X-Forwarded-For mode ignores Forwarded",
+			mode:       config.ClientIPXForwardedFor,
+			trusted:    trusted,
+			remoteAddr: "10.0.0.1:1234",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"198.51.100.4"},
+				"Forwarded":       {"for=1.1.1.1"},
+			},
+			expected: "198.51.100.4",
+		},
+		{
+			name:       "Forwarded for parameter is used",
+			mode:       config.ClientIPForwarded,
+			trusted:    trusted,
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"Forwarded": {"for=1.1.1.1, for=198.51.100.4;proto=https;by=10.0.0.1"}},
+			expected:   "198.51.100.4",
+		},
+		{
+			name:       "Forwarded quoted IPv6 with port",
+			mode:       config.ClientIPForwarded,
+			trusted:    trusted,
+			remoteAddr: "[2001:db8:ffff::1]:1234",
+			headers:    map[string][]string{"Forwarded": {`For="[2001:db8:cafe::17]:4711"`}},
+			expected:   "2001:db8:cafe::17",
+		},
+		{
+			name:       "Forwarded IPv4 with port",
+			mode:       config.ClientIPForwarded,
+			trusted:    trusted,
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"Forwarded": {`for="198.51.100.4:8080"`}},
+			expected:   "198.51.100.4",
+		},
+		{
+			name:       "Forwarded obfuscated hop stops the walk",
+			mode:       config.ClientIPForwarded,
+			trusted:    trusted,
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"Forwarded": {"for=198.51.100.4, for=unknown"}},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "Forwarded quoted separators do not split elements",
+			mode:       config.ClientIPForwarded,
+			trusted:    trusted,
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"Forwarded": {`for=198.51.100.4;ext="a,for=1.1.1.1"`}},
+			expected:   "198.51.100.4",
+		},
+		{
+			name:       "untrusted peer cannot set Forwarded",
+			mode:       config.ClientIPForwarded,
+			trusted:    trusted,
+			remoteAddr: "203.0.113.7:1234",
+			headers:    map[string][]string{"Forwarded": {"for=1.1.1.1"}},
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "X-Real-IP from trusted proxy",
+			mode:       config.ClientIPXRealIP,
+			trusted:    trusted,
+			remoteAddr: "192.168.1.10:1234",
+			headers:    map[string][]string{"X-Real-IP": {"198.51.100.4"}},
+			expected:   "198.51.100.4",
+		},
+		{
+			name:       "X-Real-IP from untrusted peer is ignored",
+			mode:       config.ClientIPXRealIP,
+			trusted:    trusted,
+			remoteAddr: "192.168.1.11:1234",
+			headers:    map[string][]string{"X-Real-IP": {"198.51.100.4"}},
+			expected:   "192.168.1.11",
+		},
+		{
+			name:       "IPv4-mapped remote addr matches IPv4 trusted proxy",
+			mode:       config.ClientIPXForwardedFor,
+			trusted:    trusted,
+			remoteAddr: "[::ffff:10.0.0.1]:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.4"}},
+			expected:   "198.51.100.4",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver, err := NewIPResolver(tt.mode, tt.trusted)
+			if err != nil {
+				t.Fatalf("Failed to create resolver: %v", err)
+			}
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for name, values := range tt.headers {
+				for _, value := range values {
+					req.Header.Add(name, value)
+				}
+			}
+
+			if ip := resolver.ClientIP(req); ip != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, ip)
+			}
+		})
+	}
+}
+
+func TestIPResolverTrustsForwarding(t *testing.T) {
+	tests := []struct {
+		mode       string
+		remoteAddr string
+		expected   bool
+	}{
+		{config.ClientIPXForwardedFor, "10.0.0.1:1234", true},
+		{config.ClientIPXForwardedFor, "[::ffff:10.0.0.1]:1234", true},
+		{config.ClientIPXForwardedFor, "203.0.113.7:1234", false},
+		{config.ClientIPRemoteAddr, "10.0.0.1:1234", false},
+	}
+	for _, tt := range tests {
+		res, _ := NewIPResolver(tt.mode, []string{"10.0.0.0/8"})
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if got := res.TrustsForwarding(req); got != tt.expected {
+			t.Errorf("%s from %s: expected %v, got %v", tt.mode, tt.remoteAddr, tt.expected, got)
+		}
+	}
+}
+
+func TestNewIPResolverRejectsInvalidConfig(t *testing.T) {
+	if _, err := NewIPResolver("true-client-ip", nil); err == nil {
+		t.Error("Expected error for unknown mode")
+	}
+	if _, err := NewIPResolver(config.ClientIPXForwardedFor, []string{"10.0.0.0/33"}); err == nil {
+		t.Error("Expected error for invalid trusted proxy")
+	}
+}
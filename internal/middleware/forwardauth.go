@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/config"
+)
+
+// CheckHandler answers forward-auth subrequests, such as nginx auth_request and
+// Traefik ForwardAuth, with the decision for the original request: 200 when it
+// is allowed, 429 with Retry-After when it is not, along with the rate limit
+// headers. The original method, URI and host are read from the headers family
+// (config.ForwardAuthOriginal or config.ForwardAuthForwarded) and the client IP
+// as configured on the IP resolver. Both are only read from trusted proxies:
+// other subrequests are decided as they were received.
+func (m *RateLimiterMiddleware) CheckHandler(headers string) http.Handler {
+	allow := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.ipResolver.TrustsForwarding(r) {
+			r = originalRequest(r, headers)
+		}
+		allow.ServeHTTP(w, r)
+	})
+}
+
+// Headers describing the original request, by family
+var originalHeaders = map[string]struct{ method, uri, host string }{
+	config.ForwardAuthOriginal:  {"X-Original-Method", "X-Original-URI", "X-Original-Host"},
+	config.ForwardAuthForwarded: {"X-Forwarded-Method", "X-Forwarded-Uri", "X-Forwarded-Host"},
+}
+
+// originalRequest rebuilds the request a forward-auth subrequest was made for
+// from the headers family. Values missing from the headers are kept from r.
+func originalRequest(r *http.Request, headers string) *http.Request {
+	original := r.Clone(r.Context())
+	names := originalHeaders[headers]
+
+	if method := r.Header.Get(names.method); method != "" {
+		original.Method = method
+	}
+	if host := r.Header.Get(names.host); host != "" {
+		original.Host = host
+	}
+
+	// ingress-nginx sends the full URL, nginx configurations usually the URI
+	if headers == config.ForwardAuthOriginal {
+		if rawURL := r.Header.Get("X-Original-URL"); rawURL != "" {
+			if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+				original.Host = u.Host
+				original.URL = &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery}
+				original.RequestURI = original.URL.RequestURI()
+			}
+		}
+	}
+	if uri := r.Header.Get(names.uri); uri != "" {
+		if u, err := url.ParseRequestURI(uri); err == nil {
+			original.URL = u
+			original.RequestURI = uri
+		}
+	}
+	return original
+}
@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/config"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/limiter"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/rules"
+)
+
+func TestCheckHandler(t *testing.T) {
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsIP:      5,
+		BlockDurationIP:    60,
+		EnableIPLimit:      true,
+		MaxRequestsToken:   1,
+		BlockDurationToken: 30,
+		EnableTokenLimit:   true,
+	}
+	set, err := rules.NewSet([]rules.Rule{
+		{ID: "health", PathPrefix: "/health", Exempt: true},
+		{ID: "search", PathPrefix: "/search", Methods: []string{"GET"}, Hosts: []string{"api.example.com"}, IP: rules.Limit{MaxRequests: 1}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create rules: %v", err)
+	}
+	resolver, err := NewIPResolver(config.ClientIPXForwardedFor, []string{"10.0.0.1"})
+	if err != nil {
+		t.Fatalf("Failed to create resolver: %v", err)
+	}
+	m := NewRateLimiterMiddleware(limiter.NewRateLimiter(store, cfg, limiter.WithRules(set)), WithIPResolver(resolver))
+
+	check := func(handler http.Handler, remoteAddr string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/check", nil)
+		req.RemoteAddr = remoteAddr
+		req.Host = "limiter:8080"
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	nginxHandler := m.CheckHandler(config.ForwardAuthOriginal)
+
+	// nginx auth_request, passing through a client's spoofed X-Forwarded-Uri
+	nginx := map[string]string{
+		"X-Original-Method": "GET",
+		"X-Original-URI":    "/search?q=go",
+		"X-Original-Host":   "api.example.com",
+		"X-Forwarded-Uri":   "/health",
+		"X-Forwarded-For":   "203.0.113.7",
+	}
+	if w := check(nginxHandler, "10.0.0.1:40000", nginx); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "1" {
+		t.Errorf("Expected 200 with the search limit, got %d and %q", w.Code, w.Header().Get("RateLimit-Limit"))
+	}
+	w := check(nginxHandler, "10.0.0.1:40000", nginx)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("Expected 429 with Retry-After 60, got %d and %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if data, _ := store.GetData(t.Context(), "route:search:ip:203.0.113.7"); data == nil {
+		t.Error("Expected the original client IP to be counted under the route rule")
+	}
+
+	// Traefik ForwardAuth, with the API key of the original request
+	traefik := map[string]string{
+		"X-Forwarded-Method": "POST",
+		"X-Forwarded-Host":   "api.example.com",
+		"X-Forwarded-Uri":    "/search",
+		"X-Forwarded-For":    "203.0.113.7",
+		"API_KEY":            "abc",
+	}
+	traefikHandler := m.CheckHandler(config.ForwardAuthForwarded)
+	if w := check(traefikHandler, "10.0.0.1:40000", traefik); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "1" {
+		t.Errorf("Expected 200 with the global token limit, got %d and %q", w.Code, w.Header().Get("RateLimit-Limit"))
+	}
+	if w := check(traefikHandler, "10.0.0.1:40000", traefik); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "30" {
+		t.Errorf("Expected 429 with Retry-After 30, got %d and %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// A client calling the endpoint directly cannot pick the exempt rule
+	direct := map[string]string{"X-Original-URI": "/health", "X-Forwarded-For": "10.0.0.1"}
+	if w := check(nginxHandler, "198.51.100.1:40000", direct); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "5" {
+		t.Errorf("Expected 200 with the global IP limit, got %d and %q", w.Code, w.Header().Get("RateLimit-Limit"))
+	}
+}
+
+func TestOriginalRequest(t *testing.T) {
+	tests := []struct {
+		family                       string
+		headers                      map[string]string
+		method, host, path, rawQuery string
+	}{
+		{config.ForwardAuthOriginal, map[string]string{}, "GET", "limiter", "/check", ""},
+		{config.ForwardAuthOriginal, map[string]string{"X-Original-Method": "DELETE", "X-Original-URI": "/users/1?force=true"}, "DELETE", "limiter", "/users/1", "force=true"},
+		{config.ForwardAuthOriginal, map[string]string{"X-Original-URL": "https://api.example.com/orders?page=2"}, "GET", "api.example.com", "/orders", "page=2"},
+		{config.ForwardAuthOriginal, map[string]string{"X-Forwarded-Method": "PUT", "X-Forwarded-Host": "app.example.com", "X-Forwarded-Uri": "/items/7"}, "GET", "limiter", "/check", ""},
+		{config.ForwardAuthForwarded, map[string]string{"X-Forwarded-Method": "PUT", "X-Forwarded-Host": "app.example.com", "X-Forwarded-Uri": "/items/7"}, "PUT", "app.example.com", "/items/7", ""},
+		{config.ForwardAuthForwarded, map[string]string{"X-Original-URI": "/health", "X-Original-URL": "https://api.example.com/health"}, "GET", "limiter", "/check", ""},
+		{config.ForwardAuthForwarded, map[string]string{"X-Forwarded-Uri": "not a uri"}, "GET", "limiter", "/check", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/check", nil)
+		req.Host = "limiter"
+		for name, value := range tt.headers {
+			req.Header.Set(name, value)
+		}
+
+		original := originalRequest(req, tt.family)
+		if original.Method != tt.method || original.Host != tt.host || original.URL.Path != tt.path || original.URL.RawQuery != tt.rawQuery {
+			t.Errorf("%s %v: expected %s %s%s?%s, got %s %s%s?%s", tt.family, tt.headers, tt.method, tt.host, tt.path, tt.rawQuery,
+				original.Method, original.Host, original.URL.Path, original.URL.RawQuery)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/config"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/limiter"
+)
+
+// setRateLimitHeaders describes the matched limit of decision in the selected header dialect.
+// Nothing is written when no limit applied to the request.
+func setRateLimitHeaders(h http.Header, mode string, decision *limiter.Decision) {
+	if decision == nil || decision.Limit == 0 || mode == config.HeadersNone {
+		return
+	}
+
+	limit := strconv.Itoa(decision.Limit)
+	remaining := strconv.Itoa(max(decision.Remaining, 0))
+	resetSeconds := int64(math.Ceil(max(time.Until(decision.Reset), 0).Seconds()))
+
+	if mode == config.HeadersIETF || mode == config.HeadersBoth || mode == "" {
+		// draft-ietf-httpapi-ratelimit-headers: reset is a delay in seconds and the
+		// policy advertises the quota and its window
+		h.Set("RateLimit-Limit", limit)
+		h.Set("RateLimit-Remaining", remaining)
+		h.Set("RateLimit-Reset", strconv.FormatInt(resetSeconds, 10))
+		h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", decision.Limit, windowSeconds(decision.Window)))
+	}
+	if mode == config.HeadersLegacy || mode == config.HeadersBoth {
+		// Legacy headers report the reset as a Unix timestamp
+		h.Set("X-RateLimit-Limit", limit)
+		h.Set("X-RateLimit-Remaining", remaining)
+		h.Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Unix()+resetSeconds, 10))
+	}
+}
+
+func windowSeconds(window time.Duration) int64 {
+	return max(int64(math.Ceil(window.Seconds())), 1)
+}
@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/config"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/limiter"
+)
+
+func serveWithHeaderMode(t *testing.T, mode string, requests int) []*httptest.ResponseRecorder {
+	t.Helper()
+
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsIP:   2,
+		BlockDurationIP: 30,
+		EnableIPLimit:   true,
+	}
+
+	m := NewRateLimiterMiddleware(limiter.NewRateLimiter(store, cfg), WithHeaderMode(mode))
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	var responses []*httptest.ResponseRecorder
+	for i := 0; i < requests; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		responses = append(responses, w)
+	}
+	return responses
+}
+
+func TestIETFRateLimitHeaders(t *testing.T) {
+	responses := serveWithHeaderMode(t, config.HeadersIETF, 3)
+
+	expected := []struct {
+		status    int
+		remaining string
+		reset     string
+	}{
+		{http.StatusOK, "1", "1"},
+		{http.StatusOK, "0", "1"},
+		{http.StatusTooManyRequests, "0", "30"},
+	}
+	for i, w := range responses {
+		h := w.Header()
+		if w.Code != expected[i].status {
+			t.Errorf("Request %d: expected status %d, got %d", i+1, expected[i].status, w.Code)
+		}
+		if h.Get("RateLimit-Limit") != "2" || h.Get("RateLimit-Policy") != "2;w=1" {
+			t.Errorf("Request %d: unexpected limit headers %v", i+1, h)
+		}
+		if h.Get("RateLimit-Remaining") != expected[i].remaining {
+			t.Errorf("Request %d: expected remaining %s, got %s", i+1, expected[i].remaining, h.Get("RateLimit-Remaining"))
+		}
+		if h.Get("RateLimit-Reset") != expected[i].reset {
+			t.Errorf("Request %d: expected reset %s, got %s", i+1, expected[i].reset, h.Get("RateLimit-Reset"))
+		}
+		if h.Get("X-RateLimit-Limit") != "" {
+			t.Errorf("Request %d: legacy headers should not be sent", i+1)
+		}
+	}
+	if responses[2].Header().Get("Retry-After") != "30" {
+		t.Errorf("Expected Retry-After 30, got %s", responses[2].Header().Get("Retry-After"))
+	}
+}
+
+func TestLegacyRateLimitHeaders(t *testing.T) {
+	w := serveWithHeaderMode(t, config.HeadersLegacy, 1)[0]
+	h := w.Header()
+
+	if h.Get("X-RateLimit-Limit") != "2" || h.Get("X-RateLimit-Remaining") != "1" {
+		t.Errorf("Unexpected legacy headers %v", h)
+	}
+	reset, err := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil || reset < time.Now().Unix() || reset > time.Now().Add(2*time.Second).Unix() {
+		t.Errorf("Expected X-RateLimit-Reset as a Unix timestamp, got %q", h.Get("X-RateLimit-Reset"))
+	}
+	if h.Get("RateLimit-Limit") != "" {
+		t.Error("IETF headers should not be sent")
+	}
+}
+
+func TestBothAndNoRateLimitHeaders(t *testing.T) {
+	h := serveWithHeaderMode(t, config.HeadersBoth, 1)[0].Header()
+	if h.Get("RateLimit-Limit") != "2" || h.Get("X-RateLimit-Limit") != "2" {
+		t.Errorf("Expected both header dialects, got %v", h)
+	}
+
+	h = serveWithHeaderMode(t, config.HeadersNone, 1)[0].Header()
+	if h.Get("RateLimit-Limit") != "" || h.Get("X-RateLimit-Limit") != "" {
+		t.Errorf("Expected no rate limit headers, got %v", h)
+	}
+}
@@ -0,0 +1,263 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/config"
+)
+
+// KeyExtractor returns the key a request is rate limited by, or "" when the
+// request carries none and only the IP limit applies. Keys are counted and
+// looked up in the token registry like API tokens.
+type KeyExtractor interface {
+	Extract(r *http.Request) string
+}
+
+// KeyExtractorFunc adapts a function to the KeyExtractor interface
+type KeyExtractorFunc func(r *http.Request) string
+
+func (f KeyExtractorFunc) Extract(r *http.Request) string {
+	return f(r)
+}
+
+// HeaderExtractor reads the key from a request header
+func HeaderExtractor(name string) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) string {
+		return r.Header.Get(name)
+	})
+}
+
+// BearerExtractor reads the key from an "Authorization: Bearer" header
+func BearerExtractor() KeyExtractor {
+	return KeyExtractorFunc(bearerToken)
+}
+
+// QueryExtractor reads the key from a query string parameter
+func QueryExtractor(name string) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) string {
+		return r.URL.Query().Get(name)
+	})
+}
+
+// CookieExtractor reads the key from a cookie
+func CookieExtractor(name string) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) string {
+		cookie, err := r.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	})
+}
+
+// ClientCertExtractor uses the subject of the verified TLS client certificate as key
+func ClientCertExtractor() KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) string {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return ""
+		}
+		return r.TLS.PeerCertificates[0].Subject.String()
+	})
+}
+
+// PathParamExtractor reads the key from the path segment matching the {name}
+// placeholder of pattern, e.g. "/tenants/{tenant}". Literal segments must
+// match, and the path may continue past the end of the pattern.
+func PathParamExtractor(pattern string) (KeyExtractor, error) {
+	segments := strings.Split(strings.Trim(pattern, "/"), "/")
+	position, name := -1, ""
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if position >= 0 {
+				return nil, fmt.Errorf("path pattern %q has more than one parameter", pattern)
+			}
+			position, name = i, segment[1:len(segment)-1]
+		}
+	}
+	if position < 0 || name == "" {
+		return nil, fmt.Errorf("path pattern %q has no {name} parameter", pattern)
+	}
+
+	return KeyExtractorFunc(func(r *http.Request) string {
+		// Honour parameters already matched by a ServeMux route
+		if value := r.PathValue(name); value != "" {
+			return value
+		}
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) < len(segments) {
+			return ""
+		}
+		for i, segment := range segments {
+			if i != position && parts[i] != segment {
+				return ""
+			}
+		}
+		return parts[position]
+	}), nil
+}
+
+// JWTClaimExtractor reads a claim, e.g. "sub" or "tenant", from the bearer JWT.
+// With a secret the HS256/HS384/HS512 signature and the exp claim are checked
+// and invalid tokens yield no key. Without one the claim is read unverified,
+// which is only safe behind a gateway that already verifies the tokens.
+func JWTClaimExtractor(claim string, secret []byte) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) string {
+		claims, err := parseJWT(bearerToken(r), secret)
+		if err != nil {
+			return ""
+		}
+		switch value := claims[claim].(type) {
+		case string:
+			return value
+		case json.Number:
+			return value.String()
+		default:
+			return ""
+		}
+	})
+}
+
+// ChainExtractor returns the key of the first extractor that finds one
+func ChainExtractor(extractors ...KeyExtractor) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) string {
+		for _, extractor := range extractors {
+			if key := extractor.Extract(r); key != "" {
+				return key
+			}
+		}
+		return ""
+	})
+}
+
+// NewKeyExtractor builds an extractor chain from "kind:argument" specs such as
+// "header:API_KEY", "bearer", "query:api_key", "cookie:session", "jwt:sub",
+// "mtls" or "path:/tenants/{tenant}". jwtSecret enables JWT verification.
+func NewKeyExtractor(specs []string, jwtSecret string) (KeyExtractor, error) {
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no key extractor configured")
+	}
+
+	extractors := make([]KeyExtractor, 0, len(specs))
+	for _, spec := range specs {
+		kind, arg, _ := strings.Cut(strings.TrimSpace(spec), ":")
+		needsArg := kind != config.KeyExtractorBearer && kind != config.KeyExtractorMTLS
+		if needsArg && arg == "" {
+			return nil, fmt.Errorf("key extractor %q needs an argument", spec)
+		}
+
+		var extractor KeyExtractor
+		switch kind {
+		case config.KeyExtractorHeader:
+			extractor = HeaderExtractor(arg)
+		case config.KeyExtractorBearer:
+			extractor = BearerExtractor()
+		case config.KeyExtractorQuery:
+			extractor = QueryExtractor(arg)
+		case config.KeyExtractorCookie:
+			extractor = CookieExtractor(arg)
+		case config.KeyExtractorJWT:
+			var secret []byte
+			if jwtSecret != "" {
+				secret = []byte(jwtSecret)
+			}
+			extractor = JWTClaimExtractor(arg, secret)
+		case config.KeyExtractorMTLS:
+			extractor = ClientCertExtractor()
+		case config.KeyExtractorPath:
+			var err error
+			if extractor, err = PathParamExtractor(arg); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown key extractor %q", spec)
+		}
+		extractors = append(extractors, extractor)
+	}
+
+	if len(extractors) == 1 {
+		return extractors[0], nil
+	}
+	return ChainExtractor(extractors...), nil
+}
+
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// parseJWT decodes the claims of a compact JWT, verifying its HMAC signature
+// and expiry when secret is set
+func parseJWT(token string, secret []byte) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed JWT")
+	}
+
+	if secret != nil {
+		headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		var header struct {
+			Alg string `json:"alg"`
+		}
+		if err := json.Unmarshal(headerJSON, &header); err != nil {
+			return nil, err
+		}
+
+		var newHash func() hash.Hash
+		switch header.Alg {
+		case "HS256":
+			newHash = sha256.New
+		case "HS384":
+			newHash = sha512.New384
+		case "HS512":
+			newHash = sha512.New
+		default:
+			return nil, fmt.Errorf("unsupported JWT algorithm %q", header.Alg)
+		}
+
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil {
+			return nil, err
+		}
+		mac := hmac.New(newHash, secret)
+		mac.Write([]byte(parts[0] + "." + parts[1]))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, fmt.Errorf("invalid JWT signature")
+		}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(payload)))
+	decoder.UseNumber()
+	var claims map[string]any
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, err
+	}
+
+	if secret != nil {
+		if exp, ok := claims["exp"].(json.Number); ok {
+			expiry, err := exp.Float64()
+			if err != nil || time.Now().After(time.Unix(int64(expiry), 0)) {
+				return nil, fmt.Errorf("expired JWT")
+			}
+		}
+	}
+	return claims, nil
+}
@@ -0,0 +1,231 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/config"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/limiter"
+)
+
+func signJWT(payload string, secret []byte) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	unsigned := encode([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + encode([]byte(payload))
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + encode(mac.Sum(nil))
+}
+
+func TestKeyExtractors(t *testing.T) {
+	secret := []byte("test-secret")
+	future := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name      string
+		specs     []string
+		jwtSecret string
+		prepare   func(r *http.Request)
+		target    string
+		expected  string
+	}{
+		{
+			name:     "header",
+			specs:    []string{"header:X-Tenant"},
+			prepare:  func(r *http.Request) { r.Header.Set("X-Tenant", "acme") },
+			expected: "acme",
+		},
+		{
+			name:     "bearer",
+			specs:    []string{"bearer"},
+			prepare:  func(r *http.Request) { r.Header.Set("Authorization", "bearer abc123") },
+			expected: "abc123",
+		},
+		{
+			name:     "bearer ignores other schemes",
+			specs:    []string{"bearer"},
+			prepare:  func(r *http.Request) { r.Header.Set("Authorization", "Basic dXNlcjpwYXNz") },
+			expected: "",
+		},
+		{
+			name:     "query",
+			specs:    []string{"query:api_key"},
+			target:   "/?api_key=abc123",
+			expected: "abc123",
+		},
+		{
+			name:     "cookie",
+			specs:    []string{"cookie:session"},
+			prepare:  func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "session", Value: "s1"}) },
+			expected: "s1",
+		},
+		{
+			name:     "path parameter",
+			specs:    []string{"path:/tenants/{tenant}"},
+			target:   "/tenants/acme/orders/1",
+			expected: "acme",
+		},
+		{
+			name:     "path literal mismatch",
+			specs:    []string{"path:/tenants/{tenant}"},
+			target:   "/users/acme",
+			expected: "",
+		},
+		{
+			name:     "mTLS subject",
+			specs:    []string{"mtls"},
+			prepare:  func(r *http.Request) { r.TLS = clientCertState("client-a") },
+			expected: "CN=client-a",
+		},
+		{
+			name:     "mTLS without certificate",
+			specs:    []string{"mtls"},
+			expected: "",
+		},
+		{
+			name:  "unverified JWT claim",
+			specs: []string{"jwt:tenant"},
+			prepare: func(r *http.Request) {
+				r.Header.Set("Authorization", "Bearer "+signJWT(`{"sub":"alice","tenant":"acme"}`, []byte("other")))
+			},
+			expected: "acme",
+		},
+		{
+			name:      "verified JWT claim",
+			specs:     []string{"jwt:sub"},
+			jwtSecret: string(secret),
+			prepare: func(r *http.Request) {
+				r.Header.Set("Authorization", "Bearer "+signJWT(`{"sub":"alice","exp":`+strconv.FormatInt(future, 10)+`}`, secret))
+			},
+			expected: "alice",
+		},
+		{
+			name:      "forged JWT signature",
+			specs:     []string{"jwt:sub"},
+			jwtSecret: string(secret),
+			prepare: func(r *http.Request) {
+				r.Header.Set("Authorization", "Bearer "+signJWT(`{"sub":"alice"}`, []byte("other")))
+			},
+			expected: "",
+		},
+		{
+			name:      "expired JWT",
+			specs:     []string{"jwt:sub"},
+			jwtSecret: string(secret),
+			prepare: func(r *http.Request) {
+				r.Header.Set("Authorization", "Bearer "+signJWT(`{"sub":"alice","exp":1}`, secret))
+			},
+			expected: "",
+		},
+		{
+			name:      "numeric JWT claim",
+			specs:     []string{"jwt:uid"},
+			jwtSecret: string(secret),
+			prepare: func(r *http.Request) {
+				r.Header.Set("Authorization", "Bearer "+signJWT(`{"uid":12345678901234}`, secret))
+			},
+			expected: "12345678901234",
+		},
+		{
+			name:  "chain falls through to the next extractor",
+			specs: []string{"jwt:sub", "header:API_KEY"},
+			prepare: func(r *http.Request) {
+				r.Header.Set("API_KEY", "token-1")
+			},
+			expected: "token-1",
+		},
+		{
+			name:  "chain prefers the first extractor",
+			specs: []string{"bearer", "header:API_KEY"},
+			prepare: func(r *http.Request) {
+				r.Header.Set("Authorization", "Bearer abc123")
+				r.Header.Set("API_KEY", "token-1")
+			},
+			expected: "abc123",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extractor, err := NewKeyExtractor(tt.specs, tt.jwtSecret)
+			if err != nil {
+				t.Fatalf("Failed to create key extractor: %v", err)
+			}
+
+			target := tt.target
+			if target == "" {
+				target = "/"
+			}
+			req := httptest.NewRequest("GET", target, nil)
+			if tt.prepare != nil {
+				tt.prepare(req)
+			}
+
+			if key := extractor.Extract(req); key != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, key)
+			}
+		})
+	}
+}
+
+func TestNewKeyExtractorRejectsInvalidSpecs(t *testing.T) {
+	for _, specs := range [][]string{
+		nil,
+		{"header"},
+		{"header:"},
+		{"basic:user"},
+		{"path:/tenants"},
+		{"path:/{a}/{b}"},
+	} {
+		if _, err := NewKeyExtractor(specs, ""); err == nil {
+			t.Errorf("Expected error for %v", specs)
+		}
+	}
+}
+
+func TestMiddlewareUsesKeyExtractor(t *testing.T) {
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsToken:   1,
+		BlockDurationToken: 60,
+		EnableTokenLimit:   true,
+	}
+	m := NewRateLimiterMiddleware(limiter.NewRateLimiter(store, cfg),
+		WithKeyExtractor(QueryExtractor("api_key")),
+	)
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for i, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("GET", "/?api_key=tenant-a", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Errorf("Request %d: expected %d, got %d", i+1, expected, w.Code)
+		}
+	}
+
+	// The API_KEY header is no longer read
+	req := httptest.NewRequest("GET", "/?api_key=tenant-b", nil)
+	req.Header.Set("API_KEY", "tenant-a")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 for another key, got %d", w.Code)
+	}
+}
+
+func clientCertState(commonName string) *tls.ConnectionState {
+	return &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: commonName}}},
+	}
+}
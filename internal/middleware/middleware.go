@@ -1,53 +1,272 @@
 package middleware
 
 import (
-	"net"
+	"errors"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/config"
 	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/limiter"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
 	"github.com/markuscandido/go-expert-desafio-rate-limiter/pkg/logger"
 )
 
 type RateLimiterMiddleware struct {
-	limiter *limiter.RateLimiter
+	limiter    *limiter.RateLimiter
+	headerMode string
+	ipResolver *IPResolver
+	keys       KeyExtractor
+	observer   DecisionObserver
+	cost       CostFunc
+
+	failurePolicy     string
+	failureRetryAfter time.Duration
+}
+
+// DecisionObserver is notified of every rate limit decision, e.g. to export metrics.
+// decision is nil when err is set.
+type DecisionObserver interface {
+	ObserveDecision(decision *limiter.Decision, err error)
+}
+
+// CostFunc returns the requests charged for r against every limit, consumed
+// all at once or not at all. Returning 0 charges the cost of the matched route
+// rule, or 1.
+type CostFunc func(r *http.Request) int
+
+// Option configures optional RateLimiterMiddleware behaviour
+type Option func(*RateLimiterMiddleware)
+
+// WithHeaderMode selects the rate limit headers sent on every response:
+// config.HeadersIETF (default), config.HeadersLegacy, config.HeadersBoth or config.HeadersNone
+func WithHeaderMode(mode string) Option {
+	return func(m *RateLimiterMiddleware) {
+		m.headerMode = mode
+	}
+}
+
+// WithIPResolver sets how the client IP is resolved; by default only the
+// connection address is used and forwarding headers are ignored
+func WithIPResolver(resolver *IPResolver) Option {
+	return func(m *RateLimiterMiddleware) {
+		m.ipResolver = resolver
+	}
+}
+
+// WithKeyExtractor sets where the key counted by the token limit comes from;
+// by default it is the API_KEY header
+func WithKeyExtractor(extractor KeyExtractor) Option {
+	return func(m *RateLimiterMiddleware) {
+		m.keys = extractor
+	}
+}
+
+// WithDecisionObserver reports every decision to observer
+func WithDecisionObserver(observer DecisionObserver) Option {
+	return func(m *RateLimiterMiddleware) {
+		m.observer = observer
+	}
 }
 
-func NewRateLimiterMiddleware(l *limiter.RateLimiter) *RateLimiterMiddleware {
-	return &RateLimiterMiddleware{
-		limiter: l,
+// WithCostFunc charges each request the cost returned by cost, e.g. more for
+// expensive endpoints or large payloads
+func WithCostFunc(cost CostFunc) Option {
+	return func(m *RateLimiterMiddleware) {
+		m.cost = cost
 	}
 }
 
+// WithCostHeader charges each request the positive integer in the header
+// name, e.g. set by an upstream that knows the request's weight. Clients can
+// set the header too, so it must be stripped or overwritten by a trusted
+// proxy in front of the limiter. Missing or invalid values charge the cost of
+// the matched route rule. An empty name keeps the current cost.
+func WithCostHeader(name string) Option {
+	return func(m *RateLimiterMiddleware) {
+		if name != "" {
+			m.cost = HeaderCost(name)
+		}
+	}
+}
+
+// HeaderCost reads the cost of a request from the header name
+func HeaderCost(name string) CostFunc {
+	return func(r *http.Request) int {
+		value := r.Header.Get(name)
+		if value == "" {
+			return 0
+		}
+		cost, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || cost < 0 {
+			logger.Warn("Ignoring invalid request cost",
+				"header", name,
+				"value", value,
+			)
+			return 0
+		}
+		return cost
+	}
+}
+
+// WithFailurePolicy selects what happens when the limiter cannot reach its storage:
+// config.FailureOpen lets the request through, config.FailureClosed (default)
+// answers 503 with retryAfter as Retry-After, or the time left until an open
+// storage circuit breaker probes the storage again. With config.FailureFallback the
+// storage itself falls back, so errors only remain when both stores fail and
+// are answered like config.FailureClosed.
+func WithFailurePolicy(policy string, retryAfter time.Duration) Option {
+	return func(m *RateLimiterMiddleware) {
+		m.failurePolicy = policy
+		m.failureRetryAfter = retryAfter
+	}
+}
+
+func NewRateLimiterMiddleware(l *limiter.RateLimiter, opts ...Option) *RateLimiterMiddleware {
+	m := &RateLimiterMiddleware{
+		limiter:    l,
+		headerMode: config.HeadersIETF,
+		ipResolver: &IPResolver{mode: config.ClientIPRemoteAddr},
+		keys:       HeaderExtractor("API_KEY"),
+
+		failurePolicy:     config.FailureClosed,
+		failureRetryAfter: 10 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
 const ErrorMessage = "you have reached the maximum number of requests or actions allowed within a certain time frame"
 
+// UnavailableMessage is returned when the limiter storage fails and the failure policy is closed
+const UnavailableMessage = "the rate limiter is temporarily unavailable, please retry later"
+
+// TokenRejectedMessage is returned when the token registry rejects the API token
+const TokenRejectedMessage = "the API token is not allowed to access this resource"
+
+// IPDeniedMessage is returned when the client IP is in the deny list
+const IPDeniedMessage = "requests from this IP address are not allowed"
+
+// QuotaExceededMessage is returned when a token has used up one of its hourly, daily or monthly quotas
+const QuotaExceededMessage = "you have used up the request quota of your plan for the current period"
+
+// QuotaHeader names the quota period a denied request exceeded: "hourly", "daily" or "monthly"
+const QuotaHeader = "X-RateLimit-Quota"
+
+// ShadowHeader reports the decision of a dry-run limit: "would-allow" or "would-deny"
+const ShadowHeader = "X-RateLimit-Shadow"
+
 func (m *RateLimiterMiddleware) Handler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := getClientIP(r)
-		token := getToken(r)
+		ip := m.ipResolver.ClientIP(r)
+		token := m.keys.Extract(r)
+
+		// Match the route and decide against the same snapshot of the limits
+		snapshot := m.limiter.Snapshot()
+		route := snapshot.Match(r)
+
+		request := limiter.Request{IP: ip, Token: token, Route: route}
+		if m.cost != nil {
+			request.Cost = m.cost(r)
+		}
+		decision, err := snapshot.Decide(r.Context(), request)
+		if m.observer != nil {
+			m.observer.ObserveDecision(decision, err)
+		}
+
+		if errors.Is(err, limiter.ErrTokenRejected) {
+			logger.Warn("Token rejected",
+				"path", r.RequestURI,
+				"ip", ip,
+			)
+			http.Error(w, TokenRejectedMessage, http.StatusUnauthorized)
+			return
+		}
 
-		allowed, blockDuration, err := m.limiter.AllowRequest(r.Context(), ip, token)
+		if errors.Is(err, limiter.ErrIPDenied) {
+			logger.Warn("IP denied",
+				"path", r.RequestURI,
+				"ip", ip,
+			)
+			http.Error(w, IPDeniedMessage, http.StatusForbidden)
+			return
+		}
 
 		if err != nil {
+			if m.failurePolicy == config.FailureOpen {
+				logger.Warn("Rate limiter unavailable, failing open",
+					"path", r.RequestURI,
+					"ip", ip,
+					"error", err,
+				)
+				next.ServeHTTP(w, r)
+				return
+			}
+
 			logger.Error("Rate limiter error",
 				"path", r.RequestURI,
 				"ip", ip,
 				"hasToken", token != "",
 				"error", err,
 			)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			retryAfter := m.failureRetryAfter
+			var open *storage.CircuitOpenError
+			if errors.As(err, &open) && open.RetryAfter > 0 {
+				retryAfter = open.RetryAfter
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, UnavailableMessage, http.StatusServiceUnavailable)
 			return
 		}
 
-		if !allowed {
+		// Dry-run limits are recorded but never enforced
+		if decision.Shadow {
+			if decision.Allowed {
+				w.Header().Set(ShadowHeader, "would-allow")
+			} else {
+				logger.Info("Rate limit would be exceeded, allowing in dry-run",
+					"path", r.RequestURI,
+					"ip", ip,
+					"hasToken", token != "",
+					"keyKind", decision.KeyKind,
+					"rule", decision.Rule,
+				)
+				w.Header().Set(ShadowHeader, "would-deny")
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		setRateLimitHeaders(w.Header(), m.headerMode, decision)
+
+		if !decision.Allowed && decision.Quota != "" {
+			logger.Warn("Quota exceeded",
+				"path", r.RequestURI,
+				"ip", ip,
+				"rule", decision.Rule,
+				"quota", decision.Quota,
+				"retryAfter", decision.RetryAfterSeconds(),
+			)
+			w.Header().Set(QuotaHeader, string(decision.Quota))
+			w.Header().Set("Retry-After", strconv.Itoa(decision.RetryAfterSeconds()))
+			http.Error(w, QuotaExceededMessage, http.StatusTooManyRequests)
+			return
+		}
+
+		if !decision.Allowed {
 			logger.Warn("Rate limit exceeded",
 				"path", r.RequestURI,
 				"ip", ip,
 				"hasToken", token != "",
-				"blockDuration", blockDuration,
+				"keyKind", decision.KeyKind,
+				"rule", decision.Rule,
+				"retryAfter", decision.RetryAfterSeconds(),
 			)
-			w.Header().Set("Retry-After", strconv.Itoa(blockDuration))
+			w.Header().Set("Retry-After", strconv.Itoa(decision.RetryAfterSeconds()))
 			http.Error(w, ErrorMessage, http.StatusTooManyRequests)
 			return
 		}
@@ -61,30 +280,3 @@ func (m *RateLimiterMiddleware) Handler(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
-
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header first (for proxies)
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		ips := strings.Split(xff, ",")
-		if len(ips) > 0 {
-			return strings.TrimSpace(ips[0])
-		}
-	}
-
-	// Check X-Real-IP header
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri
-	}
-
-	// Fall back to RemoteAddr
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
-	}
-
-	return ip
-}
-
-func getToken(r *http.Request) string {
-	return r.Header.Get("API_KEY")
-}
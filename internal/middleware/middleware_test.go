@@ -2,61 +2,33 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/config"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/iplist"
 	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/limiter"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/rules"
 	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/tokens"
 )
 
-type MockStorageForMiddleware struct {
-	counter map[string]int
-	blocked map[string]bool
-}
-
-func NewMockStorageForMiddleware() *MockStorageForMiddleware {
-	return &MockStorageForMiddleware{
-		counter: make(map[string]int),
-		blocked: make(map[string]bool),
-	}
-}
-
-func (m *MockStorageForMiddleware) CheckAndIncrement(ctx context.Context, key string, maxRequests int, windowSeconds int) (bool, error) {
-	if m.blocked[key] {
-		return false, nil
-	}
-	m.counter[key]++
-	return m.counter[key] <= maxRequests, nil
-}
-
-func (m *MockStorageForMiddleware) IsBlocked(ctx context.Context, key string) (bool, error) {
-	return m.blocked[key], nil
-}
-
-func (m *MockStorageForMiddleware) Block(ctx context.Context, key string, durationSeconds int) error {
-	m.blocked[key] = true
-	return nil
-}
+func newTestStorage(t *testing.T) *storage.MemoryStrategy {
+	t.Helper()
 
-func (m *MockStorageForMiddleware) Reset(ctx context.Context, key string) error {
-	delete(m.counter, key)
-	delete(m.blocked, key)
-	return nil
-}
-
-func (m *MockStorageForMiddleware) GetData(ctx context.Context, key string) (*storage.LimiterData, error) {
-	return nil, nil
-}
-
-func (m *MockStorageForMiddleware) Close() error {
-	return nil
+	store := storage.NewMemoryStrategy(0, 0)
+	t.Cleanup(func() { store.Close() })
+	return store
 }
 
 func TestMiddlewareBlocksExceededRequests(t *testing.T) {
-	mockStorage := NewMockStorageForMiddleware()
+	store := newTestStorage(t)
 	cfg := &config.RateLimiterConfig{
 		MaxRequestsIP:    2,
 		BlockDurationIP:  60,
@@ -64,7 +36,7 @@ func TestMiddlewareBlocksExceededRequests(t *testing.T) {
 		EnableTokenLimit: false,
 	}
 
-	rateLimiter := limiter.NewRateLimiter(mockStorage, cfg)
+	rateLimiter := limiter.NewRateLimiter(store, cfg)
 	m := NewRateLimiterMiddleware(rateLimiter)
 
 	// Mock handler
@@ -106,7 +78,7 @@ func TestMiddlewareBlocksExceededRequests(t *testing.T) {
 }
 
 func TestMiddlewareWithToken(t *testing.T) {
-	mockStorage := NewMockStorageForMiddleware()
+	store := newTestStorage(t)
 	cfg := &config.RateLimiterConfig{
 		MaxRequestsToken:   3,
 		BlockDurationToken: 60,
@@ -114,7 +86,7 @@ func TestMiddlewareWithToken(t *testing.T) {
 		EnableTokenLimit:   true,
 	}
 
-	rateLimiter := limiter.NewRateLimiter(mockStorage, cfg)
+	rateLimiter := limiter.NewRateLimiter(store, cfg)
 	m := NewRateLimiterMiddleware(rateLimiter)
 
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -148,3 +120,371 @@ func TestMiddlewareWithToken(t *testing.T) {
 		t.Errorf("4th request should return 429, got %d", w.Code)
 	}
 }
+
+type rejectingRegistry struct{}
+
+func (rejectingRegistry) Lookup(ctx context.Context, token string) (*tokens.Limit, error) {
+	return &tokens.Limit{Token: token, Enabled: false}, nil
+}
+
+func TestMiddlewareRejectsDisabledToken(t *testing.T) {
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsToken: 3,
+		EnableTokenLimit: true,
+	}
+
+	rateLimiter := limiter.NewRateLimiter(store, cfg, limiter.WithTokenRegistry(rejectingRegistry{}))
+	m := NewRateLimiterMiddleware(rateLimiter)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("API_KEY", "revoked-token")
+	w := httptest.NewRecorder()
+
+	m.Handler(handler).ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Disabled token should return 401, got %d", w.Code)
+	}
+}
+
+func TestMiddlewareRejectsDeniedIP(t *testing.T) {
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsIP: 3,
+		EnableIPLimit: true,
+	}
+
+	lists := iplist.NewLists(iplist.Entries{Deny: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}}, nil)
+	rateLimiter := limiter.NewRateLimiter(store, cfg, limiter.WithIPLists(lists))
+	m := NewRateLimiterMiddleware(rateLimiter)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+
+	m.Handler(handler).ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Denied IP should return 403, got %d", w.Code)
+	}
+}
+
+func TestMiddlewareSetsRetryAfter(t *testing.T) {
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsIP:   1,
+		BlockDurationIP: 60,
+		EnableIPLimit:   true,
+	}
+
+	m := NewRateLimiterMiddleware(limiter.NewRateLimiter(store, cfg))
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, expected := range []string{"", "60", "60"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if got := w.Header().Get("Retry-After"); got != expected {
+			t.Errorf("Expected Retry-After %q, got %q", expected, got)
+		}
+	}
+}
+
+func TestMiddlewareAppliesRouteRules(t *testing.T) {
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsIP:   5,
+		BlockDurationIP: 60,
+		EnableIPLimit:   true,
+	}
+	set, err := rules.NewSet([]rules.Rule{
+		{ID: "health", PathPrefix: "/health", Exempt: true},
+		{ID: "search", PathPrefix: "/search", Methods: []string{"GET"}, IP: rules.Limit{MaxRequests: 1}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create rules: %v", err)
+	}
+	m := NewRateLimiterMiddleware(limiter.NewRateLimiter(store, cfg, limiter.WithRules(set)))
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := serve("GET", "/search"); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "1" {
+		t.Errorf("Expected 200 with the search limit, got %d and %q", w.Code, w.Header().Get("RateLimit-Limit"))
+	}
+	if w := serve("GET", "/search"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 on second search, got %d", w.Code)
+	}
+
+	// Other methods and paths use the global limit
+	if w := serve("POST", "/search"); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "5" {
+		t.Errorf("Expected 200 with the global limit, got %d and %q", w.Code, w.Header().Get("RateLimit-Limit"))
+	}
+	for i := 0; i < 10; i++ {
+		if w := serve("GET", "/health"); w.Code != http.StatusOK {
+			t.Fatalf("Health check %d should never be limited, got %d", i+1, w.Code)
+		}
+	}
+}
+
+func TestMiddlewareRequestCost(t *testing.T) {
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsIP:   10,
+		BlockDurationIP: 60,
+		EnableIPLimit:   true,
+	}
+	set, err := rules.NewSet([]rules.Rule{{ID: "export", PathPrefix: "/export", Cost: 4}})
+	if err != nil {
+		t.Fatalf("Failed to create rules: %v", err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	serve := func(handler http.Handler, target, cost string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		if cost != "" {
+			req.Header.Set("X-Cost", cost)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	rateLimiter := limiter.NewRateLimiter(newTestStorage(t), cfg, limiter.WithRules(set))
+	handler := NewRateLimiterMiddleware(rateLimiter, WithCostHeader("X-Cost")).Handler(ok)
+	for i, tt := range []struct {
+		target, cost string
+		code         int
+		remaining    string
+	}{
+		{"/export", "", http.StatusOK, "6"},     // The rule cost
+		{"/export", "1", http.StatusOK, "5"},    // The header takes precedence
+		{"/export", "many", http.StatusOK, "1"}, // Invalid values charge the rule cost
+		{"/export", "2", http.StatusTooManyRequests, "0"},
+		{"/", "3", http.StatusOK, "7"},
+	} {
+		w := serve(handler, tt.target, tt.cost)
+		if w.Code != tt.code || w.Header().Get("RateLimit-Remaining") != tt.remaining {
+			t.Errorf("Request %d: expected %d with %s remaining, got %d with %q", i+1, tt.code, tt.remaining, w.Code, w.Header().Get("RateLimit-Remaining"))
+		}
+	}
+
+	// A cost function ignores the header
+	rateLimiter = limiter.NewRateLimiter(newTestStorage(t), cfg, limiter.WithRules(set))
+	handler = NewRateLimiterMiddleware(rateLimiter, WithCostFunc(func(r *http.Request) int { return 8 })).Handler(ok)
+	if w := serve(handler, "/export", "1"); w.Code != http.StatusOK || w.Header().Get("RateLimit-Remaining") != "2" {
+		t.Errorf("Expected 200 with 2 remaining, got %d with %q", w.Code, w.Header().Get("RateLimit-Remaining"))
+	}
+}
+
+func TestMiddlewareDryRun(t *testing.T) {
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsIP:   1,
+		BlockDurationIP: 60,
+		EnableIPLimit:   true,
+	}
+	set, err := rules.NewSet([]rules.Rule{
+		{ID: "search", PathPrefix: "/search", DryRun: true},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create rules: %v", err)
+	}
+	m := NewRateLimiterMiddleware(limiter.NewRateLimiter(store, cfg, limiter.WithRules(set)))
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := serve("/search"); w.Code != http.StatusOK || w.Header().Get(ShadowHeader) != "would-allow" {
+		t.Errorf("Expected 200 with would-allow, got %d and %q", w.Code, w.Header().Get(ShadowHeader))
+	}
+	for i := 0; i < 3; i++ {
+		w := serve("/search")
+		if w.Code != http.StatusOK || w.Header().Get(ShadowHeader) != "would-deny" {
+			t.Errorf("Expected 200 with would-deny, got %d and %q", w.Code, w.Header().Get(ShadowHeader))
+		}
+		if w.Header().Get("RateLimit-Limit") != "" || w.Header().Get("Retry-After") != "" {
+			t.Errorf("Expected no rate limit headers in dry-run, got %v", w.Header())
+		}
+	}
+
+	// Enforced limits are unaffected
+	if w := serve("/"); w.Code != http.StatusOK || w.Header().Get(ShadowHeader) != "" {
+		t.Errorf("Expected 200 without the shadow header, got %d and %q", w.Code, w.Header().Get(ShadowHeader))
+	}
+	if w := serve("/"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 outside the dry-run rule, got %d", w.Code)
+	}
+}
+
+func TestMiddlewareQuota(t *testing.T) {
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsToken:   1,
+		BlockDurationToken: 60,
+		EnableTokenLimit:   true,
+		MonthlyQuotaToken:  2,
+	}
+	m := NewRateLimiterMiddleware(limiter.NewRateLimiter(store, cfg))
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		req.Header.Set("API_KEY", "abc")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := serve(); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+
+	// Throttled by the rate limit
+	w := serve()
+	if w.Code != http.StatusTooManyRequests || w.Header().Get(QuotaHeader) != "" || !strings.Contains(w.Body.String(), ErrorMessage) {
+		t.Errorf("Expected the throttle response, got %d %q %q", w.Code, w.Header().Get(QuotaHeader), w.Body.String())
+	}
+
+	// Denied by the quota, with the rate limit reset in between
+	store.Reset(context.Background(), "token:abc")
+	serve()
+	store.Reset(context.Background(), "token:abc")
+	w = serve()
+	if w.Code != http.StatusTooManyRequests || w.Header().Get(QuotaHeader) != "monthly" || !strings.Contains(w.Body.String(), QuotaExceededMessage) {
+		t.Errorf("Expected the quota response, got %d %q %q", w.Code, w.Header().Get(QuotaHeader), w.Body.String())
+	}
+	if w.Header().Get("RateLimit-Limit") != "2" {
+		t.Errorf("Expected the quota in the rate limit headers, got %q", w.Header().Get("RateLimit-Limit"))
+	}
+	if retryAfter, _ := strconv.Atoi(w.Header().Get("Retry-After")); retryAfter <= 0 {
+		t.Errorf("Expected to retry at the end of the month, got %q", w.Header().Get("Retry-After"))
+	}
+}
+
+type recordingObserver struct {
+	decisions []*limiter.Decision
+}
+
+func (o *recordingObserver) ObserveDecision(decision *limiter.Decision, err error) {
+	o.decisions = append(o.decisions, decision)
+}
+
+func TestMiddlewareReportsDecisions(t *testing.T) {
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsIP:   1,
+		BlockDurationIP: 60,
+		EnableIPLimit:   true,
+	}
+	observer := &recordingObserver{}
+	m := NewRateLimiterMiddleware(limiter.NewRateLimiter(store, cfg), WithDecisionObserver(observer))
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if len(observer.decisions) != 2 {
+		t.Fatalf("Expected 2 decisions, got %d", len(observer.decisions))
+	}
+	if !observer.decisions[0].Allowed || observer.decisions[1].Allowed {
+		t.Errorf("Expected allowed then denied, got %+v and %+v", observer.decisions[0], observer.decisions[1])
+	}
+}
+
+// unavailableStorage fails every Consume call, like an unreachable Redis
+type unavailableStorage struct {
+	storage.Strategy
+}
+
+func (unavailableStorage) Consume(ctx context.Context, key string, limit storage.Limit) (*storage.HitResult, error) {
+	return nil, errors.New("dial tcp: connection refused")
+}
+
+func TestMiddlewareFailurePolicies(t *testing.T) {
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsIP:   5,
+		BlockDurationIP: 60,
+		EnableIPLimit:   true,
+	}
+	rateLimiter := limiter.NewRateLimiter(unavailableStorage{newTestStorage(t)}, cfg)
+
+	// An open breaker fails fast until it probes the storage again
+	breaker := storage.NewBreakerStrategy(unavailableStorage{newTestStorage(t)}, 1, 3*time.Second, nil)
+	breaker.Consume(context.Background(), "ip:127.0.0.1", storage.Limit{Algorithm: storage.AlgorithmFixedWindow, Max: 1, Window: time.Second})
+	breakerLimiter := limiter.NewRateLimiter(breaker, cfg)
+
+	tests := []struct {
+		name       string
+		limiter    *limiter.RateLimiter
+		opts       []Option
+		expected   int
+		retryAfter string
+	}{
+		{"default fails closed", rateLimiter, nil, http.StatusServiceUnavailable, "10"},
+		{"fail closed", rateLimiter, []Option{WithFailurePolicy(config.FailureClosed, 30*time.Second)}, http.StatusServiceUnavailable, "30"},
+		{"fail open", rateLimiter, []Option{WithFailurePolicy(config.FailureOpen, 30*time.Second)}, http.StatusOK, ""},
+		{"fallback exhausted", rateLimiter, []Option{WithFailurePolicy(config.FailureFallback, 30*time.Second)}, http.StatusServiceUnavailable, "30"},
+		{"open breaker", breakerLimiter, []Option{WithFailurePolicy(config.FailureClosed, 30*time.Second)}, http.StatusServiceUnavailable, "3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewRateLimiterMiddleware(tt.limiter, tt.opts...)
+			handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = "127.0.0.1:12345"
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.expected {
+				t.Errorf("Expected %d, got %d", tt.expected, w.Code)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("Expected Retry-After %q, got %q", tt.retryAfter, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/pkg/logger"
+)
+
+// NoUpstreamMessage is returned when every upstream of the matched route is unhealthy
+const NoUpstreamMessage = "no healthy upstream is available"
+
+// Proxy is an http.Handler forwarding every request to an upstream of the
+// route matching its path. Requests matching no route are answered 404.
+type Proxy struct {
+	routes    []*route // Longest prefix first
+	upstreams map[string]*upstream
+	transport *http.Transport
+
+	healthPath     string
+	healthInterval time.Duration
+	healthTimeout  time.Duration
+
+	trustForwarding func(*http.Request) bool
+}
+
+type route struct {
+	Route
+	targets []*target
+	next    atomic.Uint64
+}
+
+// target is an upstream as forwarded to by one route
+type target struct {
+	upstream *upstream
+	proxy    *httputil.ReverseProxy
+}
+
+// upstream is shared by every route forwarding to the same URL, so its
+// health is checked once
+type upstream struct {
+	url     *url.URL
+	healthy atomic.Bool
+}
+
+// Option configures optional Proxy behaviour
+type Option func(*Proxy)
+
+// WithTimeouts limits how long connecting to an upstream and waiting for its
+// response headers may take. Zero keeps the default of 5 and 30 seconds.
+func WithTimeouts(dial, responseHeader time.Duration) Option {
+	return func(p *Proxy) {
+		if dial > 0 {
+			p.transport.DialContext = (&net.Dialer{Timeout: dial, KeepAlive: 30 * time.Second}).DialContext
+		}
+		if responseHeader > 0 {
+			p.transport.ResponseHeaderTimeout = responseHeader
+		}
+	}
+}
+
+// WithHealthCheck makes CheckHealth probe path on every upstream each
+// interval, taking an upstream out of rotation while it fails to answer a
+// 2xx or 3xx within timeout
+func WithHealthCheck(path string, interval, timeout time.Duration) Option {
+	return func(p *Proxy) {
+		p.healthPath = path
+		p.healthInterval = interval
+		p.healthTimeout = timeout
+	}
+}
+
+// WithTrustedForwarding keeps the incoming X-Forwarded-For chain of the
+// requests trusted reports true for, e.g. those sent by a trusted proxy.
+// By default the chain is started afresh with the connection peer, so
+// clients cannot forge the addresses upstreams see.
+func WithTrustedForwarding(trusted func(*http.Request) bool) Option {
+	return func(p *Proxy) {
+		p.trustForwarding = trusted
+	}
+}
+
+// New creates a proxy forwarding to the upstreams of routes
+func New(routes []Route, opts ...Option) (*Proxy, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	transport.ResponseHeaderTimeout = 30 * time.Second
+
+	p := &Proxy{
+		upstreams: make(map[string]*upstream),
+		transport: transport,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	for _, config := range routes {
+		if err := config.Validate(); err != nil {
+			return nil, err
+		}
+		r := &route{Route: config}
+		for _, raw := range config.Upstreams {
+			u, _ := ParseUpstream(raw)
+			up, ok := p.upstreams[u.String()]
+			if !ok {
+				up = &upstream{url: u}
+				up.healthy.Store(true)
+				p.upstreams[u.String()] = up
+			}
+			r.targets = append(r.targets, &target{upstream: up, proxy: p.reverseProxy(r, up)})
+		}
+		p.routes = append(p.routes, r)
+	}
+	slices.SortStableFunc(p.routes, func(a, b *route) int {
+		return len(b.PathPrefix) - len(a.PathPrefix)
+	})
+	return p, nil
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r := p.match(req.URL.Path)
+	if r == nil {
+		http.NotFound(w, req)
+		return
+	}
+	t := r.pick()
+	if t == nil {
+		logger.Warn("No healthy upstream",
+			"path", req.URL.Path,
+			"route", r.PathPrefix,
+		)
+		http.Error(w, NoUpstreamMessage, http.StatusServiceUnavailable)
+		return
+	}
+	t.proxy.ServeHTTP(w, req)
+}
+
+// match returns the route with the longest prefix of path, or nil
+func (p *Proxy) match(path string) *route {
+	for _, r := range p.routes {
+		if r.matches(path) {
+			return r
+		}
+	}
+	return nil
+}
+
+// matches reports whether path is under the prefix of r on a segment
+// boundary, so /api matches /api and /api/users but not /apiary
+func (r *route) matches(path string) bool {
+	if !strings.HasPrefix(path, r.PathPrefix) {
+		return false
+	}
+	return len(path) == len(r.PathPrefix) || strings.HasSuffix(r.PathPrefix, "/") || path[len(r.PathPrefix)] == '/'
+}
+
+// pick returns the next healthy target in round-robin order, or nil when none is healthy
+func (r *route) pick() *target {
+	start := r.next.Add(1)
+	for i := range uint64(len(r.targets)) {
+		t := r.targets[(start+i)%uint64(len(r.targets))]
+		if t.upstream.healthy.Load() {
+			return t
+		}
+	}
+	return nil
+}
+
+// reverseProxy forwards the requests of r to up, appending the connection
+// peer to X-Forwarded-For and rewriting the headers configured on the route
+func (p *Proxy) reverseProxy(r *route, up *upstream) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Transport: p.transport,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			if p.trustForwarding != nil && p.trustForwarding(pr.In) {
+				pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+			}
+			pr.SetXForwarded()
+
+			if r.StripPrefix {
+				pr.Out.URL.Path = ensureSlash(strings.TrimPrefix(pr.Out.URL.Path, r.PathPrefix))
+				pr.Out.URL.RawPath = ""
+			}
+			pr.SetURL(up.url)
+			if r.PreserveHost {
+				pr.Out.Host = pr.In.Host
+			}
+			r.RequestHeaders.apply(pr.Out.Header)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			r.ResponseHeaders.apply(resp.Header)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			if errors.Is(err, context.Canceled) && req.Context().Err() != nil {
+				// The client went away, nobody is left to answer
+				return
+			}
+			status := http.StatusBadGateway
+			var netErr net.Error
+			if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+				status = http.StatusGatewayTimeout
+			}
+			logger.Warn("Upstream request failed",
+				"upstream", up.url.String(),
+				"path", req.URL.Path,
+				"status", status,
+				"error", err,
+			)
+			w.WriteHeader(status)
+		},
+		ErrorLog: slog.NewLogLogger(logger.GetLogger().Handler(), slog.LevelWarn),
+	}
+}
+
+// CheckHealth probes every upstream until ctx is done. It returns at once
+// when no health check is configured, leaving every upstream in rotation.
+func (p *Proxy) CheckHealth(ctx context.Context) {
+	if p.healthPath == "" || p.healthInterval <= 0 {
+		return
+	}
+
+	client := &http.Client{Transport: p.transport, Timeout: p.healthTimeout}
+	ticker := time.NewTicker(p.healthInterval)
+	defer ticker.Stop()
+	for {
+		for _, up := range p.upstreams {
+			p.probe(ctx, client, up)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe checks up once and logs when its health changes
+func (p *Proxy) probe(ctx context.Context, client *http.Client, up *upstream) {
+	status := 0
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, up.url.JoinPath(p.healthPath).String(), nil)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = client.Do(req); err == nil {
+			resp.Body.Close()
+			status = resp.StatusCode
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	healthy := err == nil && status < http.StatusBadRequest
+	if was := up.healthy.Swap(healthy); was != healthy {
+		if healthy {
+			logger.Info("Upstream healthy again", "upstream", up.url.String())
+		} else {
+			logger.Warn("Upstream unhealthy, taking it out of rotation",
+				"upstream", up.url.String(),
+				"status", status,
+				"error", err,
+			)
+		}
+	}
+}
+
+func ensureSlash(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		return "/" + path
+	}
+	return path
+}
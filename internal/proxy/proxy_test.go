@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newBackend starts an upstream answering with its name and what it received
+func newBackend(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", name)
+		w.Header().Set("Server", "backend")
+		fmt.Fprintf(w, "%s %s host=%s xff=%s tenant=%s cookie=%s",
+			name, r.URL.RequestURI(), r.Host, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Tenant"), r.Header.Get("Cookie"))
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func get(t *testing.T, handler http.Handler, target string, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", target, nil)
+	req.RemoteAddr = "203.0.113.7:40000"
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestProxyRoutesByPathPrefix(t *testing.T) {
+	api, web := newBackend(t, "api"), newBackend(t, "web")
+	p, err := New([]Route{
+		{PathPrefix: "/", Upstreams: []string{web.URL}},
+		{
+			PathPrefix:      "/api/",
+			Upstreams:       []string{api.URL + "/v1"},
+			StripPrefix:     true,
+			PreserveHost:    true,
+			RequestHeaders:  HeaderRewrite{Set: map[string]string{"X-Tenant": "acme"}, Remove: []string{"Cookie"}},
+			ResponseHeaders: HeaderRewrite{Set: map[string]string{"X-Proxy": "rate-limiter"}, Remove: []string{"Server"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	w := get(t, p, "http://example.com/api/users?page=2", map[string]string{"Cookie": "session=1", "X-Forwarded-For": "198.51.100.1"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	// The chain sent by an untrusted client is dropped
+	if want := "api /v1/users?page=2 host=example.com xff=203.0.113.7 tenant=acme cookie="; w.Body.String() != want {
+		t.Errorf("Expected %q, got %q", want, w.Body.String())
+	}
+	if w.Header().Get("X-Proxy") != "rate-limiter" || w.Header().Get("Server") != "" {
+		t.Errorf("Expected the response headers to be rewritten, got %v", w.Header())
+	}
+
+	w = get(t, p, "http://example.com/apiary", map[string]string{"Cookie": "session=1"})
+	if !strings.HasPrefix(w.Body.String(), "web /apiary host="+strings.TrimPrefix(web.URL, "http://")) || !strings.HasSuffix(w.Body.String(), "cookie=session=1") {
+		t.Errorf("Expected the catch-all route untouched, got %q", w.Body.String())
+	}
+
+	p, _ = New([]Route{{PathPrefix: "/api", Upstreams: []string{api.URL}, StripPrefix: true}})
+	for target, status := range map[string]int{"/other": http.StatusNotFound, "/apiary": http.StatusNotFound, "/api": http.StatusOK} {
+		if w := get(t, p, "http://example.com"+target, nil); w.Code != status {
+			t.Errorf("%s: expected %d, got %d", target, status, w.Code)
+		}
+	}
+	if w := get(t, p, "http://example.com/api/users", nil); !strings.HasPrefix(w.Body.String(), "api /users ") {
+		t.Errorf("Expected the prefix to be stripped on the segment boundary, got %q", w.Body.String())
+	}
+}
+
+func TestProxyTrustedForwarding(t *testing.T) {
+	backend := newBackend(t, "api")
+	p, err := New([]Route{{Upstreams: []string{backend.URL}}}, WithTrustedForwarding(func(r *http.Request) bool {
+		return r.Header.Get("X-Trusted") != ""
+	}))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	w := get(t, p, "/", map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Trusted": "1"})
+	if !strings.Contains(w.Body.String(), "xff=198.51.100.1, 203.0.113.7 ") {
+		t.Errorf("Expected the trusted chain to be extended, got %q", w.Body.String())
+	}
+	w = get(t, p, "/", map[string]string{"X-Forwarded-For": "198.51.100.1"})
+	if !strings.Contains(w.Body.String(), "xff=203.0.113.7 ") {
+		t.Errorf("Expected the untrusted chain to be started afresh, got %q", w.Body.String())
+	}
+}
+
+func TestProxyBalancesHealthyUpstreams(t *testing.T) {
+	first, second := newBackend(t, "first"), newBackend(t, "second")
+	var secondHealthy atomic.Bool
+	secondHealthy.Store(true)
+	health := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !secondHealthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		second.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(health.Close)
+
+	p, err := New([]Route{{Upstreams: []string{first.URL, health.URL}}}, WithHealthCheck("/healthz", time.Hour, time.Second))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		seen[get(t, p, "/", nil).Header().Get("X-Backend")]++
+	}
+	if seen["first"] != 2 || seen["second"] != 2 {
+		t.Errorf("Expected requests to alternate between upstreams, got %v", seen)
+	}
+
+	// An upstream failing its health check leaves the rotation
+	secondHealthy.Store(false)
+	for _, up := range p.upstreams {
+		p.probe(context.Background(), &http.Client{Timeout: time.Second}, up)
+	}
+	for i := 0; i < 3; i++ {
+		if backend := get(t, p, "/", nil).Header().Get("X-Backend"); backend != "first" {
+			t.Errorf("Expected only the healthy upstream, got %q", backend)
+		}
+	}
+
+	first.Close()
+	for _, up := range p.upstreams {
+		p.probe(context.Background(), &http.Client{Timeout: time.Second}, up)
+	}
+	if w := get(t, p, "/", nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without healthy upstreams, got %d", w.Code)
+	}
+}
+
+func TestProxyUpstreamErrors(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(release) })
+
+	p, err := New([]Route{{Upstreams: []string{slow.URL}}}, WithTimeouts(time.Second, 50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if w := get(t, p, "/", nil); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504 when the upstream is too slow, got %d", w.Code)
+	}
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	p, _ = New([]Route{{Upstreams: []string{down.URL}}})
+	w := get(t, p, "/", nil)
+	if body, _ := io.ReadAll(w.Body); w.Code != http.StatusBadGateway || len(body) != 0 {
+		t.Errorf("Expected an empty 502 when the upstream is down, got %d %q", w.Code, body)
+	}
+}
+
+func TestRouteValidate(t *testing.T) {
+	for _, route := range []Route{
+		{PathPrefix: "api", Upstreams: []string{"http://api:8080"}},
+		{PathPrefix: "/api"},
+		{Upstreams: []string{"api:8080"}},
+		{Upstreams: []string{"ftp://api"}},
+		{Upstreams: []string{"http://"}},
+	} {
+		if err := route.Validate(); err == nil {
+			t.Errorf("Expected an error for %+v", route)
+		}
+	}
+
+	route := Route{PathPrefix: "/api", Upstreams: []string{"http://api:8080", "https://api.example.com/base"}}
+	if err := route.Validate(); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
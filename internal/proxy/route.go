@@ -0,0 +1,65 @@
+// Package proxy forwards requests to upstream servers, so the rate limiter can
+// run as a standalone reverse proxy in front of any backend.
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HeaderRewrite removes, then sets, headers
+type HeaderRewrite struct {
+	Set    map[string]string `json:"set"`
+	Remove []string          `json:"remove"`
+}
+
+func (h HeaderRewrite) apply(header http.Header) {
+	for _, name := range h.Remove {
+		header.Del(name)
+	}
+	for name, value := range h.Set {
+		header.Set(name, value)
+	}
+}
+
+// Route forwards the requests whose path starts with PathPrefix, on a path
+// segment boundary, to Upstreams. When several routes match, the longest
+// prefix wins.
+type Route struct {
+	PathPrefix      string        `json:"path_prefix"`      // Empty matches every path
+	Upstreams       []string      `json:"upstreams"`        // Base URLs, balanced round-robin among the healthy ones
+	StripPrefix     bool          `json:"strip_prefix"`     // Remove PathPrefix from the forwarded path
+	PreserveHost    bool          `json:"preserve_host"`    // Forward the client's Host instead of the upstream's
+	RequestHeaders  HeaderRewrite `json:"request_headers"`  // Applied to the forwarded request
+	ResponseHeaders HeaderRewrite `json:"response_headers"` // Applied to the upstream response
+}
+
+// Validate checks that the route has a usable prefix and upstreams
+func (r *Route) Validate() error {
+	if r.PathPrefix != "" && !strings.HasPrefix(r.PathPrefix, "/") {
+		return fmt.Errorf("path prefix %q must start with /", r.PathPrefix)
+	}
+	if len(r.Upstreams) == 0 {
+		return fmt.Errorf("no upstreams for path prefix %q", r.PathPrefix)
+	}
+	for _, upstream := range r.Upstreams {
+		if _, err := ParseUpstream(upstream); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseUpstream parses the base URL of an upstream, which must be http or https
+func ParseUpstream(raw string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream %q: %w", raw, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("upstream %q must be an absolute http or https URL", raw)
+	}
+	return u, nil
+}
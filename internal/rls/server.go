@@ -0,0 +1,255 @@
+// Package rls serves the rate limiter over Envoy's Rate Limit Service gRPC API
+// (envoy.service.ratelimit.v3.RateLimitService), so that Envoy proxies enforce
+// the same limits, rules and counters as the HTTP middleware.
+package rls
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/config"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/limiter"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/pkg/logger"
+)
+
+// Descriptor entry keys mapped to the limiter request. Entries with other keys
+// are ignored.
+const (
+	DescriptorIP    = "remote_address" // Client IP, as sent by Envoy's remote_address action
+	DescriptorToken = "api_key"        // Key counted by the token limit, e.g. from a request_headers action
+	DescriptorRoute = "route"          // ID of the route rule whose limits apply
+)
+
+// ShadowHeader reports the decision of dry-run limits, like the middleware does
+const ShadowHeader = "X-RateLimit-Shadow"
+
+// QuotaHeader names the token quota period a denied request exceeded, like the middleware does
+const QuotaHeader = "X-RateLimit-Quota"
+
+// DecisionObserver is notified of every rate limit decision, e.g. to export metrics.
+// decision is nil when err is set.
+type DecisionObserver interface {
+	ObserveDecision(decision *limiter.Decision, err error)
+}
+
+// Server implements the ShouldRateLimit RPC on top of a RateLimiter. Every
+// descriptor of a request is decided as one limiter request.
+type Server struct {
+	rlsv3.UnimplementedRateLimitServiceServer
+
+	limiter       *limiter.RateLimiter
+	observer      DecisionObserver
+	failurePolicy string
+}
+
+// Option configures optional Server behaviour
+type Option func(*Server)
+
+// WithDecisionObserver reports every decision to observer
+func WithDecisionObserver(observer DecisionObserver) Option {
+	return func(s *Server) {
+		s.observer = observer
+	}
+}
+
+// WithFailurePolicy selects what happens when the limiter cannot reach its
+// storage: config.FailureOpen answers OK for the descriptors it could not
+// decide, otherwise (default) the call fails with Unavailable and Envoy
+// applies its own failure_mode_deny setting
+func WithFailurePolicy(policy string) Option {
+	return func(s *Server) {
+		s.failurePolicy = policy
+	}
+}
+
+// NewServer creates a Rate Limit Service backed by l
+func NewServer(l *limiter.RateLimiter, opts ...Option) *Server {
+	s := &Server{
+		limiter:       l,
+		failurePolicy: config.FailureClosed,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Register serves the Rate Limit Service on server
+func (s *Server) Register(server *grpc.Server) {
+	rlsv3.RegisterRateLimitServiceServer(server, s)
+}
+
+// ShouldRateLimit decides every descriptor of req against the same snapshot of
+// the limits. The overall code is OVER_LIMIT when any enforced descriptor is
+// over its limit; dry-run descriptors only add the shadow header. The request's
+// hits_addend is charged against every descriptor: a descriptor whose limit is
+// lower is always over the limit, and values above MaxInt32 are rejected with
+// InvalidArgument.
+func (s *Server) ShouldRateLimit(ctx context.Context, req *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+	if req.GetHitsAddend() > math.MaxInt32 {
+		return nil, status.Errorf(codes.InvalidArgument, "hits_addend %d exceeds %d", req.GetHitsAddend(), math.MaxInt32)
+	}
+	snapshot := s.limiter.Snapshot()
+	response := &rlsv3.RateLimitResponse{OverallCode: rlsv3.RateLimitResponse_OK}
+
+	var retryAfter int
+	var shadow string
+	var quota limiter.QuotaPeriod
+	for _, descriptor := range req.GetDescriptors() {
+		request, ok := s.request(snapshot, descriptor)
+		if !ok {
+			response.Statuses = append(response.Statuses, &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OK})
+			continue
+		}
+		request.Cost = int(req.GetHitsAddend())
+
+		decision, err := snapshot.Decide(ctx, request)
+		if s.observer != nil {
+			s.observer.ObserveDecision(decision, err)
+		}
+
+		if errors.Is(err, limiter.ErrTokenRejected) || errors.Is(err, limiter.ErrIPDenied) {
+			logger.Warn("Descriptor rejected",
+				"domain", req.GetDomain(),
+				"ip", request.IP,
+				"error", err,
+			)
+			response.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+			response.Statuses = append(response.Statuses, &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OVER_LIMIT})
+			continue
+		}
+
+		if err != nil {
+			if s.failurePolicy == config.FailureOpen {
+				// Only this descriptor is let through: the others keep their decisions
+				logger.Warn("Rate limiter unavailable, failing open",
+					"domain", req.GetDomain(),
+					"error", err,
+				)
+				response.Statuses = append(response.Statuses, &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OK})
+				continue
+			}
+			logger.Error("Rate limiter error",
+				"domain", req.GetDomain(),
+				"error", err,
+			)
+			return nil, status.Error(codes.Unavailable, "rate limiter unavailable")
+		}
+
+		descriptorStatus := newDescriptorStatus(decision)
+		switch {
+		case decision.Shadow:
+			if !decision.Allowed {
+				shadow = "would-deny"
+			} else if shadow == "" {
+				shadow = "would-allow"
+			}
+		case !decision.Allowed:
+			logger.Warn("Rate limit exceeded",
+				"domain", req.GetDomain(),
+				"ip", request.IP,
+				"hasToken", request.Token != "",
+				"keyKind", decision.KeyKind,
+				"rule", decision.Rule,
+				"retryAfter", decision.RetryAfterSeconds(),
+			)
+			descriptorStatus.Code = rlsv3.RateLimitResponse_OVER_LIMIT
+			response.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+			retryAfter = max(retryAfter, decision.RetryAfterSeconds())
+			if decision.Quota != "" {
+				quota = decision.Quota
+			}
+		}
+		response.Statuses = append(response.Statuses, descriptorStatus)
+	}
+
+	if response.OverallCode == rlsv3.RateLimitResponse_OVER_LIMIT && retryAfter > 0 {
+		response.ResponseHeadersToAdd = append(response.ResponseHeadersToAdd, &corev3.HeaderValue{Key: "Retry-After", Value: strconv.Itoa(retryAfter)})
+	}
+	if quota != "" {
+		response.ResponseHeadersToAdd = append(response.ResponseHeadersToAdd, &corev3.HeaderValue{Key: QuotaHeader, Value: string(quota)})
+	}
+	if shadow != "" {
+		response.ResponseHeadersToAdd = append(response.ResponseHeadersToAdd, &corev3.HeaderValue{Key: ShadowHeader, Value: shadow})
+	}
+	return response, nil
+}
+
+// request maps the entries of descriptor to a limiter request. It reports
+// false when the descriptor names a route rule missing from snapshot.
+func (s *Server) request(snapshot *limiter.Snapshot, descriptor *ratelimitv3.RateLimitDescriptor) (limiter.Request, bool) {
+	var request limiter.Request
+	for _, entry := range descriptor.GetEntries() {
+		switch entry.GetKey() {
+		case DescriptorIP:
+			request.IP = entry.GetValue()
+		case DescriptorToken:
+			request.Token = entry.GetValue()
+		case DescriptorRoute:
+			request.Route = snapshot.Rule(entry.GetValue())
+			if request.Route == nil {
+				logger.Warn("Ignoring descriptor with an unknown route rule", "route", entry.GetValue())
+				return limiter.Request{}, false
+			}
+		}
+	}
+	return request, true
+}
+
+// newDescriptorStatus reports the matched limit of decision. Only the limit
+// itself is described when no limit applied.
+func newDescriptorStatus(decision *limiter.Decision) *rlsv3.RateLimitResponse_DescriptorStatus {
+	descriptorStatus := &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OK}
+	if decision.Limit == 0 {
+		return descriptorStatus
+	}
+	descriptorStatus.CurrentLimit = &rlsv3.RateLimitResponse_RateLimit{
+		Name:            decision.Rule,
+		RequestsPerUnit: uint32(decision.Limit),
+		Unit:            unit(decision.Window),
+	}
+	if quotaUnit, ok := quotaUnits[decision.Quota]; ok {
+		descriptorStatus.CurrentLimit.Unit = quotaUnit
+	}
+	descriptorStatus.LimitRemaining = uint32(max(decision.Remaining, 0))
+	descriptorStatus.DurationUntilReset = durationpb.New(max(time.Until(decision.Reset), 0))
+	return descriptorStatus
+}
+
+// quotaUnits maps the token quota periods to their Envoy unit, as a day or
+// month is not always the same length
+var quotaUnits = map[limiter.QuotaPeriod]rlsv3.RateLimitResponse_RateLimit_Unit{
+	limiter.QuotaHourly:  rlsv3.RateLimitResponse_RateLimit_HOUR,
+	limiter.QuotaDaily:   rlsv3.RateLimitResponse_RateLimit_DAY,
+	limiter.QuotaMonthly: rlsv3.RateLimitResponse_RateLimit_MONTH,
+}
+
+// unit returns the Envoy unit matching window, or UNKNOWN for windows that
+// are not a single second, minute, hour, day or week
+func unit(window time.Duration) rlsv3.RateLimitResponse_RateLimit_Unit {
+	switch window {
+	case time.Second:
+		return rlsv3.RateLimitResponse_RateLimit_SECOND
+	case time.Minute:
+		return rlsv3.RateLimitResponse_RateLimit_MINUTE
+	case time.Hour:
+		return rlsv3.RateLimitResponse_RateLimit_HOUR
+	case 24 * time.Hour:
+		return rlsv3.RateLimitResponse_RateLimit_DAY
+	case 7 * 24 * time.Hour:
+		return rlsv3.RateLimitResponse_RateLimit_WEEK
+	default:
+		return rlsv3.RateLimitResponse_RateLimit_UNKNOWN
+	}
+}
@@ -0,0 +1,305 @@
+package rls
+
+import (
+	"context"
+	"math"
+	"net"
+	"testing"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/config"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/iplist"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/limiter"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/rules"
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
+)
+
+// newClient serves server over an in-process connection and returns a client for it
+func newClient(t *testing.T, server *Server) rlsv3.RateLimitServiceClient {
+	t.Helper()
+
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	server.Register(grpcServer)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return rlsv3.NewRateLimitServiceClient(conn)
+}
+
+func newTestStorage(t *testing.T) *storage.MemoryStrategy {
+	t.Helper()
+
+	store := storage.NewMemoryStrategy(0, 0)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func descriptor(entries ...string) *ratelimitv3.RateLimitDescriptor {
+	d := &ratelimitv3.RateLimitDescriptor{}
+	for i := 0; i+1 < len(entries); i += 2 {
+		d.Entries = append(d.Entries, &ratelimitv3.RateLimitDescriptor_Entry{Key: entries[i], Value: entries[i+1]})
+	}
+	return d
+}
+
+func header(response *rlsv3.RateLimitResponse, key string) string {
+	for _, h := range response.GetResponseHeadersToAdd() {
+		if h.GetKey() == key {
+			return h.GetValue()
+		}
+	}
+	return ""
+}
+
+func TestShouldRateLimit(t *testing.T) {
+	store := newTestStorage(t)
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsIP:      2,
+		WindowIP:           60,
+		BlockDurationIP:    30,
+		EnableIPLimit:      true,
+		MaxRequestsToken:   5,
+		BlockDurationToken: 60,
+		EnableTokenLimit:   true,
+	}
+	set, err := rules.NewSet([]rules.Rule{
+		{ID: "search", IP: rules.Limit{MaxRequests: 1, Window: 1}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create rules: %v", err)
+	}
+	client := newClient(t, NewServer(limiter.NewRateLimiter(store, cfg, limiter.WithRules(set))))
+	ctx := context.Background()
+
+	request := &rlsv3.RateLimitRequest{
+		Domain:      "edge",
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor(DescriptorIP, "10.0.0.1")},
+	}
+	for i := 0; i < 2; i++ {
+		response, err := client.ShouldRateLimit(ctx, request)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if response.GetOverallCode() != rlsv3.RateLimitResponse_OK {
+			t.Errorf("Request %d: expected OK, got %s", i+1, response.GetOverallCode())
+		}
+		descriptorStatus := response.GetStatuses()[0]
+		if descriptorStatus.GetCurrentLimit().GetRequestsPerUnit() != 2 || descriptorStatus.GetCurrentLimit().GetUnit() != rlsv3.RateLimitResponse_RateLimit_MINUTE {
+			t.Errorf("Expected a limit of 2 per minute, got %+v", descriptorStatus.GetCurrentLimit())
+		}
+		if descriptorStatus.GetLimitRemaining() != uint32(1-i) {
+			t.Errorf("Request %d: expected %d remaining, got %d", i+1, 1-i, descriptorStatus.GetLimitRemaining())
+		}
+	}
+
+	response, err := client.ShouldRateLimit(ctx, request)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if response.GetOverallCode() != rlsv3.RateLimitResponse_OVER_LIMIT || response.GetStatuses()[0].GetCode() != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("Expected OVER_LIMIT, got %+v", response)
+	}
+	if got := header(response, "Retry-After"); got != "30" {
+		t.Errorf("Expected Retry-After 30, got %q", got)
+	}
+
+	// Every descriptor is decided on its own: a route rule and a token
+	response, err = client.ShouldRateLimit(ctx, &rlsv3.RateLimitRequest{
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{
+			descriptor(DescriptorIP, "10.0.0.2", DescriptorRoute, "search"),
+			descriptor(DescriptorToken, "abc"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if response.GetOverallCode() != rlsv3.RateLimitResponse_OK || len(response.GetStatuses()) != 2 {
+		t.Fatalf("Expected OK with 2 statuses, got %+v", response)
+	}
+	if limit := response.GetStatuses()[0].GetCurrentLimit(); limit.GetName() != "route:search" || limit.GetRequestsPerUnit() != 1 || limit.GetUnit() != rlsv3.RateLimitResponse_RateLimit_SECOND {
+		t.Errorf("Expected the search rule limit, got %+v", limit)
+	}
+	if limit := response.GetStatuses()[1].GetCurrentLimit(); limit.GetName() != "global" || limit.GetRequestsPerUnit() != 5 {
+		t.Errorf("Expected the global token limit, got %+v", limit)
+	}
+	if data, _ := store.GetData(ctx, "route:search:ip:10.0.0.2"); data == nil || data.Count != 1 {
+		t.Errorf("Expected the route key to be counted, got %+v", data)
+	}
+
+	// Unknown routes and descriptors without a key are not limited
+	response, err = client.ShouldRateLimit(ctx, &rlsv3.RateLimitRequest{
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{
+			descriptor(DescriptorIP, "10.0.0.1", DescriptorRoute, "missing"),
+			descriptor("generic_key", "static"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if response.GetOverallCode() != rlsv3.RateLimitResponse_OK || response.GetStatuses()[0].GetCurrentLimit() != nil {
+		t.Errorf("Expected OK without limits, got %+v", response)
+	}
+}
+
+func TestShouldRateLimitDryRunAndDenyList(t *testing.T) {
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsIP:   1,
+		BlockDurationIP: 60,
+		EnableIPLimit:   true,
+		DryRun:          true,
+	}
+	lists := iplist.NewLists(iplist.Entries{}, nil)
+	deny, _ := iplist.ParseEntries(nil, []string{"203.0.113.0/24"})
+	lists.SetConfigured(deny)
+	client := newClient(t, NewServer(limiter.NewRateLimiter(newTestStorage(t), cfg, limiter.WithIPLists(lists))))
+	ctx := context.Background()
+
+	request := &rlsv3.RateLimitRequest{Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor(DescriptorIP, "10.0.0.1")}}
+	for i, want := range []string{"would-allow", "would-deny"} {
+		response, err := client.ShouldRateLimit(ctx, request)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if response.GetOverallCode() != rlsv3.RateLimitResponse_OK || header(response, ShadowHeader) != want {
+			t.Errorf("Request %d: expected OK with %s, got %+v", i+1, want, response)
+		}
+	}
+
+	// The deny list is enforced even in dry-run
+	response, err := client.ShouldRateLimit(ctx, &rlsv3.RateLimitRequest{Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor(DescriptorIP, "203.0.113.9")}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if response.GetOverallCode() != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("Expected OVER_LIMIT for a denied IP, got %s", response.GetOverallCode())
+	}
+}
+
+func TestShouldRateLimitQuota(t *testing.T) {
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsToken:   10,
+		BlockDurationToken: 60,
+		EnableTokenLimit:   true,
+		DailyQuotaToken:    1,
+	}
+	client := newClient(t, NewServer(limiter.NewRateLimiter(newTestStorage(t), cfg)))
+	ctx := context.Background()
+
+	request := &rlsv3.RateLimitRequest{Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor(DescriptorToken, "abc")}}
+	if response, err := client.ShouldRateLimit(ctx, request); err != nil || response.GetOverallCode() != rlsv3.RateLimitResponse_OK {
+		t.Fatalf("Expected OK, got %+v, %v", response, err)
+	}
+	response, err := client.ShouldRateLimit(ctx, request)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if response.GetOverallCode() != rlsv3.RateLimitResponse_OVER_LIMIT || header(response, QuotaHeader) != "daily" || header(response, "Retry-After") == "" {
+		t.Errorf("Expected OVER_LIMIT with the daily quota, got %+v", response)
+	}
+	if limit := response.GetStatuses()[0].GetCurrentLimit(); limit.GetRequestsPerUnit() != 1 || limit.GetUnit() != rlsv3.RateLimitResponse_RateLimit_DAY {
+		t.Errorf("Expected a limit of 1 per day, got %+v", limit)
+	}
+}
+
+func TestShouldRateLimitHitsAddend(t *testing.T) {
+	cfg := &config.RateLimiterConfig{
+		MaxRequestsIP:   10,
+		BlockDurationIP: 60,
+		EnableIPLimit:   true,
+	}
+	client := newClient(t, NewServer(limiter.NewRateLimiter(newTestStorage(t), cfg)))
+	ctx := context.Background()
+
+	for i, tt := range []struct {
+		hits      uint32
+		code      rlsv3.RateLimitResponse_Code
+		remaining uint32
+	}{{0, rlsv3.RateLimitResponse_OK, 9}, {6, rlsv3.RateLimitResponse_OK, 3}, {4, rlsv3.RateLimitResponse_OVER_LIMIT, 0}} {
+		response, err := client.ShouldRateLimit(ctx, &rlsv3.RateLimitRequest{
+			Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor(DescriptorIP, "203.0.113.7")},
+			HitsAddend:  tt.hits,
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if response.GetOverallCode() != tt.code || response.GetStatuses()[0].GetLimitRemaining() != tt.remaining {
+			t.Errorf("Request %d: expected %s with %d remaining, got %+v", i+1, tt.code, tt.remaining, response)
+		}
+	}
+
+	response, err := client.ShouldRateLimit(ctx, &rlsv3.RateLimitRequest{
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor(DescriptorIP, "203.0.113.8")},
+		HitsAddend:  11,
+	})
+	if err != nil || response.GetOverallCode() != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("Expected OVER_LIMIT for a hits_addend above the limit, got %+v (%v)", response, err)
+	}
+
+	_, err = client.ShouldRateLimit(ctx, &rlsv3.RateLimitRequest{
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor(DescriptorIP, "203.0.113.9")},
+		HitsAddend:  math.MaxInt32 + 1,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a hits_addend above MaxInt32, got %v", err)
+	}
+}
+
+// unavailableStorage fails every Consume call, like an unreachable Redis
+type unavailableStorage struct {
+	storage.Strategy
+}
+
+func (unavailableStorage) Consume(ctx context.Context, key string, limit storage.Limit) (*storage.HitResult, error) {
+	return nil, context.DeadlineExceeded
+}
+
+func TestShouldRateLimitFailurePolicies(t *testing.T) {
+	cfg := &config.RateLimiterConfig{MaxRequestsIP: 1, BlockDurationIP: 60, EnableIPLimit: true}
+	request := &rlsv3.RateLimitRequest{Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor(DescriptorIP, "10.0.0.1"), descriptor(DescriptorIP, "10.0.0.2")}}
+	ctx := context.Background()
+
+	closed := newClient(t, NewServer(limiter.NewRateLimiter(unavailableStorage{}, cfg)))
+	if _, err := closed.ShouldRateLimit(ctx, request); status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected Unavailable, got %v", err)
+	}
+
+	open := newClient(t, NewServer(limiter.NewRateLimiter(unavailableStorage{}, cfg), WithFailurePolicy(config.FailureOpen)))
+	response, err := open.ShouldRateLimit(ctx, request)
+	if err != nil || response.GetOverallCode() != rlsv3.RateLimitResponse_OK {
+		t.Fatalf("Expected OK when failing open, got %+v (%v)", response, err)
+	}
+	if statuses := response.GetStatuses(); len(statuses) != 2 || statuses[0].GetCode() != rlsv3.RateLimitResponse_OK || statuses[1].GetCode() != rlsv3.RateLimitResponse_OK {
+		t.Errorf("Expected an OK status per descriptor when failing open, got %+v", statuses)
+	}
+
+	// Failing open does not let through descriptors decided before the failure
+	lists := iplist.NewLists(iplist.Entries{}, nil)
+	deny, _ := iplist.ParseEntries(nil, []string{"203.0.113.0/24"})
+	lists.SetConfigured(deny)
+	open = newClient(t, NewServer(limiter.NewRateLimiter(unavailableStorage{}, cfg, limiter.WithIPLists(lists)), WithFailurePolicy(config.FailureOpen)))
+	response, err = open.ShouldRateLimit(ctx, &rlsv3.RateLimitRequest{Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor(DescriptorIP, "203.0.113.9"), descriptor(DescriptorIP, "10.0.0.1")}})
+	if err != nil || response.GetOverallCode() != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("Expected OVER_LIMIT for the denied descriptor, got %+v (%v)", response, err)
+	}
+	if statuses := response.GetStatuses(); len(statuses) != 2 || statuses[0].GetCode() != rlsv3.RateLimitResponse_OVER_LIMIT || statuses[1].GetCode() != rlsv3.RateLimitResponse_OK {
+		t.Errorf("Expected OVER_LIMIT then OK, got %+v", statuses)
+	}
+}
@@ -0,0 +1,34 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/pkg/logger"
+)
+
+// LoadFile reads a rule set from a JSON file of the form
+//
+//	{"rules": [{"id": "search", "path_prefix": "/search", "methods": ["GET"], "ip": {"max_requests": 2}}]}
+func LoadFile(path string) (*Set, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules: %w", err)
+	}
+
+	var file struct {
+		Rules []Rule `json:"rules"`
+	}
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse rules %s: %w", path, err)
+	}
+
+	set, err := NewSet(file.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rules %s: %w", path, err)
+	}
+
+	logger.Info("Rules loaded", "path", path, "rules", len(file.Rules))
+	return set, nil
+}
@@ -0,0 +1,174 @@
+package rules
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
+)
+
+// Limit overrides the global IP or token limit for the requests a rule matches.
+// Zero values and an empty algorithm inherit the global settings.
+type Limit struct {
+	MaxRequests   int    `json:"max_requests"`
+	Window        int    `json:"window"`         // Window length in seconds
+	BlockDuration int    `json:"block_duration"` // Block duration in seconds
+	Algorithm     string `json:"algorithm"`
+}
+
+// Rule gives the requests matching a path, method and host their own limits,
+// counted separately from other routes under route:<id>: keys
+type Rule struct {
+	ID         string   `json:"id"`
+	PathPrefix string   `json:"path_prefix"` // Matches paths starting with this prefix on a segment boundary
+	Path       string   `json:"path"`        // Matches paths against a path.Match pattern, e.g. /users/*/orders
+	Methods    []string `json:"methods"`     // Empty matches every method
+	Hosts      []string `json:"hosts"`       // Empty matches every host; entries may use path.Match wildcards such as *.example.com
+	Exempt     bool     `json:"exempt"`      // Skip rate limiting entirely
+	DryRun     bool     `json:"dry_run"`     // Record the rule's decisions without enforcing them
+	Cost       int      `json:"cost"`        // Requests charged per matching request against every limit, 0 counts as 1
+	IP         Limit    `json:"ip"`
+	Token      Limit    `json:"token"`
+}
+
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Validate checks that the rule can be matched and applied
+func (r *Rule) Validate() error {
+	if !idPattern.MatchString(r.ID) {
+		return fmt.Errorf("rule id %q must be non-empty and contain only letters, digits, '.', '_' and '-'", r.ID)
+	}
+	if r.Path != "" {
+		if _, err := path.Match(r.Path, "/"); err != nil {
+			return fmt.Errorf("rule %s: invalid path pattern %q: %w", r.ID, r.Path, err)
+		}
+	}
+	for _, host := range r.Hosts {
+		if _, err := path.Match(host, ""); err != nil {
+			return fmt.Errorf("rule %s: invalid host pattern %q: %w", r.ID, host, err)
+		}
+	}
+	if r.Cost < 0 {
+		return fmt.Errorf("rule %s: cost must not be negative", r.ID)
+	}
+	for name, limit := range map[string]Limit{"ip": r.IP, "token": r.Token} {
+		if limit.MaxRequests < 0 || limit.Window < 0 || limit.BlockDuration < 0 {
+			return fmt.Errorf("rule %s: %s limit values must not be negative", r.ID, name)
+		}
+		if limit.Algorithm != "" {
+			if _, err := storage.ParseAlgorithm(limit.Algorithm); err != nil {
+				return fmt.Errorf("rule %s: %w", r.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Matches reports whether req falls under the rule
+func (r *Rule) Matches(req *http.Request) bool {
+	if r.PathPrefix != "" && !hasPathPrefix(req.URL.Path, r.PathPrefix) {
+		return false
+	}
+	if r.Path != "" {
+		if ok, _ := path.Match(r.Path, req.URL.Path); !ok {
+			return false
+		}
+	}
+	if len(r.Methods) > 0 && !containsFold(r.Methods, req.Method) {
+		return false
+	}
+	if len(r.Hosts) > 0 && !r.matchesHost(req.Host) {
+		return false
+	}
+	return true
+}
+
+// hasPathPrefix reports whether p starts with prefix on a segment boundary,
+// so /health matches /health and /health/live but not /healthz
+func hasPathPrefix(p, prefix string) bool {
+	if !strings.HasPrefix(p, prefix) {
+		return false
+	}
+	return len(p) == len(prefix) || strings.HasSuffix(prefix, "/") || p[len(prefix)] == '/'
+}
+
+func (r *Rule) matchesHost(hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range r.Hosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Set is an ordered list of rules; the first matching rule wins
+type Set struct {
+	rules []Rule
+}
+
+// NewSet validates rules and returns them as a set, keeping their order
+func NewSet(rules []Rule) (*Set, error) {
+	seen := make(map[string]bool, len(rules))
+	for i := range rules {
+		if err := rules[i].Validate(); err != nil {
+			return nil, err
+		}
+		if seen[rules[i].ID] {
+			return nil, fmt.Errorf("rule %s is defined more than once", rules[i].ID)
+		}
+		seen[rules[i].ID] = true
+	}
+	return &Set{rules: rules}, nil
+}
+
+// Match returns the first rule matching req, or nil when the global limits apply
+func (s *Set) Match(req *http.Request) *Rule {
+	if s == nil {
+		return nil
+	}
+	for i := range s.rules {
+		if s.rules[i].Matches(req) {
+			return &s.rules[i]
+		}
+	}
+	return nil
+}
+
+// Get returns the rule with id, or nil when the set has none
+func (s *Set) Get(id string) *Rule {
+	if s == nil {
+		return nil
+	}
+	for i := range s.rules {
+		if s.rules[i].ID == id {
+			return &s.rules[i]
+		}
+	}
+	return nil
+}
+
+// Rules returns the rules of the set in evaluation order
+func (s *Set) Rules() []Rule {
+	if s == nil {
+		return nil
+	}
+	return append([]Rule(nil), s.rules...)
+}
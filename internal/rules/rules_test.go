@@ -0,0 +1,119 @@
+package rules
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetMatch(t *testing.T) {
+	set, err := NewSet([]Rule{
+		{ID: "health", PathPrefix: "/health", Exempt: true},
+		{ID: "search-post", PathPrefix: "/search", Methods: []string{"POST"}},
+		{ID: "search", PathPrefix: "/search"},
+		{ID: "orders", Path: "/users/*/orders"},
+		{ID: "admin-host", Hosts: []string{"admin.example.com", "*.internal"}},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	tests := []struct {
+		method   string
+		target   string
+		host     string
+		expected string
+	}{
+		{"GET", "/health", "", "health"},
+		{"GET", "/health/live", "", "health"},
+		{"GET", "/healthz", "", ""},
+		{"GET", "/healthX", "", ""},
+		{"GET", "/health-export", "", ""},
+		{"POST", "/search?q=go", "", "search-post"},
+		{"post", "/search", "", "search-post"},
+		{"GET", "/search/advanced", "", "search"},
+		{"GET", "/users/42/orders", "", "orders"},
+		{"GET", "/users/42/orders/7", "", ""},
+		{"GET", "/", "ADMIN.example.com:8080", "admin-host"},
+		{"GET", "/", "billing.internal", "admin-host"},
+		{"GET", "/", "example.com", ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.target, nil)
+		req.Method = tt.method
+		if tt.host != "" {
+			req.Host = tt.host
+		}
+
+		id := ""
+		if rule := set.Match(req); rule != nil {
+			id = rule.ID
+		}
+		if id != tt.expected {
+			t.Errorf("%s %s (host %q): expected rule %q, got %q", tt.method, tt.target, tt.host, tt.expected, id)
+		}
+	}
+
+	if rule := set.Get("orders"); rule == nil || rule.Path != "/users/*/orders" {
+		t.Errorf("Expected the orders rule, got %+v", rule)
+	}
+	if rule := set.Get("missing"); rule != nil {
+		t.Errorf("Expected no rule, got %+v", rule)
+	}
+}
+
+func TestNilSetMatchesNothing(t *testing.T) {
+	var set *Set
+	if rule := set.Match(httptest.NewRequest("GET", "/", nil)); rule != nil {
+		t.Errorf("Expected no rule, got %+v", rule)
+	}
+	if rule := set.Get("health"); rule != nil {
+		t.Errorf("Expected no rule, got %+v", rule)
+	}
+}
+
+func TestNewSetRejectsInvalidRules(t *testing.T) {
+	for _, rules := range [][]Rule{
+		{{}},
+		{{ID: "a:b"}},
+		{{ID: "a"}, {ID: "a"}},
+		{{ID: "a", Path: "/["}},
+		{{ID: "a", IP: Limit{MaxRequests: -1}}},
+		{{ID: "a", Token: Limit{Algorithm: "leaky_bucket"}}},
+		{{ID: "a", Cost: -1}},
+	} {
+		if _, err := NewSet(rules); err == nil {
+			t.Errorf("Expected %+v to be rejected", rules)
+		}
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	content := `{"rules": [
+		{"id": "search", "path_prefix": "/search", "methods": ["GET"],
+		 "ip": {"max_requests": 2, "window": 10, "block_duration": 30, "algorithm": "sliding_log"}}
+	]}`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write rules: %v", err)
+	}
+
+	set, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	loaded := set.Rules()
+	if len(loaded) != 1 {
+		t.Fatalf("Expected 1 rule, got %d", len(loaded))
+	}
+	expected := Limit{MaxRequests: 2, Window: 10, BlockDuration: 30, Algorithm: "sliding_log"}
+	if loaded[0].IP != expected {
+		t.Errorf("Expected %+v, got %+v", expected, loaded[0].IP)
+	}
+
+	if _, err := LoadFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("Expected error for a missing file")
+	}
+}
@@ -0,0 +1,344 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// clockedStrategy couples a storage backend with a way to move its clock forward
+type clockedStrategy struct {
+	Strategy
+	advance func(d time.Duration)
+}
+
+func algorithmBackends(t *testing.T) map[string]func() clockedStrategy {
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	return map[string]func() clockedStrategy{
+		"memory": func() clockedStrategy {
+			clock := &fakeClock{now: start}
+			st := NewMemoryStrategy(0, 0)
+			st.now = clock.Now
+			t.Cleanup(func() { st.Close() })
+			return clockedStrategy{Strategy: st, advance: clock.Advance}
+		},
+		"redis": func() clockedStrategy {
+			mr := miniredis.RunT(t)
+			mr.SetTime(start)
+			st, err := NewRedisStrategy(mr.Addr(), 0, "")
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			t.Cleanup(func() { st.Close() })
+			now := start
+			return clockedStrategy{Strategy: st, advance: func(d time.Duration) {
+				now = now.Add(d)
+				mr.SetTime(now)
+				mr.FastForward(d)
+			}}
+		},
+	}
+}
+
+func consumeN(t *testing.T, st Strategy, key string, limit Limit, n int) int {
+	t.Helper()
+
+	allowed := 0
+	for i := 0; i < n; i++ {
+		result, err := st.Consume(context.Background(), key, limit)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if result.Allowed {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestAlgorithmsBoundaryBurst(t *testing.T) {
+	const maxRequests = 10
+
+	// Requests allowed between t=950ms and t=1s after a single request at t=0
+	expected := map[Algorithm]int{
+		AlgorithmFixedWindow:          19,
+		AlgorithmSlidingLog:           10,
+		AlgorithmSlidingWindowCounter: 9,
+		AlgorithmTokenBucket:          10,
+		AlgorithmGCRA:                 10,
+	}
+
+	for backend, newStrategy := range algorithmBackends(t) {
+		for _, algorithm := range Algorithms {
+			t.Run(fmt.Sprintf("%s/%s", backend, algorithm), func(t *testing.T) {
+				st := newStrategy()
+				limit := Limit{Algorithm: algorithm, Max: maxRequests, Window: time.Second}
+
+				consumeN(t, st, "ip:1.2.3.4", limit, 1)
+				st.advance(950 * time.Millisecond)
+				burst := consumeN(t, st, "ip:1.2.3.4", limit, maxRequests-1)
+				st.advance(50 * time.Millisecond)
+				burst += consumeN(t, st, "ip:1.2.3.4", limit, maxRequests)
+
+				if burst != expected[algorithm] {
+					t.Errorf("Expected %d requests allowed across the boundary, got %d", expected[algorithm], burst)
+				}
+				if algorithm != AlgorithmFixedWindow && burst > maxRequests {
+					t.Errorf("Boundary burst of %d exceeds the limit of %d", burst, maxRequests)
+				}
+			})
+		}
+	}
+}
+
+func TestAlgorithmsRetryAfter(t *testing.T) {
+	const maxRequests = 10
+
+	for backend, newStrategy := range algorithmBackends(t) {
+		for _, algorithm := range Algorithms {
+			t.Run(fmt.Sprintf("%s/%s", backend, algorithm), func(t *testing.T) {
+				st := newStrategy()
+				ctx := context.Background()
+				limit := Limit{Algorithm: algorithm, Max: maxRequests, Window: time.Second}
+
+				if allowed := consumeN(t, st, "token:abc", limit, maxRequests); allowed != maxRequests {
+					t.Fatalf("Expected %d allowed requests, got %d", maxRequests, allowed)
+				}
+
+				result, err := st.Consume(ctx, "token:abc", limit)
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				if result.Allowed || result.Remaining != 0 || result.RetryAfter <= 0 {
+					t.Fatalf("Expected a denial with a retry delay, got %+v", result)
+				}
+
+				st.advance(result.RetryAfter)
+				result, err = st.Consume(ctx, "token:abc", limit)
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				if !result.Allowed {
+					t.Errorf("Request should be allowed after waiting RetryAfter, got %+v", result)
+				}
+			})
+		}
+	}
+}
+
+func TestAlgorithmsBlockAndGetData(t *testing.T) {
+	for backend, newStrategy := range algorithmBackends(t) {
+		for _, algorithm := range Algorithms {
+			t.Run(fmt.Sprintf("%s/%s", backend, algorithm), func(t *testing.T) {
+				st := newStrategy()
+				ctx := context.Background()
+				limit := Limit{Algorithm: algorithm, Max: 3, Window: time.Second, Block: 10 * time.Second}
+
+				consumeN(t, st, "ip:1.2.3.4", limit, 2)
+				data, err := st.GetData(ctx, "ip:1.2.3.4")
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				if data == nil || data.Count != 2 {
+					t.Fatalf("Expected count 2, got %+v", data)
+				}
+
+				consumeN(t, st, "ip:1.2.3.4", limit, 2)
+				result, err := st.Consume(ctx, "ip:1.2.3.4", limit)
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				if !result.Blocked || result.RetryAfter != 10*time.Second {
+					t.Errorf("Expected the key to be blocked for 10s, got %+v", result)
+				}
+			})
+		}
+	}
+}
+
+func TestAlgorithmsWeightedCost(t *testing.T) {
+	for backend, newStrategy := range algorithmBackends(t) {
+		for _, algorithm := range Algorithms {
+			t.Run(fmt.Sprintf("%s/%s", backend, algorithm), func(t *testing.T) {
+				st := newStrategy()
+				ctx := context.Background()
+				limit := Limit{Algorithm: algorithm, Max: 10, Window: time.Second, Cost: 4}
+
+				for _, remaining := range []int{6, 2} {
+					result, err := st.Consume(ctx, "token:abc", limit)
+					if err != nil {
+						t.Fatalf("Expected no error, got %v", err)
+					}
+					if !result.Allowed || result.Remaining != remaining {
+						t.Fatalf("Expected an allowed request with %d remaining, got %+v", remaining, result)
+					}
+				}
+
+				// A cost above the remaining budget is denied without consuming it
+				result, err := st.Consume(ctx, "token:abc", limit)
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				if result.Allowed || result.RetryAfter <= 0 {
+					t.Fatalf("Expected a denial with a retry delay, got %+v", result)
+				}
+				small := limit
+				small.Cost = 2
+				if allowed := consumeN(t, st, "token:abc", small, 2); allowed != 1 {
+					t.Errorf("Expected the remaining 2 requests to be consumed once, got %d allowed", allowed)
+				}
+
+				result, _ = st.Consume(ctx, "token:abc", limit)
+				st.advance(result.RetryAfter)
+				result, err = st.Consume(ctx, "token:abc", limit)
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				if !result.Allowed {
+					t.Errorf("Request should be allowed after waiting RetryAfter, got %+v", result)
+				}
+
+				// A cost above the limit is denied without blocking the key
+				huge := limit
+				huge.Cost = 11
+				huge.Block = time.Minute
+				huge.Penalty = Penalty{Multiplier: 2, MaxBlock: time.Hour, Decay: time.Hour}
+				for range 2 {
+					result, err := st.Consume(ctx, "token:huge", huge)
+					if err != nil {
+						t.Fatalf("Expected no error, got %v", err)
+					}
+					if result.Allowed || result.Blocked || result.Strikes != 0 {
+						t.Errorf("Expected a plain denial, got %+v", result)
+					}
+				}
+				normal := huge
+				normal.Cost = 1
+				if allowed := consumeN(t, st, "token:huge", normal, 1); allowed != 1 {
+					t.Errorf("Expected a normal cost to be allowed after an oversized one")
+				}
+			})
+		}
+	}
+}
+
+func TestRefund(t *testing.T) {
+	for backend, newStrategy := range algorithmBackends(t) {
+		t.Run(backend, func(t *testing.T) {
+			st := newStrategy()
+			ctx := context.Background()
+			limit := Limit{Algorithm: AlgorithmFixedWindow, Max: 5, Window: time.Minute, Cost: 3}
+
+			consumeN(t, st, "quota:abc", limit, 1)
+			if err := st.Refund(ctx, "quota:abc", 2); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if data, _ := st.GetData(ctx, "quota:abc"); data == nil || data.Count != 1 {
+				t.Errorf("Expected 1 request left after the refund, got %+v", data)
+			}
+			st.Refund(ctx, "quota:abc", 10)
+			if allowed := consumeN(t, st, "quota:abc", Limit{Algorithm: AlgorithmFixedWindow, Max: 5, Window: time.Minute}, 6); allowed != 5 {
+				t.Errorf("Expected a refund never to go below zero, got %d allowed", allowed)
+			}
+
+			// Missing keys and other algorithms are left alone
+			if err := st.Refund(ctx, "quota:missing", 1); err != nil {
+				t.Errorf("Expected no error for a missing key, got %v", err)
+			}
+			bucket := Limit{Algorithm: AlgorithmTokenBucket, Max: 2, Window: time.Minute}
+			consumeN(t, st, "token:abc", bucket, 2)
+			st.Refund(ctx, "token:abc", 2)
+			if allowed := consumeN(t, st, "token:abc", bucket, 1); allowed != 0 {
+				t.Errorf("Expected the token bucket not to be refunded")
+			}
+		})
+	}
+}
+
+func TestAlgorithmSwitchDiscardsState(t *testing.T) {
+	for backend, newStrategy := range algorithmBackends(t) {
+		t.Run(backend, func(t *testing.T) {
+			st := newStrategy()
+
+			for _, algorithm := range Algorithms {
+				limit := Limit{Algorithm: algorithm, Max: 2, Window: time.Second}
+				if allowed := consumeN(t, st, "ip:1.2.3.4", limit, 3); allowed != 2 {
+					t.Errorf("%s: expected 2 allowed requests, got %d", algorithm, allowed)
+				}
+			}
+		})
+	}
+}
+
+func TestPenaltyEscalatesBlocks(t *testing.T) {
+	for backend, newStrategy := range algorithmBackends(t) {
+		t.Run(backend, func(t *testing.T) {
+			st := newStrategy()
+			ctx := context.Background()
+			limit := Limit{
+				Algorithm: AlgorithmFixedWindow,
+				Max:       1,
+				Window:    time.Second,
+				Block:     10 * time.Second,
+				Penalty:   Penalty{Multiplier: 2, MaxBlock: 35 * time.Second, Decay: time.Minute},
+			}
+
+			violate := func(wantStrikes int, wantBlock time.Duration) {
+				t.Helper()
+				if allowed := consumeN(t, st, "ip:1.2.3.4", limit, 1); allowed != 1 {
+					t.Fatalf("Expected the first request to be allowed")
+				}
+				result, err := st.Consume(ctx, "ip:1.2.3.4", limit)
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				if result.Allowed || result.Strikes != wantStrikes || result.RetryAfter != wantBlock {
+					t.Errorf("Expected strike %d blocking for %v, got %+v", wantStrikes, wantBlock, result)
+				}
+				st.advance(result.RetryAfter)
+			}
+
+			violate(1, 10*time.Second)
+			violate(2, 20*time.Second)
+			violate(3, 35*time.Second)
+
+			// Strikes are forgotten once the decay passes without a violation
+			st.advance(time.Minute + time.Second)
+			violate(1, 10*time.Second)
+
+			// Resetting the key forgives its strikes
+			if err := st.Reset(ctx, "ip:1.2.3.4"); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			violate(1, 10*time.Second)
+		})
+	}
+}
+
+func TestPenaltyBlockFor(t *testing.T) {
+	penalty := Penalty{Multiplier: 3, MaxBlock: time.Minute, Decay: time.Minute}
+	tests := []struct {
+		base   time.Duration
+		strike int
+		want   time.Duration
+	}{
+		{10 * time.Second, 1, 10 * time.Second},
+		{10 * time.Second, 2, 30 * time.Second},
+		{10 * time.Second, 3, time.Minute},
+		{10 * time.Second, 1000, time.Minute},
+		{2 * time.Minute, 3, 2 * time.Minute}, // The cap never shortens the base block
+	}
+	for _, tt := range tests {
+		if got := penalty.BlockFor(tt.base, tt.strike); got != tt.want {
+			t.Errorf("BlockFor(%v, %d): expected %v, got %v", tt.base, tt.strike, tt.want, got)
+		}
+	}
+
+	if got := (Penalty{Multiplier: 1}).BlockFor(10*time.Second, 5); got != 10*time.Second {
+		t.Errorf("Expected a disabled penalty to keep the base block, got %v", got)
+	}
+}
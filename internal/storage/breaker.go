@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/pkg/logger"
+)
+
+// BreakerState is the state of a BreakerStrategy
+type BreakerState string
+
+const (
+	// BreakerClosed passes every call through
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen fails every call fast until the open timeout elapses
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets a single probe call through to decide whether to close again
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// ErrCircuitOpen is returned without calling the storage while the breaker is
+// open, as a *CircuitOpenError
+var ErrCircuitOpen = errors.New("storage circuit breaker is open")
+
+// CircuitOpenError is the ErrCircuitOpen of a breaker failing fast
+type CircuitOpenError struct {
+	RetryAfter time.Duration // Time until the breaker lets a probe through, 0 while a probe is in flight
+}
+
+func (e *CircuitOpenError) Error() string {
+	return ErrCircuitOpen.Error()
+}
+
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// BreakerStrategy is a circuit breaker around another Strategy. It opens after
+// threshold consecutive failures, fails fast for the open timeout, then lets a
+// single probe through and closes again once the probe succeeds.
+type BreakerStrategy struct {
+	next      Strategy
+	threshold int
+	timeout   time.Duration
+	onChange  func(from, to BreakerState)
+	now       func() time.Time
+
+	mu         sync.Mutex
+	state      BreakerState
+	generation uint64 // Incremented on every transition, so late outcomes of calls let through in a previous state are ignored
+	failures   int
+	openedAt   time.Time
+	probing    bool
+}
+
+// NewBreakerStrategy wraps next in a circuit breaker. onChange, when set, is
+// called on every state transition.
+func NewBreakerStrategy(next Strategy, threshold int, timeout time.Duration, onChange func(from, to BreakerState)) *BreakerStrategy {
+	return &BreakerStrategy{
+		next:      next,
+		threshold: max(threshold, 1),
+		timeout:   timeout,
+		onChange:  onChange,
+		now:       time.Now,
+		state:     BreakerClosed,
+	}
+}
+
+// State returns the current breaker state
+func (b *BreakerStrategy) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// acquire reports whether a call may go through, moving an expired open
+// breaker to half-open. It returns the generation the call is let through in.
+func (b *BreakerStrategy) acquire() (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if retryAfter := b.openedAt.Add(b.timeout).Sub(b.now()); retryAfter > 0 {
+			return 0, &CircuitOpenError{RetryAfter: retryAfter}
+		}
+		b.transition(BreakerHalfOpen)
+		b.probing = true
+	case BreakerHalfOpen:
+		if b.probing {
+			return 0, &CircuitOpenError{}
+		}
+		b.probing = true
+	}
+	return b.generation, nil
+}
+
+// release records the outcome of a call let through by acquire in generation.
+// err must come from the storage: errors of the caller's input are never
+// counted as failures.
+func (b *BreakerStrategy) release(generation uint64, err error) {
+	// A caller giving up says nothing about the health of the storage
+	if errors.Is(err, context.Canceled) {
+		err = nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// The breaker changed state since the call started, e.g. a call let
+	// through while closed is not the probe of a later half-open state
+	if generation != b.generation {
+		return
+	}
+
+	if b.state == BreakerHalfOpen {
+		b.probing = false
+		if err != nil {
+			b.open()
+		} else {
+			b.failures = 0
+			b.transition(BreakerClosed)
+		}
+		return
+	}
+
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == BreakerClosed && b.failures >= b.threshold {
+		b.open()
+	}
+}
+
+func (b *BreakerStrategy) open() {
+	b.openedAt = b.now()
+	b.transition(BreakerOpen)
+}
+
+// transition changes the state, must be called with mu held
+func (b *BreakerStrategy) transition(to BreakerState) {
+	from := b.state
+	if from == to {
+		return
+	}
+	b.state = to
+	b.generation++
+
+	if to == BreakerOpen {
+		logger.Warn("Storage circuit breaker state changed",
+			"from", from,
+			"to", to,
+			"failures", b.failures,
+			"retryAfter", b.timeout.String(),
+		)
+	} else {
+		logger.Info("Storage circuit breaker state changed", "from", from, "to", to)
+	}
+	if b.onChange != nil {
+		b.onChange(from, to)
+	}
+}
+
+func (b *BreakerStrategy) CheckAndIncrement(ctx context.Context, key string, maxRequests int, windowSeconds int) (bool, error) {
+	generation, err := b.acquire()
+	if err != nil {
+		return false, err
+	}
+	allowed, err := b.next.CheckAndIncrement(ctx, key, maxRequests, windowSeconds)
+	b.release(generation, err)
+	return allowed, err
+}
+
+func (b *BreakerStrategy) Consume(ctx context.Context, key string, limit Limit) (*HitResult, error) {
+	// An invalid limit never reaches the storage, so it must not trip the breaker
+	if err := limit.Validate(); err != nil {
+		return nil, err
+	}
+	generation, err := b.acquire()
+	if err != nil {
+		return nil, err
+	}
+	result, err := b.next.Consume(ctx, key, limit)
+	b.release(generation, err)
+	return result, err
+}
+
+func (b *BreakerStrategy) IsBlocked(ctx context.Context, key string) (bool, error) {
+	generation, err := b.acquire()
+	if err != nil {
+		return false, err
+	}
+	blocked, err := b.next.IsBlocked(ctx, key)
+	b.release(generation, err)
+	return blocked, err
+}
+
+func (b *BreakerStrategy) Block(ctx context.Context, key string, durationSeconds int) error {
+	generation, err := b.acquire()
+	if err != nil {
+		return err
+	}
+	err = b.next.Block(ctx, key, durationSeconds)
+	b.release(generation, err)
+	return err
+}
+
+func (b *BreakerStrategy) Reset(ctx context.Context, key string) error {
+	generation, err := b.acquire()
+	if err != nil {
+		return err
+	}
+	err = b.next.Reset(ctx, key)
+	b.release(generation, err)
+	return err
+}
+
+func (b *BreakerStrategy) Refund(ctx context.Context, key string, cost int) error {
+	generation, err := b.acquire()
+	if err != nil {
+		return err
+	}
+	err = b.next.Refund(ctx, key, cost)
+	b.release(generation, err)
+	return err
+}
+
+func (b *BreakerStrategy) GetData(ctx context.Context, key string) (*LimiterData, error) {
+	generation, err := b.acquire()
+	if err != nil {
+		return nil, err
+	}
+	data, err := b.next.GetData(ctx, key)
+	b.release(generation, err)
+	return data, err
+}
+
+func (b *BreakerStrategy) Close() error {
+	return b.next.Close()
+}
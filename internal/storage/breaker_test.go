@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyStrategy fails every call with err while it is set
+type flakyStrategy struct {
+	Strategy
+	mu  sync.Mutex
+	err error
+}
+
+func (f *flakyStrategy) fail(err error) {
+	f.mu.Lock()
+	f.err = err
+	f.mu.Unlock()
+}
+
+func (f *flakyStrategy) Consume(ctx context.Context, key string, limit Limit) (*HitResult, error) {
+	f.mu.Lock()
+	err := f.err
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return f.Strategy.Consume(ctx, key, limit)
+}
+
+func TestBreakerTripsAndRecovers(t *testing.T) {
+	memory, clock := newTestMemoryStrategy(t, 0)
+	flaky := &flakyStrategy{Strategy: memory}
+	var transitions []string
+	breaker := NewBreakerStrategy(flaky, 3, 10*time.Second, func(from, to BreakerState) {
+		transitions = append(transitions, string(from)+"->"+string(to))
+	})
+	breaker.now = clock.Now
+	ctx := context.Background()
+	limit := fixedWindowLimit(100, 60, 0)
+
+	errDown := errors.New("connection refused")
+	flaky.fail(errDown)
+	for i := 0; i < 3; i++ {
+		if _, err := breaker.Consume(ctx, "k", limit); !errors.Is(err, errDown) {
+			t.Fatalf("Call %d: expected storage error, got %v", i+1, err)
+		}
+	}
+	if breaker.State() != BreakerOpen {
+		t.Fatalf("Expected breaker to open after 3 failures, got %s", breaker.State())
+	}
+
+	// Open: fail fast without reaching the storage
+	flaky.fail(nil)
+	clock.Advance(4 * time.Second)
+	_, err := breaker.Consume(ctx, "k", limit)
+	var open *CircuitOpenError
+	if !errors.Is(err, ErrCircuitOpen) || !errors.As(err, &open) {
+		t.Fatalf("Expected ErrCircuitOpen, got %v", err)
+	}
+	if open.RetryAfter != 6*time.Second {
+		t.Errorf("Expected retry after the 6s left, got %v", open.RetryAfter)
+	}
+	clock.Advance(-4 * time.Second)
+
+	// Half-open probe fails: open again
+	clock.Advance(10 * time.Second)
+	flaky.fail(errDown)
+	if _, err := breaker.Consume(ctx, "k", limit); !errors.Is(err, errDown) {
+		t.Errorf("Expected the probe to reach the storage, got %v", err)
+	}
+	if breaker.State() != BreakerOpen {
+		t.Errorf("Expected failed probe to reopen the breaker, got %s", breaker.State())
+	}
+
+	// Half-open probe succeeds: closed
+	clock.Advance(10 * time.Second)
+	flaky.fail(nil)
+	if _, err := breaker.Consume(ctx, "k", limit); err != nil {
+		t.Errorf("Expected probe to succeed, got %v", err)
+	}
+	if breaker.State() != BreakerClosed {
+		t.Errorf("Expected breaker to close, got %s", breaker.State())
+	}
+
+	expected := []string{"closed->open", "open->half_open", "half_open->open", "open->half_open", "half_open->closed"}
+	if len(transitions) != len(expected) {
+		t.Fatalf("Expected transitions %v, got %v", expected, transitions)
+	}
+	for i := range expected {
+		if transitions[i] != expected[i] {
+			t.Errorf("Expected transitions %v, got %v", expected, transitions)
+			break
+		}
+	}
+}
+
+func TestBreakerIgnoresCanceledCallsAndIntermittentErrors(t *testing.T) {
+	memory, _ := newTestMemoryStrategy(t, 0)
+	flaky := &flakyStrategy{Strategy: memory}
+	breaker := NewBreakerStrategy(flaky, 2, time.Second, nil)
+	ctx := context.Background()
+	limit := fixedWindowLimit(100, 60, 0)
+
+	flaky.fail(context.Canceled)
+	for i := 0; i < 5; i++ {
+		breaker.Consume(ctx, "k", limit)
+	}
+	if breaker.State() != BreakerClosed {
+		t.Errorf("Expected canceled calls not to open the breaker, got %s", breaker.State())
+	}
+
+	// Failures must be consecutive
+	for i := 0; i < 5; i++ {
+		flaky.fail(errors.New("timeout"))
+		breaker.Consume(ctx, "k", limit)
+		flaky.fail(nil)
+		breaker.Consume(ctx, "k", limit)
+	}
+	if breaker.State() != BreakerClosed {
+		t.Errorf("Expected intermittent failures not to open the breaker, got %s", breaker.State())
+	}
+}
+
+func TestBreakerIgnoresInvalidLimits(t *testing.T) {
+	memory, _ := newTestMemoryStrategy(t, 0)
+	breaker := NewBreakerStrategy(memory, 1, time.Second, nil)
+
+	for i := 0; i < 3; i++ {
+		if _, err := breaker.Consume(context.Background(), "k", Limit{Algorithm: "leaky_bucket", Max: 1, Window: time.Second}); err == nil {
+			t.Fatal("Expected the invalid limit to be rejected")
+		}
+	}
+	if breaker.State() != BreakerClosed {
+		t.Errorf("Expected invalid limits not to open the breaker, got %s", breaker.State())
+	}
+}
+
+// gatedStrategy holds every Consume call until released
+type gatedStrategy struct {
+	Strategy
+	started, release chan struct{}
+}
+
+func (g *gatedStrategy) Consume(ctx context.Context, key string, limit Limit) (*HitResult, error) {
+	g.started <- struct{}{}
+	<-g.release
+	return g.Strategy.Consume(ctx, key, limit)
+}
+
+func TestBreakerIgnoresStaleOutcomes(t *testing.T) {
+	memory, clock := newTestMemoryStrategy(t, 0)
+	gated := &gatedStrategy{Strategy: memory, started: make(chan struct{}), release: make(chan struct{})}
+	breaker := NewBreakerStrategy(gated, 1, 10*time.Second, nil)
+	breaker.now = clock.Now
+	limit := fixedWindowLimit(100, 60, 0)
+
+	// A slow call let through while closed
+	done := make(chan error)
+	go func() {
+		_, err := breaker.Consume(context.Background(), "k", limit)
+		done <- err
+	}()
+	<-gated.started
+
+	// Meanwhile the breaker opens, then lets a probe through
+	generation, _ := breaker.acquire()
+	breaker.release(generation, errors.New("connection refused"))
+	clock.Advance(10 * time.Second)
+	probe, err := breaker.acquire()
+	if err != nil || breaker.State() != BreakerHalfOpen {
+		t.Fatalf("Expected a half-open probe, got %s, %v", breaker.State(), err)
+	}
+
+	// The slow call succeeding is not the outcome of the probe
+	close(gated.release)
+	if err := <-done; err != nil {
+		t.Fatalf("Expected the slow call to succeed, got %v", err)
+	}
+	if breaker.State() != BreakerHalfOpen {
+		t.Errorf("Expected the stale success to leave the breaker half-open, got %s", breaker.State())
+	}
+
+	breaker.release(probe, errors.New("connection refused"))
+	if breaker.State() != BreakerOpen {
+		t.Errorf("Expected the failed probe to reopen the breaker, got %s", breaker.State())
+	}
+}
+
+func TestFallbackStrategy(t *testing.T) {
+	primary, _ := newTestMemoryStrategy(t, 0)
+	flaky := &flakyStrategy{Strategy: primary}
+	fallback, _ := newTestMemoryStrategy(t, 0)
+	st := NewFallbackStrategy(flaky, fallback)
+	ctx := context.Background()
+	limit := fixedWindowLimit(2, 60, 0)
+
+	st.Consume(ctx, "k", limit)
+	flaky.fail(errors.New("connection refused"))
+
+	for i, allowed := range []bool{true, true, false} {
+		result, err := st.Consume(ctx, "k", limit)
+		if err != nil {
+			t.Fatalf("Expected fallback to serve the call, got %v", err)
+		}
+		if result.Allowed != allowed {
+			t.Errorf("Call %d: expected allowed=%v, got %v", i+1, allowed, result.Allowed)
+		}
+	}
+	if fallback.Len() != 1 {
+		t.Errorf("Expected the fallback to hold the key, got %d keys", fallback.Len())
+	}
+}
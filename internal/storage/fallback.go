@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/pkg/logger"
+)
+
+// FallbackStrategy serves every call from primary, switching to fallback for
+// the calls primary fails. It is meant to keep limiting requests with a local
+// MemoryStrategy while a shared backend is unreachable; limits are then
+// enforced per instance rather than cluster-wide.
+type FallbackStrategy struct {
+	primary  Strategy
+	fallback Strategy
+}
+
+// NewFallbackStrategy creates a strategy falling back from primary to fallback
+func NewFallbackStrategy(primary, fallback Strategy) *FallbackStrategy {
+	return &FallbackStrategy{primary: primary, fallback: fallback}
+}
+
+// failed reports whether err should send the call to the fallback
+func failed(method string, err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	logger.Debug("Primary storage failed, using fallback", "method", method, "error", err)
+	return true
+}
+
+func (f *FallbackStrategy) CheckAndIncrement(ctx context.Context, key string, maxRequests int, windowSeconds int) (bool, error) {
+	allowed, err := f.primary.CheckAndIncrement(ctx, key, maxRequests, windowSeconds)
+	if failed("CheckAndIncrement", err) {
+		return f.fallback.CheckAndIncrement(ctx, key, maxRequests, windowSeconds)
+	}
+	return allowed, err
+}
+
+func (f *FallbackStrategy) Consume(ctx context.Context, key string, limit Limit) (*HitResult, error) {
+	result, err := f.primary.Consume(ctx, key, limit)
+	if failed("Consume", err) {
+		return f.fallback.Consume(ctx, key, limit)
+	}
+	return result, err
+}
+
+func (f *FallbackStrategy) IsBlocked(ctx context.Context, key string) (bool, error) {
+	blocked, err := f.primary.IsBlocked(ctx, key)
+	if failed("IsBlocked", err) {
+		return f.fallback.IsBlocked(ctx, key)
+	}
+	return blocked, err
+}
+
+func (f *FallbackStrategy) Block(ctx context.Context, key string, durationSeconds int) error {
+	err := f.primary.Block(ctx, key, durationSeconds)
+	if failed("Block", err) {
+		return f.fallback.Block(ctx, key, durationSeconds)
+	}
+	return err
+}
+
+func (f *FallbackStrategy) Reset(ctx context.Context, key string) error {
+	err := f.primary.Reset(ctx, key)
+	if failed("Reset", err) {
+		return f.fallback.Reset(ctx, key)
+	}
+	return err
+}
+
+func (f *FallbackStrategy) Refund(ctx context.Context, key string, cost int) error {
+	err := f.primary.Refund(ctx, key, cost)
+	if failed("Refund", err) {
+		return f.fallback.Refund(ctx, key, cost)
+	}
+	return err
+}
+
+func (f *FallbackStrategy) GetData(ctx context.Context, key string) (*LimiterData, error) {
+	data, err := f.primary.GetData(ctx, key)
+	if failed("GetData", err) {
+		return f.fallback.GetData(ctx, key)
+	}
+	return data, err
+}
+
+// Close closes both strategies
+func (f *FallbackStrategy) Close() error {
+	return errors.Join(f.primary.Close(), f.fallback.Close())
+}
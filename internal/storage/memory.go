@@ -0,0 +1,390 @@
+package storage
+
+import (
+	"context"
+	"hash/fnv"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/pkg/logger"
+)
+
+const memoryShardCount = 64
+
+// memoryNoExpiry stands in for the expiry of keys blocked indefinitely
+var memoryNoExpiry = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+// MemoryStrategy is a goroutine-safe in-process Strategy for single-node
+// deployments and tests. Keys are spread over sharded maps, expired keys are
+// evicted by a background janitor and the total number of keys is bounded.
+type MemoryStrategy struct {
+	shards      [memoryShardCount]*memoryShard
+	maxPerShard int
+	now         func() time.Time
+	stop        chan struct{}
+	stopOnce    sync.Once
+	wg          sync.WaitGroup
+}
+
+type memoryShard struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+}
+
+type memoryEntry struct {
+	algorithm Algorithm
+	limit     Limit       // Last limit applied to the key
+	count     int         // Requests in the current window (fixed window, sliding window counter)
+	previous  int         // Requests in the previous aligned window (sliding window counter)
+	index     int64       // Index of the current aligned window (sliding window counter)
+	log       []time.Time // Timestamps of requests in the trailing window (sliding log)
+	tokens    float64     // Tokens left in the bucket (token bucket)
+	updatedAt time.Time   // Last refill of the bucket (token bucket)
+	tat       time.Time   // Theoretical arrival time (GCRA)
+	expiresAt time.Time   // When the state is fully replenished and can be dropped
+
+	blocked      bool
+	blockedUntil time.Time // zero means the block never expires
+
+	strikes       int       // Violations counted by an escalating penalty
+	strikesExpiry time.Time // When the strikes are forgotten
+}
+
+// NewMemoryStrategy creates an in-memory storage holding at most maxKeys keys
+// (0 means unbounded) and sweeping expired keys every cleanupInterval
+func NewMemoryStrategy(maxKeys int, cleanupInterval time.Duration) *MemoryStrategy {
+	m := &MemoryStrategy{
+		now:  time.Now,
+		stop: make(chan struct{}),
+	}
+	if maxKeys > 0 {
+		m.maxPerShard = (maxKeys + memoryShardCount - 1) / memoryShardCount
+	}
+	for i := range m.shards {
+		m.shards[i] = &memoryShard{entries: make(map[string]*memoryEntry)}
+	}
+
+	if cleanupInterval > 0 {
+		m.wg.Add(1)
+		go m.janitor(cleanupInterval)
+	}
+
+	logger.Info("Using in-memory storage",
+		"maxKeys", maxKeys,
+		"cleanupInterval", cleanupInterval.String(),
+	)
+	return m
+}
+
+func (m *MemoryStrategy) CheckAndIncrement(ctx context.Context, key string, maxRequests int, windowSeconds int) (allowed bool, err error) {
+	result, err := m.Consume(ctx, key, Limit{
+		Algorithm: AlgorithmFixedWindow,
+		Max:       maxRequests,
+		Window:    time.Duration(windowSeconds) * time.Second,
+	})
+	if err != nil {
+		return false, err
+	}
+	return result.Allowed, nil
+}
+
+func (m *MemoryStrategy) Consume(ctx context.Context, key string, limit Limit) (*HitResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := limit.Validate(); err != nil {
+		return nil, err
+	}
+
+	now := m.now()
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	entry := shard.entries[key]
+	if entry != nil && entry.isBlocked(now) {
+		result := &HitResult{Blocked: true}
+		if !entry.blockedUntil.IsZero() {
+			result.ResetAfter = entry.blockedUntil.Sub(now)
+			result.RetryAfter = result.ResetAfter
+		}
+		return result, nil
+	}
+
+	// A cost above the limit can never fit: it is denied without blocking the
+	// key, which stays available to requests of a normal cost
+	if limit.Max > 0 && limit.cost() > limit.Max {
+		return &HitResult{ResetAfter: limit.Window, RetryAfter: limit.Window}, nil
+	}
+
+	if entry == nil {
+		entry = &memoryEntry{}
+		m.insert(shard, key, entry, now)
+	}
+	if entry.algorithm != limit.Algorithm || !now.Before(entry.expiresAt) {
+		entry.resetState(limit.Algorithm)
+	}
+	entry.limit = limit
+
+	result := entry.consume(now, limit)
+	if !result.Allowed {
+		logger.Debug("Rate limit threshold reached",
+			"key", key,
+			"algorithm", limit.Algorithm,
+			"count", result.Count,
+			"maxRequests", limit.Max,
+		)
+		if limit.Block > 0 {
+			block := limit.Block
+			if limit.Penalty.Enabled() {
+				if !now.Before(entry.strikesExpiry) {
+					entry.strikes = 0
+				}
+				entry.strikes++
+				result.Strikes = entry.strikes
+				block = limit.Penalty.BlockFor(limit.Block, entry.strikes)
+				entry.strikesExpiry = now.Add(block + limit.Penalty.Decay)
+			}
+			entry.block(now, block)
+			result.RetryAfter = block
+			result.ResetAfter = max(result.ResetAfter, block)
+		}
+	}
+	return result, nil
+}
+
+func (m *MemoryStrategy) IsBlocked(ctx context.Context, key string) (blocked bool, err error) {
+	now := m.now()
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	entry := shard.entries[key]
+	return entry != nil && entry.isBlocked(now), nil
+}
+
+func (m *MemoryStrategy) Block(ctx context.Context, key string, durationSeconds int) error {
+	now := m.now()
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	entry := shard.entries[key]
+	if entry == nil {
+		entry = &memoryEntry{}
+		m.insert(shard, key, entry, now)
+	}
+	entry.block(now, time.Duration(durationSeconds)*time.Second)
+
+	logger.Debug("Key blocked",
+		"key", key,
+		"durationSeconds", durationSeconds,
+	)
+	return nil
+}
+
+func (m *MemoryStrategy) Reset(ctx context.Context, key string) error {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	delete(shard.entries, key)
+	shard.mu.Unlock()
+
+	logger.Debug("Key reset", "key", key)
+	return nil
+}
+
+func (m *MemoryStrategy) Refund(ctx context.Context, key string, cost int) error {
+	now := m.now()
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	entry := shard.entries[key]
+	if entry != nil && entry.algorithm == AlgorithmFixedWindow && now.Before(entry.expiresAt) {
+		entry.count = max(entry.count-cost, 0)
+	}
+	return nil
+}
+
+func (m *MemoryStrategy) GetData(ctx context.Context, key string) (*LimiterData, error) {
+	now := m.now()
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	entry := shard.entries[key]
+	if entry == nil || entry.expired(now) {
+		return nil, nil
+	}
+
+	data := &LimiterData{IsBlocked: entry.isBlocked(now)}
+	if now.Before(entry.expiresAt) {
+		data.Count = entry.used(now)
+		data.ExpiresAt = entry.expiresAt
+	}
+	return data, nil
+}
+
+// Close stops the background janitor and drops every key
+func (m *MemoryStrategy) Close() error {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+		m.wg.Wait()
+		for _, shard := range m.shards {
+			shard.mu.Lock()
+			shard.entries = make(map[string]*memoryEntry)
+			shard.mu.Unlock()
+		}
+		logger.Info("Closing in-memory storage")
+	})
+	return nil
+}
+
+// Len returns the number of keys currently held, including expired keys not yet swept
+func (m *MemoryStrategy) Len() int {
+	total := 0
+	for _, shard := range m.shards {
+		shard.mu.Lock()
+		total += len(shard.entries)
+		shard.mu.Unlock()
+	}
+	return total
+}
+
+// CountBlocked returns the number of keys currently blocked
+func (m *MemoryStrategy) CountBlocked(ctx context.Context) (int, error) {
+	now := m.now()
+	total := 0
+	for _, shard := range m.shards {
+		shard.mu.Lock()
+		for _, entry := range shard.entries {
+			if entry.isBlocked(now) {
+				total++
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return total, nil
+}
+
+// ListBlocked returns blocked keys in lexical order; the cursor is the last key
+// of the previous page
+func (m *MemoryStrategy) ListBlocked(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	now := m.now()
+	var keys []string
+	for _, shard := range m.shards {
+		shard.mu.Lock()
+		for key, entry := range shard.entries {
+			if key > cursor && entry.isBlocked(now) {
+				keys = append(keys, key)
+			}
+		}
+		shard.mu.Unlock()
+	}
+	slices.Sort(keys)
+
+	if limit <= 0 || len(keys) <= limit {
+		return keys, "", nil
+	}
+	return keys[:limit], keys[limit-1], nil
+}
+
+func (m *MemoryStrategy) shard(key string) *memoryShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return m.shards[h.Sum32()%memoryShardCount]
+}
+
+// insert adds an entry to a locked shard, making room first when the shard is full
+func (m *MemoryStrategy) insert(shard *memoryShard, key string, entry *memoryEntry, now time.Time) {
+	if m.maxPerShard > 0 && len(shard.entries) >= m.maxPerShard {
+		shard.sweep(now)
+		if len(shard.entries) >= m.maxPerShard {
+			shard.evictOldest()
+		}
+	}
+	shard.entries[key] = entry
+}
+
+func (m *MemoryStrategy) janitor(interval time.Duration) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			now := m.now()
+			removed := 0
+			for _, shard := range m.shards {
+				shard.mu.Lock()
+				removed += shard.sweep(now)
+				shard.mu.Unlock()
+			}
+			if removed > 0 {
+				logger.Debug("Evicted expired keys", "count", removed)
+			}
+		}
+	}
+}
+
+// sweep removes expired entries from a locked shard and returns how many were removed
+func (s *memoryShard) sweep(now time.Time) int {
+	removed := 0
+	for key, entry := range s.entries {
+		if entry.expired(now) {
+			delete(s.entries, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// evictOldest removes the entry of a locked shard that would expire first
+func (s *memoryShard) evictOldest() {
+	var victim string
+	var victimExpiry time.Time
+	for key, entry := range s.entries {
+		expiry := entry.expiry()
+		if victim == "" || expiry.Before(victimExpiry) {
+			victim, victimExpiry = key, expiry
+		}
+	}
+	delete(s.entries, victim)
+}
+
+func (e *memoryEntry) block(now time.Time, duration time.Duration) {
+	e.blocked = true
+	e.blockedUntil = time.Time{}
+	if duration > 0 {
+		e.blockedUntil = now.Add(duration)
+	}
+}
+
+func (e *memoryEntry) isBlocked(now time.Time) bool {
+	return e.blocked && (e.blockedUntil.IsZero() || now.Before(e.blockedUntil))
+}
+
+// expiry returns the instant after which the entry holds no state nor strikes,
+// or the far future for indefinite blocks
+func (e *memoryEntry) expiry() time.Time {
+	if e.blocked && e.blockedUntil.IsZero() {
+		return memoryNoExpiry
+	}
+	expiry := e.expiresAt
+	if e.blocked && e.blockedUntil.After(expiry) {
+		expiry = e.blockedUntil
+	}
+	if e.strikes > 0 && e.strikesExpiry.After(expiry) {
+		expiry = e.strikesExpiry
+	}
+	return expiry
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !now.Before(e.expiry())
+}
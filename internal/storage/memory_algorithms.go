@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"math"
+	"time"
+)
+
+// resetState drops the algorithm state of an entry, keeping its block
+func (e *memoryEntry) resetState(algorithm Algorithm) {
+	e.algorithm = algorithm
+	e.count = 0
+	e.previous = 0
+	e.index = 0
+	e.log = nil
+	e.tokens = 0
+	e.updatedAt = time.Time{}
+	e.tat = time.Time{}
+	e.expiresAt = time.Time{}
+}
+
+// consume applies the limit's algorithm to a locked entry. An empty limit
+// denies every request.
+func (e *memoryEntry) consume(now time.Time, limit Limit) *HitResult {
+	if limit.Max <= 0 {
+		return &HitResult{ResetAfter: limit.Window, RetryAfter: limit.Window}
+	}
+
+	switch limit.Algorithm {
+	case AlgorithmSlidingLog:
+		return e.slidingLog(now, limit)
+	case AlgorithmSlidingWindowCounter:
+		return e.slidingWindowCounter(now, limit)
+	case AlgorithmTokenBucket:
+		return e.tokenBucket(now, limit)
+	case AlgorithmGCRA:
+		return e.gcra(now, limit)
+	default:
+		return e.fixedWindow(now, limit)
+	}
+}
+
+func (e *memoryEntry) fixedWindow(now time.Time, limit Limit) *HitResult {
+	if e.count == 0 {
+		e.expiresAt = now.Add(limit.Window)
+	}
+	resetAfter := e.expiresAt.Sub(now)
+
+	if e.count+limit.cost() <= limit.Max {
+		e.count += limit.cost()
+		return &HitResult{
+			Allowed:    true,
+			Count:      e.count,
+			Remaining:  limit.Max - e.count,
+			ResetAfter: resetAfter,
+		}
+	}
+	return &HitResult{Count: e.count, ResetAfter: resetAfter, RetryAfter: resetAfter}
+}
+
+func (e *memoryEntry) slidingLog(now time.Time, limit Limit) *HitResult {
+	e.trimLog(now, limit.Window)
+
+	cost := limit.cost()
+	if len(e.log)+cost <= limit.Max {
+		for range cost {
+			e.log = append(e.log, now)
+		}
+		e.expiresAt = now.Add(limit.Window)
+		return &HitResult{
+			Allowed:    true,
+			Count:      len(e.log),
+			Remaining:  limit.Max - len(e.log),
+			ResetAfter: limit.Window,
+		}
+	}
+
+	// The cost fits once enough of the oldest requests left the window
+	leaving, newest := e.log[len(e.log)+cost-limit.Max-1], e.log[len(e.log)-1]
+	return &HitResult{
+		Count:      len(e.log),
+		ResetAfter: newest.Add(limit.Window).Sub(now),
+		RetryAfter: leaving.Add(limit.Window).Sub(now),
+	}
+}
+
+func (e *memoryEntry) slidingWindowCounter(now time.Time, limit Limit) *HitResult {
+	window := int64(limit.Window)
+	index := now.UnixNano() / window
+	switch index {
+	case e.index:
+	case e.index + 1:
+		e.previous, e.count = e.count, 0
+	default:
+		e.previous, e.count = 0, 0
+	}
+	e.index = index
+
+	elapsed := now.UnixNano() - index*window
+	used := float64(e.previous)*float64(window-elapsed)/float64(window) + float64(e.count)
+	resetAfter := time.Duration((index+2)*window - now.UnixNano())
+
+	max, cost := float64(limit.Max), float64(limit.cost())
+	if used+cost <= max {
+		e.count += limit.cost()
+		e.expiresAt = now.Add(resetAfter)
+		return &HitResult{
+			Allowed:    true,
+			Count:      e.count,
+			Remaining:  int(math.Floor(max - used - cost)),
+			ResetAfter: resetAfter,
+		}
+	}
+
+	var retryAfter float64
+	if float64(e.count)+cost <= max {
+		retryAfter = float64(window-elapsed) - (max-cost-float64(e.count))*float64(window)/float64(e.previous)
+	} else {
+		retryAfter = float64(window-elapsed) + math.Max(0, float64(window)-(max-cost)*float64(window)/float64(e.count))
+	}
+	return &HitResult{
+		Count:      e.count,
+		ResetAfter: resetAfter,
+		RetryAfter: ceilDuration(retryAfter),
+	}
+}
+
+func (e *memoryEntry) tokenBucket(now time.Time, limit Limit) *HitResult {
+	max, cost := float64(limit.Max), float64(limit.cost())
+	rate := max / float64(limit.Window)
+	e.refill(now, limit)
+
+	if e.tokens >= cost {
+		e.tokens -= cost
+		resetAfter := ceilDuration((max - e.tokens) / rate)
+		e.expiresAt = now.Add(resetAfter)
+		remaining := int(math.Floor(e.tokens))
+		return &HitResult{
+			Allowed:    true,
+			Count:      limit.Max - remaining,
+			Remaining:  remaining,
+			ResetAfter: resetAfter,
+		}
+	}
+
+	return &HitResult{
+		Count:      limit.Max,
+		ResetAfter: ceilDuration((max - e.tokens) / rate),
+		RetryAfter: ceilDuration((cost - e.tokens) / rate),
+	}
+}
+
+func (e *memoryEntry) gcra(now time.Time, limit Limit) *HitResult {
+	interval := float64(limit.Window) / float64(limit.Max)
+	tat := e.tat
+	if tat.Before(now) {
+		tat = now
+	}
+
+	newTat := tat.Add(time.Duration(interval * float64(limit.cost())))
+	allowAt := newTat.Add(-limit.Window)
+	if !allowAt.After(now) {
+		e.tat = newTat
+		e.expiresAt = newTat
+		remaining := int(math.Floor(float64(limit.Window-newTat.Sub(now))/interval + 1e-9))
+		return &HitResult{
+			Allowed:    true,
+			Count:      limit.Max - remaining,
+			Remaining:  remaining,
+			ResetAfter: newTat.Sub(now),
+		}
+	}
+
+	return &HitResult{
+		Count:      limit.Max,
+		ResetAfter: tat.Sub(now),
+		RetryAfter: allowAt.Sub(now),
+	}
+}
+
+// used returns the requests currently held against the entry's limit
+func (e *memoryEntry) used(now time.Time) int {
+	switch e.algorithm {
+	case AlgorithmSlidingLog:
+		e.trimLog(now, e.limit.Window)
+		return len(e.log)
+	case AlgorithmTokenBucket:
+		e.refill(now, e.limit)
+		return e.limit.Max - int(math.Floor(e.tokens))
+	case AlgorithmGCRA:
+		if e.limit.Max <= 0 || !e.tat.After(now) {
+			return 0
+		}
+		interval := float64(e.limit.Window) / float64(e.limit.Max)
+		return min(e.limit.Max, int(math.Ceil(float64(e.tat.Sub(now))/interval)))
+	default:
+		return e.count
+	}
+}
+
+// trimLog drops sliding log entries outside the trailing window
+func (e *memoryEntry) trimLog(now time.Time, window time.Duration) {
+	cutoff := now.Add(-window)
+	kept := 0
+	for kept < len(e.log) && !e.log[kept].After(cutoff) {
+		kept++
+	}
+	e.log = e.log[kept:]
+}
+
+// refill tops up the token bucket for the time elapsed since the last refill
+func (e *memoryEntry) refill(now time.Time, limit Limit) {
+	max := float64(limit.Max)
+	if e.updatedAt.IsZero() {
+		e.tokens = max
+		e.updatedAt = now
+		return
+	}
+	if now.After(e.updatedAt) {
+		rate := max / float64(limit.Window)
+		e.tokens = math.Min(max, e.tokens+float64(now.Sub(e.updatedAt))*rate)
+		e.updatedAt = now
+	}
+}
+
+func ceilDuration(nanoseconds float64) time.Duration {
+	return time.Duration(math.Ceil(nanoseconds))
+}
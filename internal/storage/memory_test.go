@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced time source for the memory strategy
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func newTestMemoryStrategy(t *testing.T, maxKeys int) (*MemoryStrategy, *fakeClock) {
+	t.Helper()
+
+	clock := &fakeClock{now: time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)}
+	st := NewMemoryStrategy(maxKeys, 0)
+	st.now = clock.Now
+	t.Cleanup(func() { st.Close() })
+	return st, clock
+}
+
+func TestMemoryConcurrentBurstAllowsExactlyMax(t *testing.T) {
+	st, _ := newTestMemoryStrategy(t, 0)
+	ctx := context.Background()
+
+	const maxRequests = 25
+	const attempts = 500
+
+	var wg sync.WaitGroup
+	var allowedCount atomic.Int64
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := st.Consume(ctx, "ip:10.0.0.1", fixedWindowLimit(maxRequests, 60, 30))
+			if err != nil {
+				t.Errorf("Expected no error, got %v", err)
+				return
+			}
+			if result.Allowed {
+				allowedCount.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowedCount.Load() != maxRequests {
+		t.Errorf("Expected exactly %d allowed requests, got %d", maxRequests, allowedCount.Load())
+	}
+}
+
+func TestMemoryWindowAndBlockExpiry(t *testing.T) {
+	st, clock := newTestMemoryStrategy(t, 0)
+	ctx := context.Background()
+
+	for i := 1; i <= 2; i++ {
+		allowed, err := st.CheckAndIncrement(ctx, "ip:1.2.3.4", 2, 1)
+		if err != nil || !allowed {
+			t.Fatalf("Request %d should be allowed, got allowed=%v err=%v", i, allowed, err)
+		}
+	}
+
+	// A new window resets the counter
+	clock.Advance(time.Second)
+	allowed, err := st.CheckAndIncrement(ctx, "ip:1.2.3.4", 2, 1)
+	if err != nil || !allowed {
+		t.Fatalf("Request in a new window should be allowed, got allowed=%v err=%v", allowed, err)
+	}
+
+	// Exceeding the limit blocks the key for the block duration
+	st.Consume(ctx, "ip:1.2.3.4", fixedWindowLimit(2, 1, 5))
+	result, err := st.Consume(ctx, "ip:1.2.3.4", fixedWindowLimit(2, 1, 5))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Allowed || result.Blocked {
+		t.Fatalf("3rd request should exceed the limit, got %+v", result)
+	}
+
+	clock.Advance(2 * time.Second)
+	result, err = st.Consume(ctx, "ip:1.2.3.4", fixedWindowLimit(2, 1, 5))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Blocked || result.RetryAfter != 3*time.Second {
+		t.Fatalf("Key should still be blocked for 3s, got %+v", result)
+	}
+
+	clock.Advance(3 * time.Second)
+	blocked, _ := st.IsBlocked(ctx, "ip:1.2.3.4")
+	if blocked {
+		t.Error("Block should have expired")
+	}
+	allowed, _ = st.CheckAndIncrement(ctx, "ip:1.2.3.4", 2, 1)
+	if !allowed {
+		t.Error("Request should be allowed after the block expired")
+	}
+}
+
+func TestMemoryGetDataAndReset(t *testing.T) {
+	st, clock := newTestMemoryStrategy(t, 0)
+	ctx := context.Background()
+
+	st.CheckAndIncrement(ctx, "token:abc", 10, 1)
+	st.CheckAndIncrement(ctx, "token:abc", 10, 1)
+
+	data, err := st.GetData(ctx, "token:abc")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if data == nil || data.Count != 2 || !data.ExpiresAt.Equal(clock.Now().Add(time.Second)) {
+		t.Fatalf("Unexpected data %+v", data)
+	}
+
+	st.Reset(ctx, "token:abc")
+	data, _ = st.GetData(ctx, "token:abc")
+	if data != nil {
+		t.Errorf("Expected no data after reset, got %+v", data)
+	}
+}
+
+func TestMemoryMaxKeysBound(t *testing.T) {
+	st, _ := newTestMemoryStrategy(t, memoryShardCount)
+	ctx := context.Background()
+
+	for i := 0; i < 10*memoryShardCount; i++ {
+		st.CheckAndIncrement(ctx, fmt.Sprintf("ip:10.0.%d.%d", i/256, i%256), 10, 60)
+	}
+
+	if st.Len() > memoryShardCount {
+		t.Errorf("Expected at most %d keys, got %d", memoryShardCount, st.Len())
+	}
+}
+
+func TestMemoryJanitorEvictsExpiredKeys(t *testing.T) {
+	st := NewMemoryStrategy(0, 10*time.Millisecond)
+	defer st.Close()
+	ctx := context.Background()
+
+	st.CheckAndIncrement(ctx, "ip:1.2.3.4", 10, 0)
+
+	deadline := time.Now().Add(time.Second)
+	for st.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if st.Len() != 0 {
+		t.Errorf("Expected expired key to be evicted, %d keys left", st.Len())
+	}
+}
+
+func fixedWindowLimit(maxRequests, windowSeconds, blockSeconds int) Limit {
+	return Limit{
+		Algorithm: AlgorithmFixedWindow,
+		Max:       maxRequests,
+		Window:    time.Duration(windowSeconds) * time.Second,
+		Block:     time.Duration(blockSeconds) * time.Second,
+	}
+}
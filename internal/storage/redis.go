@@ -2,8 +2,14 @@ package storage
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -11,116 +17,202 @@ import (
 	"github.com/markuscandido/go-expert-desafio-rate-limiter/pkg/logger"
 )
 
+// Redis deployment modes
+const (
+	RedisStandalone = "standalone"
+	RedisCluster    = "cluster"
+	RedisSentinel   = "sentinel"
+)
+
+// RedisOptions describes how to reach Redis
+type RedisOptions struct {
+	Mode       string   // RedisStandalone (default), RedisCluster or RedisSentinel
+	Addrs      []string // Server address, cluster seed nodes or sentinel addresses
+	MasterName string   // Master monitored by the sentinels
+	DB         int      // Database number, unsupported by Redis Cluster
+	Username   string   // ACL username
+	Password   string
+
+	SentinelUsername string
+	SentinelPassword string
+
+	TLS *tls.Config // Nil disables TLS
+
+	PoolSize     int           // Connections per node (0 uses the go-redis default)
+	DialTimeout  time.Duration // 0 uses the go-redis defaults
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
 type RedisStrategy struct {
-	client *redis.Client
+	client redis.UniversalClient
+	// cluster wraps keys in a hash tag so a key and its :blocked marker, which
+	// the Lua scripts touch together, always share a cluster slot
+	cluster bool
 }
 
 func NewRedisStrategy(addr string, db int, password string) (*RedisStrategy, error) {
-	client := redis.NewClient(&redis.Options{
-		Addr:     addr,
-		DB:       db,
-		Password: password,
-	})
+	return NewRedisStrategyWithOptions(RedisOptions{Addrs: []string{addr}, DB: db, Password: password})
+}
+
+// NewRedisStrategyWithOptions connects to a standalone, cluster or sentinel
+// managed Redis deployment
+func NewRedisStrategyWithOptions(opts RedisOptions) (*RedisStrategy, error) {
+	if opts.Mode == "" {
+		opts.Mode = RedisStandalone
+	}
+	universal := &redis.UniversalOptions{
+		Addrs:            opts.Addrs,
+		DB:               opts.DB,
+		Username:         opts.Username,
+		Password:         opts.Password,
+		SentinelUsername: opts.SentinelUsername,
+		SentinelPassword: opts.SentinelPassword,
+		TLSConfig:        opts.TLS,
+		PoolSize:         opts.PoolSize,
+		DialTimeout:      opts.DialTimeout,
+		ReadTimeout:      opts.ReadTimeout,
+		WriteTimeout:     opts.WriteTimeout,
+	}
+	switch opts.Mode {
+	case RedisStandalone:
+		if len(opts.Addrs) != 1 {
+			return nil, fmt.Errorf("standalone Redis takes exactly one address, got %d", len(opts.Addrs))
+		}
+	case RedisCluster:
+		if opts.DB != 0 {
+			return nil, fmt.Errorf("Redis Cluster only supports database 0")
+		}
+		universal.IsClusterMode = true
+	case RedisSentinel:
+		if opts.MasterName == "" {
+			return nil, fmt.Errorf("Redis Sentinel requires a master name")
+		}
+		universal.MasterName = opts.MasterName
+	default:
+		return nil, fmt.Errorf("unknown Redis mode %q", opts.Mode)
+	}
+	if len(opts.Addrs) == 0 {
+		return nil, fmt.Errorf("no Redis address configured")
+	}
+	client := redis.NewUniversalClient(universal)
 
 	// Test connection
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
 		logger.Error("Failed to connect to Redis",
-			"addr", addr,
+			"mode", opts.Mode,
+			"addrs", opts.Addrs,
 			"error", err,
 		)
 		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
+	// Warm the script cache so the first requests can use EVALSHA directly;
+	// on a cluster the scripts are loaded on every master
+	for _, script := range scripts {
+		if err := script.Load(ctx, client).Err(); err != nil {
+			client.Close()
+			logger.Error("Failed to load Lua script",
+				"mode", opts.Mode,
+				"addrs", opts.Addrs,
+				"error", err,
+			)
+			return nil, fmt.Errorf("failed to load Lua script: %w", err)
+		}
+	}
+
 	logger.Info("Connected to Redis",
-		"addr", addr,
-		"db", db,
+		"mode", opts.Mode,
+		"addrs", opts.Addrs,
+		"db", opts.DB,
+		"tls", opts.TLS != nil,
 	)
-	return &RedisStrategy{client: client}, nil
+	return &RedisStrategy{client: client, cluster: opts.Mode == RedisCluster}, nil
 }
 
-func (r *RedisStrategy) CheckAndIncrement(ctx context.Context, key string, maxRequests int, windowSeconds int) (allowed bool, err error) {
-	// Check if blocked
-	isBlocked, err := r.IsBlocked(ctx, key)
-	if err != nil {
-		logger.Error("Failed to check if key is blocked",
-			"key", key,
-			"error", err,
-		)
-		return false, err
+// keys returns the Redis keys holding the state, the block marker and the
+// penalty strikes of key
+func (r *RedisStrategy) keys(key string) (state, blocked, strikes string) {
+	if r.cluster {
+		key = "{" + key + "}"
 	}
-	if isBlocked {
-		return false, nil
+	return key, key + ":blocked", key + ":strikes"
+}
+
+// untag returns the limiter key of a Redis block marker
+func (r *RedisStrategy) untag(blocked string) string {
+	key := strings.TrimSuffix(blocked, ":blocked")
+	if r.cluster {
+		key = strings.TrimSuffix(strings.TrimPrefix(key, "{"), "}")
 	}
+	return key
+}
 
-	// Get current data
-	data, err := r.GetData(ctx, key)
+func (r *RedisStrategy) CheckAndIncrement(ctx context.Context, key string, maxRequests int, windowSeconds int) (allowed bool, err error) {
+	result, err := r.Consume(ctx, key, Limit{
+		Algorithm: AlgorithmFixedWindow,
+		Max:       maxRequests,
+		Window:    time.Duration(windowSeconds) * time.Second,
+	})
 	if err != nil {
-		logger.Error("Failed to get data from Redis",
-			"key", key,
-			"error", err,
-		)
 		return false, err
 	}
+	return result.Allowed, nil
+}
 
-	// Initialize if new
-	if data == nil {
-		data = &LimiterData{
-			Count:     0,
-			ExpiresAt: time.Now().Add(time.Duration(windowSeconds) * time.Second),
-			IsBlocked: false,
-		}
-	}
-
-	// Check if window expired
-	if time.Now().After(data.ExpiresAt) {
-		data.Count = 0
-		data.ExpiresAt = time.Now().Add(time.Duration(windowSeconds) * time.Second)
+func (r *RedisStrategy) Consume(ctx context.Context, key string, limit Limit) (*HitResult, error) {
+	if err := limit.Validate(); err != nil {
+		return nil, err
 	}
+	script := algorithmScripts[limit.Algorithm]
+	stateKey, blockedKey, strikesKey := r.keys(key)
 
-	// Increment counter
-	data.Count++
-
-	// Store updated data
-	dataJSON, err := json.Marshal(data)
+	// Run executes EVALSHA and falls back to EVAL when Redis answers NOSCRIPT
+	values, err := script.Run(ctx, r.client,
+		[]string{stateKey, blockedKey, strikesKey},
+		limit.Max, limit.Window.Milliseconds(), limit.Block.Milliseconds(), requestID(),
+		penaltyMultiplier(limit.Penalty), limit.Penalty.MaxBlock.Milliseconds(), limit.Penalty.Decay.Milliseconds(),
+		limit.cost(),
+	).Int64Slice()
 	if err != nil {
-		logger.Error("Failed to marshal data",
+		logger.Error("Failed to consume from limit",
 			"key", key,
+			"algorithm", limit.Algorithm,
 			"error", err,
 		)
-		return false, err
+		return nil, err
 	}
-
-	duration := time.Until(data.ExpiresAt)
-	if duration < 0 {
-		duration = time.Duration(windowSeconds) * time.Second
+	if len(values) != 7 {
+		return nil, fmt.Errorf("unexpected script reply length %d", len(values))
 	}
 
-	err = r.client.Set(ctx, key, dataJSON, duration).Err()
-	if err != nil {
-		logger.Error("Failed to set data in Redis",
-			"key", key,
-			"error", err,
-		)
-		return false, err
+	result := &HitResult{
+		Allowed:    values[0] == 1,
+		Blocked:    values[1] == 1,
+		Count:      int(values[2]),
+		Remaining:  int(values[3]),
+		ResetAfter: time.Duration(values[4]) * time.Millisecond,
+		RetryAfter: time.Duration(values[5]) * time.Millisecond,
+		Strikes:    int(values[6]),
 	}
 
-	// Check if limit exceeded
-	allowed = data.Count <= maxRequests
-	if !allowed {
+	if !result.Allowed && !result.Blocked {
 		logger.Debug("Rate limit threshold reached",
 			"key", key,
-			"count", data.Count,
-			"maxRequests", maxRequests,
+			"algorithm", limit.Algorithm,
+			"count", result.Count,
+			"maxRequests", limit.Max,
 		)
 	}
-	return allowed, nil
+	return result, nil
 }
 
 func (r *RedisStrategy) IsBlocked(ctx context.Context, key string) (blocked bool, err error) {
-	blockedKey := key + ":blocked"
+	_, blockedKey, _ := r.keys(key)
 	result, err := r.client.Get(ctx, blockedKey).Result()
 	if err == redis.Nil {
 		return false, nil
@@ -133,7 +225,7 @@ func (r *RedisStrategy) IsBlocked(ctx context.Context, key string) (blocked bool
 }
 
 func (r *RedisStrategy) Block(ctx context.Context, key string, durationSeconds int) error {
-	blockedKey := key + ":blocked"
+	_, blockedKey, _ := r.keys(key)
 	duration := time.Duration(durationSeconds) * time.Second
 	err := r.client.Set(ctx, blockedKey, "true", duration).Err()
 	if err != nil {
@@ -152,7 +244,8 @@ func (r *RedisStrategy) Block(ctx context.Context, key string, durationSeconds i
 }
 
 func (r *RedisStrategy) Reset(ctx context.Context, key string) error {
-	err := r.client.Del(ctx, key).Err()
+	stateKey, blockedKey, strikesKey := r.keys(key)
+	err := r.client.Del(ctx, stateKey, blockedKey, strikesKey).Err()
 	if err != nil {
 		logger.Error("Failed to reset key",
 			"key", key,
@@ -160,35 +253,233 @@ func (r *RedisStrategy) Reset(ctx context.Context, key string) error {
 		)
 		return err
 	}
-	blockedKey := key + ":blocked"
-	err = r.client.Del(ctx, blockedKey).Err()
+	logger.Debug("Key reset", "key", key)
+	return nil
+}
+
+func (r *RedisStrategy) Refund(ctx context.Context, key string, cost int) error {
+	stateKey, _, _ := r.keys(key)
+	err := refundScript.Run(ctx, r.client, []string{stateKey}, cost).Err()
 	if err != nil {
-		logger.Error("Failed to reset blocked key",
-			"key", blockedKey,
+		logger.Error("Failed to refund key",
+			"key", key,
+			"cost", cost,
 			"error", err,
 		)
 		return err
 	}
-	logger.Debug("Key reset", "key", key)
 	return nil
 }
 
 func (r *RedisStrategy) GetData(ctx context.Context, key string) (*LimiterData, error) {
-	result, err := r.client.Get(ctx, key).Result()
-	if err == redis.Nil {
+	stateKey, blockedKey, _ := r.keys(key)
+	pipe := r.client.Pipeline()
+	typeCmd := pipe.Type(ctx, stateKey)
+	ttlCmd := pipe.PTTL(ctx, stateKey)
+	blockedCmd := pipe.Get(ctx, blockedKey)
+	timeCmd := pipe.Time(ctx)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	blocked := blockedCmd.Val() == "true"
+	if typeCmd.Val() == "none" && !blocked {
 		return nil, nil
 	}
+
+	data := &LimiterData{IsBlocked: blocked}
+	if ttl := ttlCmd.Val(); ttl > 0 {
+		data.ExpiresAt = time.Now().Add(ttl)
+	}
+
+	// Count is the number of requests held against the limit, read from the
+	// state layout of the algorithm that wrote the key
+	switch typeCmd.Val() {
+	case "string":
+		count, err := r.client.Get(ctx, stateKey).Int()
+		if err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("invalid counter value for %s: %w", key, err)
+		}
+		data.Count = count
+	case "zset":
+		count, err := r.client.ZCard(ctx, stateKey).Result()
+		if err != nil {
+			return nil, err
+		}
+		data.Count = int(count)
+	case "hash":
+		fields, err := r.client.HGetAll(ctx, stateKey).Result()
+		if err != nil {
+			return nil, err
+		}
+		data.Count = hashStateCount(fields, timeCmd.Val())
+	}
+
+	return data, nil
+}
+
+// penaltyMultiplier returns the multiplier passed to the scripts, 0 when the
+// penalty does not escalate
+func penaltyMultiplier(p Penalty) float64 {
+	if !p.Enabled() {
+		return 0
+	}
+	return p.Multiplier
+}
+
+// hashStateCount derives the used request count from hash based algorithm state
+// at the Redis server time now
+func hashStateCount(fields map[string]string, now time.Time) int {
+	number := func(name string) float64 {
+		value, _ := strconv.ParseFloat(fields[name], 64)
+		return value
+	}
+	nowMillis := float64(now.UnixMilli())
+
+	switch Algorithm(fields["a"]) {
+	case AlgorithmSlidingWindowCounter:
+		return int(number("c"))
+	case AlgorithmTokenBucket:
+		max := number("m")
+		tokens := math.Min(max, number("t")+(nowMillis-number("ts"))*number("r"))
+		return int(max) - int(math.Floor(tokens))
+	case AlgorithmGCRA:
+		interval := number("e")
+		if interval <= 0 {
+			return 0
+		}
+		used := math.Ceil((number("tat") - nowMillis) / interval)
+		return int(math.Max(0, math.Min(number("m"), used)))
+	}
+	return 0
+}
+
+// requestID returns a unique member for sliding log entries
+func requestID() string {
+	return strconv.FormatUint(rand.Uint64(), 36)
+}
+
+// CountBlocked returns the number of keys currently blocked, scanning for their
+// :blocked markers in batches so Redis is never held up by a single command
+func (r *RedisStrategy) CountBlocked(ctx context.Context) (int, error) {
+	nodes, err := r.scanNodes(ctx)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+
+	total := 0
+	for _, node := range nodes {
+		iter := node.Scan(ctx, 0, "*:blocked", 1000).Iterator()
+		for iter.Next(ctx) {
+			total++
+		}
+		if err := iter.Err(); err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+// ListBlocked pages through blocked keys with SCAN, so a page may hold more or
+// fewer than limit keys and a key blocked during the listing may be missed.
+// On a cluster the masters are scanned one after the other and the cursor is
+// "<master index>:<scan cursor>".
+func (r *RedisStrategy) ListBlocked(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	node, position, err := parseScanCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if limit <= 0 {
+		limit = 100
 	}
 
-	var data LimiterData
-	err = json.Unmarshal([]byte(result), &data)
+	nodes, err := r.scanNodes(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	if node >= len(nodes) {
+		return nil, "", fmt.Errorf("invalid cursor %q", cursor)
+	}
+
+	var keys []string
+	for node < len(nodes) {
+		batch, next, err := nodes[node].Scan(ctx, position, "*:blocked", int64(limit)).Result()
+		if err != nil {
+			return nil, "", err
+		}
+		for _, key := range batch {
+			keys = append(keys, r.untag(key))
+		}
+		position = next
+		if position == 0 {
+			node++
+		}
+		// Keep scanning empty batches so callers do not page through nothing
+		if len(keys) > 0 {
+			break
+		}
+	}
+
+	if node == len(nodes) {
+		return keys, "", nil
+	}
+	if len(nodes) == 1 {
+		return keys, strconv.FormatUint(position, 10), nil
+	}
+	return keys, strconv.Itoa(node) + ":" + strconv.FormatUint(position, 10), nil
+}
+
+// scanNodes returns the clients to SCAN for block markers: every master of a
+// cluster, ordered by address so cursors stay valid between calls, or the
+// client itself
+func (r *RedisStrategy) scanNodes(ctx context.Context) ([]redis.Cmdable, error) {
+	cluster, ok := r.client.(*redis.ClusterClient)
+	if !ok {
+		return []redis.Cmdable{r.client}, nil
+	}
+
+	var mu sync.Mutex
+	var masters []*redis.Client
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+		mu.Lock()
+		masters = append(masters, master)
+		mu.Unlock()
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	sort.Slice(masters, func(i, j int) bool {
+		return masters[i].Options().Addr < masters[j].Options().Addr
+	})
+
+	nodes := make([]redis.Cmdable, len(masters))
+	for i, master := range masters {
+		nodes[i] = master
+	}
+	return nodes, nil
+}
+
+// parseScanCursor splits a ListBlocked cursor into the node index and SCAN cursor
+func parseScanCursor(cursor string) (node int, position uint64, err error) {
+	if cursor == "" {
+		return 0, 0, nil
+	}
+	nodePart, positionPart, clustered := strings.Cut(cursor, ":")
+	if !clustered {
+		positionPart = nodePart
+	} else if node, err = strconv.Atoi(nodePart); err != nil || node < 0 {
+		return 0, 0, fmt.Errorf("invalid cursor %q", cursor)
+	}
+	if position, err = strconv.ParseUint(positionPart, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid cursor %q", cursor)
+	}
+	return node, position, nil
+}
 
-	return &data, nil
+// Client returns the underlying Redis client, shared with other Redis backed components
+func (r *RedisStrategy) Client() redis.UniversalClient {
+	return r.client
 }
 
 func (r *RedisStrategy) Close() error {
@@ -0,0 +1,237 @@
+package storage
+
+import "github.com/redis/go-redis/v9"
+
+// Every algorithm script shares the same calling convention:
+//
+// KEYS[1]: state key
+// KEYS[2]: blocked key
+// KEYS[3]: penalty strikes key
+// ARGV[1]: maximum requests (bucket capacity for token bucket and GCRA)
+// ARGV[2]: window in milliseconds
+// ARGV[3]: block duration in milliseconds (0 disables blocking)
+// ARGV[4]: unique request id, prefix of the sliding log members
+// ARGV[5]: penalty multiplier (0 disables escalation)
+// ARGV[6]: penalty max block in milliseconds
+// ARGV[7]: penalty decay in milliseconds
+// ARGV[8]: requests charged by the hit, consumed all at once or not at all
+//
+// and returns {allowed, alreadyBlocked, count, remaining, resetAfterMillis, retryAfterMillis, strikes}.
+//
+// The prologue rejects blocked keys, reads the server clock, denies costs
+// above the limit, which can never fit, without blocking the key, and discards
+// state written by a different algorithm; finish blocks the key on denial,
+// escalating the block with every strike remembered for the key.
+const scriptPrologue = `
+local blocked_ttl = redis.call('PTTL', KEYS[2])
+if blocked_ttl ~= -2 then
+  if blocked_ttl < 0 then blocked_ttl = 0 end
+  return {0, 1, 0, 0, blocked_ttl, blocked_ttl, 0}
+end
+
+local max = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local block = tonumber(ARGV[3])
+local multiplier = tonumber(ARGV[5])
+local max_block = tonumber(ARGV[6])
+local decay = tonumber(ARGV[7])
+local cost = tonumber(ARGV[8])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local function finish(allowed, count, remaining, reset_after, retry_after)
+  local strikes = 0
+  if allowed == 0 and block > 0 then
+    if multiplier > 1 then
+      strikes = redis.call('INCR', KEYS[3])
+      block = math.floor(math.min(block * multiplier ^ (strikes - 1), math.max(max_block, block)))
+      redis.call('PEXPIRE', KEYS[3], block + decay)
+    end
+    redis.call('SET', KEYS[2], 'true', 'PX', block)
+    retry_after = block
+    reset_after = math.max(reset_after, block)
+  end
+  return {allowed, 0, count, remaining, math.ceil(reset_after), math.ceil(retry_after), strikes}
+end
+
+local function ensure_type(expected, algorithm)
+  local current = redis.call('TYPE', KEYS[1])['ok']
+  if current == 'none' then
+    return
+  end
+  if current ~= expected or (algorithm and redis.call('HGET', KEYS[1], 'a') ~= algorithm) then
+    redis.call('DEL', KEYS[1])
+  end
+end
+
+if max <= 0 then
+  return finish(0, 0, 0, window, window)
+end
+if cost > max then
+  return {0, 0, 0, 0, window, window, 0}
+end
+`
+
+// fixedWindowScript counts requests in a window that starts with the first request
+var fixedWindowScript = redis.NewScript(scriptPrologue + `
+ensure_type('string')
+local count = tonumber(redis.call('GET', KEYS[1]) or '0')
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < 0 then
+  ttl = window
+end
+
+if count + cost <= max then
+  count = redis.call('INCRBY', KEYS[1], cost)
+  if count == cost or redis.call('PTTL', KEYS[1]) < 0 then
+    redis.call('PEXPIRE', KEYS[1], window)
+  end
+  return finish(1, count, max - count, ttl, 0)
+end
+return finish(0, count, 0, ttl, ttl)
+`)
+
+// slidingLogScript keeps one sorted set member per charged request in the trailing window
+var slidingLogScript = redis.NewScript(scriptPrologue + `
+ensure_type('zset')
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+
+if count + cost <= max then
+  for i = 1, cost do
+    redis.call('ZADD', KEYS[1], now, ARGV[4] .. ':' .. i)
+  end
+  redis.call('PEXPIRE', KEYS[1], window)
+  count = count + cost
+  return finish(1, count, max - count, window, 0)
+end
+
+-- The cost fits once enough of the oldest requests left the window
+local leaving = count + cost - max - 1
+local oldest = tonumber(redis.call('ZRANGE', KEYS[1], leaving, leaving, 'WITHSCORES')[2])
+local newest = tonumber(redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')[2])
+return finish(0, count, 0, newest + window - now, oldest + window - now)
+`)
+
+// slidingWindowCounterScript estimates the trailing window count from the
+// current and previous aligned windows
+var slidingWindowCounterScript = redis.NewScript(scriptPrologue + `
+ensure_type('hash', 'sliding_window_counter')
+local index = math.floor(now / window)
+local state = redis.call('HMGET', KEYS[1], 'w', 'c', 'p')
+local current_index = tonumber(state[1])
+local current = tonumber(state[2]) or 0
+local previous = tonumber(state[3]) or 0
+if current_index == nil or index > current_index + 1 then
+  current = 0
+  previous = 0
+elseif index == current_index + 1 then
+  previous = current
+  current = 0
+end
+
+local elapsed = now - index * window
+local used = previous * (window - elapsed) / window + current
+local reset_after = (index + 2) * window - now
+
+if used + cost <= max then
+  current = current + cost
+  redis.call('HSET', KEYS[1], 'a', 'sliding_window_counter', 'w', index, 'c', current, 'p', previous, 'm', max)
+  redis.call('PEXPIRE', KEYS[1], reset_after)
+  return finish(1, current, math.floor(max - used - cost), reset_after, 0)
+end
+
+local retry_after
+if current + cost <= max then
+  retry_after = window - elapsed - (max - cost - current) * window / previous
+else
+  retry_after = window - elapsed + math.max(0, window - (max - cost) * window / current)
+end
+if current == 0 and previous == 0 then
+  reset_after = 0
+end
+return finish(0, current, 0, reset_after, retry_after)
+`)
+
+// tokenBucketScript refills max tokens per window and spends one per charged request
+var tokenBucketScript = redis.NewScript(scriptPrologue + `
+ensure_type('hash', 'token_bucket')
+local rate = max / window
+local state = redis.call('HMGET', KEYS[1], 't', 'ts')
+local tokens = tonumber(state[1])
+local updated = tonumber(state[2])
+if tokens == nil or updated == nil then
+  tokens = max
+  updated = now
+end
+if now > updated then
+  tokens = math.min(max, tokens + (now - updated) * rate)
+  updated = now
+end
+
+if tokens >= cost then
+  tokens = tokens - cost
+  local reset_after = math.ceil((max - tokens) / rate)
+  redis.call('HSET', KEYS[1], 'a', 'token_bucket', 't', tokens, 'ts', updated, 'm', max, 'r', rate)
+  redis.call('PEXPIRE', KEYS[1], reset_after)
+  local remaining = math.floor(tokens)
+  return finish(1, max - remaining, remaining, reset_after, 0)
+end
+
+return finish(0, max, 0, (max - tokens) / rate, (cost - tokens) / rate)
+`)
+
+// gcraScript tracks the theoretical arrival time of the next request
+var gcraScript = redis.NewScript(scriptPrologue + `
+ensure_type('hash', 'gcra')
+local interval = window / max
+local tat = tonumber(redis.call('HGET', KEYS[1], 'tat')) or now
+if tat < now then
+  tat = now
+end
+
+local new_tat = tat + interval * cost
+local allow_at = new_tat - window
+if allow_at <= now then
+  local reset_after = math.ceil(new_tat - now)
+  redis.call('HSET', KEYS[1], 'a', 'gcra', 'tat', new_tat, 'e', interval, 'm', max)
+  redis.call('PEXPIRE', KEYS[1], reset_after)
+  local remaining = math.floor((window - (new_tat - now)) / interval + 1e-9)
+  return finish(1, max - remaining, remaining, reset_after, 0)
+end
+
+return finish(0, max, 0, tat - now, allow_at - now)
+`)
+
+// refundScript gives back ARGV[1] requests charged to the fixed window at
+// KEYS[1]; DECRBY keeps the expiry of the window
+var refundScript = redis.NewScript(`
+if redis.call('TYPE', KEYS[1])['ok'] ~= 'string' then
+  return 0
+end
+local count = tonumber(redis.call('GET', KEYS[1])) or 0
+local refund = math.min(count, tonumber(ARGV[1]))
+if refund > 0 then
+  return redis.call('DECRBY', KEYS[1], refund)
+end
+return count
+`)
+
+// algorithmScripts maps every algorithm to the script implementing it
+var algorithmScripts = map[Algorithm]*redis.Script{
+	AlgorithmFixedWindow:          fixedWindowScript,
+	AlgorithmSlidingLog:           slidingLogScript,
+	AlgorithmSlidingWindowCounter: slidingWindowCounterScript,
+	AlgorithmTokenBucket:          tokenBucketScript,
+	AlgorithmGCRA:                 gcraScript,
+}
+
+// scripts lists every Lua script preloaded into the Redis script cache at startup
+var scripts = []*redis.Script{
+	fixedWindowScript,
+	slidingLogScript,
+	slidingWindowCounterScript,
+	tokenBucketScript,
+	gcraScript,
+	refundScript,
+}
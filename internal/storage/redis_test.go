@@ -0,0 +1,460 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedisStrategy(t *testing.T) (*RedisStrategy, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	st, err := NewRedisStrategy(mr.Addr(), 0, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st, mr
+}
+
+func TestRedisConcurrentIncrementsAreNotLost(t *testing.T) {
+	st, _ := newTestRedisStrategy(t)
+	ctx := context.Background()
+
+	const workers = 20
+	const hitsPerWorker = 50
+
+	var wg sync.WaitGroup
+	var denied atomic.Int64
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < hitsPerWorker; j++ {
+				allowed, err := st.CheckAndIncrement(ctx, "ip:10.0.0.1", workers*hitsPerWorker, 60)
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+					return
+				}
+				if !allowed {
+					denied.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := st.GetData(ctx, "ip:10.0.0.1")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if data == nil || data.Count != workers*hitsPerWorker {
+		t.Fatalf("Expected count %d, got %+v", workers*hitsPerWorker, data)
+	}
+	if denied.Load() != 0 {
+		t.Errorf("Expected no denied requests, got %d", denied.Load())
+	}
+}
+
+func TestRedisConcurrentBurstAllowsExactlyMax(t *testing.T) {
+	st, _ := newTestRedisStrategy(t)
+	ctx := context.Background()
+
+	const maxRequests = 25
+	const attempts = 200
+
+	var wg sync.WaitGroup
+	var allowedCount atomic.Int64
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := st.Consume(ctx, "token:abc", fixedWindowLimit(maxRequests, 60, 30))
+			if err != nil {
+				t.Errorf("Expected no error, got %v", err)
+				return
+			}
+			if result.Allowed {
+				allowedCount.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowedCount.Load() != maxRequests {
+		t.Errorf("Expected exactly %d allowed requests, got %d", maxRequests, allowedCount.Load())
+	}
+
+	blocked, err := st.IsBlocked(ctx, "token:abc")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !blocked {
+		t.Error("Key should be blocked after exceeding the limit")
+	}
+}
+
+func TestRedisConsumeBlocksAfterLimit(t *testing.T) {
+	st, mr := newTestRedisStrategy(t)
+	ctx := context.Background()
+
+	for i := 1; i <= 2; i++ {
+		result, err := st.Consume(ctx, "ip:1.2.3.4", fixedWindowLimit(2, 1, 10))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !result.Allowed || result.Count != i {
+			t.Fatalf("Request %d should be allowed with count %d, got %+v", i, i, result)
+		}
+	}
+
+	result, err := st.Consume(ctx, "ip:1.2.3.4", fixedWindowLimit(2, 1, 10))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Allowed || result.Blocked {
+		t.Fatalf("3rd request should exceed the limit without being pre-blocked, got %+v", result)
+	}
+	if result.RetryAfter != 10*time.Second {
+		t.Errorf("Expected retry after 10s, got %v", result.RetryAfter)
+	}
+
+	// The window expires but the block is still active
+	mr.FastForward(2 * time.Second)
+	result, err = st.Consume(ctx, "ip:1.2.3.4", fixedWindowLimit(2, 1, 10))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Allowed || !result.Blocked {
+		t.Fatalf("Request should be rejected as blocked, got %+v", result)
+	}
+
+	// Once the block expires a fresh window starts
+	mr.FastForward(10 * time.Second)
+	result, err = st.Consume(ctx, "ip:1.2.3.4", fixedWindowLimit(2, 1, 10))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Allowed || result.Count != 1 {
+		t.Fatalf("Request should be allowed after block expiry, got %+v", result)
+	}
+}
+
+func TestRedisScriptReloadedAfterFlush(t *testing.T) {
+	st, mr := newTestRedisStrategy(t)
+	ctx := context.Background()
+
+	mr.FlushAll()
+	if _, err := st.client.ScriptFlush(ctx).Result(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	allowed, err := st.CheckAndIncrement(ctx, "ip:1.2.3.4", 1, 1)
+	if err != nil {
+		t.Fatalf("Expected NOSCRIPT fallback to succeed, got %v", err)
+	}
+	if !allowed {
+		t.Error("First request should be allowed")
+	}
+}
+
+func TestRedisResetAndGetData(t *testing.T) {
+	st, _ := newTestRedisStrategy(t)
+	ctx := context.Background()
+
+	if _, err := st.Consume(ctx, "ip:1.2.3.4", fixedWindowLimit(1, 1, 60)); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := st.Consume(ctx, "ip:1.2.3.4", fixedWindowLimit(1, 1, 60)); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	data, err := st.GetData(ctx, "ip:1.2.3.4")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if data == nil || data.Count != 1 || !data.IsBlocked {
+		t.Fatalf("Expected count 1 and blocked, got %+v", data)
+	}
+
+	if err := st.Reset(ctx, "ip:1.2.3.4"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	data, err = st.GetData(ctx, "ip:1.2.3.4")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if data != nil {
+		t.Errorf("Expected no data after reset, got %+v", data)
+	}
+}
+
+// hashTag returns the part of key Redis Cluster hashes to pick a slot
+func hashTag(key string) string {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			return key[start+1 : start+1+end]
+		}
+	}
+	return key
+}
+
+func TestRedisClusterKeysShareSlot(t *testing.T) {
+	st := &RedisStrategy{cluster: true}
+	for _, key := range []string{"ip:10.0.0.1", "token:a}b", "token:{x}", "route:search:token:{", "token:"} {
+		state, blocked, strikes := st.keys(key)
+		if hashTag(state) != hashTag(blocked) || hashTag(state) != hashTag(strikes) {
+			t.Errorf("Key %q: expected %q, %q and %q to share a hash tag", key, state, blocked, strikes)
+		}
+		if got := st.untag(blocked); got != key {
+			t.Errorf("Expected untagged key %q, got %q", key, got)
+		}
+	}
+
+	st = &RedisStrategy{}
+	if state, blocked, _ := st.keys("ip:10.0.0.1"); state != "ip:10.0.0.1" || blocked != "ip:10.0.0.1:blocked" {
+		t.Errorf("Expected untagged keys outside a cluster, got %q and %q", state, blocked)
+	}
+}
+
+func TestRedisClusterMode(t *testing.T) {
+	mr := miniredis.RunT(t)
+	st, err := NewRedisStrategyWithOptions(RedisOptions{Mode: RedisCluster, Addrs: []string{mr.Addr()}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+	ctx := context.Background()
+
+	limit := Limit{Algorithm: AlgorithmFixedWindow, Max: 1, Window: time.Second, Block: time.Minute}
+	for i := 0; i < 2; i++ {
+		if _, err := st.Consume(ctx, "ip:10.0.0.1", limit); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	if !mr.Exists("{ip:10.0.0.1}") || !mr.Exists("{ip:10.0.0.1}:blocked") {
+		t.Errorf("Expected hash tagged keys, got %v", mr.Keys())
+	}
+
+	blocked, err := st.IsBlocked(ctx, "ip:10.0.0.1")
+	if err != nil || !blocked {
+		t.Errorf("Expected the key to be blocked, got %v (%v)", blocked, err)
+	}
+	keys, cursor, err := st.ListBlocked(ctx, "", 10)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(keys) != 1 || keys[0] != "ip:10.0.0.1" || cursor != "" {
+		t.Errorf("Expected [ip:10.0.0.1] without cursor, got %v %q", keys, cursor)
+	}
+	if count, err := st.CountBlocked(ctx); err != nil || count != 1 {
+		t.Errorf("Expected 1 blocked key, got %d (%v)", count, err)
+	}
+
+	if err := st.Reset(ctx, "ip:10.0.0.1"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if data, _ := st.GetData(ctx, "ip:10.0.0.1"); data != nil {
+		t.Errorf("Expected no state after reset, got %+v", data)
+	}
+
+	if _, err := NewRedisStrategyWithOptions(RedisOptions{Mode: RedisCluster, Addrs: []string{mr.Addr()}, DB: 1}); err == nil {
+		t.Error("Expected an error for a cluster database other than 0")
+	}
+}
+
+func TestRedisACLAuth(t *testing.T) {
+	mr := miniredis.RunT(t)
+	mr.RequireUserAuth("limiter", "s3cret")
+
+	if _, err := NewRedisStrategyWithOptions(RedisOptions{Addrs: []string{mr.Addr()}, Username: "limiter", Password: "wrong"}); err == nil {
+		t.Error("Expected an error with a wrong password")
+	}
+
+	st, err := NewRedisStrategyWithOptions(RedisOptions{Addrs: []string{mr.Addr()}, Username: "limiter", Password: "s3cret"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	st.Close()
+}
+
+func TestRedisTLS(t *testing.T) {
+	serverConfig, pool := testTLSConfig(t)
+	mr, err := miniredis.RunTLS(serverConfig)
+	if err != nil {
+		t.Fatalf("Failed to start miniredis: %v", err)
+	}
+	t.Cleanup(mr.Close)
+
+	if _, err := NewRedisStrategyWithOptions(RedisOptions{Addrs: []string{mr.Addr()}, DialTimeout: time.Second}); err == nil {
+		t.Error("Expected a plain connection to a TLS server to fail")
+	}
+
+	st, err := NewRedisStrategyWithOptions(RedisOptions{
+		Addrs: []string{mr.Addr()},
+		TLS:   &tls.Config{RootCAs: pool, ServerName: "localhost"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer st.Close()
+
+	if _, err := st.Consume(context.Background(), "ip:10.0.0.1", Limit{Algorithm: AlgorithmGCRA, Max: 1, Window: time.Second}); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestRedisSentinelMode(t *testing.T) {
+	mr := miniredis.RunT(t)
+	sentinel := startFakeSentinel(t, "mymaster", mr.Addr())
+
+	if _, err := NewRedisStrategyWithOptions(RedisOptions{Mode: RedisSentinel, Addrs: []string{sentinel}}); err == nil {
+		t.Error("Expected an error without a master name")
+	}
+
+	st, err := NewRedisStrategyWithOptions(RedisOptions{Mode: RedisSentinel, Addrs: []string{sentinel}, MasterName: "mymaster"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer st.Close()
+
+	if _, err := st.Consume(context.Background(), "ip:10.0.0.1", Limit{Algorithm: AlgorithmFixedWindow, Max: 5, Window: time.Second}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !mr.Exists("ip:10.0.0.1") {
+		t.Errorf("Expected the key on the master returned by the sentinel, got %v", mr.Keys())
+	}
+}
+
+// testTLSConfig returns a server TLS configuration with a self-signed
+// certificate for localhost and the pool trusting it
+func testTLSConfig(t *testing.T) (*tls.Config, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, pool
+}
+
+// startFakeSentinel serves the subset of the Sentinel protocol go-redis uses to
+// discover a master, answering with masterAddr for master
+func startFakeSentinel(t *testing.T, master, masterAddr string) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	host, port, _ := net.SplitHostPort(masterAddr)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					args, err := readCommand(reader)
+					if err != nil {
+						return
+					}
+					switch strings.ToLower(strings.Join(args[:min(2, len(args))], " ")) {
+					case "sentinel get-master-addr-by-name":
+						if len(args) == 3 && args[2] == master {
+							fmt.Fprintf(conn, "*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(host), host, len(port), port)
+						} else {
+							conn.Write([]byte("*-1\r\n"))
+						}
+					case "sentinel sentinels", "sentinel replicas":
+						conn.Write([]byte("*0\r\n"))
+					case "subscribe +switch-master":
+						for i, channel := range args[1:] {
+							fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:%d\r\n", len(channel), channel, i+1)
+						}
+					case "ping":
+						conn.Write([]byte("+PONG\r\n"))
+					default:
+						if strings.EqualFold(args[0], "hello") {
+							conn.Write([]byte("-ERR unknown command 'HELLO'\r\n"))
+						} else {
+							conn.Write([]byte("+OK\r\n"))
+						}
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// readCommand reads a RESP array of bulk strings
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || count <= 0 {
+		return nil, fmt.Errorf("invalid command header %q", line)
+	}
+
+	args := make([]string, count)
+	for i := range args {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		value, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(value, "\r\n")
+	}
+	return args, nil
+}
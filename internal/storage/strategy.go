@@ -2,6 +2,8 @@ package storage
 
 import (
 	"context"
+	"fmt"
+	"math"
 	"time"
 )
 
@@ -12,11 +14,137 @@ type LimiterData struct {
 	IsBlocked bool      `json:"is_blocked"`
 }
 
+// Algorithm identifies a rate limiting algorithm implemented by every storage backend
+type Algorithm string
+
+const (
+	// AlgorithmFixedWindow counts requests in a window started by the first request
+	AlgorithmFixedWindow Algorithm = "fixed_window"
+	// AlgorithmSlidingLog keeps the timestamp of every request in the trailing window
+	AlgorithmSlidingLog Algorithm = "sliding_log"
+	// AlgorithmSlidingWindowCounter weights the previous aligned window by its overlap with the trailing window
+	AlgorithmSlidingWindowCounter Algorithm = "sliding_window_counter"
+	// AlgorithmTokenBucket refills a bucket of Max tokens at Max tokens per Window
+	AlgorithmTokenBucket Algorithm = "token_bucket"
+	// AlgorithmGCRA is the generic cell rate algorithm with a burst of Max requests
+	AlgorithmGCRA Algorithm = "gcra"
+)
+
+// Algorithms lists every supported algorithm
+var Algorithms = []Algorithm{
+	AlgorithmFixedWindow,
+	AlgorithmSlidingLog,
+	AlgorithmSlidingWindowCounter,
+	AlgorithmTokenBucket,
+	AlgorithmGCRA,
+}
+
+// ParseAlgorithm returns the algorithm matching name
+func ParseAlgorithm(name string) (Algorithm, error) {
+	for _, algorithm := range Algorithms {
+		if string(algorithm) == name {
+			return algorithm, nil
+		}
+	}
+	return "", fmt.Errorf("unknown rate limiting algorithm %q", name)
+}
+
+// Limit describes how requests against a key are limited
+type Limit struct {
+	Algorithm Algorithm
+	Max       int           // Requests allowed per window (bucket capacity / burst for token bucket and GCRA)
+	Window    time.Duration // Window length, or time to refill Max requests for token bucket and GCRA
+	Block     time.Duration // Block applied once the limit is exceeded (0 disables blocking)
+	Penalty   Penalty       // Escalation of the block for repeat offenders
+	Cost      int           // Requests charged by this hit, consumed all at once or not at all (0 counts as 1)
+}
+
+// cost returns the requests charged by a hit against the limit
+func (l Limit) cost() int {
+	if l.Cost <= 0 {
+		return 1
+	}
+	return l.Cost
+}
+
+// Penalty escalates the block of keys that keep exceeding their limit. Every
+// violation is a strike, and the n-th strike blocks the key for
+// Block * Multiplier^(n-1), capped at MaxBlock. Strikes are forgotten once the
+// key goes Decay past the end of its last block without a new violation.
+type Penalty struct {
+	Multiplier float64       // Growth factor of the block per strike (1 or less disables escalation)
+	MaxBlock   time.Duration // Longest escalated block; never shortens the base block
+	Decay      time.Duration // How long strikes are remembered after a block ends
+}
+
+// Enabled reports whether the penalty escalates blocks
+func (p Penalty) Enabled() bool {
+	return p.Multiplier > 1
+}
+
+// BlockFor returns the block for the given strike, starting at 1, of a limit
+// blocking for base
+func (p Penalty) BlockFor(base time.Duration, strike int) time.Duration {
+	if !p.Enabled() || strike <= 1 {
+		return base
+	}
+	limit := max(p.MaxBlock, base)
+	block := float64(base) * math.Pow(p.Multiplier, float64(strike-1))
+	if block >= float64(limit) {
+		return limit
+	}
+	return time.Duration(block)
+}
+
+// Validate checks that the limit can be enforced
+func (l Limit) Validate() error {
+	if _, err := ParseAlgorithm(string(l.Algorithm)); err != nil {
+		return err
+	}
+	if l.Max < 0 {
+		return fmt.Errorf("max requests must not be negative, got %d", l.Max)
+	}
+	if l.Window < time.Millisecond {
+		return fmt.Errorf("window must be at least 1ms, got %v", l.Window)
+	}
+	if l.Block < 0 {
+		return fmt.Errorf("block duration must not be negative, got %v", l.Block)
+	}
+	if l.Cost < 0 {
+		return fmt.Errorf("cost must not be negative, got %d", l.Cost)
+	}
+	if l.Penalty.Enabled() {
+		if l.Penalty.MaxBlock <= 0 {
+			return fmt.Errorf("penalty max block must be positive, got %v", l.Penalty.MaxBlock)
+		}
+		if l.Penalty.Decay <= 0 {
+			return fmt.Errorf("penalty decay must be positive, got %v", l.Penalty.Decay)
+		}
+	}
+	return nil
+}
+
+// HitResult represents the outcome of consuming a request from a limit
+type HitResult struct {
+	Allowed    bool          // Whether the request fits within the limit
+	Blocked    bool          // Whether the key was already blocked before this hit
+	Count      int           // Requests counted against the limit after this hit
+	Remaining  int           // Requests still available
+	ResetAfter time.Duration // Time until the limit is fully replenished
+	RetryAfter time.Duration // Time until a request may be allowed again, when denied
+	Strikes    int           // Violations remembered for the key when this hit was denied, with an escalating penalty
+}
+
 // Strategy defines the interface for rate limiter storage
 type Strategy interface {
 	// CheckAndIncrement checks if the request is allowed and increments the counter
+	// by one; Consume charges weighted requests through Limit.Cost
 	CheckAndIncrement(ctx context.Context, key string, maxRequests int, windowSeconds int) (allowed bool, err error)
 
+	// Consume atomically checks if the key is blocked, applies the limit's algorithm
+	// and blocks the key once the limit is exceeded
+	Consume(ctx context.Context, key string, limit Limit) (*HitResult, error)
+
 	// IsBlocked checks if a key is blocked
 	IsBlocked(ctx context.Context, key string) (blocked bool, err error)
 
@@ -26,9 +154,26 @@ type Strategy interface {
 	// Reset resets the counter for a key
 	Reset(ctx context.Context, key string) error
 
+	// Refund gives back cost requests charged to the fixed window of key,
+	// keeping its expiry, e.g. when a later limit denies the same request.
+	// Keys limited by other algorithms are left alone.
+	Refund(ctx context.Context, key string, cost int) error
+
 	// GetData retrieves the current data for a key
 	GetData(ctx context.Context, key string) (*LimiterData, error)
 
 	// Close closes the storage connection
 	Close() error
 }
+
+// BlockedCounter is implemented by strategies that can count their currently blocked keys
+type BlockedCounter interface {
+	CountBlocked(ctx context.Context) (int, error)
+}
+
+// BlockedLister is implemented by strategies that can page through their blocked keys
+type BlockedLister interface {
+	// ListBlocked returns up to about limit blocked keys starting at cursor ("" for
+	// the first page) and the cursor of the next page, "" once every key was listed
+	ListBlocked(ctx context.Context, cursor string, limit int) (keys []string, next string, err error)
+}
@@ -0,0 +1,84 @@
+package tokens
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/pkg/logger"
+)
+
+// FileRegistry serves token limits loaded from a JSON file of the form
+//
+//	{"tokens": [{"token": "abc", "max_requests": 1000, "window": 1, "block_duration": 30, "quota": {"daily": 10000}, "enabled": true}]}
+type FileRegistry struct {
+	path   string
+	mu     sync.RWMutex
+	limits map[string]*Limit
+}
+
+// NewFileRegistry loads the token limits stored at path
+func NewFileRegistry(path string) (*FileRegistry, error) {
+	r := &FileRegistry{path: path}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload re-reads the file, keeping the current limits when it is invalid
+func (r *FileRegistry) Reload() error {
+	content, err := os.ReadFile(r.path)
+	if err != nil {
+		return fmt.Errorf("failed to read token registry: %w", err)
+	}
+
+	var file struct {
+		Tokens []Limit `json:"tokens"`
+	}
+	if err := json.Unmarshal(content, &file); err != nil {
+		return fmt.Errorf("failed to parse token registry %s: %w", r.path, err)
+	}
+
+	limits, err := index(file.Tokens)
+	if err != nil {
+		return fmt.Errorf("invalid token registry %s: %w", r.path, err)
+	}
+
+	r.mu.Lock()
+	r.limits = limits
+	r.mu.Unlock()
+
+	logger.Info("Token registry loaded", "path", r.path, "tokens", len(limits))
+	return nil
+}
+
+func (r *FileRegistry) Lookup(ctx context.Context, token string) (*Limit, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	limit, ok := r.limits[token]
+	if !ok {
+		return nil, nil
+	}
+	copied := *limit
+	return &copied, nil
+}
+
+// index validates limits and maps them by token
+func index(limits []Limit) (map[string]*Limit, error) {
+	indexed := make(map[string]*Limit, len(limits))
+	for i := range limits {
+		limit := limits[i]
+		if err := limit.Validate(); err != nil {
+			return nil, err
+		}
+		if _, exists := indexed[limit.Token]; exists {
+			return nil, fmt.Errorf("token %s is registered more than once", limit.Token)
+		}
+		indexed[limit.Token] = &limit
+	}
+	return indexed, nil
+}
@@ -0,0 +1,149 @@
+package tokens
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/markuscandido/go-expert-desafio-rate-limiter/pkg/logger"
+)
+
+const (
+	// redisKeyPrefix namespaces the hashes holding token limits
+	redisKeyPrefix = "token_limits:"
+
+	// maxCachedTokens bounds the lookup cache against floods of random tokens
+	maxCachedTokens = 10000
+)
+
+// RedisRegistry serves token limits stored as Redis hashes, so that every
+// replica sees changes made by any of them. Lookups are cached in process
+// for cacheTTL to keep Redis off the hot path.
+type RedisRegistry struct {
+	client   redis.UniversalClient
+	cacheTTL time.Duration
+	mu       sync.Mutex
+	cache    map[string]cachedLimit
+}
+
+type cachedLimit struct {
+	limit     *Limit
+	expiresAt time.Time
+}
+
+// NewRedisRegistry creates a registry backed by client, caching lookups for cacheTTL (0 disables caching)
+func NewRedisRegistry(client redis.UniversalClient, cacheTTL time.Duration) *RedisRegistry {
+	return &RedisRegistry{
+		client:   client,
+		cacheTTL: cacheTTL,
+		cache:    make(map[string]cachedLimit),
+	}
+}
+
+func (r *RedisRegistry) Lookup(ctx context.Context, token string) (*Limit, error) {
+	if r.cacheTTL > 0 {
+		r.mu.Lock()
+		cached, ok := r.cache[token]
+		r.mu.Unlock()
+		if ok && time.Now().Before(cached.expiresAt) {
+			return cached.limit, nil
+		}
+	}
+
+	fields, err := r.client.HGetAll(ctx, redisKeyPrefix+token).Result()
+	if err != nil {
+		logger.Error("Failed to look up token limit", "error", err)
+		return nil, err
+	}
+
+	var limit *Limit
+	if len(fields) > 0 {
+		limit = &Limit{
+			Token:         token,
+			MaxRequests:   atoi(fields["max_requests"]),
+			Window:        atoi(fields["window"]),
+			BlockDuration: atoi(fields["block_duration"]),
+			Quota: Quota{
+				Hourly:  atoi(fields["hourly_quota"]),
+				Daily:   atoi(fields["daily_quota"]),
+				Monthly: atoi(fields["monthly_quota"]),
+			},
+			Enabled: fields["enabled"] != "false",
+		}
+	}
+
+	if r.cacheTTL > 0 {
+		r.remember(token, limit)
+	}
+	return limit, nil
+}
+
+// Put registers or replaces the limit of a token
+func (r *RedisRegistry) Put(ctx context.Context, limit Limit) error {
+	if err := limit.Validate(); err != nil {
+		return err
+	}
+
+	key := redisKeyPrefix + limit.Token
+	pipe := r.client.TxPipeline()
+	pipe.Del(ctx, key)
+	pipe.HSet(ctx, key,
+		"max_requests", limit.MaxRequests,
+		"window", limit.Window,
+		"block_duration", limit.BlockDuration,
+		"hourly_quota", limit.Quota.Hourly,
+		"daily_quota", limit.Quota.Daily,
+		"monthly_quota", limit.Quota.Monthly,
+		"enabled", strconv.FormatBool(limit.Enabled),
+	)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger.Error("Failed to store token limit", "error", err)
+		return err
+	}
+
+	r.forget(limit.Token)
+	return nil
+}
+
+// Delete removes the limit of a token
+func (r *RedisRegistry) Delete(ctx context.Context, token string) error {
+	if err := r.client.Del(ctx, redisKeyPrefix+token).Err(); err != nil {
+		logger.Error("Failed to delete token limit", "error", err)
+		return err
+	}
+
+	r.forget(token)
+	return nil
+}
+
+func (r *RedisRegistry) remember(token string, limit *Limit) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.cache) >= maxCachedTokens {
+		for cachedToken, cached := range r.cache {
+			if !now.Before(cached.expiresAt) {
+				delete(r.cache, cachedToken)
+			}
+		}
+		if len(r.cache) >= maxCachedTokens {
+			clear(r.cache)
+		}
+	}
+	r.cache[token] = cachedLimit{limit: limit, expiresAt: now.Add(r.cacheTTL)}
+}
+
+func (r *RedisRegistry) forget(token string) {
+	r.mu.Lock()
+	delete(r.cache, token)
+	r.mu.Unlock()
+}
+
+func atoi(value string) int {
+	n, _ := strconv.Atoi(value)
+	return n
+}
@@ -0,0 +1,68 @@
+package tokens
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Limit describes the rate limit applied to a single API token.
+// Zero MaxRequests, Window or BlockDuration inherit the global token defaults.
+type Limit struct {
+	Token         string `json:"token"`
+	MaxRequests   int    `json:"max_requests"`
+	Window        int    `json:"window"`         // Window length in seconds
+	BlockDuration int    `json:"block_duration"` // Block duration in seconds
+	Quota         Quota  `json:"quota"`
+	Enabled       bool   `json:"enabled"`
+}
+
+// Quota caps the requests of a token over calendar periods, on top of its rate
+// limit. Zero values inherit the global token quotas.
+type Quota struct {
+	Hourly  int `json:"hourly"`
+	Daily   int `json:"daily"`
+	Monthly int `json:"monthly"`
+}
+
+// UnmarshalJSON decodes a token limit, treating a missing enabled flag as true
+func (l *Limit) UnmarshalJSON(data []byte) error {
+	type plain Limit
+	raw := struct {
+		plain
+		Enabled *bool `json:"enabled"`
+	}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*l = Limit(raw.plain)
+	l.Enabled = raw.Enabled == nil || *raw.Enabled
+	return nil
+}
+
+// Validate checks that the limit values are usable
+func (l *Limit) Validate() error {
+	if l.Token == "" {
+		return fmt.Errorf("token must not be empty")
+	}
+	if l.MaxRequests < 0 {
+		return fmt.Errorf("token %s: max_requests must not be negative", l.Token)
+	}
+	if l.Window < 0 {
+		return fmt.Errorf("token %s: window must not be negative", l.Token)
+	}
+	if l.BlockDuration < 0 {
+		return fmt.Errorf("token %s: block_duration must not be negative", l.Token)
+	}
+	if l.Quota.Hourly < 0 || l.Quota.Daily < 0 || l.Quota.Monthly < 0 {
+		return fmt.Errorf("token %s: quotas must not be negative", l.Token)
+	}
+	return nil
+}
+
+// Registry maps API tokens to their own rate limits
+type Registry interface {
+	// Lookup returns the limit registered for token, or nil when the token is unknown
+	Lookup(ctx context.Context, token string) (*Limit, error)
+}
@@ -0,0 +1,142 @@
+package tokens
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func writeRegistryFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write registry file: %v", err)
+	}
+}
+
+func TestFileRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	writeRegistryFile(t, path, `{"tokens": [
+		{"token": "premium", "max_requests": 1000, "window": 2, "block_duration": 5, "quota": {"daily": 10000, "monthly": 1000000}},
+		{"token": "revoked", "max_requests": 10, "enabled": false}
+	]}`)
+
+	registry, err := NewFileRegistry(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	ctx := context.Background()
+
+	limit, err := registry.Lookup(ctx, "premium")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := Limit{Token: "premium", MaxRequests: 1000, Window: 2, BlockDuration: 5, Quota: Quota{Daily: 10000, Monthly: 1000000}, Enabled: true}
+	if limit == nil || *limit != expected {
+		t.Errorf("Expected %+v, got %+v", expected, limit)
+	}
+
+	limit, _ = registry.Lookup(ctx, "revoked")
+	if limit == nil || limit.Enabled {
+		t.Errorf("Expected revoked token to be disabled, got %+v", limit)
+	}
+
+	limit, _ = registry.Lookup(ctx, "unknown")
+	if limit != nil {
+		t.Errorf("Expected unknown token to be missing, got %+v", limit)
+	}
+}
+
+func TestFileRegistryReloadKeepsLimitsOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	writeRegistryFile(t, path, `{"tokens": [{"token": "premium", "max_requests": 1000}]}`)
+
+	registry, err := NewFileRegistry(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	for _, content := range []string{
+		`{"tokens": [`,
+		`{"tokens": [{"token": "premium", "max_requests": -1}]}`,
+		`{"tokens": [{"token": "a"}, {"token": "a"}]}`,
+		`{"tokens": [{"max_requests": 5}]}`,
+		`{"tokens": [{"token": "premium", "quota": {"daily": -1}}]}`,
+	} {
+		writeRegistryFile(t, path, content)
+		if err := registry.Reload(); err == nil {
+			t.Errorf("Expected reload of %s to fail", content)
+		}
+	}
+
+	limit, _ := registry.Lookup(context.Background(), "premium")
+	if limit == nil || limit.MaxRequests != 1000 {
+		t.Errorf("Expected previous limits to be kept, got %+v", limit)
+	}
+}
+
+func TestStaticRegistry(t *testing.T) {
+	registry, err := NewStaticRegistry([]Limit{{Token: "premium", MaxRequests: 1000, Enabled: true}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	limit, _ := registry.Lookup(context.Background(), "premium")
+	if limit == nil || limit.MaxRequests != 1000 {
+		t.Errorf("Expected premium limit, got %+v", limit)
+	}
+	limit, _ = registry.Lookup(context.Background(), "unknown")
+	if limit != nil {
+		t.Errorf("Expected unknown token to be missing, got %+v", limit)
+	}
+
+	if _, err := NewStaticRegistry([]Limit{{Token: "a"}, {Token: "a"}}); err == nil {
+		t.Error("Expected duplicate tokens to be rejected")
+	}
+}
+
+func TestRedisRegistry(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	registry := NewRedisRegistry(client, time.Minute)
+	ctx := context.Background()
+
+	limit, err := registry.Lookup(ctx, "premium")
+	if err != nil || limit != nil {
+		t.Fatalf("Expected unknown token, got %+v, %v", limit, err)
+	}
+
+	// Put invalidates the cached negative lookup
+	if err := registry.Put(ctx, Limit{Token: "premium", MaxRequests: 500, Window: 1, BlockDuration: 10, Quota: Quota{Hourly: 2000}, Enabled: true}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	limit, err = registry.Lookup(ctx, "premium")
+	if err != nil || limit == nil || limit.MaxRequests != 500 || limit.BlockDuration != 10 || limit.Quota.Hourly != 2000 || !limit.Enabled {
+		t.Fatalf("Expected stored limit, got %+v, %v", limit, err)
+	}
+
+	// Changes made by another replica are seen once the cache expires
+	other := NewRedisRegistry(client, 0)
+	if err := other.Put(ctx, Limit{Token: "premium", MaxRequests: 5, Enabled: false}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	limit, _ = other.Lookup(ctx, "premium")
+	if limit == nil || limit.Enabled || limit.MaxRequests != 5 {
+		t.Errorf("Expected disabled limit, got %+v", limit)
+	}
+
+	if err := registry.Delete(ctx, "premium"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	limit, _ = registry.Lookup(ctx, "premium")
+	if limit != nil {
+		t.Errorf("Expected deleted token to be missing, got %+v", limit)
+	}
+}
@@ -0,0 +1,27 @@
+package tokens
+
+import "context"
+
+// StaticRegistry serves a fixed set of token limits, such as the overrides of
+// the configuration file
+type StaticRegistry struct {
+	limits map[string]*Limit
+}
+
+// NewStaticRegistry validates limits and indexes them by token
+func NewStaticRegistry(limits []Limit) (*StaticRegistry, error) {
+	indexed, err := index(limits)
+	if err != nil {
+		return nil, err
+	}
+	return &StaticRegistry{limits: indexed}, nil
+}
+
+func (r *StaticRegistry) Lookup(ctx context.Context, token string) (*Limit, error) {
+	limit, ok := r.limits[token]
+	if !ok {
+		return nil, nil
+	}
+	copied := *limit
+	return &copied, nil
+}
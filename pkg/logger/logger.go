@@ -46,3 +46,9 @@ func Fatal(msg string, args ...any) {
 func GetLogger() *slog.Logger {
 	return defaultLogger
 }
+
+// Sync flushes log output; it is called last when the program exits
+func Sync() {
+	// Stdout may be a pipe or terminal that cannot be synced, which is fine
+	_ = os.Stdout.Sync()
+}
@@ -6,7 +6,6 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
-	"time"
 
 	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/config"
 	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/limiter"
@@ -14,67 +13,18 @@ import (
 	"github.com/markuscandido/go-expert-desafio-rate-limiter/internal/storage"
 )
 
-// MockStorageForIntegration for integration testing
-type MockStorageForIntegration struct {
-	data    map[string]*storage.LimiterData
-	blocked map[string]bool
-}
-
-func NewMockStorageForIntegration() *MockStorageForIntegration {
-	return &MockStorageForIntegration{
-		data:    make(map[string]*storage.LimiterData),
-		blocked: make(map[string]bool),
-	}
-}
-
-func (m *MockStorageForIntegration) CheckAndIncrement(ctx context.Context, key string, maxRequests int, windowSeconds int) (bool, error) {
-	if m.blocked[key] {
-		return false, nil
-	}
-
-	if m.data[key] == nil {
-		m.data[key] = &storage.LimiterData{
-			Count:     0,
-			ExpiresAt: time.Now().Add(time.Duration(windowSeconds) * time.Second),
-		}
-	}
-
-	if time.Now().After(m.data[key].ExpiresAt) {
-		m.data[key].Count = 0
-		m.data[key].ExpiresAt = time.Now().Add(time.Duration(windowSeconds) * time.Second)
-	}
-
-	m.data[key].Count++
-	return m.data[key].Count <= maxRequests, nil
-}
-
-func (m *MockStorageForIntegration) IsBlocked(ctx context.Context, key string) (bool, error) {
-	return m.blocked[key], nil
-}
-
-func (m *MockStorageForIntegration) Block(ctx context.Context, key string, durationSeconds int) error {
-	m.blocked[key] = true
-	return nil
-}
-
-func (m *MockStorageForIntegration) Reset(ctx context.Context, key string) error {
-	delete(m.data, key)
-	delete(m.blocked, key)
-	return nil
-}
-
-func (m *MockStorageForIntegration) GetData(ctx context.Context, key string) (*storage.LimiterData, error) {
-	return m.data[key], nil
-}
+func newTestStorage(t *testing.T) *storage.MemoryStrategy {
+	t.Helper()
 
-func (m *MockStorageForIntegration) Close() error {
-	return nil
+	store := storage.NewMemoryStrategy(0, 0)
+	t.Cleanup(func() { store.Close() })
+	return store
 }
 
 // Integration Tests
 
 func TestIPRateLimitingIntegration(t *testing.T) {
-	storage := NewMockStorageForIntegration()
+	store := newTestStorage(t)
 	cfg := &config.RateLimiterConfig{
 		MaxRequestsIP:    3,
 		BlockDurationIP:  60,
@@ -82,7 +32,7 @@ func TestIPRateLimitingIntegration(t *testing.T) {
 		EnableTokenLimit: false,
 	}
 
-	limiter := limiter.NewRateLimiter(storage, cfg)
+	limiter := limiter.NewRateLimiter(store, cfg)
 	middleware := middleware.NewRateLimiterMiddleware(limiter)
 
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -118,7 +68,7 @@ func TestIPRateLimitingIntegration(t *testing.T) {
 }
 
 func TestTokenRateLimitingIntegration(t *testing.T) {
-	storage := NewMockStorageForIntegration()
+	store := newTestStorage(t)
 	cfg := &config.RateLimiterConfig{
 		MaxRequestsToken:   2,
 		BlockDurationToken: 60,
@@ -126,7 +76,7 @@ func TestTokenRateLimitingIntegration(t *testing.T) {
 		EnableTokenLimit:   true,
 	}
 
-	limiter := limiter.NewRateLimiter(storage, cfg)
+	limiter := limiter.NewRateLimiter(store, cfg)
 	middleware := middleware.NewRateLimiterMiddleware(limiter)
 
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -162,7 +112,7 @@ func TestTokenRateLimitingIntegration(t *testing.T) {
 }
 
 func TestTokenPrecedenceIntegration(t *testing.T) {
-	storage := NewMockStorageForIntegration()
+	store := newTestStorage(t)
 	cfg := &config.RateLimiterConfig{
 		MaxRequestsIP:      2,
 		BlockDurationIP:    60,
@@ -172,7 +122,7 @@ func TestTokenPrecedenceIntegration(t *testing.T) {
 		EnableTokenLimit:   true,
 	}
 
-	limiter := limiter.NewRateLimiter(storage, cfg)
+	limiter := limiter.NewRateLimiter(store, cfg)
 	middleware := middleware.NewRateLimiterMiddleware(limiter)
 
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -210,7 +160,7 @@ func TestTokenPrecedenceIntegration(t *testing.T) {
 	}
 
 	// But request with token should be allowed (token takes precedence)
-	storage.Reset(context.Background(), "ip:"+ip)
+	store.Reset(context.Background(), "ip:"+ip)
 	req = httptest.NewRequest("GET", "/", nil)
 	req.RemoteAddr = ip
 	req.Header.Set("API_KEY", token)
@@ -224,7 +174,7 @@ func TestTokenPrecedenceIntegration(t *testing.T) {
 }
 
 func TestDifferentIPsAreIndependent(t *testing.T) {
-	storage := NewMockStorageForIntegration()
+	store := newTestStorage(t)
 	cfg := &config.RateLimiterConfig{
 		MaxRequestsIP:    2,
 		BlockDurationIP:  60,
@@ -232,7 +182,7 @@ func TestDifferentIPsAreIndependent(t *testing.T) {
 		EnableTokenLimit: false,
 	}
 
-	limiter := limiter.NewRateLimiter(storage, cfg)
+	limiter := limiter.NewRateLimiter(store, cfg)
 	middleware := middleware.NewRateLimiterMiddleware(limiter)
 
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {